@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Directions of an AQI crossing reported in alert messages
+const (
+	alertAbove = "above" // The AQI rose above -alert-threshold
+	alertBelow = "below" // The AQI fell back to -alert-threshold minus -alert-hysteresis
+)
+
+// alertMessage is published to the alert topic when a sensor's AQI crosses
+// the threshold
+type alertMessage struct {
+	SerialNo  string `json:"serialno"`
+	Direction string `json:"direction"`
+	Alert     bool   `json:"alert"` // Whether the sensor is now in alert
+	AQI       int    `json:"aqi"`
+	Scale     string `json:"scale"`
+	Threshold int    `json:"threshold"`
+	Timestamp string `json:"timestamp"`
+}
+
+// alertCrossing updates a sensor's alert state for a new AQI and returns the
+// direction it crossed the threshold in, or "" if the state is unchanged
+// A sensor goes into alert when its AQI exceeds the threshold and leaves it
+// once the AQI is back at the threshold minus the hysteresis, so values
+// hovering around the threshold do not alert repeatedly.
+func (p *processor) alertCrossing(serialNo string, aqi int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch alerting := p.alerting[serialNo]; {
+	case !alerting && aqi > p.alertThreshold:
+		p.alerting[serialNo] = true
+		return alertAbove
+	case alerting && aqi <= p.alertThreshold-p.alertHysteresis:
+		delete(p.alerting, serialNo)
+		return alertBelow
+	}
+	return ""
+}
+
+// checkAlert publishes an alert message if the sensor's AQI crossed the
+// -alert-threshold
+func (p *processor) checkAlert(client mqtt.Client, serialNo string, aqi int, t time.Time) {
+	direction := p.alertCrossing(serialNo, aqi)
+	if direction == "" {
+		return
+	}
+
+	msg := alertMessage{
+		SerialNo:  serialNo,
+		Direction: direction,
+		Alert:     direction == alertAbove,
+		AQI:       aqi,
+		Scale:     p.standard,
+		Threshold: p.alertThreshold,
+		Timestamp: formatTimestamp(t),
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling alert", "serialno", serialNo, "error", err)
+		return
+	}
+	topic := expandOutputTopic(p.alertTopic, serialNo)
+	if p.publish(client, topic, false, payload) {
+		slog.Info("Published AQI alert", "serialno", serialNo, "direction", direction, "aqi", aqi, "threshold", p.alertThreshold, "topic", topic)
+	}
+}
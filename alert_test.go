@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestAlerts drives a sensor's AQI across the threshold and checks that one
+// alert is published per crossing
+func TestAlerts(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.alertTopic = "alerts/{serialno}"
+	proc.alertThreshold = 100
+	proc.alertHysteresis = 5
+	client := &fakeClient{}
+
+	// PM2.5 concentrations and the AQI they map to
+	steps := []struct {
+		pm25 float64
+		aqi  int
+	}{
+		{30.0, 89},  // Below
+		{35.5, 101}, // Crosses above
+		{40.0, 112}, // Still above
+		{35.0, 99},  // Below the threshold but within the hysteresis
+		{35.7, 101}, // Not a new crossing
+		{33.0, 95},  // Clears
+		{20.0, 68},  // Still below
+		{55.5, 151}, // Crosses above again
+	}
+	for _, step := range steps {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %g}`, step.pm25)),
+		})
+	}
+
+	var alerts []alertMessage
+	for _, msg := range client.messages() {
+		if msg.Topic != "alerts/abc" {
+			continue
+		}
+		var alert alertMessage
+		if err := json.Unmarshal(msg.Payload, &alert); err != nil {
+			t.Fatalf("Failed to parse alert %s: %v", msg.Payload, err)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	expected := []struct {
+		direction string
+		alert     bool
+		aqi       int
+	}{
+		{alertAbove, true, 101},
+		{alertBelow, false, 95},
+		{alertAbove, true, 151},
+	}
+	if len(alerts) != len(expected) {
+		t.Fatalf("Published %d alerts, want %d: %+v", len(alerts), len(expected), alerts)
+	}
+	for i, want := range expected {
+		got := alerts[i]
+		if got.Direction != want.direction || got.Alert != want.alert || got.AQI != want.aqi {
+			t.Errorf("Alert %d = %s/%v at AQI %d, want %s/%v at AQI %d", i, got.Direction, got.Alert, got.AQI, want.direction, want.alert, want.aqi)
+		}
+		if got.SerialNo != "abc" || got.Threshold != 100 || got.Scale != standardEPA {
+			t.Errorf("Alert %d = %+v, want serial abc, threshold 100 and scale epa", i, got)
+		}
+	}
+}
+
+// TestAlertsPerSensor checks that each sensor has its own alert state
+func TestAlertsPerSensor(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.alertThreshold = 100
+
+	if got := proc.alertCrossing("abc", 120); got != alertAbove {
+		t.Errorf("abc crossing = %q, want %q", got, alertAbove)
+	}
+	if got := proc.alertCrossing("def", 120); got != alertAbove {
+		t.Errorf("def crossing = %q, want %q", got, alertAbove)
+	}
+	if got := proc.alertCrossing("abc", 100); got != alertBelow {
+		t.Errorf("abc crossing = %q, want %q with no hysteresis", got, alertBelow)
+	}
+	if got := proc.alertCrossing("def", 110); got != "" {
+		t.Errorf("def crossing = %q, want none", got)
+	}
+}
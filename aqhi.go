@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// computeAQHI calculates the Canadian Air Quality Health Index
+// no2 and o3 are in ppb and pm25 in µg/m³. Environment Canada defines the
+// inputs as 3-hour averages:
+//
+//	AQHI = (10 / 10.4) × 100 × [(e^(0.000871×NO2) - 1) + (e^(0.000537×O3) - 1) + (e^(0.000487×PM2.5) - 1)]
+//
+// The result is rounded to the nearest integer with a minimum of 1. Values
+// above 10 are returned as they are, and published as numbers too; only the
+// log shows them as "10+", see formatAQHI.
+// Source: https://www.canada.ca/en/environment-climate-change/services/air-quality-health-index/about.html
+func computeAQHI(no2, o3, pm25 float64) int {
+	aqhi := (10.0 / 10.4) * 100 * ((math.Exp(0.000871*no2) - 1) +
+		(math.Exp(0.000537*o3) - 1) +
+		(math.Exp(0.000487*pm25) - 1))
+
+	if rounded := int(math.Round(aqhi)); rounded > 1 {
+		return rounded
+	}
+	return 1
+}
+
+// formatAQHI formats an AQHI value the way Environment Canada reports it
+func formatAQHI(aqhi int) string {
+	if aqhi > 10 {
+		return "10+"
+	}
+	return strconv.Itoa(aqhi)
+}
+
+// aqhiCategory returns the health risk category for an AQHI value
+func aqhiCategory(aqhi int) string {
+	switch {
+	case aqhi <= 3:
+		return "Low Risk"
+	case aqhi <= 6:
+		return "Moderate Risk"
+	case aqhi <= 10:
+		return "High Risk"
+	default:
+		return "Very High Risk"
+	}
+}
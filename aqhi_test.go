@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestComputeAQHI checks computeAQHI against the published formula
+// The comments give the formula's unrounded value for each case, evaluated
+// separately; the single-pollutant cases check each coefficient on its own.
+func TestComputeAQHI(t *testing.T) {
+	testCases := []struct {
+		no2, o3, pm25 float64
+		expected      int
+	}{
+		{0, 0, 0, 1},      // Clean air is reported as 1, not 0
+		{100, 0, 0, 9},    // 8.75 = 96.15 × (e^0.0871 - 1)
+		{0, 100, 0, 5},    // 5.30 = 96.15 × (e^0.0537 - 1)
+		{0, 0, 100, 5},    // 4.80 = 96.15 × (e^0.0487 - 1)
+		{5, 20, 3, 2},     // 1.60
+		{20, 30, 10, 4},   // 3.72
+		{40, 50, 35, 8},   // 7.68
+		{30, 40, 150, 12}, // 11.92, reported as 10+
+		{60, 80, 100, 14}, // 14.18, reported as 10+
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("NO2=%g,O3=%g,PM2.5=%g", tc.no2, tc.o3, tc.pm25), func(t *testing.T) {
+			if result := computeAQHI(tc.no2, tc.o3, tc.pm25); result != tc.expected {
+				t.Errorf("computeAQHI = %d, want %d", result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFormatAQHI(t *testing.T) {
+	for aqhi, expected := range map[int]string{1: "1", 10: "10", 11: "10+", 14: "10+"} {
+		if result := formatAQHI(aqhi); result != expected {
+			t.Errorf("formatAQHI(%d) = %q, want %q", aqhi, result, expected)
+		}
+	}
+}
+
+func TestAQHICategory(t *testing.T) {
+	for aqhi, expected := range map[int]string{1: "Low Risk", 3: "Low Risk", 4: "Moderate Risk", 7: "High Risk", 10: "High Risk", 11: "Very High Risk"} {
+		if result := aqhiCategory(aqhi); result != expected {
+			t.Errorf("aqhiCategory(%d) = %q, want %q", aqhi, result, expected)
+		}
+	}
+}
+
+// TestAQHIOutput tests that -standard aqhi replaces the aqi field with aqhi
+func TestAQHIOutput(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.standard = standardAQHI
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 10, "no2": 20, "ozone": 30}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var output map[string]interface{}
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output["aqhi"] != 4.0 || output["category"] != "Moderate Risk" {
+		t.Errorf("aqhi/category = %v/%v, want 4/Moderate Risk", output["aqhi"], output["category"])
+	}
+
+	// Above 10 the JSON keeps the number, which Environment Canada shows as 10+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 150, "no2": 30, "ozone": 40}`),
+	})
+	if err := json.Unmarshal(client.messages()[1].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output["aqhi"] != 12.0 || output["category"] != "Very High Risk" {
+		t.Errorf("aqhi/category = %v/%v, want 12/Very High Risk", output["aqhi"], output["category"])
+	}
+	for _, field := range []string{"aqi", "color"} {
+		if _, ok := output[field]; ok {
+			t.Errorf("Output contains EPA field %q in AQHI mode", field)
+		}
+	}
+}
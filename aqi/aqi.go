@@ -0,0 +1,568 @@
+// Package aqi computes the US EPA Air Quality Index from pollutant concentrations.
+//
+// The package has no MQTT dependencies and can be used on its own:
+//
+//	aqi.ComputeAQI(35.4, 45) // 100
+//
+// A Calculator selects the PM2.5 breakpoint revision, whether values above
+// 500 are extrapolated, and how the AQI is rounded.
+package aqi
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// AQIBreakpoint is one range of a breakpoint table
+// Each breakpoint covers the half-open concentration range [ConcLow, ConcHigh),
+// and ConcHigh equals the next breakpoint's ConcLow, so every concentration
+// within a table falls in exactly one range. EPA tables list the highest
+// reportable concentration of each range instead (12.0 followed by 12.1); that
+// value is ConcHigh minus the resolution concentrations are truncated to, and
+// it is what AQIHigh corresponds to in the AQI formula.
+type AQIBreakpoint struct {
+	ConcLow  float64 `json:"concLow"`
+	ConcHigh float64 `json:"concHigh"`
+	AQILow   int     `json:"aqiLow"`
+	AQIHigh  int     `json:"aqiHigh"`
+}
+
+// Table is an AQI breakpoint table with its truncation rule
+// Concentrations are truncated (not rounded) to Decimals places before the
+// lookup, as the EPA specifies for each pollutant: PM2.5 and CO to one
+// decimal, PM10 to an integer, ozone to three decimals in ppm, which is an
+// integer in ppb, and SO2 and NO2 to integers in ppb. The truncation step is
+// also the resolution used for the highest concentration of each range, see
+// AQIBreakpoint.
+type Table struct {
+	Decimals    int
+	Breakpoints []AQIBreakpoint
+}
+
+// resolution is the truncation step of the table's concentrations
+func (t Table) resolution() float64 {
+	return 1 / math.Pow10(t.Decimals)
+}
+
+// Validate checks that the table is usable by CalculateAQI, see
+// ValidateBreakpoints
+func (t Table) Validate() error {
+	return ValidateBreakpoints(t.Breakpoints, t.resolution())
+}
+
+// PM2.5 AQI breakpoints based on the 2012 EPA standard
+// Source: https://www.airnow.gov/sites/default/files/2020-05/aqi-technical-assistance-document-sept2018.pdf
+var PM25Breakpoints2012 = Table{
+	Decimals: 1,
+	Breakpoints: []AQIBreakpoint{
+		{0.0, 12.1, 0, 50},
+		{12.1, 35.5, 51, 100},
+		{35.5, 55.5, 101, 150},
+		{55.5, 150.5, 151, 200},
+		{150.5, 250.5, 201, 300},
+		{250.5, 350.5, 301, 400},
+		{350.5, 500.5, 401, 500},
+	},
+}
+
+// PM2.5 AQI breakpoints based on the 2024 EPA standard
+// The 50 boundary moved from 12.0 to 9.0 and the Hazardous category is a single range.
+// Source: https://www.airnow.gov/sites/default/files/2024-02/aqi-technical-assistance-document-feb-2024.pdf
+var PM25Breakpoints2024 = Table{
+	Decimals: 1,
+	Breakpoints: []AQIBreakpoint{
+		{0.0, 9.1, 0, 50},
+		{9.1, 35.5, 51, 100},
+		{35.5, 55.5, 101, 150},
+		{55.5, 125.5, 151, 200},
+		{125.5, 225.5, 201, 300},
+		{225.5, 325.5, 301, 500},
+	},
+}
+
+// PM10 AQI breakpoints based on EPA standards
+var PM10Breakpoints = Table{
+	Decimals: 0,
+	Breakpoints: []AQIBreakpoint{
+		{0, 55, 0, 50},
+		{55, 155, 51, 100},
+		{155, 255, 101, 150},
+		{255, 355, 151, 200},
+		{355, 425, 201, 300},
+		{425, 505, 301, 400},
+		{505, 605, 401, 500},
+	},
+}
+
+// Ozone 8-hour AQI breakpoints in ppb (EPA table is in ppm, truncated to 3 decimals)
+// The 8-hour table is not defined above 200 ppb; the 1-hour table takes over there.
+var Ozone8hBreakpoints = Table{
+	Decimals: 0,
+	Breakpoints: []AQIBreakpoint{
+		{0, 55, 0, 50},
+		{55, 71, 51, 100},
+		{71, 86, 101, 150},
+		{86, 106, 151, 200},
+		{106, 201, 201, 300},
+	},
+}
+
+// Ozone 1-hour AQI breakpoints in ppb
+// The 1-hour table starts at 125 ppb (0.125 ppm); lower values use the 8-hour table only.
+var Ozone1hBreakpoints = Table{
+	Decimals: 0,
+	Breakpoints: []AQIBreakpoint{
+		{125, 165, 101, 150},
+		{165, 205, 151, 200},
+		{205, 405, 201, 300},
+		{405, 505, 301, 400},
+		{505, 605, 401, 500},
+	},
+}
+
+// CO 8-hour AQI breakpoints in ppm
+var COBreakpoints = Table{
+	Decimals: 1,
+	Breakpoints: []AQIBreakpoint{
+		{0.0, 4.5, 0, 50},
+		{4.5, 9.5, 51, 100},
+		{9.5, 12.5, 101, 150},
+		{12.5, 15.5, 151, 200},
+		{15.5, 30.5, 201, 300},
+		{30.5, 40.5, 301, 400},
+		{40.5, 50.5, 401, 500},
+	},
+}
+
+// SO2 1-hour AQI breakpoints in ppb
+// The EPA defines 1-hour SO2 only up to AQI 200 (304 ppb) and uses 24-hour
+// averages above that. Those upper ranges are applied to the 1-hour
+// concentration here, so a single reading can still reach AQI 500.
+var SO2Breakpoints = Table{
+	Decimals: 0,
+	Breakpoints: []AQIBreakpoint{
+		{0, 36, 0, 50},
+		{36, 76, 51, 100},
+		{76, 186, 101, 150},
+		{186, 305, 151, 200},
+		{305, 605, 201, 300},
+		{605, 805, 301, 400},
+		{805, 1005, 401, 500},
+	},
+}
+
+// NO2 1-hour AQI breakpoints in ppb
+var NO2Breakpoints = Table{
+	Decimals: 0,
+	Breakpoints: []AQIBreakpoint{
+		{0, 54, 0, 50},
+		{54, 101, 51, 100},
+		{101, 361, 101, 150},
+		{361, 650, 151, 200},
+		{650, 1250, 201, 300},
+		{1250, 1650, 301, 400},
+		{1650, 2050, 401, 500},
+	},
+}
+
+// ValidateBreakpoints checks that a table with the given resolution is usable
+// by Interpolate
+// Each range must be increasing and wider than the resolution, as the formula
+// divides by the width less the resolution, and each range must start where
+// the previous one ends so that there are no gaps or overlaps (see
+// AQIBreakpoint).
+func ValidateBreakpoints(breakpoints []AQIBreakpoint, resolution float64) error {
+	if len(breakpoints) == 0 {
+		return fmt.Errorf("table is empty")
+	}
+	for i, bp := range breakpoints {
+		if bp.ConcLow >= bp.ConcHigh {
+			return fmt.Errorf("row %d: concentration range %g-%g is not increasing", i, bp.ConcLow, bp.ConcHigh)
+		}
+		// Allow for floating-point error in the width, e.g. 0.2 - 0.1
+		if bp.ConcHigh-bp.ConcLow-resolution < resolution*1e-6 {
+			return fmt.Errorf("row %d: concentration range %g-%g is not wider than the resolution %g", i, bp.ConcLow, bp.ConcHigh, resolution)
+		}
+		if bp.AQILow >= bp.AQIHigh {
+			return fmt.Errorf("row %d: AQI range %d-%d is not increasing", i, bp.AQILow, bp.AQIHigh)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := breakpoints[i-1]
+		if bp.ConcLow != prev.ConcHigh {
+			return fmt.Errorf("row %d: concentration range starts at %g, but the previous range ends at %g", i, bp.ConcLow, prev.ConcHigh)
+		}
+		if bp.AQILow < prev.AQIHigh {
+			return fmt.Errorf("row %d: AQI %d overlaps previous range ending at %d", i, bp.AQILow, prev.AQIHigh)
+		}
+	}
+	return nil
+}
+
+// Interpolate converts a truncated concentration to an AQI value
+// Based on EPA formula: AQI = ((IHi - ILo) / (BPHi - BPLo)) * (Cp - BPLo) + ILo
+// Where:
+// - IHi = AQI value corresponding to BPHi
+// - ILo = AQI value corresponding to BPLo
+// - BPHi = Highest concentration of the range, ConcHigh - resolution
+// - BPLo = Lowest concentration of the range, ConcLow
+// - Cp = Pollutant concentration, ConcLow <= Cp < ConcHigh
+// A resolution of zero treats the table as continuous, for scales such as the
+// European CAQI where one range's AQIHigh is the next range's AQILow. ok is
+// false if the concentration is outside the table.
+// Source: https://www.airnow.gov/sites/default/files/2020-05/aqi-technical-assistance-document-sept2018.pdf
+func Interpolate(concentration float64, breakpoints []AQIBreakpoint, resolution float64) (aqi int, ok bool) {
+	return interpolate(concentration, breakpoints, resolution, RoundNearest)
+}
+
+// interpolate is Interpolate with the given rounding
+func interpolate(concentration float64, breakpoints []AQIBreakpoint, resolution float64, rounding Rounding) (aqi int, ok bool) {
+	for _, bp := range breakpoints {
+		if concentration >= bp.ConcLow && concentration < bp.ConcHigh {
+			return linear(concentration, bp, resolution, rounding), true
+		}
+	}
+	return 0, false
+}
+
+// Rounding selects how the AQI formula's fractional result becomes an integer
+type Rounding int
+
+const (
+	// RoundNearest rounds to the nearest integer, halves up, as the EPA
+	// technical assistance document specifies
+	RoundNearest Rounding = iota
+	// RoundTruncate drops the fraction, as some AirNow documents do
+	RoundTruncate
+	// RoundCeil rounds up to the next integer
+	RoundCeil
+)
+
+// roundingEpsilon absorbs floating-point error in the AQI formula, so that
+// a concentration at a breakpoint gives exactly its AQI with every rounding
+const roundingEpsilon = 1e-9
+
+// linear applies the EPA AQI formula for a single range
+func linear(concentration float64, bp AQIBreakpoint, resolution float64, rounding Rounding) int {
+	aqi := ((float64(bp.AQIHigh-bp.AQILow) / (bp.ConcHigh - resolution - bp.ConcLow)) *
+		(concentration - bp.ConcLow)) + float64(bp.AQILow)
+	switch rounding {
+	case RoundTruncate:
+		return int(math.Floor(aqi + roundingEpsilon))
+	case RoundCeil:
+		return int(math.Ceil(aqi - roundingEpsilon))
+	default:
+		return int(math.Round(aqi))
+	}
+}
+
+// CalculateAQI computes the Air Quality Index for a single pollutant
+// The concentration is truncated to the table's decimals as per EPA
+// guidelines. Concentrations below the table, such as the small negative
+// values some sensors report in clean air, count as its lowest concentration.
+// Concentrations beyond the table return 500 (hazardous); use a Calculator
+// with Extended set to extrapolate instead.
+func CalculateAQI(concentration float64, table Table) int {
+	return Calculator{}.CalculateAQI(concentration, table)
+}
+
+// ConcentrationForAQI inverts the EPA formula: it returns the lowest
+// concentration, at the table's resolution, whose AQI is at least aqi, so that
+// a concentration threshold can stand in for an AQI threshold
+// CalculateAQI of the result is aqi unless one resolution step spans more than
+// one AQI point there. AQI values beyond the table are clamped to it. The
+// result assumes RoundNearest.
+func ConcentrationForAQI(aqi int, table Table) float64 {
+	breakpoints := table.Breakpoints
+	scale := math.Pow10(table.Decimals)
+	resolution := 1 / scale
+
+	bp := breakpoints[len(breakpoints)-1]
+	if aqi > bp.AQIHigh {
+		aqi = bp.AQIHigh
+	}
+	for _, b := range breakpoints {
+		if aqi <= b.AQIHigh {
+			bp = b
+			break
+		}
+	}
+	if aqi <= bp.AQILow {
+		return bp.ConcLow
+	}
+
+	// linear rounds, so the AQI reaches aqi half a point early
+	target := float64(aqi) - 0.5
+	concentration := bp.ConcLow + (target-float64(bp.AQILow))*(bp.ConcHigh-resolution-bp.ConcLow)/float64(bp.AQIHigh-bp.AQILow)
+	// Round up to the resolution, allowing for floating-point error
+	return math.Ceil(concentration*scale-1e-9) / scale
+}
+
+// ComputeAQI calculates AQI from PM2.5 and PM10 values in µg/m³ using the
+// 2012 PM2.5 table
+// Returns the higher of the two AQI values as per EPA guidelines
+func ComputeAQI(pm25, pm10 float64) int {
+	return NewCalculator().ComputeAQI(pm25, pm10)
+}
+
+// ComputeAQIDetailed is ComputeAQI with the sub-indices, dominant pollutant
+// and category the AQI was derived from
+func ComputeAQIDetailed(pm25, pm10 float64) AQIResult {
+	return NewCalculator().ComputeAQIDetailed(pm25, pm10, Gases{})
+}
+
+// Calculator computes AQI values with a configurable PM2.5 and PM10 table
+type Calculator struct {
+	PM25 Table
+	PM10 Table
+
+	// Extended continues the last breakpoint range beyond 500 instead of
+	// capping, AirNow's extended AQI for extreme smoke
+	Extended bool
+
+	// Rounding converts the formula's result to an integer AQI; the zero
+	// value rounds to the nearest integer
+	Rounding Rounding
+}
+
+// NewCalculator returns a Calculator using the 2012 PM2.5 table, capped at 500
+func NewCalculator() Calculator {
+	return Calculator{PM25: PM25Breakpoints2012, PM10: PM10Breakpoints}
+}
+
+// CalculateAQI computes the Air Quality Index for a single pollutant
+// See the package-level CalculateAQI.
+func (c Calculator) CalculateAQI(concentration float64, table Table) int {
+	scale := math.Pow10(table.Decimals)
+	resolution := 1 / scale
+	concentration = math.Floor(concentration*scale) / scale
+	concentration = max(concentration, table.Breakpoints[0].ConcLow)
+
+	if aqi, ok := interpolate(concentration, table.Breakpoints, resolution, c.Rounding); ok {
+		return aqi
+	}
+
+	// If concentration exceeds all breakpoints, extrapolate the last range
+	// or return 500 (hazardous)
+	if last := table.Breakpoints[len(table.Breakpoints)-1]; c.Extended && concentration >= last.ConcHigh {
+		return linear(concentration, last, resolution, c.Rounding)
+	}
+	return 500
+}
+
+// OzoneAQI computes the ozone sub-index from a concentration in ppb
+// Below 125 ppb only the 8-hour table applies. From 125 to 200 ppb both tables
+// apply and the higher sub-index is used, as the EPA recommends reporting the
+// more precautionary value. Above 200 ppb the 8-hour table is undefined; its
+// sub-index is held at the top of the table, 300, until the 1-hour table
+// exceeds it, so the AQI never falls as the concentration rises.
+func (c Calculator) OzoneAQI(ppb float64) int {
+	// Truncate to whole ppb (3 decimal places in ppm) as per EPA guidelines
+	ppb = math.Floor(ppb)
+
+	aqi := c.CalculateAQI(min(ppb, ozone8hMax), Ozone8hBreakpoints)
+	if ppb >= 125 {
+		aqi = max(aqi, c.CalculateAQI(ppb, Ozone1hBreakpoints))
+	}
+	return aqi
+}
+
+// ozone8hMax is the highest concentration in ppb the 8-hour ozone table defines
+const ozone8hMax = 200
+
+// ComputeAQI calculates AQI from PM2.5 and PM10 values in µg/m³
+// Returns the higher of the two AQI values as per EPA guidelines
+func (c Calculator) ComputeAQI(pm25, pm10 float64) int {
+	return c.ComputeAQIDetailed(pm25, pm10, Gases{}).Value
+}
+
+// AQIResult is an AQI together with the details it was derived from
+type AQIResult struct {
+	Value    int    // Overall AQI, the highest sub-index
+	Dominant string // Pollutant with the highest sub-index, see SubIndices.Dominant
+	Category string // EPA category of Value, see Category
+
+	// SubIndices maps the Pollutant names to their AQI. Ozone, CO, SO2 and
+	// NO2 are only present when the reading includes them.
+	SubIndices map[string]int
+}
+
+// Gases holds the gas concentrations of a reading, each nil when the reading
+// does not include it
+// SO2 and NO2 are 1-hour concentrations; ozone is looked up as OzoneAQI does.
+type Gases struct {
+	Ozone *float64 // ppb
+	CO    *float64 // ppm
+	SO2   *float64 // ppb
+	NO2   *float64 // ppb
+}
+
+// ComputeAQIDetailed calculates the AQI from PM2.5 and PM10 (µg/m³) and the
+// gases present in a reading
+func (c Calculator) ComputeAQIDetailed(pm25, pm10 float64, gases Gases) AQIResult {
+	return c.SubIndices(pm25, pm10, gases).Result()
+}
+
+// SubIndices holds the AQI of each pollutant
+// The gases are nil when the reading does not include them.
+type SubIndices struct {
+	PM25  int
+	PM10  int
+	Ozone *int
+	CO    *int
+	SO2   *int
+	NO2   *int
+}
+
+// SubIndices calculates the sub-index of PM2.5 and PM10 (µg/m³) and of each
+// gas present in gases
+func (c Calculator) SubIndices(pm25, pm10 float64, gases Gases) SubIndices {
+	s := SubIndices{
+		PM25: c.CalculateAQI(pm25, c.PM25),
+		PM10: c.CalculateAQI(pm10, c.PM10),
+	}
+	if gases.Ozone != nil {
+		aqiO3 := c.OzoneAQI(*gases.Ozone)
+		s.Ozone = &aqiO3
+	}
+	if gases.CO != nil {
+		aqiCO := c.CalculateAQI(*gases.CO, COBreakpoints)
+		s.CO = &aqiCO
+	}
+	if gases.SO2 != nil {
+		aqiSO2 := c.CalculateAQI(*gases.SO2, SO2Breakpoints)
+		s.SO2 = &aqiSO2
+	}
+	if gases.NO2 != nil {
+		aqiNO2 := c.CalculateAQI(*gases.NO2, NO2Breakpoints)
+		s.NO2 = &aqiNO2
+	}
+	return s
+}
+
+// Max returns the highest sub-index, which is the overall AQI as per EPA guidelines
+func (s SubIndices) Max() int {
+	aqi := max(s.PM25, s.PM10)
+	if s.Ozone != nil {
+		aqi = max(aqi, *s.Ozone)
+	}
+	if s.CO != nil {
+		aqi = max(aqi, *s.CO)
+	}
+	if s.SO2 != nil {
+		aqi = max(aqi, *s.SO2)
+	}
+	if s.NO2 != nil {
+		aqi = max(aqi, *s.NO2)
+	}
+	return aqi
+}
+
+// Result collects the sub-indices into an AQIResult
+func (s SubIndices) Result() AQIResult {
+	value := s.Max()
+	result := AQIResult{
+		Value:    value,
+		Dominant: s.Dominant(),
+		Category: Category(value),
+		SubIndices: map[string]int{
+			PollutantPM25: s.PM25,
+			PollutantPM10: s.PM10,
+		},
+	}
+	if s.Ozone != nil {
+		result.SubIndices[PollutantOzone] = *s.Ozone
+	}
+	if s.CO != nil {
+		result.SubIndices[PollutantCO] = *s.CO
+	}
+	if s.SO2 != nil {
+		result.SubIndices[PollutantSO2] = *s.SO2
+	}
+	if s.NO2 != nil {
+		result.SubIndices[PollutantNO2] = *s.NO2
+	}
+	return result
+}
+
+// Category returns the EPA category label for an AQI value
+// Values above 500, which only an extended Calculator produces, are
+// "Beyond Index".
+func Category(aqi int) string {
+	switch {
+	case aqi <= 50:
+		return "Good"
+	case aqi <= 100:
+		return "Moderate"
+	case aqi <= 150:
+		return "Unhealthy for Sensitive Groups"
+	case aqi <= 200:
+		return "Unhealthy"
+	case aqi <= 300:
+		return "Very Unhealthy"
+	case aqi <= 500:
+		return "Hazardous"
+	default:
+		return "Beyond Index"
+	}
+}
+
+// Pollutant names returned by SubIndices.Dominant
+const (
+	PollutantPM25  = "pm25"
+	PollutantPM10  = "pm10"
+	PollutantOzone = "ozone"
+	PollutantCO    = "co"
+	PollutantSO2   = "so2"
+	PollutantNO2   = "no2"
+)
+
+// Pollutants lists the pollutants with an EPA sub-index, in the order ties
+// are resolved
+var Pollutants = []string{PollutantPM25, PollutantPM10, PollutantOzone, PollutantCO, PollutantSO2, PollutantNO2}
+
+// Select recomputes the result from the sub-indices of the given pollutants
+// only, so the others neither count toward the AQI nor appear in SubIndices
+// Ties go to the pollutant listed first in Pollutants.
+func (r AQIResult) Select(pollutants []string) AQIResult {
+	selected := AQIResult{SubIndices: make(map[string]int)}
+	for _, pollutant := range Pollutants {
+		if !slices.Contains(pollutants, pollutant) {
+			continue
+		}
+		v, ok := r.SubIndices[pollutant]
+		if !ok {
+			continue
+		}
+		selected.SubIndices[pollutant] = v
+		if selected.Dominant == "" || v > selected.Value {
+			selected.Value, selected.Dominant = v, pollutant
+		}
+	}
+	selected.Category = Category(selected.Value)
+	return selected
+}
+
+// Dominant returns the pollutant with the highest sub-index
+// Ties go to the pollutant listed first: PM2.5, PM10, ozone, CO, SO2, NO2.
+func (s SubIndices) Dominant() string {
+	dominant, aqi := PollutantPM25, s.PM25
+	if s.PM10 > aqi {
+		dominant, aqi = PollutantPM10, s.PM10
+	}
+	if s.Ozone != nil && *s.Ozone > aqi {
+		dominant, aqi = PollutantOzone, *s.Ozone
+	}
+	if s.CO != nil && *s.CO > aqi {
+		dominant, aqi = PollutantCO, *s.CO
+	}
+	if s.SO2 != nil && *s.SO2 > aqi {
+		dominant, aqi = PollutantSO2, *s.SO2
+	}
+	if s.NO2 != nil && *s.NO2 > aqi {
+		dominant = PollutantNO2
+	}
+	return dominant
+}
@@ -0,0 +1,459 @@
+package aqi
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestAQICalculation tests the AQI calculation logic directly
+func TestAQICalculation(t *testing.T) {
+	testCases := []struct {
+		name     string
+		pm25     float64
+		pm10     float64
+		expected int
+	}{
+		{"Good air quality", 8.0, 20.0, 33},
+		{"Moderate air quality", 35.4, 50.0, 100},
+		{"Unhealthy for sensitive groups", 55.4, 100.0, 150},
+		{"Very unhealthy", 250.4, 350.0, 300},
+		{"Hazardous", 400.0, 500.0, 434},
+		{"PM10 dominant", 10.0, 200.0, 123}, // PM10 AQI higher than PM2.5
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := ComputeAQI(tc.pm25, tc.pm10)
+			// Allow small tolerance for rounding
+			if result < tc.expected-1 || result > tc.expected+1 {
+				t.Errorf("ComputeAQI(%f, %f) = %d, want ~%d", tc.pm25, tc.pm10, result, tc.expected)
+			}
+		})
+	}
+}
+
+// TestAQIBreakpointEdgeCases tests edge cases in AQI calculation
+func TestAQIBreakpointEdgeCases(t *testing.T) {
+	// Test exact breakpoint values
+	testCases := []struct {
+		pm25     float64
+		expected int
+	}{
+		{-3.2, 0},    // Below the table, e.g. sensor noise, counts as the minimum
+		{0.0, 0},     // Minimum
+		{12.0, 50},   // Exact breakpoint
+		{12.1, 51},   // Just over breakpoint
+		{35.4, 100},  // Exact breakpoint
+		{35.5, 101},  // Just over breakpoint
+		{500.4, 500}, // Maximum defined breakpoint
+		{600.0, 500}, // Beyond maximum (should cap at 500)
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("PM2.5=%.1f", tc.pm25), func(t *testing.T) {
+			result := CalculateAQI(tc.pm25, PM25Breakpoints2012)
+			if result != tc.expected {
+				t.Errorf("CalculateAQI(%f) = %d, want %d", tc.pm25, result, tc.expected)
+			}
+		})
+	}
+}
+
+// TestPM10BreakpointGap tests the critical gap between 54 and 55 for PM10
+func TestPM10BreakpointGap(t *testing.T) {
+	// Test PM10 values around the 54-55 boundary where the bug occurred
+	testCases := []struct {
+		pm10     float64
+		expected int
+	}{
+		{53.0, 49},   // Just below first breakpoint upper bound (BPHi is 54 with integer truncation)
+		{54.0, 50},   // At first breakpoint upper bound
+		{54.5, 50},   // Below 55 - first tier, as ranges are half-open
+		{54.9, 50},   // Just below 55, truncated to 54
+		{55.0, 51},   // At second breakpoint lower bound
+		{55.1, 51},   // Just above 55, truncated to 55
+		{100.0, 73},  // Middle value in second tier
+		{154.0, 100}, // Near upper bound of second tier
+		{154.5, 100}, // Below 155 - second tier
+		{155.0, 101}, // At third breakpoint lower bound
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("PM10=%.1f", tc.pm10), func(t *testing.T) {
+			result := CalculateAQI(tc.pm10, PM10Breakpoints)
+			if result != tc.expected {
+				t.Errorf("CalculateAQI(PM10=%f) = %d, want %d", tc.pm10, result, tc.expected)
+			}
+		})
+	}
+}
+
+// TestOzoneAQI tests the ozone sub-index around the 8-hour/1-hour switchover
+func TestOzoneAQI(t *testing.T) {
+	testCases := []struct {
+		ppb      float64
+		expected int
+	}{
+		{0, 0},
+		{54, 50},
+		{70, 100},
+		{124.9, 220}, // Truncated to 124, 8-hour table only
+		{125, 221},   // 1-hour table starts, 8-hour sub-index is still higher
+		{164, 262},
+		{200, 300}, // Top of the 8-hour table
+		{201, 300}, // 8-hour sub-index held at 300, above the 1-hour 196
+		{300, 300},
+		{404, 300},
+		{405, 301}, // 1-hour table exceeds the top of the 8-hour table
+		{604, 500},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("O3=%.1f", tc.ppb), func(t *testing.T) {
+			result := NewCalculator().OzoneAQI(tc.ppb)
+			if result != tc.expected {
+				t.Errorf("OzoneAQI(%f) = %d, want %d", tc.ppb, result, tc.expected)
+			}
+		})
+	}
+
+	// The AQI never falls as the concentration rises
+	prev := 0
+	for ppb := 0.0; ppb <= 700; ppb++ {
+		aqi := NewCalculator().OzoneAQI(ppb)
+		if aqi < prev {
+			t.Errorf("OzoneAQI(%g) = %d, below %d at %g ppb", ppb, aqi, prev, ppb-1)
+		}
+		prev = aqi
+	}
+}
+
+// TestSubIndicesOzone tests that ozone is optional and participates in the maximum
+func TestSubIndicesOzone(t *testing.T) {
+	calc := NewCalculator()
+	ozone := 90.0
+	if got, want := calc.SubIndices(8.0, 20.0, Gases{}).Max(), ComputeAQI(8.0, 20.0); got != want {
+		t.Errorf("SubIndices without ozone = %d, want %d", got, want)
+	}
+	sub := calc.SubIndices(8.0, 20.0, Gases{Ozone: &ozone})
+	if sub.Ozone == nil || *sub.Ozone != 161 || sub.Max() != 161 {
+		t.Errorf("SubIndices with ozone = %+v, want ozone and maximum 161", sub)
+	}
+}
+
+// TestRounding tests each rounding mode at concentrations whose AQI falls
+// between two integers, and that exact breakpoint AQIs are unaffected
+func TestRounding(t *testing.T) {
+	testCases := []struct {
+		pm25     float64
+		rounding Rounding
+		expected int
+	}{
+		{34.7, RoundNearest, 99}, // AQI 98.53
+		{34.7, RoundTruncate, 98},
+		{34.7, RoundCeil, 99},
+		{34.2, RoundNearest, 97}, // AQI 97.48
+		{34.2, RoundTruncate, 97},
+		{34.2, RoundCeil, 98},
+		{12.1, RoundTruncate, 51}, // Breakpoints are exact
+		{12.1, RoundCeil, 51},
+		{35.4, RoundTruncate, 100},
+		{35.4, RoundCeil, 100},
+	}
+	for _, tc := range testCases {
+		calc := NewCalculator()
+		calc.Rounding = tc.rounding
+		if got := calc.CalculateAQI(tc.pm25, PM25Breakpoints2012); got != tc.expected {
+			t.Errorf("CalculateAQI(%.1f) with rounding %d = %d, want %d", tc.pm25, tc.rounding, got, tc.expected)
+		}
+	}
+}
+
+// TestExtendedAQI tests extrapolation above the last breakpoint
+func TestExtendedAQI(t *testing.T) {
+	testCases := []struct {
+		pm25     float64
+		extended bool
+		expected int
+	}{
+		{600, false, 500},
+		{1000, false, 500},
+		{600, true, 566},
+		{1000, true, 830},
+		{450, true, 467},
+	}
+	for _, tc := range testCases {
+		calc := NewCalculator()
+		calc.Extended = tc.extended
+		if got := calc.ComputeAQI(tc.pm25, 0); got != tc.expected {
+			t.Errorf("ComputeAQI(%.1f, 0) with extended=%v = %d, want %d", tc.pm25, tc.extended, got, tc.expected)
+		}
+	}
+}
+
+func TestCOAQI(t *testing.T) {
+	testCases := []struct {
+		ppm      float64
+		expected int
+	}{
+		{0.0, 0},
+		{4.4, 50},
+		{4.5, 51},
+		{9.4, 100},
+		{9.49, 100}, // Truncated to 9.4
+		{12.4, 150},
+		{15.4, 200},
+		{30.4, 300},
+		{40.4, 400},
+		{50.4, 500},
+	}
+	for _, tc := range testCases {
+		if got := CalculateAQI(tc.ppm, COBreakpoints); got != tc.expected {
+			t.Errorf("CalculateAQI(%.2f ppm CO) = %d, want %d", tc.ppm, got, tc.expected)
+		}
+	}
+
+	co := 12.4
+	if got := NewCalculator().SubIndices(8.0, 20.0, Gases{CO: &co}).Max(); got != 150 {
+		t.Errorf("SubIndices with CO = %d, want 150", got)
+	}
+}
+
+func TestSO2AQI(t *testing.T) {
+	testCases := []struct {
+		ppb      float64
+		expected int
+	}{
+		{0, 0},
+		{35, 50},
+		{35.9, 50}, // Truncated to 35
+		{36, 51},
+		{75, 100},
+		{185, 150},
+		{304, 200},
+		{305, 201}, // 24-hour ranges applied to the 1-hour value
+		{604, 300},
+		{804, 400},
+		{1004, 500},
+		{2000, 500},
+	}
+	for _, tc := range testCases {
+		if got := CalculateAQI(tc.ppb, SO2Breakpoints); got != tc.expected {
+			t.Errorf("CalculateAQI(%.1f ppb SO2) = %d, want %d", tc.ppb, got, tc.expected)
+		}
+	}
+}
+
+func TestNO2AQI(t *testing.T) {
+	testCases := []struct {
+		ppb      float64
+		expected int
+	}{
+		{0, 0},
+		{53, 50},
+		{54, 51},
+		{100, 100},
+		{100.9, 100}, // Truncated to 100
+		{360, 150},
+		{649, 200},
+		{1249, 300},
+		{1649, 400},
+		{2049, 500},
+	}
+	for _, tc := range testCases {
+		if got := CalculateAQI(tc.ppb, NO2Breakpoints); got != tc.expected {
+			t.Errorf("CalculateAQI(%.1f ppb NO2) = %d, want %d", tc.ppb, got, tc.expected)
+		}
+	}
+
+	so2, no2 := 75.0, 360.0
+	result := NewCalculator().ComputeAQIDetailed(8.0, 20.0, Gases{SO2: &so2, NO2: &no2})
+	if result.Value != 150 || result.Dominant != PollutantNO2 {
+		t.Errorf("ComputeAQIDetailed with SO2 and NO2 = %+v, want 150 from NO2", result)
+	}
+	if result.SubIndices[PollutantSO2] != 100 || result.SubIndices[PollutantNO2] != 150 {
+		t.Errorf("SubIndices = %v, want so2 100 and no2 150", result.SubIndices)
+	}
+}
+
+func TestValidateBreakpoints(t *testing.T) {
+	builtin := map[string]Table{
+		"PM2.5 2012":   PM25Breakpoints2012,
+		"PM2.5 2024":   PM25Breakpoints2024,
+		"PM10":         PM10Breakpoints,
+		"Ozone 8-hour": Ozone8hBreakpoints,
+		"Ozone 1-hour": Ozone1hBreakpoints,
+		"CO":           COBreakpoints,
+		"SO2":          SO2Breakpoints,
+		"NO2":          NO2Breakpoints,
+	}
+	for name, table := range builtin {
+		if err := table.Validate(); err != nil {
+			t.Errorf("Built-in %s table is invalid: %v", name, err)
+		}
+	}
+
+	testCases := []struct {
+		name        string
+		breakpoints []AQIBreakpoint
+	}{
+		{"Empty", nil},
+		{"Decreasing concentration", []AQIBreakpoint{{12, 0, 0, 50}}},
+		{"Decreasing AQI", []AQIBreakpoint{{0, 12, 50, 0}}},
+		{"Overlapping concentration", []AQIBreakpoint{{0, 12.1, 0, 50}, {11, 35.5, 51, 100}}},
+		{"Gap in concentration", []AQIBreakpoint{{0, 12.0, 0, 50}, {12.1, 35.5, 51, 100}}},
+		{"Overlapping AQI", []AQIBreakpoint{{0, 12.1, 0, 50}, {12.1, 35.5, 40, 100}}},
+		{"Out of order", []AQIBreakpoint{{12.1, 35.5, 51, 100}, {0, 12.1, 0, 50}}},
+		{"Range as narrow as the resolution", []AQIBreakpoint{{0, 12.1, 0, 50}, {12.1, 12.2, 51, 100}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateBreakpoints(tc.breakpoints, 0.1); err == nil {
+				t.Error("ValidateBreakpoints returned nil error")
+			}
+		})
+	}
+}
+
+func TestDominant(t *testing.T) {
+	ozone, co, low := 120, 160, 10
+	testCases := []struct {
+		sub      SubIndices
+		expected string
+	}{
+		{SubIndices{PM25: 80, PM10: 40}, PollutantPM25},
+		{SubIndices{PM25: 40, PM10: 80}, PollutantPM10},
+		{SubIndices{PM25: 50, PM10: 50}, PollutantPM25},
+		{SubIndices{PM25: 80, PM10: 40, Ozone: &ozone}, PollutantOzone},
+		{SubIndices{PM25: 80, PM10: 40, Ozone: &ozone, CO: &co}, PollutantCO},
+		{SubIndices{PM25: 80, PM10: 40, Ozone: &low, CO: &low}, PollutantPM25},
+		{SubIndices{PM25: 80, PM10: 40, CO: &co, SO2: &co}, PollutantCO},
+		{SubIndices{PM25: 80, PM10: 40, SO2: &ozone, NO2: &low}, PollutantSO2},
+		{SubIndices{PM25: 80, PM10: 40, SO2: &ozone, NO2: &co}, PollutantNO2},
+	}
+	for _, tc := range testCases {
+		if got := tc.sub.Dominant(); got != tc.expected {
+			t.Errorf("Dominant(%+v) = %q, want %q", tc.sub, got, tc.expected)
+		}
+	}
+}
+
+func TestComputeAQIDetailed(t *testing.T) {
+	result := ComputeAQIDetailed(35.7, 45)
+	expected := AQIResult{
+		Value:      101,
+		Dominant:   PollutantPM25,
+		Category:   "Unhealthy for Sensitive Groups",
+		SubIndices: map[string]int{PollutantPM25: 101, PollutantPM10: 42},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("ComputeAQIDetailed(35.7, 45) = %+v, want %+v", result, expected)
+	}
+	if value := ComputeAQI(35.7, 45); value != result.Value {
+		t.Errorf("ComputeAQI(35.7, 45) = %d, want %d as in the detailed result", value, result.Value)
+	}
+
+	ozone, co := 70.0, 10.0
+	result = NewCalculator().ComputeAQIDetailed(12.0, 20, Gases{Ozone: &ozone, CO: &co})
+	expected = AQIResult{
+		Value:      109,
+		Dominant:   PollutantCO,
+		Category:   "Unhealthy for Sensitive Groups",
+		SubIndices: map[string]int{PollutantPM25: 50, PollutantPM10: 19, PollutantOzone: 100, PollutantCO: 109},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("ComputeAQIDetailed with ozone and CO = %+v, want %+v", result, expected)
+	}
+}
+
+func TestAQIResultSelect(t *testing.T) {
+	ozone, co := 70.0, 10.0
+	result := NewCalculator().ComputeAQIDetailed(12.0, 200, Gases{Ozone: &ozone, CO: &co})
+
+	selected := result.Select([]string{PollutantPM25, PollutantOzone})
+	expected := AQIResult{
+		Value:      100,
+		Dominant:   PollutantOzone,
+		Category:   "Moderate",
+		SubIndices: map[string]int{PollutantPM25: 50, PollutantOzone: 100},
+	}
+	if !reflect.DeepEqual(selected, expected) {
+		t.Errorf("Select(pm25, ozone) = %+v, want %+v", selected, expected)
+	}
+
+	// Selecting every pollutant leaves the result unchanged
+	if all := result.Select(Pollutants); !reflect.DeepEqual(all, result) {
+		t.Errorf("Select(all) = %+v, want %+v", all, result)
+	}
+}
+
+func TestCategory(t *testing.T) {
+	testCases := []struct {
+		aqi      int
+		expected string
+	}{
+		{0, "Good"},
+		{50, "Good"},
+		{51, "Moderate"},
+		{150, "Unhealthy for Sensitive Groups"},
+		{200, "Unhealthy"},
+		{300, "Very Unhealthy"},
+		{500, "Hazardous"},
+		{501, "Beyond Index"},
+	}
+	for _, tc := range testCases {
+		if got := Category(tc.aqi); got != tc.expected {
+			t.Errorf("Category(%d) = %q, want %q", tc.aqi, got, tc.expected)
+		}
+	}
+}
+
+func TestConcentrationForAQI(t *testing.T) {
+	testCases := []struct {
+		name     string
+		aqi      int
+		table    Table
+		expected float64
+	}{
+		{"Zero", 0, PM25Breakpoints2012, 0},
+		{"Top of Good", 50, PM25Breakpoints2012, 11.9},
+		{"Start of Moderate", 51, PM25Breakpoints2012, 12.1},
+		{"Start of USG", 101, PM25Breakpoints2012, 35.5},
+		{"2024 Moderate", 51, PM25Breakpoints2024, 9.1},
+		{"PM10 Moderate", 51, PM10Breakpoints, 55},
+		{"Beyond the table", 600, PM25Breakpoints2012, 499.7}, // Clamped to AQI 500
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ConcentrationForAQI(tc.aqi, tc.table); got != tc.expected {
+				t.Errorf("ConcentrationForAQI(%d) = %g, want %g", tc.aqi, got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestConcentrationForAQIRoundTrip checks that CalculateAQI inverts
+// ConcentrationForAQI, and that the result is the lowest such concentration
+func TestConcentrationForAQIRoundTrip(t *testing.T) {
+	for _, table := range []struct {
+		name  string
+		table Table
+	}{
+		{"PM2.5 2012", PM25Breakpoints2012},
+		{"PM2.5 2024", PM25Breakpoints2024},
+		{"PM10", PM10Breakpoints},
+	} {
+		resolution := 1 / math.Pow10(table.table.Decimals)
+		for _, aqi := range []int{1, 25, 50, 51, 75, 100, 101, 125, 150, 151, 175, 200, 250, 300, 350, 400, 450, 500} {
+			concentration := ConcentrationForAQI(aqi, table.table)
+			if got := CalculateAQI(concentration, table.table); got != aqi {
+				t.Errorf("%s: CalculateAQI(ConcentrationForAQI(%d) = %g) = %d", table.name, aqi, concentration, got)
+			}
+			if below := concentration - resolution; below >= 0 && CalculateAQI(below, table.table) >= aqi {
+				t.Errorf("%s: %g already has AQI %d, below ConcentrationForAQI(%d) = %g", table.name, below, CalculateAQI(below, table.table), aqi, concentration)
+			}
+		}
+	}
+}
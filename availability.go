@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// runAvailability publishes "online" to topic every interval until stop is
+// closed, whether or not readings arrive
+// Unlike the retained -status-topic, which only changes on connect and when
+// the Last Will fires, a missing heartbeat also reveals a daemon that is
+// connected but hung. Heartbeats are skipped while disconnected.
+func (p *processor) runAvailability(client mqtt.Client, topic string, interval time.Duration, stop <-chan struct{}) {
+	for {
+		select {
+		case <-p.clock.After(interval):
+		case <-stop:
+			return
+		}
+		if !client.IsConnected() {
+			slog.Debug("Not connected, skipping availability heartbeat", "topic", topic)
+			continue
+		}
+		p.publish(client, topic, false, statusOnline)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAvailabilityHeartbeat tests that "online" is published every
+// -heartbeat-interval on the fake clock, and skipped while disconnected
+func TestAvailabilityHeartbeat(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	client := &fakeClient{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		proc.runAvailability(client, "aqi/availability", time.Minute, stop)
+		close(done)
+	}()
+
+	// Each step advances the clock and waits for the loop to wait again,
+	// which it does only after publishing any heartbeat that was due
+	step := func(d time.Duration) int {
+		clock.advance(d)
+		clock.waitForWaiters(t, 1)
+		return len(client.messages())
+	}
+	clock.waitForWaiters(t, 1)
+	if got := step(59 * time.Second); got != 0 {
+		t.Fatalf("Published %d heartbeats before the interval elapsed, want 0", got)
+	}
+	if got := step(time.Second); got != 1 {
+		t.Fatalf("Published %d heartbeats after one interval, want 1", got)
+	}
+	if got := step(time.Minute); got != 2 {
+		t.Fatalf("Published %d heartbeats after two intervals, want 2", got)
+	}
+	for _, msg := range client.messages() {
+		if msg.Topic != "aqi/availability" || string(msg.Payload) != statusOnline || msg.Retained {
+			t.Errorf("Published %s %q retained=%v, want non-retained online on aqi/availability", msg.Topic, msg.Payload, msg.Retained)
+		}
+	}
+
+	// A disconnected client gets no heartbeat
+	client.Disconnect(0)
+	if got := step(time.Minute); got != 2 {
+		t.Errorf("Published %d heartbeats, want 2 with none while disconnected", got)
+	}
+
+	close(stop)
+	<-done
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// PM averaging modes selectable with -pm-averaging
+const (
+	pmAveragingWindow  = "window"  // Moving average over -average-window
+	pmAveraging24h     = "24h"     // 24-hour rolling mean, as the EPA breakpoints assume
+	pmAveragingNowCast = "nowcast" // EPA NowCast concentration
+)
+
+// pmAveragingInstant labels output computed from the instantaneous PM2.5
+// because the NowCast does not have enough data yet
+const pmAveragingInstant = "instant"
+
+// validatePMAveraging checks that a PM averaging mode is supported
+func validatePMAveraging(mode string) error {
+	switch mode {
+	case pmAveragingWindow, pmAveraging24h, pmAveragingNowCast:
+		return nil
+	default:
+		return fmt.Errorf("unknown PM averaging %q: must be %q, %q or %q", mode, pmAveragingWindow, pmAveraging24h, pmAveragingNowCast)
+	}
+}
+
+// averageSample is a single timestamped PM reading
+// A nil concentration was missing from the reading.
+type averageSample struct {
+	Time time.Time `json:"time"`
+	PM25 *float64  `json:"pm25,omitempty"`
+	PM10 *float64  `json:"pm10,omitempty"`
+}
+
+// movingAverage maintains a time-windowed moving average of PM2.5 and PM10
+type movingAverage struct {
+	window  time.Duration
+	samples []averageSample
+}
+
+// newMovingAverage creates a moving average over the given window
+// A zero window disables averaging.
+func newMovingAverage(window time.Duration) *movingAverage {
+	return &movingAverage{window: window}
+}
+
+// Add records a reading taken at time t, evicts readings that have fallen out
+// of the window, and returns the averaged PM2.5 and PM10 concentrations
+// A nil concentration is missing from the reading: each pollutant is averaged
+// over the readings that have it, and is 0 if none do.
+func (m *movingAverage) Add(t time.Time, pm25, pm10 *float64) (float64, float64) {
+	if m.window <= 0 {
+		return valueOrZero(pm25), valueOrZero(pm10)
+	}
+
+	m.samples = append(m.samples, averageSample{Time: t, PM25: pm25, PM10: pm10})
+
+	cutoff := t.Add(-m.window)
+	kept := m.samples[:0]
+	for _, s := range m.samples {
+		if s.Time.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	m.samples = kept
+
+	var sum25, sum10, n25, n10 float64
+	for _, s := range m.samples {
+		if s.PM25 != nil {
+			sum25 += *s.PM25
+			n25++
+		}
+		if s.PM10 != nil {
+			sum10 += *s.PM10
+			n10++
+		}
+	}
+	return mean(sum25, n25), mean(sum10, n10)
+}
+
+// mean returns sum/n, or 0 if there are no values
+func mean(sum, n float64) float64 {
+	if n == 0 {
+		return 0
+	}
+	return sum / n
+}
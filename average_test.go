@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"aqi-mqtt/aqi"
+)
+
+// ptr returns a pointer to v
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestMovingAverage(t *testing.T) {
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	avg := newMovingAverage(5 * time.Minute)
+
+	testCases := []struct {
+		offset         time.Duration
+		pm25, pm10     float64
+		want25, want10 float64
+	}{
+		{0, 10, 20, 10, 20},
+		{time.Minute, 20, 40, 15, 30},
+		{2 * time.Minute, 30, 60, 20, 40},
+		// The first reading is exactly 5 minutes old and is evicted
+		{5 * time.Minute, 40, 80, 30, 60},
+		// Only the 5 minute reading remains in the window
+		{9 * time.Minute, 100, 100, 70, 90},
+	}
+
+	for _, tc := range testCases {
+		got25, got10 := avg.Add(start.Add(tc.offset), ptr(tc.pm25), ptr(tc.pm10))
+		if got25 != tc.want25 || got10 != tc.want10 {
+			t.Errorf("At +%v: average = (%f, %f), want (%f, %f)", tc.offset, got25, got10, tc.want25, tc.want10)
+		}
+	}
+}
+
+// TestMovingAverageMissing tests that a concentration missing from a reading
+// is left out of its average instead of counting as 0
+func TestMovingAverageMissing(t *testing.T) {
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	avg := newMovingAverage(5 * time.Minute)
+
+	avg.Add(start, ptr(10.0), ptr(20.0))
+	pm25, pm10 := avg.Add(start.Add(time.Minute), nil, ptr(40.0))
+	if pm25 != 10 || pm10 != 30 {
+		t.Errorf("Average = (%f, %f), want (10, 30)", pm25, pm10)
+	}
+
+	empty := newMovingAverage(5 * time.Minute)
+	if pm25, _ := empty.Add(start, nil, ptr(40.0)); pm25 != 0 {
+		t.Errorf("Average of no PM2.5 readings = %f, want 0", pm25)
+	}
+}
+
+// TestMovingAverageZeroWindow checks that a zero window matches the instantaneous calculation
+func TestMovingAverageZeroWindow(t *testing.T) {
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	avg := newMovingAverage(0)
+
+	avg.Add(start, ptr(100.0), ptr(100.0))
+	pm25, pm10 := avg.Add(start.Add(time.Second), ptr(35.7), ptr(45.0))
+	if pm25 != 35.7 || pm10 != 45 {
+		t.Errorf("Zero window average = (%f, %f), want (35.7, 45)", pm25, pm10)
+	}
+	if got := aqi.ComputeAQI(pm25, pm10); got != aqi.ComputeAQI(35.7, 45) {
+		t.Errorf("Zero window AQI = %d, want %d", got, aqi.ComputeAQI(35.7, 45))
+	}
+}
+
+// averagedReading handles a reading of PM2.5 pm25 taken at at and returns the output
+func averagedReading(t *testing.T, proc *processor, at time.Time, pm25 float64) AQIReading {
+	t.Helper()
+
+	client := &fakeClient{}
+	payload := fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %g, "pm10Standard": 0, "timestamp": %q}`, pm25, at.Format(time.RFC3339))
+	proc.handleMessage(client, &fakeMessage{topic: "in", payload: []byte(payload)})
+
+	msgs := client.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(msgs))
+	}
+	var output AQIReading
+	if err := json.Unmarshal(msgs[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	return output
+}
+
+func TestPMAveraging24h(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PMAveraging = pmAveraging24h
+	cfg.TimestampSource = timestampPayload
+	proc := newProcessor("aqi")
+	proc.applyConfig(cfg)
+
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		offset time.Duration
+		pm25   float64
+		want   float64 // Averaged PM2.5
+	}{
+		{0, 100, 100},
+		{12 * time.Hour, 0, 50},
+		{23 * time.Hour, 20, 40},
+		// The first reading is more than 24 hours old and is evicted
+		{25 * time.Hour, 20, 40.0 / 3},
+		// Only the readings of the last 24 hours remain
+		{40 * time.Hour, 60, 100.0 / 3},
+	}
+	for _, tc := range testCases {
+		output := averagedReading(t, proc, start.Add(tc.offset), tc.pm25)
+		if want := aqi.ComputeAQI(tc.want, 0); output.AQI != want {
+			t.Errorf("At +%v: AQI = %d, want %d from the 24h mean %.2f", tc.offset, output.AQI, want, tc.want)
+		}
+		if output.Averaging != pmAveraging24h {
+			t.Errorf("At +%v: averaging = %q, want %q", tc.offset, output.Averaging, pmAveraging24h)
+		}
+	}
+}
+
+func TestPMAveragingNowCast(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PMAveraging = pmAveragingNowCast
+	cfg.TimestampSource = timestampPayload
+	proc := newProcessor("aqi")
+	proc.applyConfig(cfg)
+
+	// Until the NowCast has data for two of the last three hours the
+	// instantaneous concentration is used
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	output := averagedReading(t, proc, start, 50)
+	if output.Averaging != pmAveragingInstant || output.AQI != aqi.ComputeAQI(50, 0) {
+		t.Errorf("First reading: averaging %q, AQI %d, want %q, %d", output.Averaging, output.AQI, pmAveragingInstant, aqi.ComputeAQI(50, 0))
+	}
+
+	output = averagedReading(t, proc, start.Add(time.Hour), 10)
+	if output.Averaging != pmAveragingNowCast {
+		t.Errorf("Averaging = %q, want %q", output.Averaging, pmAveragingNowCast)
+	}
+	if output.NowCastAQI == nil || output.AQI != *output.NowCastAQI {
+		t.Errorf("AQI = %d, want the NowCast AQI %v", output.AQI, output.NowCastAQI)
+	}
+	if output.AQI == aqi.ComputeAQI(10, 0) {
+		t.Errorf("AQI = %d is the instantaneous AQI, want the NowCast", output.AQI)
+	}
+}
+
+// TestPMAveragingWindow checks that the default leaves the output unlabeled
+func TestPMAveragingWindow(t *testing.T) {
+	proc := newProcessor("aqi")
+	output := averagedReading(t, proc, time.Now(), 35.7)
+	if output.Averaging != "" {
+		t.Errorf("Averaging = %q, want omitted", output.Averaging)
+	}
+}
+
+// TestAQIInstant checks that averaged output also carries the instantaneous AQI
+func TestAQIInstant(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PMAveraging = pmAveraging24h
+	cfg.TimestampSource = timestampPayload
+	proc := newProcessor("aqi")
+	proc.applyConfig(cfg)
+
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	averagedReading(t, proc, start, 100)
+	output := averagedReading(t, proc, start.Add(time.Hour), 10)
+
+	if want := aqi.ComputeAQI(55, 0); output.AQI != want {
+		t.Errorf("AQI = %d, want %d from the 24h mean", output.AQI, want)
+	}
+	if output.AQIInstant == nil {
+		t.Fatal("aqiInstant missing with 24h averaging")
+	}
+	if want := aqi.ComputeAQI(10, 0); *output.AQIInstant != want {
+		t.Errorf("aqiInstant = %d, want %d from the latest reading", *output.AQIInstant, want)
+	}
+	if *output.AQIInstant >= output.AQI {
+		t.Errorf("aqiInstant %d should be below the averaged AQI %d after the level dropped", *output.AQIInstant, output.AQI)
+	}
+
+	// Without averaging both would be the same, so aqiInstant is omitted
+	if output := averagedReading(t, newProcessor("aqi"), start, 10); output.AQIInstant != nil {
+		t.Errorf("aqiInstant = %d without averaging, want omitted", *output.AQIInstant)
+	}
+}
+
+// TestAQIInstantRenamed checks that aqiInstant follows the renamed index field
+func TestAQIInstantRenamed(t *testing.T) {
+	for standard, field := range map[string]string{standardAQHI: "aqhiInstant", standardDAQI: "daqiInstant"} {
+		instant := 3
+		data, err := marshalOutput(AQIReading{AQIInstant: &instant}, standard)
+		if err != nil {
+			t.Fatalf("marshalOutput(%s) failed: %v", standard, err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		if _, ok := fields["aqiInstant"]; ok {
+			t.Errorf("%s output still has aqiInstant", standard)
+		}
+		if fields[field] != float64(3) {
+			t.Errorf("%s output %s = %v, want 3", standard, field, fields[field])
+		}
+	}
+}
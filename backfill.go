@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Pollutants remembered for -backfill-max-age
+const (
+	backfillPM25  = "pm25"
+	backfillPM10  = "pm10"
+	backfillOzone = "ozone"
+	backfillCO    = "co"
+	backfillSO2   = "so2"
+	backfillNO2   = "no2"
+)
+
+// knownConcentration is the last reported concentration of a pollutant
+type knownConcentration struct {
+	value float64
+	at    time.Time
+}
+
+// backfill fills the pollutants missing from a reading with the sensor's last
+// known concentrations, if they are no older than -backfill-max-age, and
+// remembers the ones the reading has
+// pm25 is the PM2.5 concentration selected with -pm25-source. Filled-in
+// values are also set in reading, so they appear in the output. Concentrations
+// are cached after unit normalization and before any correction. Returns the
+// pollutants that were filled in.
+func (p *processor) backfill(payload []byte, reading *SensorReading, pm25 *float64, now time.Time) (filled []string) {
+	var fields pollutantFields
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil // Already parsed by the caller
+	}
+	hasPM25 := fields.PM02 != nil || fields.PM02Standard != nil || fields.PM02Compensated != nil
+
+	// Each pollutant with a pointer to its value, nil if the reading lacks it
+	gases := []struct {
+		name  string
+		value **float64
+	}{
+		{backfillOzone, &reading.Ozone},
+		{backfillCO, &reading.CO},
+		{backfillSO2, &reading.SO2},
+		{backfillNO2, &reading.NO2},
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known := p.concentrations[reading.SerialNo]
+	if known == nil {
+		known = make(map[string]knownConcentration)
+		p.concentrations[reading.SerialNo] = known
+	}
+
+	// lookup returns the cached value of a missing pollutant if it is recent
+	lookup := func(name string) (float64, bool) {
+		c, ok := known[name]
+		if !ok || now.Sub(c.at) > p.backfillMaxAge {
+			return 0, false
+		}
+		filled = append(filled, name)
+		return c.value, true
+	}
+
+	if hasPM25 {
+		known[backfillPM25] = knownConcentration{*pm25, now}
+	} else if v, ok := lookup(backfillPM25); ok {
+		*pm25 = v
+		switch p.pm25Source {
+		case pm25SourceCompensated:
+			reading.PM02Compensated = v
+		case pm25SourceAtmospheric:
+			reading.PM02 = v
+		default:
+			reading.PM02Standard = v
+		}
+	}
+	if fields.PM10Standard != nil {
+		known[backfillPM10] = knownConcentration{reading.PM10Standard, now}
+	} else if v, ok := lookup(backfillPM10); ok {
+		reading.PM10Standard = v
+	}
+	for _, gas := range gases {
+		if *gas.value != nil {
+			known[gas.name] = knownConcentration{**gas.value, now}
+		} else if v, ok := lookup(gas.name); ok {
+			*gas.value = &v
+		}
+	}
+	return filled
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestBackfill tests that a PM10-less reading uses the sensor's cached PM10
+// within -backfill-max-age, and computes without it once the value is too old
+func TestBackfill(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	proc.backfillMaxAge = 10 * time.Minute
+
+	handle := func(payload string) AQIReading {
+		t.Helper()
+		client := &fakeClient{}
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+		var output AQIReading
+		if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		return output
+	}
+
+	// PM10 of 200 is AQI 123, well above PM2.5 of 5
+	if output := handle(`{"serialno": "abc", "pm02Standard": 5, "pm10Standard": 200}`); output.AQI != 123 || output.Backfilled != nil {
+		t.Fatalf("With PM10: aqi = %d, backfilled = %v; want 123 and none", output.AQI, output.Backfilled)
+	}
+
+	clock.advance(5 * time.Minute)
+	output := handle(`{"serialno": "abc", "pm02Standard": 5}`)
+	if output.AQI != 123 || output.PM10Standard != 200 {
+		t.Errorf("Without PM10: aqi = %d, pm10Standard = %v; want 123 and 200 from the cache", output.AQI, output.PM10Standard)
+	}
+	if want := []string{backfillPM10}; !reflect.DeepEqual(output.Backfilled, want) {
+		t.Errorf("backfilled = %v, want %v", output.Backfilled, want)
+	}
+
+	// Other sensors have their own cache
+	if output := handle(`{"serialno": "def", "pm02Standard": 5}`); output.AQI != 21 {
+		t.Errorf("Other sensor: aqi = %d, want 21 from PM2.5 alone", output.AQI)
+	}
+
+	// The backfilled reading does not refresh the cached PM10
+	clock.advance(6 * time.Minute)
+	if output := handle(`{"serialno": "abc", "pm02Standard": 5}`); output.AQI != 21 || output.Backfilled != nil {
+		t.Errorf("After max age: aqi = %d, backfilled = %v; want 21 and none", output.AQI, output.Backfilled)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"aqi-mqtt/aqi"
+)
+
+// breakpointsFile is the JSON layout accepted by -breakpoints
+// Tables that are omitted keep their built-in defaults.
+type breakpointsFile struct {
+	PM25 []aqi.AQIBreakpoint `json:"pm25"`
+	PM10 []aqi.AQIBreakpoint `json:"pm10"`
+
+	// PM1 is the table of the experimental PM1.0 sub-index, see pm1Index
+	PM1 []aqi.AQIBreakpoint `json:"pm1"`
+}
+
+// loadBreakpointsFile reads and validates breakpoint tables from a JSON file
+func loadBreakpointsFile(path string) (*breakpointsFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read breakpoints file: %w", err)
+	}
+
+	var tables breakpointsFile
+	if err := json.Unmarshal(data, &tables); err != nil {
+		return nil, fmt.Errorf("failed to parse breakpoints file %s: %w", path, err)
+	}
+
+	// Loaded tables keep the truncation of the built-in ones they replace,
+	// and PM1.0 that of PM2.5, see applyBreakpoints
+	if tables.PM25 != nil {
+		if err := (aqi.Table{Decimals: aqi.PM25Breakpoints2012.Decimals, Breakpoints: tables.PM25}).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid pm25 breakpoints in %s: %w", path, err)
+		}
+	}
+	if tables.PM10 != nil {
+		if err := (aqi.Table{Decimals: aqi.PM10Breakpoints.Decimals, Breakpoints: tables.PM10}).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid pm10 breakpoints in %s: %w", path, err)
+		}
+	}
+	if tables.PM1 != nil {
+		if err := (aqi.Table{Decimals: aqi.PM25Breakpoints2012.Decimals, Breakpoints: tables.PM1}).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid pm1 breakpoints in %s: %w", path, err)
+		}
+	}
+	return &tables, nil
+}
+
+// applyBreakpointsFile replaces the processor's PM breakpoint tables with those from path
+func (p *processor) applyBreakpointsFile(path string) error {
+	tables, err := loadBreakpointsFile(path)
+	if err != nil {
+		return err
+	}
+	p.applyBreakpoints(tables)
+	return nil
+}
+
+// applyBreakpoints replaces the built-in tables defined in a breakpoints file
+func (p *processor) applyBreakpoints(tables *breakpointsFile) {
+	// The EPA truncation rules do not change with the breakpoints
+	if tables.PM25 != nil {
+		p.calc.PM25 = aqi.Table{Decimals: p.calc.PM25.Decimals, Breakpoints: tables.PM25}
+	}
+	if tables.PM10 != nil {
+		p.calc.PM10 = aqi.Table{Decimals: p.calc.PM10.Decimals, Breakpoints: tables.PM10}
+	}
+	if tables.PM1 != nil {
+		p.pm1Breakpoints = tables.PM1
+	}
+}
+
+// pm1Index returns the experimental PM1.0 sub-index of a concentration
+// There is no official PM1.0 AQI. Without a pm1 table in the breakpoints
+// file, PM1.0, which is a fraction of PM2.5, is rated on the PM2.5 table.
+// Concentrations are truncated like PM2.5.
+func (p *processor) pm1Index(pm1 float64) int {
+	table := p.calc.PM25
+	if p.pm1Breakpoints != nil {
+		table = aqi.Table{Decimals: p.calc.PM25.Decimals, Breakpoints: p.pm1Breakpoints}
+	}
+	return p.calc.CalculateAQI(pm1, table)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"aqi-mqtt/aqi"
+)
+
+// TestApplyBreakpointsFile loads the revised 2024 PM2.5 table
+func TestApplyBreakpointsFile(t *testing.T) {
+	proc := newProcessor("aqi")
+	if got := proc.calc.CalculateAQI(100.0, proc.calc.PM25); got != 174 {
+		t.Fatalf("Default table: CalculateAQI(100.0) = %d, want 174", got)
+	}
+
+	if err := proc.applyBreakpointsFile(filepath.Join("testdata", "breakpoints-2024.json")); err != nil {
+		t.Fatalf("applyBreakpointsFile returned error: %v", err)
+	}
+
+	if got := proc.calc.CalculateAQI(100.0, proc.calc.PM25); got != 182 {
+		t.Errorf("2024 table: CalculateAQI(100.0) = %d, want 182", got)
+	}
+	if got := proc.calc.CalculateAQI(9.0, proc.calc.PM25); got != 50 {
+		t.Errorf("2024 table: CalculateAQI(9.0) = %d, want 50", got)
+	}
+	if &proc.calc.PM10.Breakpoints[0] != &aqi.PM10Breakpoints.Breakpoints[0] {
+		t.Error("PM10 table replaced although the file does not define it")
+	}
+}
+
+func TestCAQIBreakpoints(t *testing.T) {
+	builtin := map[string][]aqi.AQIBreakpoint{
+		"CAQI PM2.5": caqiPM25Breakpoints,
+		"CAQI PM10":  caqiPM10Breakpoints,
+		"CAQI NO2":   caqiNO2Breakpoints,
+		"CAQI ozone": caqiOzoneBreakpoints,
+	}
+	for name, breakpoints := range builtin {
+		if err := aqi.ValidateBreakpoints(breakpoints, 0); err != nil {
+			t.Errorf("Built-in %s table is invalid: %v", name, err)
+		}
+	}
+}
+
+func TestLoadBreakpointsFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breakpoints.json")
+	content := `{"pm10": [{"concLow": 0, "concHigh": 55, "aqiLow": 0, "aqiHigh": 50}, {"concLow": 50, "concHigh": 155, "aqiLow": 51, "aqiHigh": 100}]}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write breakpoints file: %v", err)
+	}
+
+	if _, err := loadBreakpointsFile(path); err == nil {
+		t.Error("loadBreakpointsFile accepted overlapping ranges")
+	}
+	if _, err := loadBreakpointsFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadBreakpointsFile accepted a missing file")
+	}
+}
+
+func TestPM25Revision(t *testing.T) {
+	testCases := []struct {
+		revision string
+		pm25     float64
+		expected int
+	}{
+		{pm25Revision2012, 9.0, 38},
+		{pm25Revision2012, 12.0, 50},
+		{pm25Revision2024, 9.0, 50},
+		{pm25Revision2024, 12.0, 56},
+		{pm25Revision2024, 250.0, 350},
+	}
+	for _, tc := range testCases {
+		calc := newCalculator(tc.revision, false, aqiRoundingRound)
+		if got := calc.ComputeAQI(tc.pm25, 0); got != tc.expected {
+			t.Errorf("Revision %s: ComputeAQI(%.1f, 0) = %d, want %d", tc.revision, tc.pm25, got, tc.expected)
+		}
+	}
+
+	// PM10 is unaffected by the revision
+	if got := newCalculator(pm25Revision2024, false, aqiRoundingRound).ComputeAQI(0, 100); got != 73 {
+		t.Errorf("Revision 2024: ComputeAQI(0, 100) = %d, want 73", got)
+	}
+
+	if err := validatePM25Revision("2020"); err == nil {
+		t.Error("validatePM25Revision accepted an unknown revision")
+	}
+}
+
+func TestAQIRounding(t *testing.T) {
+	// PM2.5 of 34.7 is AQI 98.53
+	for rounding, expected := range map[string]int{
+		aqiRoundingRound:    99,
+		aqiRoundingTruncate: 98,
+		aqiRoundingCeil:     99,
+	} {
+		if got := newCalculator(pm25Revision2012, false, rounding).ComputeAQI(34.7, 0); got != expected {
+			t.Errorf("Rounding %s: ComputeAQI(34.7, 0) = %d, want %d", rounding, got, expected)
+		}
+	}
+
+	if err := validateAQIRounding("floor"); err == nil {
+		t.Error("validateAQIRounding accepted an unknown rounding")
+	}
+}
+
+// TestExperimentalPM1 tests the experimental PM1.0 sub-index with the PM2.5
+// table and a pm1 table from the breakpoints file, and that it does not
+// affect the AQI
+func TestExperimentalPM1(t *testing.T) {
+	proc := newProcessor("aqi")
+	if got, want := proc.pm1Index(20.0), proc.calc.CalculateAQI(20.0, proc.calc.PM25); got != want {
+		t.Errorf("Without a pm1 table: pm1Index(20.0) = %d, want %d from the PM2.5 table", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "breakpoints.json")
+	content := `{"pm1": [{"concLow": 0, "concHigh": 6.1, "aqiLow": 0, "aqiHigh": 50}, {"concLow": 6.1, "concHigh": 24.1, "aqiLow": 51, "aqiHigh": 100}]}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write breakpoints file: %v", err)
+	}
+	if err := proc.applyBreakpointsFile(path); err != nil {
+		t.Fatalf("applyBreakpointsFile returned error: %v", err)
+	}
+	for _, tc := range []struct {
+		pm1  float64
+		want int
+	}{
+		{6.0, 50},
+		{15.09, 75}, // Truncated to 15.0
+		{24.1, 500}, // Above the table
+	} {
+		if got := proc.pm1Index(tc.pm1); got != tc.want {
+			t.Errorf("pm1Index(%g) = %d, want %d", tc.pm1, got, tc.want)
+		}
+	}
+	if &proc.calc.PM25.Breakpoints[0] == &proc.pm1Breakpoints[0] {
+		t.Error("PM2.5 table replaced by the pm1 table")
+	}
+
+	// processMessage updates the sensor's state, so each call is for a
+	// different sensor
+	reading, err := proc.processMessage([]byte(`{"serialno": "abc", "pm01Standard": 15.0, "pm02Standard": 5.0}`))
+	if err != nil {
+		t.Fatalf("processMessage returned error: %v", err)
+	}
+	if reading.AQIPM1Experimental != nil {
+		t.Errorf("aqiPm1Experimental = %d without -experimental-pm1, want none", *reading.AQIPM1Experimental)
+	}
+	proc.experimentalPM1 = true
+	withPM1, err := proc.processMessage([]byte(`{"serialno": "def", "pm01Standard": 15.0, "pm02Standard": 5.0}`))
+	if err != nil {
+		t.Fatalf("processMessage returned error: %v", err)
+	}
+	if withPM1.AQIPM1Experimental == nil || *withPM1.AQIPM1Experimental != 75 {
+		t.Errorf("aqiPm1Experimental = %v, want 75", withPM1.AQIPM1Experimental)
+	}
+	if withPM1.AQI != reading.AQI {
+		t.Errorf("AQI = %d with -experimental-pm1, want %d as without it", withPM1.AQI, reading.AQI)
+	}
+	withoutPM1, err := proc.processMessage([]byte(`{"serialno": "ghi", "pm02Standard": 5.0}`))
+	if err != nil {
+		t.Fatalf("processMessage returned error: %v", err)
+	}
+	if withoutPM1.AQIPM1Experimental != nil {
+		t.Errorf("aqiPm1Experimental = %d for a reading without pm01Standard, want none", *withoutPM1.AQIPM1Experimental)
+	}
+
+	bad := `{"pm1": [{"concLow": 0, "concHigh": 6.1, "aqiLow": 0, "aqiHigh": 50}, {"concLow": 7, "concHigh": 24.1, "aqiLow": 51, "aqiHigh": 100}]}`
+	if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+		t.Fatalf("Failed to write breakpoints file: %v", err)
+	}
+	if _, err := loadBreakpointsFile(path); err == nil {
+		t.Error("loadBreakpointsFile accepted a pm1 table with a gap")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// startEmbeddedBroker starts an in-process MQTT broker on a free local port
+// and returns its URL. Unlike startMosquitto it needs neither Docker nor a
+// fixed port, so the end-to-end flow runs with the unit tests.
+func startEmbeddedBroker(t *testing.T) string {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("Failed to add auth hook: %v", err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("Failed to start broker: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return "tcp://" + tcp.Address()
+}
+
+// connectTestClient connects an MQTT client to broker
+func connectTestClient(t *testing.T, broker, clientID string, onConnect mqtt.OnConnectHandler) mqtt.Client {
+	t.Helper()
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	opts.SetConnectTimeout(5 * time.Second)
+	opts.SetOnConnectHandler(onConnect)
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("Timeout connecting to broker")
+	}
+	if err := token.Error(); err != nil {
+		t.Fatalf("Failed to connect to broker: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	return client
+}
+
+// TestEndToEndEmbeddedBroker runs the publish/subscribe flow of
+// TestEndToEndHappyPath against an in-process broker
+func TestEndToEndEmbeddedBroker(t *testing.T) {
+	broker := startEmbeddedBroker(t)
+
+	// Subscribe to the output before the daemon can publish anything
+	testClient := connectTestClient(t, broker, "test-client", nil)
+	outputChan := make(chan []byte, 1)
+	token := testClient.Subscribe(testOutputTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		outputChan <- msg.Payload()
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to subscribe to output topic: %v", token.Error())
+	}
+
+	// Wire up the processor the way main does
+	proc := newProcessor(testOutputTopic)
+	subscribed := make(chan struct{})
+	connectTestClient(t, broker, "aqi-daemon-test", func(client mqtt.Client) {
+		subscribe(client, []string{testInputTopic}, 1, proc.handleMessage)
+		close(subscribed)
+	})
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the daemon to subscribe")
+	}
+
+	testInput := SensorReading{
+		PM02Standard: 35.7, // AQI 101
+		PM10Standard: 45,   // AQI 41
+		Atmp:         24.1,
+		Rhum:         60.7,
+		RCO2:         417,
+		SerialNo:     "d83bda1d7660",
+		Firmware:     "3.2.0",
+		Model:        "O-1PST",
+	}
+	inputJSON, err := json.Marshal(testInput)
+	if err != nil {
+		t.Fatalf("Failed to marshal test input: %v", err)
+	}
+	token = testClient.Publish(testInputTopic, 1, false, inputJSON)
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to publish test message: %v", token.Error())
+	}
+
+	select {
+	case payload := <-outputChan:
+		var output AQIReading
+		if err := json.Unmarshal(payload, &output); err != nil {
+			t.Fatalf("Failed to parse output message: %v", err)
+		}
+		if output.SerialNo != testInput.SerialNo {
+			t.Errorf("Serial number mismatch: got %s, want %s", output.SerialNo, testInput.SerialNo)
+		}
+		if output.PM02Standard != testInput.PM02Standard {
+			t.Errorf("PM2.5 mismatch: got %f, want %f", output.PM02Standard, testInput.PM02Standard)
+		}
+		if output.AQI != 101 {
+			t.Errorf("AQI = %d, want 101 from PM2.5", output.AQI)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for output message")
+	}
+}
+
+// TestOutputBroker tests that the output is published to both the primary
+// broker and the -output-broker
+func TestOutputBroker(t *testing.T) {
+	primary := startEmbeddedBroker(t)
+	secondary := startEmbeddedBroker(t)
+
+	// Subscribe to the output on both brokers
+	outputs := make(chan string, 2)
+	for _, broker := range []string{primary, secondary} {
+		testClient := connectTestClient(t, broker, "test-client", nil)
+		token := testClient.Subscribe(testOutputTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+			outputs <- broker
+		})
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			t.Fatalf("Failed to subscribe to output topic: %v", token.Error())
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.OutputBroker = secondary
+	opts, err := outputBrokerOptions(cfg, "aqi-daemon")
+	if err != nil {
+		t.Fatalf("outputBrokerOptions failed: %v", err)
+	}
+	proc := newProcessor(testOutputTopic)
+	proc.outputClient = mqtt.NewClient(opts)
+	if token := proc.outputClient.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to connect to the output broker: %v", token.Error())
+	}
+	t.Cleanup(func() { proc.outputClient.Disconnect(250) })
+
+	client := connectTestClient(t, primary, "aqi-daemon-test", nil)
+	proc.handleMessage(client, &fakeMessage{
+		topic:   testInputTopic,
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7}`),
+	})
+
+	received := make(map[string]bool)
+	for len(received) < 2 {
+		select {
+		case broker := <-outputs:
+			received[broker] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for output; received from %v", received)
+		}
+	}
+}
+
+// TestOutputBrokerDown tests that an unreachable -output-broker does not
+// affect publishing to the primary broker
+func TestOutputBrokerDown(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OutputBroker = "tcp://127.0.0.1:1"
+	opts, err := outputBrokerOptions(cfg, "aqi-daemon")
+	if err != nil {
+		t.Fatalf("outputBrokerOptions failed: %v", err)
+	}
+	proc := newProcessor("aqi")
+	proc.outputClient = mqtt.NewClient(opts) // Never connected
+
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7}`),
+	})
+
+	if len(client.messages()) != 1 {
+		t.Errorf("Published %d messages to the primary broker, want 1", len(client.messages()))
+	}
+	if got := testutil.ToFloat64(proc.metrics.outputBrokerErrors); got != 1 {
+		t.Errorf("aqi_output_broker_errors_total = %v, want 1", got)
+	}
+}
+
+// TestOutputBrokerClientID tests that the -output-broker connection does not
+// reuse the client ID of the primary connection
+func TestOutputBrokerClientID(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OutputBroker = "tcp://localhost:1883"
+	opts, err := outputBrokerOptions(cfg, "aqi-daemon")
+	if err != nil {
+		t.Fatalf("outputBrokerOptions failed: %v", err)
+	}
+	if opts.ClientID != "aqi-daemon-output" {
+		t.Errorf("Output broker client ID = %q, want aqi-daemon-output", opts.ClientID)
+	}
+}
+
+// connectMQTT5Client connects an MQTT 5 client to broker
+func connectMQTT5Client(t *testing.T, broker, clientID string, onConnect mqtt.OnConnectHandler) mqtt.Client {
+	t.Helper()
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(clientID)
+	opts.SetConnectTimeout(5 * time.Second)
+	opts.SetOnConnectHandler(onConnect)
+
+	client := newMQTTClient(opts, 5)
+	token := client.Connect()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("Timeout connecting to broker")
+	}
+	if err := token.Error(); err != nil {
+		t.Fatalf("Failed to connect to broker: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(250) })
+
+	return client
+}
+
+// TestMQTT5 tests the flow of TestEndToEndEmbeddedBroker with
+// -mqtt-version 5, and that the output carries the sensor's model and
+// firmware as user properties and the -message-expiry
+func TestMQTT5(t *testing.T) {
+	broker := startEmbeddedBroker(t)
+
+	testClient := connectMQTT5Client(t, broker, "test-client", nil)
+	outputChan := make(chan *mqtt5Message, 1)
+	token := testClient.Subscribe(testOutputTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		outputChan <- msg.(*mqtt5Message)
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to subscribe to output topic: %v", token.Error())
+	}
+
+	proc := newProcessor(testOutputTopic)
+	proc.messageExpiry = time.Hour
+	subscribed := make(chan struct{})
+	daemon := connectMQTT5Client(t, broker, "aqi-daemon-test", func(client mqtt.Client) {
+		subscribe(client, []string{testInputTopic}, 1, proc.handleMessage)
+		close(subscribed)
+	})
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the daemon to subscribe")
+	}
+	if got := daemon.OptionsReader(); protocolName(got.ProtocolVersion()) != mqttVersion5 {
+		t.Errorf("Protocol version = %d, want 5", got.ProtocolVersion())
+	}
+
+	token = testClient.Publish(testInputTopic, 1, false, `{"serialno": "abc", "pm02Standard": 35.7, "model": "O-1PST", "firmware": "3.2.0"}`)
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to publish test message: %v", token.Error())
+	}
+
+	select {
+	case msg := <-outputChan:
+		var output AQIReading
+		if err := json.Unmarshal(msg.Payload(), &output); err != nil {
+			t.Fatalf("Failed to parse output message: %v", err)
+		}
+		if output.AQI != 101 {
+			t.Errorf("AQI = %d, want 101", output.AQI)
+		}
+		properties := msg.packet.Properties
+		if properties == nil {
+			t.Fatal("Output has no properties")
+		}
+		if model, firmware := properties.User.Get("model"), properties.User.Get("firmware"); model != "O-1PST" || firmware != "3.2.0" {
+			t.Errorf("User properties model = %q, firmware = %q; want O-1PST and 3.2.0", model, firmware)
+		}
+		if expiry := properties.MessageExpiry; expiry == nil || *expiry > 3600 || *expiry < 3590 {
+			t.Errorf("Message expiry = %v, want about 3600", expiry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for output message")
+	}
+}
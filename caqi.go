@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"aqi-mqtt/aqi"
+)
+
+// CAQI grids selectable with -caqi-grid
+const (
+	caqiGridBackground = "background"
+	caqiGridRoadside   = "roadside"
+)
+
+// Conversion factors from ppb to µg/m³ at 20°C and 1013 hPa, the reference
+// conditions used by EU air quality legislation
+const (
+	ozonePPBToUGM3 = 1.9957
+	no2PPBToUGM3   = 1.9125
+)
+
+// CAQI hourly grid breakpoints in µg/m³ (CiteAir II, 2012)
+// The roadside and background grids share these concentrations; they differ
+// in which pollutants participate, see computeCAQI.
+// Source: https://www.airqualitynow.eu/about_indices_definition.php
+var caqiPM25Breakpoints = []aqi.AQIBreakpoint{
+	{ConcLow: 0, ConcHigh: 15, AQILow: 0, AQIHigh: 25},
+	{ConcLow: 15, ConcHigh: 30, AQILow: 25, AQIHigh: 50},
+	{ConcLow: 30, ConcHigh: 55, AQILow: 50, AQIHigh: 75},
+	{ConcLow: 55, ConcHigh: 110, AQILow: 75, AQIHigh: 100},
+}
+
+var caqiPM10Breakpoints = []aqi.AQIBreakpoint{
+	{ConcLow: 0, ConcHigh: 25, AQILow: 0, AQIHigh: 25},
+	{ConcLow: 25, ConcHigh: 50, AQILow: 25, AQIHigh: 50},
+	{ConcLow: 50, ConcHigh: 90, AQILow: 50, AQIHigh: 75},
+	{ConcLow: 90, ConcHigh: 180, AQILow: 75, AQIHigh: 100},
+}
+
+var caqiNO2Breakpoints = []aqi.AQIBreakpoint{
+	{ConcLow: 0, ConcHigh: 50, AQILow: 0, AQIHigh: 25},
+	{ConcLow: 50, ConcHigh: 100, AQILow: 25, AQIHigh: 50},
+	{ConcLow: 100, ConcHigh: 200, AQILow: 50, AQIHigh: 75},
+	{ConcLow: 200, ConcHigh: 400, AQILow: 75, AQIHigh: 100},
+}
+
+var caqiOzoneBreakpoints = []aqi.AQIBreakpoint{
+	{ConcLow: 0, ConcHigh: 60, AQILow: 0, AQIHigh: 25},
+	{ConcLow: 60, ConcHigh: 120, AQILow: 25, AQIHigh: 50},
+	{ConcLow: 120, ConcHigh: 180, AQILow: 50, AQIHigh: 75},
+	{ConcLow: 180, ConcHigh: 240, AQILow: 75, AQIHigh: 100},
+}
+
+// validateCAQIGrid checks that a CAQI grid is supported
+func validateCAQIGrid(grid string) error {
+	switch grid {
+	case caqiGridBackground, caqiGridRoadside:
+		return nil
+	default:
+		return fmt.Errorf("unknown CAQI grid %q: must be %q or %q", grid, caqiGridBackground, caqiGridRoadside)
+	}
+}
+
+// caqiSubIndex computes a CAQI sub-index
+// The CAQI scale is open-ended above 100, so concentrations beyond the grid
+// are extrapolated along the top class instead of being capped.
+func caqiSubIndex(concentration float64, breakpoints []aqi.AQIBreakpoint) int {
+	// The grid is continuous, so interpolate without a resolution gap
+	if index, ok := aqi.Interpolate(math.Floor(concentration*10)/10, breakpoints, 0); ok {
+		return index
+	}
+	top := breakpoints[len(breakpoints)-1]
+	slope := float64(top.AQIHigh-top.AQILow) / (top.ConcHigh - top.ConcLow)
+	return int(math.Round(float64(top.AQIHigh) + slope*(concentration-top.ConcHigh)))
+}
+
+// computeCAQI calculates the European Common Air Quality Index
+// pm25 and pm10 are in µg/m³; the optional no2 and o3 are in ppb as reported
+// by the sensor and are converted to µg/m³. The roadside grid uses NO2, PM10
+// and PM2.5; the background grid additionally uses ozone. The result is the
+// highest sub-index.
+func computeCAQI(pm25, pm10 float64, no2, o3 *float64, grid string) int {
+	caqi := caqiSubIndex(pm25, caqiPM25Breakpoints)
+	if sub := caqiSubIndex(pm10, caqiPM10Breakpoints); sub > caqi {
+		caqi = sub
+	}
+	if no2 != nil {
+		if sub := caqiSubIndex(*no2*no2PPBToUGM3, caqiNO2Breakpoints); sub > caqi {
+			caqi = sub
+		}
+	}
+	if o3 != nil && grid == caqiGridBackground {
+		if sub := caqiSubIndex(*o3*ozonePPBToUGM3, caqiOzoneBreakpoints); sub > caqi {
+			caqi = sub
+		}
+	}
+	return caqi
+}
+
+// caqiCategory returns the CAQI class label for an index value
+func caqiCategory(caqi int) string {
+	switch {
+	case caqi < 25:
+		return "Very Low"
+	case caqi < 50:
+		return "Low"
+	case caqi < 75:
+		return "Medium"
+	case caqi <= 100:
+		return "High"
+	default:
+		return "Very High"
+	}
+}
+
+// caqiColor returns the CAQI class color for an index value
+func caqiColor(caqi int) string {
+	switch {
+	case caqi < 25:
+		return "#79BC6A"
+	case caqi < 50:
+		return "#BBCF4C"
+	case caqi < 75:
+		return "#EEC20B"
+	case caqi <= 100:
+		return "#F29305"
+	default:
+		return "#E8416F"
+	}
+}
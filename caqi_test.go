@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestCAQISubIndex(t *testing.T) {
+	testCases := []struct {
+		concentration float64
+		expected      int
+	}{
+		{0, 0},
+		{15, 25},
+		{22.5, 38},
+		{55, 75},
+		{110, 100},
+		{165, 125}, // Extrapolated above the grid
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("PM2.5=%g", tc.concentration), func(t *testing.T) {
+			if result := caqiSubIndex(tc.concentration, caqiPM25Breakpoints); result != tc.expected {
+				t.Errorf("caqiSubIndex(%g) = %d, want %d", tc.concentration, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestComputeCAQIGrids(t *testing.T) {
+	ozone := 75.0 // 149.7 µg/m³, CAQI 62
+	no2 := 30.0   // 57.4 µg/m³, CAQI 29
+
+	if got := computeCAQI(10, 20, &no2, &ozone, caqiGridBackground); got != 62 {
+		t.Errorf("Background CAQI = %d, want 62 from ozone", got)
+	}
+	if got := computeCAQI(10, 20, &no2, &ozone, caqiGridRoadside); got != 29 {
+		t.Errorf("Roadside CAQI = %d, want 29 from NO2 (ozone excluded)", got)
+	}
+	if got := computeCAQI(10, 20, nil, nil, caqiGridBackground); got != 20 {
+		t.Errorf("CAQI without gases = %d, want 20 from PM10", got)
+	}
+}
+
+func TestCAQICategory(t *testing.T) {
+	for caqi, expected := range map[int]string{0: "Very Low", 24: "Very Low", 25: "Low", 50: "Medium", 75: "High", 100: "High", 101: "Very High"} {
+		if result := caqiCategory(caqi); result != expected {
+			t.Errorf("caqiCategory(%d) = %q, want %q", caqi, result, expected)
+		}
+	}
+}
+
+// TestCAQIvsEPA compares the same reading under the epa and caqi standards
+func TestCAQIvsEPA(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 35.5, "pm10Standard": 45}`)
+
+	outputs := make(map[string]AQIReading)
+	for _, standard := range []string{standardEPA, standardCAQI} {
+		proc := newProcessor("aqi")
+		proc.standard = standard
+		client := &fakeClient{}
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+		var output AQIReading
+		if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+			t.Fatalf("Failed to parse %s output: %v", standard, err)
+		}
+		outputs[standard] = output
+	}
+
+	epa, caqi := outputs[standardEPA], outputs[standardCAQI]
+	if epa.Scale != "epa" || epa.AQI != 101 || epa.Category != "Unhealthy for Sensitive Groups" {
+		t.Errorf("EPA output = %s/%d/%s, want epa/101/Unhealthy for Sensitive Groups", epa.Scale, epa.AQI, epa.Category)
+	}
+	if caqi.Scale != "caqi" || caqi.AQI != 56 || caqi.Category != "Medium" {
+		t.Errorf("CAQI output = %s/%d/%s, want caqi/56/Medium", caqi.Scale, caqi.AQI, caqi.Category)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestPublishOnChange tests that identical AQI values are not republished
+func TestPublishOnChange(t *testing.T) {
+	proc := newProcessor("aqi/{serialno}")
+	proc.publishOnChange = true
+	client := &fakeClient{}
+
+	payloads := []string{
+		`{"serialno": "abc", "pm02Standard": 5}`,
+		`{"serialno": "abc", "pm02Standard": 5}`,
+		`{"serialno": "def", "pm02Standard": 5}`,
+		`{"serialno": "abc", "pm02Standard": 50}`,
+		`{"serialno": "abc", "pm02Standard": 50}`,
+	}
+	for _, payload := range payloads {
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+	}
+
+	messages := client.messages()
+	var topics []string
+	for _, msg := range messages {
+		topics = append(topics, msg.Topic)
+	}
+	expected := []string{"aqi/abc", "aqi/def", "aqi/abc"}
+	if len(topics) != len(expected) {
+		t.Fatalf("Published to %v, want %v", topics, expected)
+	}
+	for i := range expected {
+		if topics[i] != expected[i] {
+			t.Errorf("Message %d published to %s, want %s", i, topics[i], expected[i])
+		}
+	}
+}
+
+// TestHeartbeat tests that an unchanged AQI is republished once the heartbeat elapses
+func TestHeartbeat(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.publishOnChange = true
+	proc.heartbeat = 10 * time.Minute
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		offset   time.Duration
+		aqi      int
+		expected bool
+	}{
+		{0, 21, true},
+		{time.Minute, 21, false},
+		{9 * time.Minute, 21, false},
+		{10 * time.Minute, 21, true},
+		{11 * time.Minute, 21, false},
+		{12 * time.Minute, 22, true},
+	}
+	for _, tc := range testCases {
+		if got := proc.changed("abc", tc.aqi, start.Add(tc.offset)); got != tc.expected {
+			t.Errorf("changed(AQI %d at +%v) = %v, want %v", tc.aqi, tc.offset, got, tc.expected)
+		}
+	}
+
+	// Without a heartbeat an unchanged value is never forced
+	proc.heartbeat = 0
+	if proc.changed("abc", 22, start.Add(24*time.Hour)) {
+		t.Error("Unchanged AQI published without a heartbeat")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// checkConfig validates cfg and loads the files it refers to, without
+// connecting to a broker, and returns every problem found
+func checkConfig(cfg *Config) []error {
+	var errs []error
+	if err := cfg.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.BreakpointsFile != "" {
+		if _, err := loadBreakpointsFile(cfg.BreakpointsFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if usesTLS(cfg.Transport, cfg.TLS) {
+		if _, err := newTLSConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.InsecureSkipVerify); err != nil {
+			errs = append(errs, fmt.Errorf("TLS: %w", err))
+		}
+	}
+	if cfg.OutputBroker != "" {
+		if _, err := outputBrokerOptions(cfg, cfg.ClientID); err != nil {
+			errs = append(errs, fmt.Errorf("output broker: %w", err))
+		}
+	}
+	return errs
+}
+
+// runCheckConfig implements -check-config, printing OK to stdout or the
+// errors to stderr, and returns the exit status
+func runCheckConfig(cfg *Config, stdout, stderr io.Writer) int {
+	errs := checkConfig(cfg)
+	if len(errs) == 0 {
+		fmt.Fprintln(stdout, "OK")
+		return 0
+	}
+	for _, err := range errs {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+	}
+	return 1
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCheckConfig tests that -check-config prints OK for a valid configuration
+// and exits non-zero with every error for a bad breakpoints file and topic
+func TestCheckConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Broker = "localhost"
+	cfg.InputTopics = []string{"airgradient/+/readings"}
+	cfg.OutputTopic = "aqi/{serialno}"
+	cfg.BreakpointsFile = filepath.Join("testdata", "breakpoints-2024.json")
+
+	var stdout, stderr bytes.Buffer
+	if status := runCheckConfig(cfg, &stdout, &stderr); status != 0 || stdout.String() != "OK\n" {
+		t.Errorf("Valid config: status %d, stdout %q, stderr %q; want 0 and OK", status, stdout.String(), stderr.String())
+	}
+
+	// The second range goes down instead of up
+	path := filepath.Join(t.TempDir(), "breakpoints.json")
+	bad := `{"pm25": [{"concLow": 0, "concHigh": 9.1, "aqiLow": 0, "aqiHigh": 50}, {"concLow": 9.1, "concHigh": 5, "aqiLow": 51, "aqiHigh": 100}]}`
+	if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+		t.Fatalf("Failed to write breakpoints file: %v", err)
+	}
+	cfg.BreakpointsFile = path
+	cfg.InputTopics = []string{"airgradient/#/readings"}
+
+	stdout.Reset()
+	stderr.Reset()
+	if status := runCheckConfig(cfg, &stdout, &stderr); status == 0 {
+		t.Errorf("Bad config: status 0, want non-zero")
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Bad config printed %q to stdout, want nothing", stdout.String())
+	}
+	for _, want := range []string{"# must be the last level", "invalid pm25 breakpoints"} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr = %q, want it to mention %q", stderr.String(), want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "time"
+
+// Clock tells the current time and waits for time to pass
+// The processor reads the time through a Clock rather than time.Now, so tests
+// of time-based features such as averaging, NowCast and stale detection can
+// control it instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the running daemon
+type realClock struct{}
+
+// Now returns the wall-clock time
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for d to elapse on the wall clock
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a channel returned by fakeClock.After and the time it fires at
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Now returns the fake time
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the fake time once it has advanced by d
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// advance moves the fake time forward by d, firing the After channels due by then
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+// waitForWaiters blocks until n callers are waiting on After, so that a test
+// advances the clock only once a background loop is ready for it
+func (c *fakeClock) waitForWaiters(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %d After callers, have %d", n, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestFakeClock tests that message handling reads the time from the
+// processor's clock, so averaging can be tested without sleeping
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	proc.averageWindow = time.Hour
+
+	steps := []struct {
+		advance time.Duration
+		pm25    float64
+		aqi     int
+	}{
+		{0, 10, 42},
+		{30 * time.Minute, 30, 68}, // Mean of 10 and 30
+		{90 * time.Minute, 30, 89}, // The first two readings have left the window
+	}
+	for _, step := range steps {
+		clock.advance(step.advance)
+		client := &fakeClient{}
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %g}`, step.pm25)),
+		})
+
+		var output AQIReading
+		if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		if want := formatTimestamp(clock.Now()); output.Timestamp != want {
+			t.Errorf("timestamp = %s, want %s from the clock", output.Timestamp, want)
+		}
+		if output.AQI != step.aqi {
+			t.Errorf("At %v: aqi = %d, want %d", clock.Now().Sub(start), output.AQI, step.aqi)
+		}
+	}
+
+	if got, want := testutil.ToFloat64(proc.metrics.lastPublish), float64(clock.Now().Unix()); got != want {
+		t.Errorf("aqi_last_publish_timestamp_seconds = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// compressedTopicSuffix is appended to the output topic for -compress, so
+// consumers expecting plain JSON on the output topic never receive gzip data
+const compressedTopicSuffix = "/gz"
+
+// gzipPayload compresses an output payload for -compress
+func gzipPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
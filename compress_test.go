@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// TestCompress tests that -compress publishes gzipped JSON that decompresses
+// to the uncompressed output
+func TestCompress(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45}`)
+
+	plain := &fakeClient{}
+	newProcessor("aqi").handleMessage(plain, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+	proc := newProcessor("aqi")
+	proc.compress = true
+	compressed := &fakeClient{}
+	proc.handleMessage(compressed, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+	messages := compressed.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	if messages[0].Topic != "aqi/gz" {
+		t.Errorf("Topic = %q, want aqi/gz", messages[0].Topic)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(messages[0].Payload))
+	if err != nil {
+		t.Fatalf("Payload is not gzip data: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to decompress payload: %v", err)
+	}
+
+	var got, want AQIReading
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Decompressed payload is not JSON: %v", err)
+	}
+	if err := json.Unmarshal(plain.messages()[0].Payload, &want); err != nil {
+		t.Fatalf("Failed to parse uncompressed output: %v", err)
+	}
+	// Only the timestamps may differ between the two runs
+	got.Timestamp, want.Timestamp = "", ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decompressed output = %+v, want %+v", got, want)
+	}
+}
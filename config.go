@@ -0,0 +1,663 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// errMissingRequired is returned by Config.validate when required settings are absent
+var errMissingRequired = errors.New("missing required settings: broker, input topic or HTTP poll URL, and output topic")
+
+// Config holds the daemon configuration
+// Values come from compiled defaults, then the -config YAML file, then
+// environment variables (see applyEnv), then command-line flags, each
+// overriding the previous.
+type Config struct {
+	ConfigFile  string `yaml:"-"`
+	Version     bool   `yaml:"-"`
+	Stdin       bool   `yaml:"-"`
+	CheckConfig bool   `yaml:"-"`
+
+	// Replay of captured payloads, see runReplay
+	ReplayDir     string  `yaml:"-"`
+	ReplaySpeed   float64 `yaml:"-"`
+	ReplayPublish bool    `yaml:"-"`
+
+	Broker   string `yaml:"broker"`
+	Port     int    `yaml:"port"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	Transport          string `yaml:"transport"`
+	WSPath             string `yaml:"ws_path"`
+	TLS                bool   `yaml:"tls"`
+	CAFile             string `yaml:"cafile"`
+	CertFile           string `yaml:"certfile"`
+	KeyFile            string `yaml:"keyfile"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	// Optional second broker that output messages are also published to
+	OutputBroker   string `yaml:"output_broker"`
+	OutputUsername string `yaml:"output_username"`
+	OutputPassword string `yaml:"output_password"`
+	OutputCAFile   string `yaml:"output_cafile"`
+	OutputCertFile string `yaml:"output_certfile"`
+	OutputKeyFile  string `yaml:"output_keyfile"`
+
+	InputTopics          []string      `yaml:"input_topics"`
+	HTTPPollURL          string        `yaml:"http_poll_url"`
+	PollInterval         time.Duration `yaml:"poll_interval"`
+	OutputTopic          string        `yaml:"output_topic"`
+	TopicPrefix          string        `yaml:"topic_prefix"`
+	OutputFields         []string      `yaml:"output_fields"`
+	RoundDecimals        int           `yaml:"round_decimals"`
+	Compress             bool          `yaml:"compress"`
+	Retain               bool          `yaml:"retain"`
+	ErrorTopic           string        `yaml:"error_topic"`
+	StatusTopic          string        `yaml:"status_topic"`
+	AvailabilityTopic    string        `yaml:"availability_topic"`
+	HeartbeatInterval    time.Duration `yaml:"heartbeat_interval"`
+	ReconnectMaxInterval time.Duration `yaml:"reconnect_max_interval"`
+	KeepAlive            time.Duration `yaml:"keepalive"`
+	ConnectTimeout       time.Duration `yaml:"connect_timeout"`
+	ConnectRetries       int           `yaml:"connect_retries"`
+	CleanSession         bool          `yaml:"clean_session"`
+	MQTTVersion          string        `yaml:"mqtt_version"`
+	MessageExpiry        time.Duration `yaml:"message_expiry"`
+	InputQoS             int           `yaml:"input_qos"`
+	OutputQoS            int           `yaml:"output_qos"`
+	PublishBuffer        int           `yaml:"publish_buffer"`
+	MaxPayloadBytes      int           `yaml:"max_payload_bytes"`
+	IgnoreRetainedInput  time.Duration `yaml:"ignore_retained_input"`
+
+	Standard           string        `yaml:"standard"`
+	CAQIGrid           string        `yaml:"caqi_grid"`
+	PM25Source         string        `yaml:"pm25_source"`
+	TempSource         string        `yaml:"temp_source"`
+	HumiditySource     string        `yaml:"humidity_source"`
+	PMUnit             string        `yaml:"pm_unit"`
+	PMScale            float64       `yaml:"pm_scale"`
+	Correction         string        `yaml:"correction"`
+	PM25Revision       string        `yaml:"pm25_revision"`
+	BreakpointsFile    string        `yaml:"breakpoints"`
+	ExtendedAQI        bool          `yaml:"extended_aqi"`
+	ExperimentalPM1    bool          `yaml:"experimental_pm1"`
+	AQIRounding        string        `yaml:"aqi_rounding"`
+	Pollutants         []string      `yaml:"pollutants"`
+	TempUnit           string        `yaml:"temp_unit"`
+	TimestampSource    string        `yaml:"timestamp_source"`
+	MinInterval        time.Duration `yaml:"min_interval"`
+	PublishOnChange    bool          `yaml:"publish_on_change"`
+	Heartbeat          time.Duration `yaml:"heartbeat"`
+	AverageWindow      time.Duration `yaml:"average_window"`
+	BackfillMaxAge     time.Duration `yaml:"backfill_max_age"`
+	PMAveraging        string        `yaml:"pm_averaging"`
+	CategoryHysteresis int           `yaml:"category_hysteresis"`
+	StrictValidation   bool          `yaml:"strict_validation"`
+	Dedup              bool          `yaml:"dedup"`
+	Explode            bool          `yaml:"explode"`
+	PlainTopic         string        `yaml:"plain_topic"`
+	HADiscovery        bool          `yaml:"ha_discovery"`
+	HAStateMode        string        `yaml:"ha_state_mode"`
+	DiscoveryPrefix    string        `yaml:"discovery_prefix"`
+	DiscoveryQoS       int           `yaml:"discovery_qos"`
+	SummaryTopic       string        `yaml:"summary_topic"`
+	SummaryTimezone    string        `yaml:"summary_timezone"`
+	StaleAfter         time.Duration `yaml:"stale_after"`
+	AlertTopic         string        `yaml:"alert_topic"`
+	AlertThreshold     int           `yaml:"alert_threshold"`
+	AlertHysteresis    int           `yaml:"alert_hysteresis"`
+	TrendWindow        int           `yaml:"trend_window"`
+	TrendMinDelta      int           `yaml:"trend_min_delta"`
+
+	// FieldMap renames incoming JSON keys to SensorReading fields
+	FieldMap map[string]string `yaml:"field_map"`
+
+	InfluxTopic  string `yaml:"influx_topic"`
+	InfluxURL    string `yaml:"influx_url"`
+	InfluxOrg    string `yaml:"influx_org"`
+	InfluxBucket string `yaml:"influx_bucket"`
+	InfluxToken  string `yaml:"influx_token"`
+	WebhookURL   string `yaml:"webhook_url"`
+	CSVFile      string `yaml:"csv_file"`
+	CSVMaxSize   int64  `yaml:"csv_max_size"`
+
+	MetricsAddr   string        `yaml:"metrics_addr"`
+	HealthAddr    string        `yaml:"health_addr"`
+	StatsInterval time.Duration `yaml:"stats_interval"`
+	StateFile     string        `yaml:"state_file"`
+	StateInterval time.Duration `yaml:"state_interval"`
+	LogFormat     string        `yaml:"log_format"`
+	LogLevel      string        `yaml:"log_level"`
+}
+
+// defaultConfig returns the compiled defaults
+func defaultConfig() *Config {
+	return &Config{
+		Port:                 1883,
+		ClientID:             defaultClientID,
+		Transport:            transportTCP,
+		WSPath:               "/mqtt",
+		ReconnectMaxInterval: time.Minute,
+		KeepAlive:            30 * time.Second,
+		ConnectTimeout:       30 * time.Second,
+		CleanSession:         true,
+		MQTTVersion:          mqttVersion311,
+		InputQoS:             1,
+		OutputQoS:            1,
+		AvailabilityTopic:    "aqi/availability",
+		MaxPayloadBytes:      defaultMaxPayloadBytes,
+		Standard:             standardEPA,
+		CAQIGrid:             caqiGridBackground,
+		PM25Source:           pm25SourceStandard,
+		TempSource:           climateSourceRaw,
+		HumiditySource:       climateSourceRaw,
+		PMUnit:               pmUnitMicrograms,
+		PMScale:              1,
+		Correction:           correctionNone,
+		PM25Revision:         pm25Revision2012,
+		AQIRounding:          aqiRoundingRound,
+		TempUnit:             tempUnitCelsius,
+		TimestampSource:      timestampProcessing,
+		PMAveraging:          pmAveragingWindow,
+		RoundDecimals:        -1,
+		AlertHysteresis:      5,
+		TrendMinDelta:        5,
+		HAStateMode:          haStateCombined,
+		DiscoveryPrefix:      haDiscoveryPrefix,
+		DiscoveryQoS:         1,
+		SummaryTimezone:      "Local",
+		StateInterval:        time.Minute,
+		PollInterval:         time.Minute,
+		LogFormat:            "text",
+		LogLevel:             "info",
+	}
+}
+
+// newFlagSet creates the command-line flags, bound to the fields of c
+// The current values of c are used as the flag defaults.
+func newFlagSet(c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "YAML configuration file; flags override values from the file")
+	fs.BoolVar(&c.Version, "version", c.Version, "Print version information")
+	fs.BoolVar(&c.CheckConfig, "check-config", c.CheckConfig, "Validate the configuration, breakpoints file and TLS files, print OK or the errors, and exit without connecting")
+	fs.BoolVar(&c.Stdin, "stdin", c.Stdin, "Read newline-delimited JSON readings from stdin and write the output to stdout instead of using MQTT")
+	fs.StringVar(&c.ReplayDir, "replay-dir", c.ReplayDir, "Process the readings in the *.json files in this directory, in name order, write the output to stdout and exit")
+	fs.Float64Var(&c.ReplaySpeed, "replay-speed", c.ReplaySpeed, "Space out replayed readings by their payload timestamps, sped up by this factor, e.g. 60 (default: 0, as fast as possible)")
+	fs.BoolVar(&c.ReplayPublish, "replay-publish", c.ReplayPublish, "Publish replayed readings to the broker instead of writing them to stdout")
+
+	fs.StringVar(&c.Broker, "broker", c.Broker, "MQTT broker hostname or IP address (required)")
+	fs.IntVar(&c.Port, "port", c.Port, "MQTT broker port")
+	fs.StringVar(&c.ClientID, "client-id", c.ClientID, "MQTT client ID, unique per connection; {hostname} and {pid} are replaced with the host name and process ID")
+	fs.StringVar(&c.Username, "username", c.Username, "MQTT username (default: $MQTT_USERNAME)")
+	fs.StringVar(&c.Password, "password", c.Password, "MQTT password (default: $MQTT_PASSWORD)")
+
+	fs.StringVar(&c.Transport, "transport", c.Transport, "Broker transport: tcp, ws (WebSocket) or wss (WebSocket over TLS)")
+	fs.StringVar(&c.WSPath, "ws-path", c.WSPath, "HTTP path of the broker WebSocket endpoint for the ws and wss transports")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "Connect to the broker using TLS (ssl://, or wss:// with -transport ws)")
+	fs.StringVar(&c.CAFile, "cafile", c.CAFile, "CA certificate file for verifying the broker (default: system roots)")
+	fs.StringVar(&c.CertFile, "certfile", c.CertFile, "Client certificate file for TLS authentication")
+	fs.StringVar(&c.KeyFile, "keyfile", c.KeyFile, "Client private key file for TLS authentication")
+	fs.BoolVar(&c.InsecureSkipVerify, "insecure-skip-verify", c.InsecureSkipVerify, "Skip broker certificate verification (testing only)")
+
+	fs.StringVar(&c.OutputBroker, "output-broker", c.OutputBroker, "Also publish output messages to this broker URL, e.g. ssl://cloud.example.com:8883 (default: disabled)")
+	fs.StringVar(&c.OutputUsername, "output-username", c.OutputUsername, "Username for -output-broker")
+	fs.StringVar(&c.OutputPassword, "output-password", c.OutputPassword, "Password for -output-broker")
+	fs.StringVar(&c.OutputCAFile, "output-cafile", c.OutputCAFile, "CA certificate file for verifying -output-broker (default: system roots)")
+	fs.StringVar(&c.OutputCertFile, "output-certfile", c.OutputCertFile, "Client certificate file for TLS authentication to -output-broker")
+	fs.StringVar(&c.OutputKeyFile, "output-keyfile", c.OutputKeyFile, "Client private key file for TLS authentication to -output-broker")
+
+	// Input topics given on the command line replace those from the file
+	replaced := false
+	fs.Func("input-topic", "MQTT topic to subscribe for sensor readings; may be repeated or comma-separated (required)", func(value string) error {
+		if !replaced {
+			c.InputTopics = nil
+			replaced = true
+		}
+		return (*stringList)(&c.InputTopics).Set(value)
+	})
+	fs.StringVar(&c.HTTPPollURL, "http-poll-url", c.HTTPPollURL, "Also read readings by polling this sensor URL, e.g. http://airgradient_<serial>.local/measures/current (default: disabled)")
+	fs.DurationVar(&c.PollInterval, "poll-interval", c.PollInterval, "How often to poll -http-poll-url")
+	fs.StringVar(&c.OutputTopic, "output-topic", c.OutputTopic, "MQTT topic to publish AQI data; {serialno}, {model}, {firmware}, {scale} and {category} are replaced with the reading's values (required)")
+	// Likewise, output fields from the command line replace those from the file
+	fieldsReplaced := false
+	fs.Func("output-fields", "Only publish these JSON fields of the output, e.g. aqi,category,pm02Standard,pm10Standard; may be repeated or comma-separated (default: all)", func(value string) error {
+		if !fieldsReplaced {
+			c.OutputFields = nil
+			fieldsReplaced = true
+		}
+		return (*stringList)(&c.OutputFields).Set(value)
+	})
+	fs.IntVar(&c.RoundDecimals, "round-decimals", c.RoundDecimals, "Round fractional numbers in the output to this many decimals (-1 disables rounding)")
+	fs.BoolVar(&c.Compress, "compress", c.Compress, "Publish the output gzipped to <output-topic>/gz instead of plain JSON to <output-topic>; consumers must decompress it")
+	fs.BoolVar(&c.Retain, "retain", c.Retain, "Set the retained flag on output messages so new subscribers get the latest AQI")
+	fs.StringVar(&c.TopicPrefix, "topic-prefix", c.TopicPrefix, "Prefix for all input, output, error, status, availability, summary, alert, plain, InfluxDB and Home Assistant discovery topics, e.g. home/livingroom/")
+	fs.StringVar(&c.ErrorTopic, "error-topic", c.ErrorTopic, "MQTT topic for messages that could not be processed (default: drop them)")
+	fs.StringVar(&c.StatusTopic, "status-topic", c.StatusTopic, "MQTT topic for retained online/offline status with Last Will (default: disabled)")
+	fs.StringVar(&c.AvailabilityTopic, "availability-topic", c.AvailabilityTopic, "MQTT topic for the -heartbeat-interval availability heartbeat")
+	fs.DurationVar(&c.HeartbeatInterval, "heartbeat-interval", c.HeartbeatInterval, "Publish \"online\" to -availability-topic this often while the daemon runs (default: 0, disabled)")
+	fs.DurationVar(&c.ReconnectMaxInterval, "reconnect-max-interval", c.ReconnectMaxInterval, "Maximum delay between reconnection attempts")
+	fs.DurationVar(&c.KeepAlive, "keepalive", c.KeepAlive, "Interval between MQTT keep-alive pings; shorter detects dropped connections sooner")
+	fs.DurationVar(&c.ConnectTimeout, "connect-timeout", c.ConnectTimeout, "Timeout for each attempt to connect to the broker")
+	fs.BoolVar(&c.CleanSession, "clean-session", c.CleanSession, "Start a clean MQTT session on every connection; -clean-session=false has the broker keep subscriptions and queue QoS 1 and 2 messages while disconnected")
+	fs.IntVar(&c.ConnectRetries, "connect-retries", c.ConnectRetries, "Give up and exit after this many failed attempts to reach the broker at startup; 0 retries forever")
+	fs.StringVar(&c.MQTTVersion, "mqtt-version", c.MQTTVersion, "MQTT protocol version (3.1, 3.1.1, 5)")
+	fs.DurationVar(&c.MessageExpiry, "message-expiry", c.MessageExpiry, "With -mqtt-version 5, have the broker discard output messages not delivered within this long, e.g. 10m (default: 0, never)")
+	fs.IntVar(&c.InputQoS, "input-qos", c.InputQoS, "QoS for the input subscriptions: 0, 1 or 2")
+	fs.IntVar(&c.OutputQoS, "output-qos", c.OutputQoS, "QoS for published messages: 0, 1 or 2")
+	fs.IntVar(&c.PublishBuffer, "publish-buffer", c.PublishBuffer, "Publish from a background worker with a queue of this many messages, dropping the oldest when full, so a slow broker does not block incoming readings (default: 0, publish synchronously)")
+	fs.IntVar(&c.MaxPayloadBytes, "max-payload-bytes", c.MaxPayloadBytes, "Reject input messages larger than this many bytes without parsing them (0 for no limit)")
+	fs.DurationVar(&c.IgnoreRetainedInput, "ignore-retained-input", c.IgnoreRetainedInput, "Drop retained input messages delivered up to this long after subscribing, e.g. 10s, so old readings are not republished as fresh (default: 0, disabled)")
+
+	fs.StringVar(&c.Standard, "standard", c.Standard, "Air quality index standard (epa, aqhi, caqi, daqi, india)")
+	fs.StringVar(&c.CAQIGrid, "caqi-grid", c.CAQIGrid, "CAQI grid when -standard is caqi (background, roadside)")
+	fs.Func("field-map", "Rename incoming JSON keys before parsing: incoming=field pairs, comma-separated, or a YAML/JSON file", func(value string) error {
+		m, err := parseFieldMap(value)
+		if err != nil {
+			return err
+		}
+		if c.FieldMap == nil {
+			c.FieldMap = make(map[string]string)
+		}
+		for from, to := range m {
+			c.FieldMap[from] = to
+		}
+		return nil
+	})
+	fs.StringVar(&c.PM25Source, "pm25-source", c.PM25Source, "PM2.5 field used for the index: standard (pm02Standard), compensated (pm02Compensated) or atmospheric (pm02)")
+	fs.StringVar(&c.TempSource, "temp-source", c.TempSource, "Temperature published as atmp: raw (atmp) or compensated (atmpCompensated)")
+	fs.StringVar(&c.HumiditySource, "humidity-source", c.HumiditySource, "Humidity published as rhum: raw (rhum) or compensated (rhumCompensated)")
+	fs.StringVar(&c.PMUnit, "pm-unit", c.PMUnit, "Unit of the incoming PM concentrations, converted to µg/m³: ugm3 or mgm3")
+	fs.Float64Var(&c.PMScale, "pm-scale", c.PMScale, "Multiplier applied to incoming PM concentrations before the unit conversion, for sensors that report scaled values")
+	fs.StringVar(&c.Correction, "correction", c.Correction, "PM2.5 correction applied before computing AQI (none, epa-2021)")
+	fs.StringVar(&c.PM25Revision, "pm25-revision", c.PM25Revision, "EPA PM2.5 breakpoint revision (2012, 2024)")
+	fs.StringVar(&c.BreakpointsFile, "breakpoints", c.BreakpointsFile, "JSON file overriding the PM2.5 and PM10 breakpoint tables (default: built-in EPA tables)")
+	// Pollutants from the command line replace those from the file
+	pollutantsReplaced := false
+	fs.Func("pollutants", "EPA sub-indices that count toward the AQI, e.g. pm25 to ignore PM10 (pm25, pm10, ozone, co, so2, no2); may be repeated or comma-separated (default: all)", func(value string) error {
+		if !pollutantsReplaced {
+			c.Pollutants = nil
+			pollutantsReplaced = true
+		}
+		return (*stringList)(&c.Pollutants).Set(value)
+	})
+	fs.BoolVar(&c.ExtendedAQI, "extended-aqi", c.ExtendedAQI, "Extrapolate the AQI above 500 for extreme concentrations instead of capping at 500")
+	fs.BoolVar(&c.ExperimentalPM1, "experimental-pm1", c.ExperimentalPM1, "Add an experimental, unofficial PM1.0 sub-index to the output; it does not affect the AQI")
+	fs.StringVar(&c.AQIRounding, "aqi-rounding", c.AQIRounding, "How the EPA AQI formula's result is converted to an integer: round, truncate or ceil")
+	fs.StringVar(&c.TempUnit, "temp-unit", c.TempUnit, "Unit for published temperatures (celsius, fahrenheit)")
+	fs.StringVar(&c.TimestampSource, "timestamp-source", c.TimestampSource, "Source of the output timestamp (processing, payload)")
+	fs.DurationVar(&c.MinInterval, "min-interval", c.MinInterval, "Minimum time between published readings per sensor; the latest reading is kept (0 publishes every reading)")
+	fs.BoolVar(&c.PublishOnChange, "publish-on-change", c.PublishOnChange, "Only publish when a sensor's AQI differs from the last published value")
+	fs.DurationVar(&c.Heartbeat, "heartbeat", c.Heartbeat, "With -publish-on-change, republish an unchanged AQI after this long (0 never forces a publish)")
+	fs.IntVar(&c.CategoryHysteresis, "category-hysteresis", c.CategoryHysteresis, "AQI points past a category boundary before the EPA category changes (0 disables)")
+	fs.DurationVar(&c.AverageWindow, "average-window", c.AverageWindow, "Compute AQI from the moving average of PM readings over this window, e.g. 5m (default: instantaneous)")
+	fs.DurationVar(&c.BackfillMaxAge, "backfill-max-age", c.BackfillMaxAge, "Fill in pollutants missing from a reading with the sensor's last known value up to this old, e.g. 10m (default: 0, disabled)")
+	fs.StringVar(&c.PMAveraging, "pm-averaging", c.PMAveraging, "PM averaging the AQI is computed from (window: -average-window, 24h: 24-hour rolling mean, nowcast: EPA NowCast)")
+	fs.BoolVar(&c.StrictValidation, "strict-validation", c.StrictValidation, "Do not publish readings with implausible values")
+	fs.BoolVar(&c.Dedup, "dedup", c.Dedup, "Drop duplicate and out-of-order readings, ordered by payload timestamp or boot counter")
+	fs.BoolVar(&c.Explode, "explode", c.Explode, "Also publish retained scalar values to <output-topic>/pm25, /pm10, /value and /category")
+	fs.StringVar(&c.PlainTopic, "plain-topic", c.PlainTopic, "Also publish the AQI alone as a retained plain integer, e.g. 102, to this topic for clients that cannot parse JSON; placeholders are replaced as in -output-topic (default: disabled)")
+	fs.BoolVar(&c.HADiscovery, "ha-discovery", c.HADiscovery, "Publish Home Assistant MQTT discovery config for each new sensor")
+	fs.StringVar(&c.DiscoveryPrefix, "discovery-prefix", c.DiscoveryPrefix, "Home Assistant MQTT discovery prefix; must match the discovery prefix configured in Home Assistant")
+	fs.IntVar(&c.DiscoveryQoS, "discovery-qos", c.DiscoveryQoS, "QoS for the retained Home Assistant discovery config: 0, 1 or 2")
+	fs.StringVar(&c.HAStateMode, "ha-state-mode", c.HAStateMode, "Where Home Assistant entities read their state: combined (value_template into the output JSON) or split (one retained topic per entity under <output-topic>/state/)")
+	fs.StringVar(&c.SummaryTopic, "summary-topic", c.SummaryTopic, "MQTT topic for a daily AQI summary per sensor, published at midnight; {serialno} is replaced (default: disabled)")
+	fs.StringVar(&c.SummaryTimezone, "summary-timezone", c.SummaryTimezone, "IANA time zone whose midnight ends a summary day, e.g. Europe/Oslo")
+	fs.StringVar(&c.AlertTopic, "alert-topic", c.AlertTopic, "MQTT topic for alerts when a sensor's AQI crosses -alert-threshold; {serialno} is replaced (default: disabled)")
+	fs.IntVar(&c.AlertThreshold, "alert-threshold", c.AlertThreshold, "Alert when the AQI rises above this value, on the -standard scale")
+	fs.IntVar(&c.AlertHysteresis, "alert-hysteresis", c.AlertHysteresis, "AQI points below -alert-threshold the AQI must fall to before the alert clears")
+	fs.IntVar(&c.TrendWindow, "trend-window", c.TrendWindow, "Add a rising/falling/steady trend to the output, comparing the AQI to the mean of this many previous readings per sensor (default: 0, disabled)")
+	fs.IntVar(&c.TrendMinDelta, "trend-min-delta", c.TrendMinDelta, "AQI points the AQI must differ from the recent mean by to count as rising or falling")
+	fs.DurationVar(&c.StaleAfter, "stale-after", c.StaleAfter, "Publish a retained true to <output-topic>/stale when a sensor sends nothing for this long (0 disables)")
+
+	fs.StringVar(&c.InfluxTopic, "influx-topic", c.InfluxTopic, "Also publish readings in InfluxDB line protocol to this topic (default: disabled)")
+	fs.StringVar(&c.InfluxURL, "influx-url", c.InfluxURL, "Write readings to the InfluxDB v2 HTTP API at this URL, e.g. http://localhost:8086 (default: disabled)")
+	fs.StringVar(&c.InfluxOrg, "influx-org", c.InfluxOrg, "InfluxDB organization for -influx-url")
+	fs.StringVar(&c.InfluxBucket, "influx-bucket", c.InfluxBucket, "InfluxDB bucket for -influx-url")
+	fs.StringVar(&c.InfluxToken, "influx-token", c.InfluxToken, "InfluxDB API token for -influx-url (default: $INFLUX_TOKEN)")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "Also POST each published output message to this URL (default: disabled)")
+	fs.StringVar(&c.CSVFile, "csv-file", c.CSVFile, "Append each reading to this CSV file (default: disabled)")
+	fs.Int64Var(&c.CSVMaxSize, "csv-max-size", c.CSVMaxSize, "Rotate the CSV file to <csv-file>.1 once it reaches this many bytes (default: 0, never rotate)")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Serve Prometheus metrics on this address, e.g. :9090 (default: disabled)")
+	fs.StringVar(&c.HealthAddr, "health-addr", c.HealthAddr, "Serve /healthz and /readyz on this address, e.g. :8080 (default: disabled)")
+	fs.DurationVar(&c.StatsInterval, "stats-interval", c.StatsInterval, "Log a summary of uptime and message counts at this interval, e.g. 1h (default: disabled)")
+	fs.StringVar(&c.StateFile, "state-file", c.StateFile, "Save averaging, NowCast and last-published state to this JSON file and restore it at startup (default: disabled)")
+	fs.DurationVar(&c.StateInterval, "state-interval", c.StateInterval, "How often to save -state-file; it is also saved on shutdown")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format (text, json)")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level (debug, info, warn, error)")
+
+	return fs
+}
+
+// loadConfigFile reads a YAML configuration file on top of the current values of c
+func (c *Config) loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// loadConfig builds the configuration from defaults, the optional -config
+// file and the command-line args, in increasing order of precedence
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := newFlagSet(cfg).Parse(args); err != nil {
+		return nil, err
+	}
+
+	if cfg.ConfigFile != "" {
+		// Load the file over the defaults, then parse the flags again so
+		// that they take precedence over the file
+		fileCfg := defaultConfig()
+		if err := fileCfg.loadConfigFile(cfg.ConfigFile); err != nil {
+			return nil, err
+		}
+		if err := fileCfg.applyEnv(); err != nil {
+			return nil, err
+		}
+		fs := newFlagSet(fileCfg)
+		fs.SetOutput(io.Discard)
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		cfg = fileCfg
+	}
+
+	// Fall back to environment variables for credentials
+	if cfg.Username == "" {
+		cfg.Username = os.Getenv("MQTT_USERNAME")
+	}
+	if cfg.Password == "" {
+		cfg.Password = os.Getenv("MQTT_PASSWORD")
+	}
+	if cfg.InfluxToken == "" {
+		cfg.InfluxToken = os.Getenv("INFLUX_TOKEN")
+	}
+
+	cfg.applyTopicPrefix()
+	return cfg, nil
+}
+
+// applyEnv overrides the broker settings with the environment variables
+// MQTT_BROKER, MQTT_PORT, INPUT_TOPIC (comma-separated), OUTPUT_TOPIC and
+// CLIENT_ID, for container deployments. Unset or empty variables are ignored.
+func (c *Config) applyEnv() error {
+	if v := os.Getenv("MQTT_BROKER"); v != "" {
+		c.Broker = v
+	}
+	if v := os.Getenv("MQTT_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid MQTT_PORT %q: %w", v, err)
+		}
+		c.Port = port
+	}
+	if v := os.Getenv("INPUT_TOPIC"); v != "" {
+		c.InputTopics = nil
+		if err := (*stringList)(&c.InputTopics).Set(v); err != nil {
+			return err
+		}
+	}
+	if v := os.Getenv("OUTPUT_TOPIC"); v != "" {
+		c.OutputTopic = v
+	}
+	if v := os.Getenv("CLIENT_ID"); v != "" {
+		c.ClientID = v
+	}
+	return nil
+}
+
+// writesStdout reports whether the output is written to stdout instead of
+// being published, with -stdin or -replay-dir without -replay-publish
+func (c *Config) writesStdout() bool {
+	return c.Stdin || (c.ReplayDir != "" && !c.ReplayPublish)
+}
+
+// validate checks the configuration for missing or invalid values
+func (c *Config) validate() error {
+	if !c.writesStdout() && (c.Broker == "" || (len(c.InputTopics) == 0 && c.HTTPPollURL == "" && !c.ReplayPublish) || c.OutputTopic == "") {
+		return errMissingRequired
+	}
+	if c.Stdin && c.ReplayDir != "" {
+		return fmt.Errorf("-stdin and -replay-dir cannot be used together")
+	}
+	if c.ReplayPublish && c.ReplayDir == "" {
+		return fmt.Errorf("-replay-publish requires -replay-dir")
+	}
+	if c.ReplaySpeed < 0 {
+		return fmt.Errorf("replay speed must not be negative")
+	}
+	if err := validatePort(c.Port); err != nil {
+		return err
+	}
+	if err := validateTransport(c.Transport); err != nil {
+		return err
+	}
+	if c.ReconnectMaxInterval <= 0 {
+		return fmt.Errorf("reconnect max interval must be positive")
+	}
+	// MQTT counts the keep-alive in whole seconds, and 0 disables it
+	if c.KeepAlive < time.Second {
+		return fmt.Errorf("keepalive must be at least 1s")
+	}
+	if c.ConnectTimeout <= 0 {
+		return fmt.Errorf("connect timeout must be positive")
+	}
+	if c.ConnectRetries < 0 {
+		return fmt.Errorf("connect retries must not be negative")
+	}
+	if _, err := protocolVersion(c.MQTTVersion); err != nil {
+		return err
+	}
+	if c.MessageExpiry < 0 {
+		return fmt.Errorf("message expiry must not be negative")
+	}
+	if c.MessageExpiry > 0 && c.MQTTVersion != mqttVersion5 {
+		return fmt.Errorf("-message-expiry requires -mqtt-version 5")
+	}
+	if err := validateQoS(c.InputQoS); err != nil {
+		return fmt.Errorf("input QoS: %w", err)
+	}
+	if err := validateQoS(c.OutputQoS); err != nil {
+		return fmt.Errorf("output QoS: %w", err)
+	}
+	if err := validateQoS(c.DiscoveryQoS); err != nil {
+		return fmt.Errorf("discovery QoS: %w", err)
+	}
+	if err := validateDiscoveryPrefix(c.DiscoveryPrefix); err != nil {
+		return err
+	}
+	for _, topic := range c.InputTopics {
+		if err := validateTopicFilter(topic); err != nil {
+			return err
+		}
+	}
+	published := []struct{ name, topic string }{
+		{"output", c.OutputTopic},
+		{"error", c.ErrorTopic},
+		{"status", c.StatusTopic},
+		{"availability", c.AvailabilityTopic},
+		{"summary", c.SummaryTopic},
+		{"alert", c.AlertTopic},
+		{"plain", c.PlainTopic},
+		{"InfluxDB", c.InfluxTopic},
+	}
+	for _, p := range published {
+		if err := validateTopicName(p.name, p.topic); err != nil {
+			return err
+		}
+	}
+	for _, template := range []string{c.OutputTopic, c.PlainTopic} {
+		if err := validateTopicTemplate(template); err != nil {
+			return err
+		}
+	}
+	// Alerts and summaries are not tied to a single reading, so only the
+	// serial number is substituted into their topics
+	if err := validateSerialNoTopic("alert", c.AlertTopic); err != nil {
+		return err
+	}
+	if err := validateSerialNoTopic("summary", c.SummaryTopic); err != nil {
+		return err
+	}
+	// Discovery and stale flags need a topic that stays the same for a sensor
+	if strings.Contains(c.OutputTopic, categoryPlaceholder) && (c.HADiscovery || c.StaleAfter > 0) {
+		return fmt.Errorf("%s in the output topic cannot be used with -ha-discovery or -stale-after", categoryPlaceholder)
+	}
+	if err := validateStandard(c.Standard); err != nil {
+		return err
+	}
+	if c.ExperimentalPM1 && c.Standard != standardEPA {
+		return fmt.Errorf("-experimental-pm1 requires -standard %s", standardEPA)
+	}
+	if err := validateCAQIGrid(c.CAQIGrid); err != nil {
+		return err
+	}
+	if err := validatePM25Revision(c.PM25Revision); err != nil {
+		return err
+	}
+	if err := validateAQIRounding(c.AQIRounding); err != nil {
+		return err
+	}
+	if err := validatePM25Source(c.PM25Source); err != nil {
+		return err
+	}
+	if err := validateClimateSource("temperature", c.TempSource); err != nil {
+		return err
+	}
+	if err := validateClimateSource("humidity", c.HumiditySource); err != nil {
+		return err
+	}
+	if err := validateOutputFields(c.OutputFields); err != nil {
+		return err
+	}
+	if err := validatePollutants(c.Pollutants); err != nil {
+		return err
+	}
+	if c.Compress && c.writesStdout() {
+		return fmt.Errorf("-compress cannot be used with -stdin or -replay-dir, which write one JSON line per reading")
+	}
+	if c.Compress && c.HADiscovery && c.HAStateMode == haStateCombined {
+		return fmt.Errorf("-compress requires -ha-state-mode split with -ha-discovery, as Home Assistant cannot read gzipped state")
+	}
+	if c.RoundDecimals < -1 {
+		return fmt.Errorf("round decimals must be -1 (disabled) or more")
+	}
+	if err := validatePMUnit(c.PMUnit); err != nil {
+		return err
+	}
+	if c.PMScale <= 0 {
+		return fmt.Errorf("PM scale must be positive")
+	}
+	if err := validateHAStateMode(c.HAStateMode); err != nil {
+		return err
+	}
+	if err := validateCorrection(c.Correction); err != nil {
+		return err
+	}
+	if err := validateTempUnit(c.TempUnit); err != nil {
+		return err
+	}
+	if err := validateTimestampSource(c.TimestampSource); err != nil {
+		return err
+	}
+	if err := validatePMAveraging(c.PMAveraging); err != nil {
+		return err
+	}
+	if c.AverageWindow != 0 && c.PMAveraging != pmAveragingWindow {
+		return fmt.Errorf("average window cannot be combined with PM averaging %q", c.PMAveraging)
+	}
+	if c.MinInterval < 0 {
+		return fmt.Errorf("min interval must not be negative")
+	}
+	if c.BackfillMaxAge < 0 {
+		return fmt.Errorf("backfill max age must not be negative")
+	}
+	if c.Heartbeat < 0 {
+		return fmt.Errorf("heartbeat must not be negative")
+	}
+	if _, err := time.LoadLocation(c.SummaryTimezone); err != nil {
+		return fmt.Errorf("invalid summary time zone: %w", err)
+	}
+	if c.StatsInterval < 0 {
+		return fmt.Errorf("stats interval must not be negative")
+	}
+	if c.PublishBuffer < 0 {
+		return fmt.Errorf("publish buffer must not be negative")
+	}
+	if c.HeartbeatInterval < 0 {
+		return fmt.Errorf("heartbeat interval must not be negative")
+	}
+	if c.HeartbeatInterval > 0 && c.AvailabilityTopic == "" {
+		return fmt.Errorf("-heartbeat-interval requires an -availability-topic")
+	}
+	if c.MaxPayloadBytes < 0 {
+		return fmt.Errorf("max payload bytes must not be negative")
+	}
+	if c.IgnoreRetainedInput < 0 {
+		return fmt.Errorf("ignore retained input must not be negative")
+	}
+	if c.AlertTopic != "" && c.AlertThreshold <= 0 {
+		return fmt.Errorf("-alert-topic requires a positive -alert-threshold")
+	}
+	if c.AlertHysteresis < 0 {
+		return fmt.Errorf("alert hysteresis must not be negative")
+	}
+	if c.TrendWindow < 0 {
+		return fmt.Errorf("trend window must not be negative")
+	}
+	if c.TrendMinDelta < 0 {
+		return fmt.Errorf("trend min delta must not be negative")
+	}
+	if c.StaleAfter < 0 {
+		return fmt.Errorf("stale after must not be negative")
+	}
+	if c.StateInterval <= 0 {
+		return fmt.Errorf("state interval must be positive")
+	}
+	if c.CategoryHysteresis < 0 {
+		return fmt.Errorf("category hysteresis must not be negative")
+	}
+	if c.InfluxURL != "" && c.InfluxBucket == "" {
+		return fmt.Errorf("-influx-url requires -influx-bucket")
+	}
+	if c.OutputBroker != "" {
+		if err := validateOutputBroker(c.OutputBroker); err != nil {
+			return err
+		}
+	}
+	if c.HTTPPollURL != "" {
+		if err := validateHTTPURL("HTTP poll", c.HTTPPollURL); err != nil {
+			return err
+		}
+	}
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("poll interval must be positive")
+	}
+	if c.WebhookURL != "" {
+		if err := validateHTTPURL("webhook", c.WebhookURL); err != nil {
+			return err
+		}
+	}
+	if c.CSVMaxSize < 0 {
+		return fmt.Errorf("CSV max size must not be negative")
+	}
+	return nil
+}
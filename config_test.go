@@ -0,0 +1,265 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a YAML config file to a temporary directory
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// clearEnv unsets the environment variables read by loadConfig
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"MQTT_USERNAME", "MQTT_PASSWORD", "MQTT_BROKER", "MQTT_PORT", "INPUT_TOPIC", "OUTPUT_TOPIC", "CLIENT_ID"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	clearEnv(t)
+
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("loadConfig(nil) = %+v, want defaults %+v", cfg, defaultConfig())
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+broker: file.example.com
+port: 8883
+input_topics: [file/a, file/b]
+output_topic: file/aqi
+average_window: 5m
+correction: epa-2021
+`)
+
+	cfg, err := loadConfig([]string{"-config", path, "-port", "1884", "-input-topic", "flag/a"})
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+
+	// Flags override the file
+	if cfg.Port != 1884 {
+		t.Errorf("Port = %d, want 1884 from flag", cfg.Port)
+	}
+	if !reflect.DeepEqual(cfg.InputTopics, []string{"flag/a"}) {
+		t.Errorf("InputTopics = %q, want flag value to replace file value", cfg.InputTopics)
+	}
+
+	// The file overrides defaults
+	if cfg.Broker != "file.example.com" || cfg.OutputTopic != "file/aqi" {
+		t.Errorf("Broker/OutputTopic = %s/%s, want values from file", cfg.Broker, cfg.OutputTopic)
+	}
+	if cfg.AverageWindow != 5*time.Minute {
+		t.Errorf("AverageWindow = %v, want 5m from file", cfg.AverageWindow)
+	}
+	if cfg.Correction != correctionEPA2021 {
+		t.Errorf("Correction = %s, want %s from file", cfg.Correction, correctionEPA2021)
+	}
+
+	// Defaults remain for values set nowhere
+	if cfg.ReconnectMaxInterval != time.Minute || cfg.LogFormat != "text" {
+		t.Errorf("ReconnectMaxInterval/LogFormat = %v/%s, want defaults", cfg.ReconnectMaxInterval, cfg.LogFormat)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MQTT_BROKER", "env.example.com")
+	t.Setenv("MQTT_PORT", "8883")
+	t.Setenv("INPUT_TOPIC", "env/a,env/b")
+	t.Setenv("OUTPUT_TOPIC", "env/aqi")
+	t.Setenv("CLIENT_ID", "env-client")
+
+	// The environment overrides defaults
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	expected := defaultConfig()
+	expected.Broker = "env.example.com"
+	expected.Port = 8883
+	expected.InputTopics = []string{"env/a", "env/b"}
+	expected.OutputTopic = "env/aqi"
+	expected.ClientID = "env-client"
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("loadConfig(nil) = %+v, want %+v", cfg, expected)
+	}
+
+	// The environment overrides the file, and flags override the environment
+	path := writeConfigFile(t, `
+broker: file.example.com
+port: 1884
+output_topic: file/aqi
+`)
+	cfg, err = loadConfig([]string{"-config", path, "-input-topic", "flag/a", "-client-id", "flag-client"})
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if cfg.Broker != "env.example.com" || cfg.Port != 8883 || cfg.OutputTopic != "env/aqi" {
+		t.Errorf("Broker/Port/OutputTopic = %s/%d/%s, want values from the environment", cfg.Broker, cfg.Port, cfg.OutputTopic)
+	}
+	if !reflect.DeepEqual(cfg.InputTopics, []string{"flag/a"}) || cfg.ClientID != "flag-client" {
+		t.Errorf("InputTopics/ClientID = %q/%s, want flag values", cfg.InputTopics, cfg.ClientID)
+	}
+
+	t.Setenv("MQTT_PORT", "mqtt")
+	if _, err := loadConfig(nil); err == nil {
+		t.Error("loadConfig accepted a non-numeric MQTT_PORT")
+	}
+}
+
+func TestLoadConfigMalformedYAML(t *testing.T) {
+	path := writeConfigFile(t, "broker: [unterminated\n")
+
+	_, err := loadConfig([]string{"-config", path})
+	if err == nil {
+		t.Fatal("loadConfig accepted malformed YAML")
+	}
+	if !strings.Contains(err.Error(), "failed to parse config file") || !strings.Contains(err.Error(), path) {
+		t.Errorf("Error %q does not identify the config file", err)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, err := loadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("loadConfig accepted a missing config file")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := defaultConfig()
+		cfg.Broker = "localhost"
+		cfg.InputTopics = []string{"in"}
+		cfg.OutputTopic = "out"
+		return cfg
+	}
+
+	if err := valid().validate(); err != nil {
+		t.Errorf("validate returned error for valid config: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"Missing broker", func(c *Config) { c.Broker = "" }},
+		{"Invalid port", func(c *Config) { c.Port = 0 }},
+		{"Unknown transport", func(c *Config) { c.Transport = "quic" }},
+		{"Invalid reconnect interval", func(c *Config) { c.ReconnectMaxInterval = 0 }},
+		{"Zero keepalive", func(c *Config) { c.KeepAlive = 0 }},
+		{"Sub-second keepalive", func(c *Config) { c.KeepAlive = 500 * time.Millisecond }},
+		{"Zero connect timeout", func(c *Config) { c.ConnectTimeout = 0 }},
+		{"Negative message expiry", func(c *Config) { c.MQTTVersion = mqttVersion5; c.MessageExpiry = -time.Second }},
+		{"Message expiry without MQTT 5", func(c *Config) { c.MessageExpiry = time.Minute }},
+		{"Experimental PM1 without EPA", func(c *Config) { c.ExperimentalPM1 = true; c.Standard = standardDAQI }},
+		{"Invalid input QoS", func(c *Config) { c.InputQoS = 3 }},
+		{"Invalid output QoS", func(c *Config) { c.OutputQoS = -1 }},
+		{"Invalid discovery QoS", func(c *Config) { c.DiscoveryQoS = 3 }},
+		{"Empty discovery prefix", func(c *Config) { c.DiscoveryPrefix = "" }},
+		{"Wildcard in discovery prefix", func(c *Config) { c.DiscoveryPrefix = "ha/#" }},
+		{"Unknown standard", func(c *Config) { c.Standard = "bogus" }},
+		{"Unknown correction", func(c *Config) { c.Correction = "bogus" }},
+		{"Unknown AQI rounding", func(c *Config) { c.AQIRounding = "bogus" }},
+		{"Unknown PM2.5 source", func(c *Config) { c.PM25Source = "bogus" }},
+		{"Unknown temperature source", func(c *Config) { c.TempSource = "bogus" }},
+		{"Unknown humidity source", func(c *Config) { c.HumiditySource = "bogus" }},
+		{"Unknown output field", func(c *Config) { c.OutputFields = []string{"aqi", "bogus"} }},
+		{"Negative publish buffer", func(c *Config) { c.PublishBuffer = -1 }},
+		{"Negative heartbeat interval", func(c *Config) { c.HeartbeatInterval = -time.Second }},
+		{"Heartbeat interval without topic", func(c *Config) { c.HeartbeatInterval = time.Minute; c.AvailabilityTopic = "" }},
+		{"Negative max payload bytes", func(c *Config) { c.MaxPayloadBytes = -1 }},
+		{"Zero state interval", func(c *Config) { c.StateInterval = 0 }},
+		{"Unknown PM unit", func(c *Config) { c.PMUnit = "ppm" }},
+		{"Zero PM scale", func(c *Config) { c.PMScale = 0 }},
+		{"Invalid output broker", func(c *Config) { c.OutputBroker = "cloud.example.com" }},
+		{"Invalid HTTP poll URL", func(c *Config) { c.HTTPPollURL = "airgradient.local/measures/current" }},
+		{"Zero poll interval", func(c *Config) { c.PollInterval = 0 }},
+		{"Invalid webhook URL", func(c *Config) { c.WebhookURL = "localhost:8080/hook" }},
+		{"Negative CSV max size", func(c *Config) { c.CSVMaxSize = -1 }},
+		{"Alert topic without threshold", func(c *Config) { c.AlertTopic = "alerts" }},
+		{"Negative alert hysteresis", func(c *Config) { c.AlertHysteresis = -1 }},
+		{"Negative trend window", func(c *Config) { c.TrendWindow = -1 }},
+		{"Negative backfill max age", func(c *Config) { c.BackfillMaxAge = -time.Minute }},
+		{"Negative ignore retained input", func(c *Config) { c.IgnoreRetainedInput = -time.Second }},
+		{"Wildcard in output topic", func(c *Config) { c.OutputTopic = "aqi/+" }},
+		{"Wildcard in error topic", func(c *Config) { c.ErrorTopic = "aqi/errors/#" }},
+		{"Wildcard in plain topic", func(c *Config) { c.PlainTopic = "aqi/+/plain" }},
+		{"Misplaced input wildcard", func(c *Config) { c.InputTopics = []string{"in/#/readings"} }},
+		{"Unknown output topic placeholder", func(c *Config) { c.OutputTopic = "aqi/{location}" }},
+		{"Unknown plain topic placeholder", func(c *Config) { c.PlainTopic = "aqi/{location}/plain" }},
+		{"Model placeholder in alert topic", func(c *Config) { c.AlertTopic = "aqi/alerts/{model}/{serialno}" }},
+		{"Category placeholder in summary topic", func(c *Config) { c.SummaryTopic = "aqi/summary/{category}" }},
+		{"Category topic with discovery", func(c *Config) { c.OutputTopic = "aqi/{category}"; c.HADiscovery = true }},
+		{"Category topic with stale flags", func(c *Config) { c.OutputTopic = "aqi/{category}"; c.StaleAfter = time.Minute }},
+		{"Negative trend min delta", func(c *Config) { c.TrendMinDelta = -1 }},
+		{"Negative stale after", func(c *Config) { c.StaleAfter = -time.Minute }},
+		{"Compress with stdin", func(c *Config) { c.Compress = true; c.Stdin = true }},
+		{"Compress with replay", func(c *Config) { c.Compress = true; c.ReplayDir = "captures" }},
+		{"Stdin with replay", func(c *Config) { c.Stdin = true; c.ReplayDir = "captures" }},
+		{"Replay publish without directory", func(c *Config) { c.ReplayPublish = true }},
+		{"Negative replay speed", func(c *Config) { c.ReplayDir = "captures"; c.ReplaySpeed = -1 }},
+		{"Compress with combined HA state", func(c *Config) { c.Compress = true; c.HADiscovery = true }},
+		{"Invalid round decimals", func(c *Config) { c.RoundDecimals = -2 }},
+		{"Unknown pollutant", func(c *Config) { c.Pollutants = []string{"pm25", "nox"} }},
+		{"Unknown PM averaging", func(c *Config) { c.PMAveraging = "bogus" }},
+		{"Average window with 24h averaging", func(c *Config) { c.PMAveraging = pmAveraging24h; c.AverageWindow = time.Hour }},
+		{"Unknown HA state mode", func(c *Config) { c.HAStateMode = "bogus" }},
+		{"Unknown summary time zone", func(c *Config) { c.SummaryTimezone = "Mars/Olympus_Mons" }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := valid()
+			tc.modify(cfg)
+			if err := cfg.validate(); err == nil {
+				t.Error("validate returned nil error")
+			}
+		})
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	testCases := []struct {
+		version  string
+		expected uint
+		wantErr  bool
+	}{
+		{"3.1", 3, false},
+		{"3.1.1", 4, false},
+		{"5", 5, false},
+		{"4", 0, true},
+	}
+	for _, tc := range testCases {
+		got, err := protocolVersion(tc.version)
+		if (err != nil) != tc.wantErr || got != tc.expected {
+			t.Errorf("protocolVersion(%q) = %d, %v; want %d, error %v", tc.version, got, err, tc.expected, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateQoS(t *testing.T) {
+	for qos := -1; qos <= 3; qos++ {
+		err := validateQoS(qos)
+		if valid := qos >= 0 && qos <= 2; (err == nil) != valid {
+			t.Errorf("validateQoS(%d) = %v, want valid %v", qos, err, valid)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// connectRetryInitial is the delay after the first failed attempt to reach
+// the broker at startup; it doubles with each further failure
+const connectRetryInitial = time.Second
+
+// connectRetryInterval caps the delay between attempts while the broker is
+// unreachable at startup
+const connectRetryInterval = 10 * time.Second
+
+// pingTimeout is how long to wait for the broker to answer a keep-alive ping
+const pingTimeout = 10 * time.Second
+
+// setConnectionTimeouts applies -keepalive and -connect-timeout to opts
+// The ping timeout is capped at the keep-alive, so a short keep-alive also
+// detects a dead connection quickly.
+func setConnectionTimeouts(opts *mqtt.ClientOptions, cfg *Config) {
+	opts.SetKeepAlive(cfg.KeepAlive)
+	opts.SetPingTimeout(min(pingTimeout, cfg.KeepAlive))
+	opts.SetConnectTimeout(cfg.ConnectTimeout)
+}
+
+// connectWithRetry calls connect until it succeeds, backing off exponentially
+// from initial to maxInterval between attempts
+// With retries > 0 it gives up after that many failed attempts and returns
+// the last error; with retries == 0 it keeps trying forever.
+func connectWithRetry(connect func() error, retries int, initial, maxInterval time.Duration) error {
+	delay := initial
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if retries > 0 && attempt >= retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("Failed to connect to MQTT broker, retrying", "attempt", attempt, "retry_in", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxInterval)
+	}
+}
+
+// setSession applies -clean-session to opts
+// Without a clean session the broker keeps the subscriptions of the client ID
+// and queues QoS 1 and 2 messages for it while it is disconnected.
+func setSession(opts *mqtt.ClientOptions, cfg *Config) {
+	opts.SetCleanSession(cfg.CleanSession)
+}
+
+// connectionSettings returns log attributes describing the settings the
+// client connects with, for debugging broker compatibility
+func connectionSettings(client mqtt.Client) []any {
+	opts := client.OptionsReader()
+	return []any{
+		"mqtt_version", protocolName(opts.ProtocolVersion()),
+		"keepalive", opts.KeepAlive(),
+		"clean_session", opts.CleanSession(),
+	}
+}
+
+// connected records that the MQTT client has connected, counting every
+// connection after the first as a reconnect
+func (p *processor) connected() {
+	p.health.setConnected(true)
+	p.metrics.connected.Set(1)
+
+	p.mu.Lock()
+	reconnect := p.hasConnected
+	p.hasConnected = true
+	p.mu.Unlock()
+	if reconnect {
+		p.metrics.reconnects.Inc()
+	}
+}
+
+// connectionLost records that the MQTT client has lost its connection
+func (p *processor) connectionLost() {
+	p.health.setConnected(false)
+	p.metrics.connected.Set(0)
+}
+
+// markSubscribed records that the input topics are being subscribed to, for
+// -ignore-retained-input
+func (p *processor) markSubscribed() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscribedAt = p.clock.Now()
+}
+
+// ignoringRetained reports whether retained input messages arriving at now
+// are dropped under -ignore-retained-input
+func (p *processor) ignoringRetained(now time.Time) bool {
+	if p.ignoreRetained <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.subscribedAt.IsZero() && now.Sub(p.subscribedAt) < p.ignoreRetained
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestConnectWithRetryClosedPort points a client at a closed port and checks
+// that it retries with backoff instead of failing on the first attempt
+func TestConnectWithRetryClosedPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetConnectTimeout(time.Second)
+	client := mqtt.NewClient(opts)
+
+	attempts := 0
+	connect := func() error {
+		attempts++
+		token := client.Connect()
+		token.Wait()
+		return token.Error()
+	}
+
+	start := time.Now()
+	err = connectWithRetry(connect, 3, 10*time.Millisecond, 20*time.Millisecond)
+	if err == nil {
+		t.Fatal("connectWithRetry succeeded against a closed port")
+	}
+	if attempts != 3 {
+		t.Errorf("Made %d attempts, want 3", attempts)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Returned after %v, want at least the 30ms of backoff", elapsed)
+	}
+}
+
+func TestConnectWithRetryEventuallySucceeds(t *testing.T) {
+	attempts := 0
+	connect := func() error {
+		attempts++
+		if attempts < 4 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	// With 0 retries it keeps trying until the broker is up
+	if err := connectWithRetry(connect, 0, time.Millisecond, time.Millisecond); err != nil {
+		t.Fatalf("connectWithRetry returned error: %v", err)
+	}
+	if attempts != 4 {
+		t.Errorf("Made %d attempts, want 4", attempts)
+	}
+}
+
+// TestConnectionTimeoutsFromFlags tests that -keepalive and -connect-timeout
+// are applied to the client options
+func TestConnectionTimeoutsFromFlags(t *testing.T) {
+	cfg, err := loadConfig([]string{"-broker", "localhost", "-input-topic", "airgradient/#", "-keepalive", "5s", "-connect-timeout", "3s"})
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	opts := mqtt.NewClientOptions()
+	setConnectionTimeouts(opts, cfg)
+	if opts.KeepAlive != 5 {
+		t.Errorf("KeepAlive = %ds, want 5s", opts.KeepAlive)
+	}
+	if opts.PingTimeout != 5*time.Second {
+		t.Errorf("PingTimeout = %v, want 5s, capped at the keep-alive", opts.PingTimeout)
+	}
+	if opts.ConnectTimeout != 3*time.Second {
+		t.Errorf("ConnectTimeout = %v, want 3s", opts.ConnectTimeout)
+	}
+}
+
+// TestConnectionMetrics simulates a disconnect and checks that the connected
+// gauge flips and the reconnect is counted
+func TestConnectionMetrics(t *testing.T) {
+	proc := newProcessor("aqi")
+
+	check := func(step string, connected, reconnects float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(proc.metrics.connected); got != connected {
+			t.Errorf("%s: mqtt_connected = %g, want %g", step, got, connected)
+		}
+		if got := testutil.ToFloat64(proc.metrics.reconnects); got != reconnects {
+			t.Errorf("%s: mqtt_reconnects_total = %g, want %g", step, got, reconnects)
+		}
+	}
+
+	check("Before connecting", 0, 0)
+	proc.connected()
+	check("Connected", 1, 0)
+	proc.connectionLost()
+	check("Connection lost", 0, 0)
+	proc.connected()
+	check("Reconnected", 1, 1)
+}
+
+// TestIgnoreRetainedInput tests that retained input is dropped for the
+// -ignore-retained-input window after subscribing, and live input is not
+func TestIgnoreRetainedInput(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	proc.ignoreRetained = 10 * time.Second
+	client := &fakeClient{}
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 10}`)
+
+	proc.markSubscribed()
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload, retained: true})
+	if n := len(client.messages()); n != 0 {
+		t.Fatalf("Published %d messages for retained input after subscribing, want 0", n)
+	}
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+	if n := len(client.messages()); n != 1 {
+		t.Fatalf("Published %d messages for live input, want 1", n)
+	}
+
+	clock.advance(10 * time.Second)
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload, retained: true})
+	if n := len(client.messages()); n != 2 {
+		t.Errorf("Published %d messages for retained input after the window, want 2", n)
+	}
+
+	// Disabled by default
+	proc = newProcessor("aqi")
+	proc.markSubscribed()
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload, retained: true})
+	if n := len(client.messages()); n != 3 {
+		t.Errorf("Published %d messages for retained input without the flag, want 3", n)
+	}
+}
+
+// TestCleanSessionFromFlags tests that -clean-session is applied to the
+// client options and reported in the connection settings
+func TestCleanSessionFromFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, true},
+		{[]string{"-clean-session=false"}, false},
+	} {
+		cfg, err := loadConfig(append([]string{"-broker", "localhost", "-input-topic", "airgradient/#"}, tc.args...))
+		if err != nil {
+			t.Fatalf("loadConfig failed: %v", err)
+		}
+
+		opts := mqtt.NewClientOptions()
+		opts.SetProtocolVersion(4)
+		setConnectionTimeouts(opts, cfg)
+		setSession(opts, cfg)
+		client := mqtt.NewClient(opts)
+		reader := client.OptionsReader()
+		if got := reader.CleanSession(); got != tc.want {
+			t.Errorf("%v: CleanSession = %v, want %v", tc.args, got, tc.want)
+		}
+
+		settings := connectionSettings(client)
+		want := []any{"mqtt_version", mqttVersion311, "keepalive", cfg.KeepAlive, "clean_session", tc.want}
+		if fmt.Sprint(settings) != fmt.Sprint(want) {
+			t.Errorf("%v: connectionSettings = %v, want %v", tc.args, settings, want)
+		}
+	}
+}
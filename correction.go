@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PM2.5 correction modes selectable with -correction
+const (
+	correctionNone    = "none"
+	correctionEPA2021 = "epa-2021"
+)
+
+// validateCorrection checks that a correction mode is supported
+func validateCorrection(mode string) error {
+	switch mode {
+	case correctionNone, correctionEPA2021:
+		return nil
+	default:
+		return fmt.Errorf("unknown correction mode %q: must be %q or %q", mode, correctionNone, correctionEPA2021)
+	}
+}
+
+// PM2.5 fields selectable with -pm25-source
+const (
+	pm25SourceStandard    = "standard"    // pm02Standard
+	pm25SourceCompensated = "compensated" // pm02Compensated
+	pm25SourceAtmospheric = "atmospheric" // pm02
+)
+
+// validatePM25Source checks that a PM2.5 source is supported
+func validatePM25Source(source string) error {
+	switch source {
+	case pm25SourceStandard, pm25SourceCompensated, pm25SourceAtmospheric:
+		return nil
+	default:
+		return fmt.Errorf("unknown PM2.5 source %q: must be %q, %q or %q", source, pm25SourceStandard, pm25SourceCompensated, pm25SourceAtmospheric)
+	}
+}
+
+// selectPM25 returns the PM2.5 concentration from the field chosen by source
+// A compensated value of zero means the sensor did not report one, in which
+// case the standard value is returned and fellBack is true.
+func selectPM25(source string, reading SensorReading) (pm25 float64, fellBack bool) {
+	switch source {
+	case pm25SourceCompensated:
+		if reading.PM02Compensated == 0 {
+			return reading.PM02Standard, true
+		}
+		return reading.PM02Compensated, false
+	case pm25SourceAtmospheric:
+		return reading.PM02, false
+	default:
+		return reading.PM02Standard, false
+	}
+}
+
+// Temperature and humidity fields selectable with -temp-source and
+// -humidity-source
+const (
+	climateSourceRaw         = "raw"         // atmp, rhum
+	climateSourceCompensated = "compensated" // atmpCompensated, rhumCompensated
+)
+
+// validateClimateSource checks that a temperature or humidity source is
+// supported; name is the setting being checked
+func validateClimateSource(name, source string) error {
+	switch source {
+	case climateSourceRaw, climateSourceCompensated:
+		return nil
+	default:
+		return fmt.Errorf("unknown %s source %q: must be %q or %q", name, source, climateSourceRaw, climateSourceCompensated)
+	}
+}
+
+// compensatedClimate holds the compensated temperature and humidity of a
+// payload, nil when absent
+// Unlike PM2.5, zero is a valid temperature, so presence is checked on the
+// payload rather than the parsed value.
+type compensatedClimate struct {
+	Atmp *float64 `json:"atmpCompensated"`
+	Rhum *float64 `json:"rhumCompensated"`
+}
+
+// selectClimate replaces the temperature and humidity in reading with the
+// compensated values when tempSource or humiditySource select them, so the
+// output, Home Assistant states and metrics carry the selected values
+// It returns the compensated fields that were selected but absent from
+// payload, for which the raw values are kept.
+func selectClimate(payload []byte, reading *SensorReading, tempSource, humiditySource string) (missing []string) {
+	if tempSource != climateSourceCompensated && humiditySource != climateSourceCompensated {
+		return nil
+	}
+	var compensated compensatedClimate
+	if err := json.Unmarshal(payload, &compensated); err != nil {
+		return nil // Already parsed by the caller
+	}
+	if tempSource == climateSourceCompensated {
+		if compensated.Atmp == nil {
+			missing = append(missing, "atmpCompensated")
+		} else {
+			reading.Atmp = *compensated.Atmp
+		}
+	}
+	if humiditySource == climateSourceCompensated {
+		if compensated.Rhum == nil {
+			missing = append(missing, "rhumCompensated")
+		} else {
+			reading.Rhum = *compensated.Rhum
+		}
+	}
+	return missing
+}
+
+// correctPM25 applies the selected correction to a PM2.5 concentration
+// rh is the relative humidity in percent.
+func correctPM25(mode string, pm25, rh float64) float64 {
+	if mode == correctionEPA2021 {
+		return epa2021Correction(pm25, rh)
+	}
+	return pm25
+}
+
+// epa2021Correction applies the EPA US-wide correction for PurpleAir-class sensors
+// The equation is linear at typical concentrations and blends into a quadratic
+// fit above 210 µg/m³ so that wildfire smoke is not under-reported:
+//
+//	x < 30:        0.524x - 0.0862RH + 5.75
+//	30 <= x < 50:  blend of the 0.524 and 0.786 slopes
+//	50 <= x < 210: 0.786x - 0.0862RH + 5.75
+//	210 <= x < 260: blend of the linear and quadratic fits
+//	x >= 260:      2.966 + 0.69x + 8.84e-4x²
+//
+// Source: https://document.airnow.gov/airnow-fire-and-smoke-map-questions-and-answers.pdf
+func epa2021Correction(x, rh float64) float64 {
+	var corrected float64
+	switch {
+	case x < 30:
+		corrected = 0.524*x - 0.0862*rh + 5.75
+	case x < 50:
+		f := x/20 - 3.0/2
+		corrected = (0.786*f+0.524*(1-f))*x - 0.0862*rh + 5.75
+	case x < 210:
+		corrected = 0.786*x - 0.0862*rh + 5.75
+	case x < 260:
+		f := x/50 - 21.0/5
+		corrected = (0.69*f+0.786*(1-f))*x - 0.0862*rh*(1-f) +
+			2.966*f + 5.75*(1-f) + 8.84e-4*x*x*f
+	default:
+		corrected = 2.966 + 0.69*x + 8.84e-4*x*x
+	}
+
+	// The intercept can push very clean readings below zero
+	if corrected < 0 {
+		return 0
+	}
+	return corrected
+}
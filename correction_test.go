@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"aqi-mqtt/aqi"
+)
+
+func TestEPA2021Correction(t *testing.T) {
+	testCases := []struct {
+		name     string
+		pm25     float64
+		rh       float64
+		expected float64
+	}{
+		{"Low concentration", 10, 50, 0.524*10 - 0.0862*50 + 5.75},
+		{"Linear range", 100, 50, 0.786*100 - 0.0862*50 + 5.75},
+		{"Smoke range", 300, 50, 2.966 + 0.69*300 + 8.84e-4*300*300},
+		{"Clean air clamps at zero", 0, 100, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := epa2021Correction(tc.pm25, tc.rh)
+			if math.Abs(result-tc.expected) > 1e-9 {
+				t.Errorf("epa2021Correction(%f, %f) = %f, want %f", tc.pm25, tc.rh, result, tc.expected)
+			}
+		})
+	}
+}
+
+// TestEPA2021CorrectionContinuity checks that the blended ranges join the adjacent equations
+func TestEPA2021CorrectionContinuity(t *testing.T) {
+	for _, boundary := range []float64{30, 50, 210, 260} {
+		below := epa2021Correction(boundary-1e-9, 40)
+		above := epa2021Correction(boundary, 40)
+		if math.Abs(below-above) > 1e-3 {
+			t.Errorf("Discontinuity at %.0f: %f vs %f", boundary, below, above)
+		}
+	}
+}
+
+// TestCorrectionAQI compares corrected and uncorrected AQI for a smoky reading
+func TestCorrectionAQI(t *testing.T) {
+	pm25, rh := 300.0, 50.0
+
+	uncorrected := aqi.ComputeAQI(correctPM25(correctionNone, pm25, rh), 0)
+	corrected := aqi.ComputeAQI(correctPM25(correctionEPA2021, pm25, rh), 0)
+
+	if uncorrected != 350 {
+		t.Errorf("Uncorrected AQI = %d, want 350", uncorrected)
+	}
+	if corrected != 340 {
+		t.Errorf("Corrected AQI = %d, want 340", corrected)
+	}
+}
+
+func TestValidateCorrection(t *testing.T) {
+	for _, mode := range []string{correctionNone, correctionEPA2021} {
+		if err := validateCorrection(mode); err != nil {
+			t.Errorf("validateCorrection(%q) returned error: %v", mode, err)
+		}
+	}
+	if err := validateCorrection("epa-2016"); err == nil {
+		t.Error("validateCorrection accepted an unknown mode")
+	}
+}
+
+func TestSelectPM25(t *testing.T) {
+	reading := SensorReading{PM02: 12, PM02Standard: 10, PM02Compensated: 8}
+	testCases := []struct {
+		source       string
+		reading      SensorReading
+		expected     float64
+		wantFellBack bool
+	}{
+		{pm25SourceStandard, reading, 10, false},
+		{pm25SourceCompensated, reading, 8, false},
+		{pm25SourceAtmospheric, reading, 12, false},
+		{pm25SourceCompensated, SensorReading{PM02Standard: 10}, 10, true},
+	}
+	for _, tc := range testCases {
+		got, fellBack := selectPM25(tc.source, tc.reading)
+		if got != tc.expected || fellBack != tc.wantFellBack {
+			t.Errorf("selectPM25(%q, %+v) = %v, %v; want %v, %v", tc.source, tc.reading, got, fellBack, tc.expected, tc.wantFellBack)
+		}
+	}
+
+	if err := validatePM25Source("raw"); err == nil {
+		t.Error("validatePM25Source accepted an unknown source")
+	}
+}
+
+// TestClimateSource tests the published temperature and humidity for each
+// -temp-source and -humidity-source, including the Home Assistant states
+func TestClimateSource(t *testing.T) {
+	full := `{"serialno": "abc", "pm02Standard": 5, "atmp": 24.1, "atmpCompensated": 0, "rhum": 60.7, "rhumCompensated": 55.2}`
+	rawOnly := `{"serialno": "abc", "pm02Standard": 5, "atmp": 24.1, "rhum": 60.7}`
+	testCases := []struct {
+		name           string
+		tempSource     string
+		humiditySource string
+		payload        string
+		wantTemp       float64
+		wantHumidity   float64
+	}{
+		{"Raw", climateSourceRaw, climateSourceRaw, full, 24.1, 60.7},
+		{"Compensated temperature", climateSourceCompensated, climateSourceRaw, full, 0, 60.7},
+		{"Compensated humidity", climateSourceRaw, climateSourceCompensated, full, 24.1, 55.2},
+		{"Both compensated", climateSourceCompensated, climateSourceCompensated, full, 0, 55.2},
+		{"Compensated missing", climateSourceCompensated, climateSourceCompensated, rawOnly, 24.1, 60.7},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proc := newProcessor("aqi")
+			proc.tempSource = tc.tempSource
+			proc.humiditySource = tc.humiditySource
+			proc.haDiscovery = true
+			proc.haStateMode = haStateSplit
+			client := &fakeClient{}
+			proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(tc.payload)})
+
+			states := make(map[string]string)
+			var output AQIReading
+			for _, msg := range client.messages() {
+				switch msg.Topic {
+				case "aqi":
+					if err := json.Unmarshal(msg.Payload, &output); err != nil {
+						t.Fatalf("Failed to parse output: %v", err)
+					}
+				case "aqi/state/temperature", "aqi/state/humidity":
+					states[msg.Topic] = string(msg.Payload)
+				}
+			}
+			if output.Atmp != tc.wantTemp || output.Rhum != tc.wantHumidity {
+				t.Errorf("atmp, rhum = %v, %v; want %v, %v", output.Atmp, output.Rhum, tc.wantTemp, tc.wantHumidity)
+			}
+			var temp, humidity float64
+			json.Unmarshal([]byte(states["aqi/state/temperature"]), &temp)
+			json.Unmarshal([]byte(states["aqi/state/humidity"]), &humidity)
+			if temp != tc.wantTemp || humidity != tc.wantHumidity {
+				t.Errorf("Home Assistant states = %v, want temperature %v and humidity %v", states, tc.wantTemp, tc.wantHumidity)
+			}
+		})
+	}
+
+	if err := validateClimateSource("temperature", "standard"); err == nil {
+		t.Error("validateClimateSource accepted an unknown source")
+	}
+}
+
+// TestPM25SourceAQI tests that the selected PM2.5 field drives the published AQI
+func TestPM25SourceAQI(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02": 55.5, "pm02Standard": 35.5, "pm02Compensated": 12.1}`)
+	testCases := []struct {
+		source string
+		pm25   float64
+	}{
+		{pm25SourceStandard, 35.5},
+		{pm25SourceCompensated, 12.1},
+		{pm25SourceAtmospheric, 55.5},
+	}
+	for _, tc := range testCases {
+		proc := newProcessor("aqi")
+		proc.pm25Source = tc.source
+		client := &fakeClient{}
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+		messages := client.messages()
+		if len(messages) != 1 {
+			t.Fatalf("Source %s: published %d messages, want 1", tc.source, len(messages))
+		}
+		var output AQIReading
+		if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		if want := aqi.ComputeAQI(tc.pm25, 0); output.AQI != want {
+			t.Errorf("Source %s: AQI = %d, want %d", tc.source, output.AQI, want)
+		}
+	}
+}
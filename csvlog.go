@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// csvHeader is the first row of every -csv-file
+var csvHeader = []string{"timestamp", "serialno", "pm25", "pm10", "aqi", "category", "temp", "humidity", "co2"}
+
+// csvFlushInterval is how often buffered rows are written to the -csv-file,
+// bounding how much data a crash loses
+const csvFlushInterval = 5 * time.Second
+
+// csvLog appends readings to a CSV file, rotating it by size
+// Rows are buffered until the next flush, so the file can exceed maxSize by
+// up to the buffer size before it is rotated.
+type csvLog struct {
+	path    string
+	maxSize int64 // Rotate once the file reaches this many bytes, zero to never rotate
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+	size   int64 // Bytes written to the file; buffered rows count once flushed
+}
+
+// countingWriter counts the bytes written to file
+type countingWriter struct {
+	file *os.File
+	n    *int64
+}
+
+// Write writes p to the file and adds the bytes written to the count
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	*w.n += int64(n)
+	return n, err
+}
+
+// openCSVLog opens path for appending, writing the header if the file is new
+// or empty
+func openCSVLog(path string, maxSize int64) (*csvLog, error) {
+	l := &csvLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file and writes the header if it is empty
+func (l *csvLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening CSV file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening CSV file: %w", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	l.writer = csv.NewWriter(countingWriter{file: file, n: &l.size})
+	if l.size == 0 {
+		return l.writer.Write(csvHeader)
+	}
+	return nil
+}
+
+// rotate renames the file to path.1, replacing an older one, and starts a
+// new file
+func (l *csvLog) rotate() error {
+	l.writer.Flush()
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("closing CSV file: %w", err)
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("rotating CSV file: %w", err)
+	}
+	return l.open()
+}
+
+// write appends a row for reading
+// pm25 and pm10 are the concentrations the AQI was computed from.
+func (l *csvLog) write(reading AQIReading, pm25, pm10 float64) {
+	formatFloat := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	row := []string{
+		reading.Timestamp,
+		reading.SerialNo,
+		formatFloat(pm25),
+		formatFloat(pm10),
+		strconv.Itoa(reading.AQI),
+		reading.Category,
+		formatFloat(reading.Atmp),
+		formatFloat(reading.Rhum),
+		formatFloat(reading.RCO2),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			slog.Error("Failed to rotate CSV file", "file", l.path, "error", err)
+			return
+		}
+	}
+	if err := l.writer.Write(row); err != nil {
+		slog.Error("Failed to write CSV row", "file", l.path, "error", err)
+	}
+}
+
+// flush writes the buffered rows to the file
+func (l *csvLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writer.Flush()
+	if err := l.writer.Error(); err != nil {
+		slog.Error("Failed to write CSV file", "file", l.path, "error", err)
+	}
+}
+
+// close flushes the buffered rows and closes the file
+func (l *csvLog) close() error {
+	l.flush()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// closeCSVLog closes the -csv-file, if any, once no more readings are handled
+func (p *processor) closeCSVLog() {
+	if p.csvLog == nil {
+		return
+	}
+	if err := p.csvLog.close(); err != nil {
+		slog.Error("Failed to close CSV file", "file", p.csvLog.path, "error", err)
+	}
+}
+
+// run flushes the file every interval until stop is closed
+func (l *csvLog) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readCSV parses the CSV file at path
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open CSV file: %v", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV file: %v", err)
+	}
+	return rows
+}
+
+// TestCSVLog tests that readings are appended to the -csv-file below a
+// single header, also when the file is reopened
+func TestCSVLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.csv")
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	for _, pm25 := range []float64{5, 35.7} {
+		csvLog, err := openCSVLog(path, 0)
+		if err != nil {
+			t.Fatalf("openCSVLog failed: %v", err)
+		}
+		proc.csvLog = csvLog
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %g, "pm10Standard": 45, "atmp": 24.1, "rhum": 60.7, "rco2": 417}`, pm25)),
+		})
+		proc.closeCSVLog()
+	}
+
+	rows := readCSV(t, path)
+	if len(rows) != 3 {
+		t.Fatalf("CSV file has %d rows, want a header and 2 readings: %v", len(rows), rows)
+	}
+	if !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Errorf("Header = %v, want %v", rows[0], csvHeader)
+	}
+	want := []string{"abc", "35.7", "45", "101", "Unhealthy for Sensitive Groups", "24.1", "60.7", "417"}
+	if got := rows[2][1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Row = %v, want %v after the timestamp", got, want)
+	}
+	if rows[2][0] == "" {
+		t.Error("Row has no timestamp")
+	}
+}
+
+// TestCSVLogRotation tests that the file is rotated to .1 once it reaches
+// -csv-max-size, and that the new file starts with a header
+func TestCSVLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.csv")
+	csvLog, err := openCSVLog(path, 80)
+	if err != nil {
+		t.Fatalf("openCSVLog failed: %v", err)
+	}
+
+	for i := range 2 {
+		csvLog.write(AQIReading{SensorReading: SensorReading{SerialNo: fmt.Sprintf("sensor-%d", i)}, AQI: 42, Category: "Good"}, 10, 20)
+		csvLog.flush()
+	}
+	if err := csvLog.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// The header and first row pass 80 bytes, so the second row starts a
+	// new file
+	rotated := readCSV(t, path+".1")
+	if len(rotated) != 2 || rotated[1][1] != "sensor-0" {
+		t.Errorf("Rotated file = %v, want the header and sensor-0", rotated)
+	}
+	current := readCSV(t, path)
+	if len(current) != 2 || !reflect.DeepEqual(current[0], csvHeader) || current[1][1] != "sensor-1" {
+		t.Errorf("Current file = %v, want a header followed by sensor-1", current)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "math"
+
+// so2PPBToUGM3 converts SO2 from ppb to µg/m³ at the reference conditions of
+// ozonePPBToUGM3 and no2PPBToUGM3
+const so2PPBToUGM3 = 2.6633
+
+// daqiTable holds the highest concentration in µg/m³ of DAQI indices 1-9
+// Anything above the last value is index 10.
+type daqiTable [9]float64
+
+// DAQI index boundaries (DEFRA, 2013)
+// Source: https://uk-air.defra.gov.uk/air-pollution/daqi?view=more-info
+var (
+	daqiOzone = daqiTable{33, 66, 100, 120, 140, 160, 187, 213, 240}   // 8-hour running mean
+	daqiNO2   = daqiTable{67, 134, 200, 267, 334, 400, 467, 534, 600}  // hourly mean
+	daqiSO2   = daqiTable{88, 177, 266, 354, 443, 532, 710, 887, 1064} // 15-minute mean
+	daqiPM25  = daqiTable{11, 23, 35, 41, 47, 53, 58, 64, 70}          // 24-hour mean
+	daqiPM10  = daqiTable{16, 33, 50, 58, 66, 75, 83, 91, 100}         // 24-hour mean
+)
+
+// index returns the DAQI index (1-10) of a concentration in µg/m³
+// DEFRA publishes the boundaries as whole numbers, so the concentration is
+// rounded before the lookup.
+func (t daqiTable) index(concentration float64) int {
+	c := math.Round(concentration)
+	for i, high := range t {
+		if c <= high {
+			return i + 1
+		}
+	}
+	return 10
+}
+
+// computeDAQI calculates the UK Daily Air Quality Index
+// pm25 and pm10 are in µg/m³; the optional no2, o3 and so2 are in ppb as
+// reported by the sensor and are converted to µg/m³. The result is the
+// highest index of the pollutants present.
+func computeDAQI(pm25, pm10 float64, no2, o3, so2 *float64) int {
+	daqi := max(daqiPM25.index(pm25), daqiPM10.index(pm10))
+	if no2 != nil {
+		daqi = max(daqi, daqiNO2.index(*no2*no2PPBToUGM3))
+	}
+	if o3 != nil {
+		daqi = max(daqi, daqiOzone.index(*o3*ozonePPBToUGM3))
+	}
+	if so2 != nil {
+		daqi = max(daqi, daqiSO2.index(*so2*so2PPBToUGM3))
+	}
+	return daqi
+}
+
+// daqiBand returns the DAQI band name for an index
+func daqiBand(daqi int) string {
+	switch {
+	case daqi <= 3:
+		return "Low"
+	case daqi <= 6:
+		return "Moderate"
+	case daqi <= 9:
+		return "High"
+	default:
+		return "Very High"
+	}
+}
+
+// daqiColor returns the DEFRA color for an index
+func daqiColor(daqi int) string {
+	colors := []string{"#9CFF9C", "#31FF00", "#31CF00", "#FFFF00", "#FFCF00", "#FF9A00", "#FF6464", "#FF0000", "#990000", "#CE30FF"}
+	return colors[min(max(daqi, 1), 10)-1]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestDAQIIndex(t *testing.T) {
+	testCases := []struct {
+		name          string
+		table         daqiTable
+		concentration float64
+		expected      int
+	}{
+		{"PM2.5", daqiPM25, 0, 1},
+		{"PM2.5", daqiPM25, 11, 1},
+		{"PM2.5", daqiPM25, 11.4, 1},
+		{"PM2.5", daqiPM25, 12, 2},
+		{"PM2.5", daqiPM25, 35, 3},
+		{"PM2.5", daqiPM25, 36, 4},
+		{"PM2.5", daqiPM25, 70, 9},
+		{"PM2.5", daqiPM25, 71, 10},
+		{"PM10", daqiPM10, 50, 3},
+		{"PM10", daqiPM10, 51, 4},
+		{"PM10", daqiPM10, 101, 10},
+		{"Ozone", daqiOzone, 100, 3},
+		{"Ozone", daqiOzone, 101, 4},
+		{"NO2", daqiNO2, 200, 3},
+		{"NO2", daqiNO2, 601, 10},
+		{"SO2", daqiSO2, 266, 3},
+		{"SO2", daqiSO2, 711, 8},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s=%g", tc.name, tc.concentration), func(t *testing.T) {
+			if result := tc.table.index(tc.concentration); result != tc.expected {
+				t.Errorf("index(%g) = %d, want %d", tc.concentration, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestComputeDAQI(t *testing.T) {
+	ozone := 51.0 // 101.8 µg/m³, index 4
+	no2 := 100.0  // 191.3 µg/m³, index 3
+	so2 := 300.0  // 799.0 µg/m³, index 8
+
+	if got := computeDAQI(8, 20, nil, nil, nil); got != 2 {
+		t.Errorf("DAQI without gases = %d, want 2 from PM10", got)
+	}
+	if got := computeDAQI(8, 20, &no2, &ozone, nil); got != 4 {
+		t.Errorf("DAQI with NO2 and ozone = %d, want 4 from ozone", got)
+	}
+	if got := computeDAQI(8, 20, &no2, &ozone, &so2); got != 8 {
+		t.Errorf("DAQI with SO2 = %d, want 8 from SO2", got)
+	}
+}
+
+func TestDAQIBand(t *testing.T) {
+	for daqi, expected := range map[int]string{1: "Low", 3: "Low", 4: "Moderate", 6: "Moderate", 7: "High", 9: "High", 10: "Very High"} {
+		if result := daqiBand(daqi); result != expected {
+			t.Errorf("daqiBand(%d) = %q, want %q", daqi, result, expected)
+		}
+	}
+}
+
+// TestDAQIOutput tests that the index is published as daqi with its band
+func TestDAQIOutput(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.standard = standardDAQI
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 40, "pm10Standard": 30}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var output map[string]any
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output["daqi"] != 4.0 || output["category"] != "Moderate" || output["color"] != "#FFFF00" {
+		t.Errorf("daqi/category/color = %v/%v/%v, want 4/Moderate/#FFFF00", output["daqi"], output["category"], output["color"])
+	}
+	if _, ok := output["aqi"]; ok {
+		t.Error("Output contains aqi for the DAQI standard")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "time"
+
+// lastReading is the position in sequence of the last accepted reading from a sensor
+type lastReading struct {
+	timestamp time.Time // Payload timestamp, zero if the payload had none
+	boot      int       // AirGradient measurement counter, zero if absent
+}
+
+// bootRestartGap is how far the boot counter can fall below the last accepted
+// one for a reading to count as delivered out of order rather than as the
+// first after a sensor restart, which starts the counter over
+const bootRestartGap = 10
+
+// isDuplicate reports whether a reading is not newer than the last accepted
+// reading from the same sensor, and records it as the last one if it is newer
+// Readings are ordered by their payload timestamp when they carry one, and
+// otherwise by the boot counter, which AirGradient sensors increment with every
+// measurement. A counter far below the last one means the sensor restarted,
+// see bootRestartGap. Readings with neither are always accepted.
+func (p *processor) isDuplicate(serialNo string, payload []byte, boot int) bool {
+	seq := lastReading{boot: boot}
+	if t, ok := payloadTimestamp(payload); ok {
+		seq.timestamp = t
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last, ok := p.sequences[serialNo]
+	switch {
+	case !ok:
+	case !seq.timestamp.IsZero() && !last.timestamp.IsZero():
+		if !seq.timestamp.After(last.timestamp) {
+			return true
+		}
+	case seq.boot > 0 && last.boot > 0:
+		if seq.boot <= last.boot && last.boot-seq.boot <= bootRestartGap {
+			return true
+		}
+	}
+	p.sequences[serialNo] = seq
+	return false
+}
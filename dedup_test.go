@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+// TestDedupSamePayload sends the same payload twice and expects one output
+func TestDedupSamePayload(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.dedup = true
+	client := &fakeClient{}
+
+	msg := &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 12.0, "boot": 42}`),
+	}
+	proc.handleMessage(client, msg)
+	proc.handleMessage(client, msg)
+
+	if messages := client.messages(); len(messages) != 1 {
+		t.Errorf("Published %d messages, want 1", len(messages))
+	}
+}
+
+func TestIsDuplicate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		payloads []string
+		boots    []int
+		expected []bool
+	}{
+		{
+			"Boot counter",
+			[]string{`{}`, `{}`, `{}`},
+			[]int{10, 10, 11},
+			[]bool{false, true, false},
+		},
+		{
+			"Boot counter out of order",
+			[]string{`{}`, `{}`, `{}`, `{}`},
+			[]int{10, 12, 11, 13},
+			[]bool{false, false, true, false},
+		},
+		{
+			"Sensor restart resets the boot counter",
+			[]string{`{}`, `{}`},
+			[]int{500, 1},
+			[]bool{false, false},
+		},
+		{
+			"Payload timestamps",
+			[]string{`{"timestamp": 1700000060}`, `{"timestamp": 1700000000}`, `{"timestamp": 1700000060}`, `{"timestamp": 1700000120}`},
+			[]int{0, 0, 0, 0},
+			[]bool{false, true, true, false},
+		},
+		{
+			"No sequence",
+			[]string{`{}`, `{}`},
+			[]int{0, 0},
+			[]bool{false, false},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proc := newProcessor("aqi")
+			for i, payload := range tc.payloads {
+				if got := proc.isDuplicate("abc", []byte(payload), tc.boots[i]); got != tc.expected[i] {
+					t.Errorf("Reading %d: isDuplicate = %v, want %v", i+1, got, tc.expected[i])
+				}
+			}
+		})
+	}
+}
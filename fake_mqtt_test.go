@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is a completed MQTT token
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return t.err }
+
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// fakePublish records a single Publish call
+type fakePublish struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+}
+
+// fakeClient records published messages without a broker
+// Methods not overridden here panic through the nil embedded interface.
+type fakeClient struct {
+	mqtt.Client
+
+	// publishDelay makes Publish block, simulating a slow broker, and
+	// publishStarted, if set, is closed when the first Publish begins
+	publishDelay   time.Duration
+	publishStarted chan struct{}
+	// publishBlock, if set, makes Publish wait until it is closed
+	publishBlock chan struct{}
+	// publishErr, if set, fails every Publish without recording the message
+	publishErr error
+
+	mu           sync.Mutex
+	published    []fakePublish
+	subscribed   []string
+	unsubscribed []string
+	disconnected bool
+	// publishedAtDisconnect is the number of messages published before Disconnect
+	publishedAtDisconnect int
+	startOnce             sync.Once
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if c.publishStarted != nil {
+		c.startOnce.Do(func() { close(c.publishStarted) })
+	}
+	time.Sleep(c.publishDelay)
+	if c.publishBlock != nil {
+		<-c.publishBlock
+	}
+	if c.publishErr != nil {
+		return &fakeToken{err: c.publishErr}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+	c.published = append(c.published, fakePublish{Topic: topic, QoS: qos, Retained: retained, Payload: data})
+	return &fakeToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = append(c.subscribed, topic)
+	return &fakeToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return &fakeToken{}
+}
+
+func (c *fakeClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.disconnected
+}
+
+func (c *fakeClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnected = true
+	c.publishedAtDisconnect = len(c.published)
+}
+
+// messages returns the messages published so far
+func (c *fakeClient) messages() []fakePublish {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakePublish(nil), c.published...)
+}
+
+// fakeMessage is an incoming MQTT message
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
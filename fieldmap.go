@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseFieldMap parses a -field-map value
+// The value is either an inline comma-separated list of incoming=field pairs,
+// e.g. "pm25=pm02Standard,pm10=pm10Standard", or the path of a YAML or JSON
+// file mapping incoming keys to field names.
+func parseFieldMap(value string) (map[string]string, error) {
+	if !strings.Contains(value, "=") {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("reading field map: %w", err)
+		}
+		var m map[string]string
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("parsing field map %s: %w", value, err)
+		}
+		return m, nil
+	}
+
+	m := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid field map entry %q: must be incoming=field", pair)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// remapFields renames the top-level keys of a JSON payload according to fieldMap
+// Keys not in the map are kept as they are. A mapped key replaces any value
+// already present under the target name. Without a map the payload is
+// returned unchanged.
+func remapFields(payload []byte, fieldMap map[string]string) ([]byte, error) {
+	if len(fieldMap) == 0 {
+		return payload, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	remapped := make(map[string]json.RawMessage, len(fields))
+	for key, value := range fields {
+		if _, ok := fieldMap[key]; !ok {
+			remapped[key] = value
+		}
+	}
+	for from, to := range fieldMap {
+		if value, ok := fields[from]; ok {
+			remapped[to] = value
+		}
+	}
+	return json.Marshal(remapped)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"aqi-mqtt/aqi"
+)
+
+func TestParseFieldMap(t *testing.T) {
+	expected := map[string]string{"pm25": "pm02Standard", "pm10": "pm10Standard"}
+
+	got, err := parseFieldMap("pm25=pm02Standard, pm10=pm10Standard")
+	if err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("Inline map = %v, %v; want %v", got, err, expected)
+	}
+
+	path := filepath.Join(t.TempDir(), "fields.yaml")
+	if err := os.WriteFile(path, []byte("pm25: pm02Standard\npm10: pm10Standard\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write field map: %v", err)
+	}
+	got, err = parseFieldMap(path)
+	if err != nil || !reflect.DeepEqual(got, expected) {
+		t.Errorf("File map = %v, %v; want %v", got, err, expected)
+	}
+
+	for _, invalid := range []string{"pm25=", "=pm02Standard", "pm25=pm02Standard,pm10", filepath.Join(t.TempDir(), "missing.yaml")} {
+		if _, err := parseFieldMap(invalid); err == nil {
+			t.Errorf("parseFieldMap(%q) accepted an invalid map", invalid)
+		}
+	}
+}
+
+func TestRemapFields(t *testing.T) {
+	payload := []byte(`{"a": 1, "b": 2, "pm02Standard": 3, "c": 4}`)
+	fieldMap := map[string]string{"a": "b", "b": "a", "c": "pm02Standard"}
+
+	remapped, err := remapFields(payload, fieldMap)
+	if err != nil {
+		t.Fatalf("remapFields returned error: %v", err)
+	}
+	var got map[string]int
+	if err := json.Unmarshal(remapped, &got); err != nil {
+		t.Fatalf("Failed to parse remapped payload: %v", err)
+	}
+	// Mapped keys win over a value already under the target name
+	expected := map[string]int{"a": 2, "b": 1, "pm02Standard": 4}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("remapFields = %v, want %v", got, expected)
+	}
+
+	if _, err := remapFields([]byte(`not json`), fieldMap); err == nil {
+		t.Error("remapFields accepted an invalid payload")
+	}
+}
+
+// TestFieldMapAQI tests that a remapped payload produces the correct AQI
+func TestFieldMapAQI(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.fieldMap = map[string]string{"pm2_5": "pm02Standard", "id": "serialno"}
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "other/sensor",
+		payload: []byte(`{"id": "xyz", "pm2_5": 35.7, "pm10Standard": 45}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var output AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output.SerialNo != "xyz" || output.PM02Standard != 35.7 {
+		t.Errorf("Output serialno %q, pm02Standard %v; want xyz and 35.7", output.SerialNo, output.PM02Standard)
+	}
+	if want := aqi.ComputeAQI(35.7, 45); output.AQI != want {
+		t.Errorf("AQI = %d, want %d", output.AQI, want)
+	}
+}
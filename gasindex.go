@@ -0,0 +1,53 @@
+package main
+
+// gasIndexBand is the upper bound (inclusive) of a Sensirion gas index category
+type gasIndexBand struct {
+	max      float64
+	category string
+}
+
+// VOC index bands. The Sensirion VOC index adapts to its environment so that
+// 100 is the average of the past 24 hours; higher values mean more VOCs than
+// usual, lower values fewer.
+// Source: Sensirion, "What is Sensirion's VOC Index?" (2022)
+var vocIndexBands = []gasIndexBand{
+	{100, "Good"},
+	{250, "Elevated"},
+	{400, "High"},
+	{500, "Very High"},
+}
+
+// NOx index bands. The Sensirion NOx index is 1 in clean air and rises
+// during NOx events such as gas cooking or traffic.
+// Source: Sensirion, "What is Sensirion's NOx Index?" (2022)
+var noxIndexBands = []gasIndexBand{
+	{20, "Good"},
+	{150, "Elevated"},
+	{300, "High"},
+	{500, "Very High"},
+}
+
+// gasIndexCategory returns the category of a Sensirion gas index
+// An index of 0 means the sensor has not reported one (it is still warming
+// up, or the model lacks the sensor) and has no category.
+func gasIndexCategory(index float64, bands []gasIndexBand) string {
+	if index <= 0 {
+		return ""
+	}
+	for _, band := range bands {
+		if index <= band.max {
+			return band.category
+		}
+	}
+	return bands[len(bands)-1].category
+}
+
+// vocCategory returns the category of a Sensirion VOC index
+func vocCategory(index float64) string {
+	return gasIndexCategory(index, vocIndexBands)
+}
+
+// noxCategory returns the category of a Sensirion NOx index
+func noxCategory(index float64) string {
+	return gasIndexCategory(index, noxIndexBands)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVOCCategory(t *testing.T) {
+	testCases := []struct {
+		index    float64
+		expected string
+	}{
+		{0, ""},
+		{1, "Good"},
+		{100, "Good"},
+		{101, "Elevated"},
+		{250, "Elevated"},
+		{251, "High"},
+		{400, "High"},
+		{401, "Very High"},
+		{500, "Very High"},
+		{600, "Very High"}, // Out of range, clamped to the top band
+	}
+	for _, tc := range testCases {
+		if got := vocCategory(tc.index); got != tc.expected {
+			t.Errorf("vocCategory(%.0f) = %q, want %q", tc.index, got, tc.expected)
+		}
+	}
+}
+
+func TestNOxCategory(t *testing.T) {
+	testCases := []struct {
+		index    float64
+		expected string
+	}{
+		{0, ""},
+		{1, "Good"},
+		{20, "Good"},
+		{21, "Elevated"},
+		{150, "Elevated"},
+		{151, "High"},
+		{300, "High"},
+		{301, "Very High"},
+		{500, "Very High"},
+	}
+	for _, tc := range testCases {
+		if got := noxCategory(tc.index); got != tc.expected {
+			t.Errorf("noxCategory(%.0f) = %q, want %q", tc.index, got, tc.expected)
+		}
+	}
+}
+
+// TestGasIndexCategoryOutput tests that the categories are published alongside the indices
+func TestGasIndexCategoryOutput(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5, "tvocIndex": 180, "noxIndex": 1}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var output AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output.VOCCategory != "Elevated" || output.NOxCategory != "Good" {
+		t.Errorf("vocCategory = %q, noxCategory = %q; want Elevated and Good", output.VOCCategory, output.NOxCategory)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readyMessageMaxAge is how long readiness holds after the last processed message
+const readyMessageMaxAge = 10 * time.Minute
+
+// health tracks the state reported by the /healthz and /readyz probes
+type health struct {
+	mu          sync.Mutex
+	connected   bool
+	lastMessage time.Time // Zero until the first message is processed
+}
+
+// newHealth creates a health tracker that is not yet ready
+func newHealth() *health {
+	return &health{}
+}
+
+// setConnected records whether the MQTT client is connected
+func (h *health) setConnected(connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = connected
+}
+
+// messageProcessed records that a message was processed at time t
+func (h *health) messageProcessed(t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastMessage = t
+}
+
+// ready reports whether the client is connected and has processed a message
+// within readyMessageMaxAge of now
+func (h *health) ready(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connected && !h.lastMessage.IsZero() && now.Sub(h.lastMessage) <= readyMessageMaxAge
+}
+
+// handler returns an HTTP handler serving /healthz and /readyz
+// /healthz succeeds whenever the process is serving requests; /readyz returns
+// 503 until the client is connected and messages are flowing.
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.ready(time.Now()) {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
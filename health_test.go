@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	proc := newProcessor("aqi")
+	server := httptest.NewServer(proc.health.handler())
+	defer server.Close()
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d, want 200", code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before connecting returned %d, want 503", code)
+	}
+
+	proc.health.setConnected(true)
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before the first message returned %d, want 503", code)
+	}
+
+	proc.handleMessage(&fakeClient{}, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`),
+	})
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz after a message returned %d, want 200", code)
+	}
+
+	proc.health.setConnected(false)
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after losing the connection returned %d, want 503", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz after losing the connection returned %d, want 200", code)
+	}
+}
+
+func TestReadyStaleMessages(t *testing.T) {
+	h := newHealth()
+	h.setConnected(true)
+	now := time.Now()
+	h.messageProcessed(now.Add(-readyMessageMaxAge - time.Second))
+	if h.ready(now) {
+		t.Error("Ready although the last message is older than readyMessageMaxAge")
+	}
+}
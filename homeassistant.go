@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// haDiscoveryPrefix is Home Assistant's default MQTT discovery topic prefix,
+// the default -discovery-prefix
+const haDiscoveryPrefix = "homeassistant"
+
+// validateDiscoveryPrefix checks that a discovery prefix can be published to
+func validateDiscoveryPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("discovery prefix must not be empty")
+	}
+	if strings.ContainsAny(prefix, "+#") {
+		return fmt.Errorf("discovery prefix %q must not contain MQTT wildcards", prefix)
+	}
+	return nil
+}
+
+// Home Assistant state modes selectable with -ha-state-mode
+const (
+	haStateCombined = "combined" // Entities extract their value from the output JSON
+	haStateSplit    = "split"    // Each entity has its own scalar state topic
+)
+
+// validateHAStateMode checks that a Home Assistant state mode is supported
+func validateHAStateMode(mode string) error {
+	switch mode {
+	case haStateCombined, haStateSplit:
+		return nil
+	default:
+		return fmt.Errorf("unknown Home Assistant state mode %q: must be %q or %q", mode, haStateCombined, haStateSplit)
+	}
+}
+
+// haEntityStateTopic returns the state topic of an entity in split mode
+func haEntityStateTopic(outputTopic, objectID string) string {
+	return outputTopic + "/state/" + objectID
+}
+
+// haDevice describes the physical sensor in a discovery config
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// haSensorConfig is the discovery payload for a single sensor entity
+// See https://www.home-assistant.io/integrations/sensor.mqtt/
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template,omitempty"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	StateClass        string   `json:"state_class"`
+	Device            haDevice `json:"device"`
+}
+
+// haEntity describes how a field of the output message maps to a Home Assistant sensor
+type haEntity struct {
+	objectID    string
+	name        string
+	field       string // JSON field in AQIReading
+	deviceClass string
+	unit        string
+}
+
+// haEntities lists the sensors announced for each device
+var haEntities = []haEntity{
+	{"aqi", "AQI", "aqi", "aqi", ""},
+	{"pm25", "PM2.5", "pm02Standard", "pm25", "µg/m³"},
+	{"pm10", "PM10", "pm10Standard", "pm10", "µg/m³"},
+	{"temperature", "Temperature", "atmp", "temperature", "°C"},
+	{"humidity", "Humidity", "rhum", "humidity", "%"},
+	{"co2", "CO2", "rco2", "carbon_dioxide", "ppm"},
+}
+
+// haDiscoveryMessage is a discovery config ready to publish
+type haDiscoveryMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// discoveryMessages builds the discovery configs for the sensor that produced reading
+// In combined mode all entities read their state from the JSON on stateTopic
+// through a value_template; in split mode each reads its own scalar topic
+// below it. Temperatures are in tempUnit.
+func discoveryMessages(reading SensorReading, discoveryPrefix, stateTopic, tempUnit, mode string) ([]haDiscoveryMessage, error) {
+	device := haDevice{
+		Identifiers:  []string{reading.SerialNo},
+		Name:         fmt.Sprintf("AirGradient %s", reading.SerialNo),
+		Manufacturer: "AirGradient",
+		Model:        reading.Model,
+		SWVersion:    reading.Firmware,
+	}
+
+	messages := make([]haDiscoveryMessage, 0, len(haEntities))
+	for _, entity := range haEntities {
+		unit := entity.unit
+		if entity.deviceClass == "temperature" {
+			unit = temperatureSymbol(tempUnit)
+		}
+		config := haSensorConfig{
+			Name:              entity.name,
+			UniqueID:          fmt.Sprintf("%s_%s", reading.SerialNo, entity.objectID),
+			StateTopic:        stateTopic,
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", entity.field),
+			DeviceClass:       entity.deviceClass,
+			UnitOfMeasurement: unit,
+			StateClass:        "measurement",
+			Device:            device,
+		}
+		if mode == haStateSplit {
+			config.StateTopic = haEntityStateTopic(stateTopic, entity.objectID)
+			config.ValueTemplate = ""
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, haDiscoveryMessage{
+			Topic:   fmt.Sprintf("%s/sensor/%s/%s/config", discoveryPrefix, reading.SerialNo, entity.objectID),
+			Payload: payload,
+		})
+	}
+	return messages, nil
+}
+
+// publishDiscovery publishes retained discovery configs the first time a serial number is seen
+// stateTopic is the sensor's expanded output topic.
+func (p *processor) publishDiscovery(client mqtt.Client, reading SensorReading, stateTopic string) {
+	if reading.SerialNo == "" {
+		slog.Warn("Skipping Home Assistant discovery: reading has no serial number")
+		return
+	}
+
+	p.mu.Lock()
+	seen := p.discovered[reading.SerialNo]
+	p.discovered[reading.SerialNo] = true
+	p.mu.Unlock()
+	if seen {
+		return
+	}
+
+	messages, err := discoveryMessages(reading, p.discoveryPrefix, stateTopic, p.tempUnit, p.haStateMode)
+	if err != nil {
+		slog.Error("Error building Home Assistant discovery config", "serialno", reading.SerialNo, "error", err)
+		return
+	}
+
+	// Discovery is not retried for a serial number, so it must not be dropped
+	// by a full publish queue
+	for _, msg := range messages {
+		p.send(publishRequest{client: client, topic: msg.Topic, qos: p.discoveryQoS, retained: true, payload: msg.Payload, keep: true})
+	}
+	slog.Info("Published Home Assistant discovery config", "serialno", reading.SerialNo)
+}
+
+// publishHAStates publishes the value of each discovered entity as a retained
+// scalar on its own state topic, for -ha-state-mode split. The values are
+// taken from the output JSON so they always match the combined message.
+func (p *processor) publishHAStates(client mqtt.Client, outputTopic string, outputJSON []byte) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(outputJSON, &fields); err != nil {
+		slog.Error("Error extracting Home Assistant states", "topic", outputTopic, "error", err)
+		return
+	}
+	for _, entity := range haEntities {
+		value, ok := fields[entity.field]
+		if !ok {
+			continue
+		}
+		p.publish(client, haEntityStateTopic(outputTopic, entity.objectID), true, []byte(value))
+	}
+}
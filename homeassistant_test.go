@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiscoveryMessages(t *testing.T) {
+	reading := SensorReading{SerialNo: "d83bda1d7660", Model: "O-1PST", Firmware: "3.2.0"}
+
+	messages, err := discoveryMessages(reading, haDiscoveryPrefix, "aqi/sensor1", tempUnitCelsius, haStateCombined)
+	if err != nil {
+		t.Fatalf("discoveryMessages returned error: %v", err)
+	}
+	if len(messages) != len(haEntities) {
+		t.Fatalf("Got %d discovery messages, want %d", len(messages), len(haEntities))
+	}
+
+	for _, msg := range messages {
+		if !strings.HasPrefix(msg.Topic, "homeassistant/sensor/d83bda1d7660/") || !strings.HasSuffix(msg.Topic, "/config") {
+			t.Errorf("Unexpected discovery topic %s", msg.Topic)
+		}
+
+		var config haSensorConfig
+		if err := json.Unmarshal(msg.Payload, &config); err != nil {
+			t.Fatalf("Failed to parse discovery payload: %v", err)
+		}
+		if config.StateTopic != "aqi/sensor1" {
+			t.Errorf("%s: state_topic = %s, want aqi/sensor1", msg.Topic, config.StateTopic)
+		}
+		if config.Device.Model != "O-1PST" || config.Device.SWVersion != "3.2.0" {
+			t.Errorf("%s: device = %+v, want model and firmware from reading", msg.Topic, config.Device)
+		}
+		if len(config.Device.Identifiers) != 1 || config.Device.Identifiers[0] != "d83bda1d7660" {
+			t.Errorf("%s: device identifiers = %v", msg.Topic, config.Device.Identifiers)
+		}
+	}
+
+	var pm25 haSensorConfig
+	if err := json.Unmarshal(messages[1].Payload, &pm25); err != nil {
+		t.Fatalf("Failed to parse discovery payload: %v", err)
+	}
+	if pm25.DeviceClass != "pm25" || pm25.UnitOfMeasurement != "µg/m³" || pm25.ValueTemplate != "{{ value_json.pm02Standard }}" {
+		t.Errorf("Unexpected PM2.5 config: %+v", pm25)
+	}
+}
+
+// TestDiscoveryPublishedOnce tests that discovery is only published for new serial numbers
+func TestDiscoveryPublishedOnce(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.haDiscovery = true
+	client := &fakeClient{}
+
+	for _, serial := range []string{"sensor-a", "sensor-a", "sensor-b"} {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(`{"serialno": "` + serial + `", "pm02Standard": 10}`),
+		})
+	}
+
+	discovery := 0
+	for _, msg := range client.messages() {
+		if strings.HasPrefix(msg.Topic, "homeassistant/") {
+			discovery++
+			if !msg.Retained {
+				t.Errorf("Discovery config %s not retained", msg.Topic)
+			}
+		}
+	}
+	if want := 2 * len(haEntities); discovery != want {
+		t.Errorf("Published %d discovery configs, want %d", discovery, want)
+	}
+}
+
+// TestDiscoveryPrefixAndQoS tests that discovery config is published
+// retained under -discovery-prefix at -discovery-qos
+func TestDiscoveryPrefixAndQoS(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.HADiscovery = true
+	cfg.DiscoveryPrefix = "ha"
+	cfg.DiscoveryQoS = 2
+	cfg.TopicPrefix = "home/"
+	proc := newProcessor("aqi")
+	proc.applyConfig(cfg)
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "home/airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 10}`),
+	})
+
+	discovery := 0
+	for _, msg := range client.messages() {
+		if !strings.HasPrefix(msg.Topic, "home/ha/sensor/abc/") {
+			continue
+		}
+		discovery++
+		if !msg.Retained {
+			t.Errorf("Discovery config %s not retained", msg.Topic)
+		}
+		if msg.QoS != 2 {
+			t.Errorf("Discovery config %s QoS = %d, want 2", msg.Topic, msg.QoS)
+		}
+	}
+	if discovery != len(haEntities) {
+		t.Errorf("Published %d discovery configs under home/ha/, want %d", discovery, len(haEntities))
+	}
+}
+
+// TestDiscoveryStateTopics tests that every discovered entity's state_topic
+// (and value_template, in combined mode) points at a value that is actually
+// published
+func TestDiscoveryStateTopics(t *testing.T) {
+	for _, mode := range []string{haStateCombined, haStateSplit} {
+		t.Run(mode, func(t *testing.T) {
+			proc := newProcessor("aqi/{serialno}")
+			proc.haDiscovery = true
+			proc.haStateMode = mode
+			client := &fakeClient{}
+
+			proc.handleMessage(client, &fakeMessage{
+				topic:   "airgradient/readings",
+				payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45, "atmp": 21.5, "rhum": 40, "rco2": 612}`),
+			})
+
+			published := map[string][]byte{}
+			var configs []haSensorConfig
+			for _, msg := range client.messages() {
+				if strings.HasPrefix(msg.Topic, "homeassistant/") {
+					var config haSensorConfig
+					if err := json.Unmarshal(msg.Payload, &config); err != nil {
+						t.Fatalf("Failed to parse discovery payload: %v", err)
+					}
+					configs = append(configs, config)
+					continue
+				}
+				published[msg.Topic] = msg.Payload
+			}
+			if len(configs) != len(haEntities) {
+				t.Fatalf("Published %d discovery configs, want %d", len(configs), len(haEntities))
+			}
+
+			for _, config := range configs {
+				state, ok := published[config.StateTopic]
+				if !ok {
+					t.Errorf("%s: nothing published to state_topic %s", config.UniqueID, config.StateTopic)
+					continue
+				}
+				if mode == haStateSplit {
+					if config.ValueTemplate != "" {
+						t.Errorf("%s: value_template = %q, want none in split mode", config.UniqueID, config.ValueTemplate)
+					}
+					var value float64
+					if err := json.Unmarshal(state, &value); err != nil {
+						t.Errorf("%s: state %q is not a number", config.UniqueID, state)
+					}
+					continue
+				}
+
+				field := strings.TrimSuffix(strings.TrimPrefix(config.ValueTemplate, "{{ value_json."), " }}")
+				var fields map[string]json.RawMessage
+				if err := json.Unmarshal(state, &fields); err != nil {
+					t.Fatalf("Failed to parse state: %v", err)
+				}
+				if _, ok := fields[field]; !ok {
+					t.Errorf("%s: value_template %q refers to a field missing from %s", config.UniqueID, config.ValueTemplate, config.StateTopic)
+				}
+			}
+
+			if mode == haStateSplit {
+				if got := string(published["aqi/abc/state/pm10"]); got != "45" {
+					t.Errorf("PM10 state = %q, want 45", got)
+				}
+			}
+		})
+	}
+}
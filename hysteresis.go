@@ -0,0 +1,53 @@
+package main
+
+// epaBandUpperBounds are the highest AQI values of the EPA categories
+// AQI values above the last bound are in the Beyond Index band.
+var epaBandUpperBounds = []int{50, 100, 150, 200, 300, 500}
+
+// epaBand returns the index of the EPA category containing aqi
+func epaBand(aqi int) int {
+	for i, upper := range epaBandUpperBounds {
+		if aqi <= upper {
+			return i
+		}
+	}
+	return len(epaBandUpperBounds)
+}
+
+// epaBandAQI returns an AQI value inside band, for looking up its category and color
+func epaBandAQI(band int) int {
+	if band < len(epaBandUpperBounds) {
+		return epaBandUpperBounds[band]
+	}
+	return epaBandUpperBounds[len(epaBandUpperBounds)-1] + 1
+}
+
+// hysteresisBand returns the category band for aqi given the previous band
+// The band only changes once aqi is more than hysteresis points past the
+// boundary of the previous band, so values oscillating around a boundary keep
+// their category.
+func hysteresisBand(prev, aqi, hysteresis int) int {
+	band := epaBand(aqi)
+	switch {
+	case band > prev:
+		return max(prev, epaBand(aqi-hysteresis))
+	case band < prev:
+		return min(prev, epaBand(aqi+hysteresis))
+	default:
+		return prev
+	}
+}
+
+// categoryBand applies hysteresis to the category of a sensor's AQI and
+// records the resulting band
+func (p *processor) categoryBand(serialNo string, aqi int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	band := epaBand(aqi)
+	if prev, ok := p.bands[serialNo]; ok {
+		band = hysteresisBand(prev, aqi, p.categoryHysteresis)
+	}
+	p.bands[serialNo] = band
+	return band
+}
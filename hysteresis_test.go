@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestCategoryHysteresis oscillates the AQI around 50 and checks that the
+// category only changes once the value is far enough past the boundary
+func TestCategoryHysteresis(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.categoryHysteresis = 3
+
+	testCases := []struct {
+		aqi      int
+		expected string
+	}{
+		{48, "Good"},
+		{52, "Good"},
+		{49, "Good"},
+		{53, "Good"},
+		{54, "Moderate"},
+		{50, "Moderate"},
+		{48, "Moderate"},
+		{47, "Good"},
+		{160, "Unhealthy"},
+		{148, "Unhealthy"},
+		{146, "Unhealthy for Sensitive Groups"},
+	}
+	for i, tc := range testCases {
+		got := categoryForAQI(epaBandAQI(proc.categoryBand("abc", tc.aqi)))
+		if got != tc.expected {
+			t.Errorf("Step %d: AQI %d category = %s, want %s", i, tc.aqi, got, tc.expected)
+		}
+	}
+}
+
+// TestCategoryHysteresisPublished tests the category and color in the output
+// and that the state is kept per sensor
+func TestCategoryHysteresisPublished(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.categoryHysteresis = 5
+	client := &fakeClient{}
+
+	// PM2.5 of 11.9 and 12.3 give AQI 50 and 51
+	for _, msg := range []struct {
+		serial string
+		pm25   float64
+	}{
+		{"abc", 11.9},
+		{"abc", 12.3},
+		{"def", 12.3},
+	} {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": %q, "pm02Standard": %v}`, msg.serial, msg.pm25)),
+		})
+	}
+
+	expected := []struct{ category, color string }{
+		{"Good", "#00E400"},
+		{"Good", "#00E400"},
+		{"Moderate", "#FFFF00"},
+	}
+	messages := client.messages()
+	if len(messages) != len(expected) {
+		t.Fatalf("Published %d messages, want %d", len(messages), len(expected))
+	}
+	for i, want := range expected {
+		var output map[string]any
+		if err := json.Unmarshal(messages[i].Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		if output["category"] != want.category || output["color"] != want.color {
+			t.Errorf("Message %d: category %v color %v, want %s %s", i, output["category"], output["color"], want.category, want.color)
+		}
+	}
+}
+
+func TestHysteresisDisabled(t *testing.T) {
+	for _, aqi := range []int{50, 51, 50, 101} {
+		if got, want := hysteresisBand(epaBand(50), aqi, 0), epaBand(aqi); got != want {
+			t.Errorf("hysteresisBand(AQI %d) with zero hysteresis = %d, want %d", aqi, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "aqi-mqtt/aqi"
+
+// India National AQI breakpoints in µg/m³ (CPCB, 2014), 24-hour averages
+// CPCB leaves the Severe range open; it ends where the AQI reaches 500 in the
+// CPCB calculator, 380 µg/m³ for PM2.5 and 510 µg/m³ for PM10.
+// Source: https://app.cpcbccr.com/ccr_docs/How_AQI_calculated.pdf
+var indiaPM25Breakpoints = aqi.Table{
+	Decimals: 0,
+	Breakpoints: []aqi.AQIBreakpoint{
+		{ConcLow: 0, ConcHigh: 31, AQILow: 0, AQIHigh: 50},
+		{ConcLow: 31, ConcHigh: 61, AQILow: 51, AQIHigh: 100},
+		{ConcLow: 61, ConcHigh: 91, AQILow: 101, AQIHigh: 200},
+		{ConcLow: 91, ConcHigh: 121, AQILow: 201, AQIHigh: 300},
+		{ConcLow: 121, ConcHigh: 251, AQILow: 301, AQIHigh: 400},
+		{ConcLow: 251, ConcHigh: 381, AQILow: 401, AQIHigh: 500},
+	},
+}
+
+var indiaPM10Breakpoints = aqi.Table{
+	Decimals: 0,
+	Breakpoints: []aqi.AQIBreakpoint{
+		{ConcLow: 0, ConcHigh: 51, AQILow: 0, AQIHigh: 50},
+		{ConcLow: 51, ConcHigh: 101, AQILow: 51, AQIHigh: 100},
+		{ConcLow: 101, ConcHigh: 251, AQILow: 101, AQIHigh: 200},
+		{ConcLow: 251, ConcHigh: 351, AQILow: 201, AQIHigh: 300},
+		{ConcLow: 351, ConcHigh: 431, AQILow: 301, AQIHigh: 400},
+		{ConcLow: 431, ConcHigh: 511, AQILow: 401, AQIHigh: 500},
+	},
+}
+
+// computeIndiaAQI calculates the India National AQI from PM2.5 and PM10 in
+// µg/m³ as the higher of the two sub-indices, like the EPA AQI. Values beyond
+// the Severe range are capped at 500.
+func computeIndiaAQI(pm25, pm10 float64) int {
+	return max(aqi.CalculateAQI(pm25, indiaPM25Breakpoints), aqi.CalculateAQI(pm10, indiaPM10Breakpoints))
+}
+
+// indiaCategory returns the CPCB category label for an index value
+func indiaCategory(value int) string {
+	switch {
+	case value <= 50:
+		return "Good"
+	case value <= 100:
+		return "Satisfactory"
+	case value <= 200:
+		return "Moderate"
+	case value <= 300:
+		return "Poor"
+	case value <= 400:
+		return "Very Poor"
+	default:
+		return "Severe"
+	}
+}
+
+// indiaColor returns the CPCB category color for an index value
+func indiaColor(value int) string {
+	switch {
+	case value <= 50:
+		return "#00B050"
+	case value <= 100:
+		return "#92D050"
+	case value <= 200:
+		return "#FFFF00"
+	case value <= 300:
+		return "#FF9900"
+	case value <= 400:
+		return "#FF0000"
+	default:
+		return "#C00000"
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"aqi-mqtt/aqi"
+)
+
+func TestIndiaBreakpoints(t *testing.T) {
+	for name, table := range map[string]aqi.Table{"PM2.5": indiaPM25Breakpoints, "PM10": indiaPM10Breakpoints} {
+		if err := table.Validate(); err != nil {
+			t.Errorf("India %s table is invalid: %v", name, err)
+		}
+	}
+}
+
+func TestComputeIndiaAQI(t *testing.T) {
+	testCases := []struct {
+		pm25, pm10 float64
+		expected   int
+	}{
+		{0, 0, 0},
+		{30, 20, 50},
+		{31, 20, 51},
+		{60, 20, 100},
+		{90, 20, 200},
+		{20, 250, 200}, // PM10 dominant
+		{185.5, 100, 350},
+		{380, 100, 500},
+		{600, 100, 500}, // Capped
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("PM2.5=%g,PM10=%g", tc.pm25, tc.pm10), func(t *testing.T) {
+			if result := computeIndiaAQI(tc.pm25, tc.pm10); result != tc.expected {
+				t.Errorf("computeIndiaAQI(%g, %g) = %d, want %d", tc.pm25, tc.pm10, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestIndiaCategory(t *testing.T) {
+	for value, expected := range map[int]string{0: "Good", 50: "Good", 51: "Satisfactory", 150: "Moderate", 250: "Poor", 400: "Very Poor", 401: "Severe"} {
+		if result := indiaCategory(value); result != expected {
+			t.Errorf("indiaCategory(%d) = %q, want %q", value, result, expected)
+		}
+	}
+}
+
+// TestIndiaVersusEPA tests the same reading under both standards, whose
+// PM2.5 breakpoints differ considerably
+func TestIndiaVersusEPA(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45}`)
+	testCases := []struct {
+		standard string
+		aqi      int
+		category string
+	}{
+		{standardEPA, 101, "Unhealthy for Sensitive Groups"},
+		{standardIndia, 58, "Satisfactory"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.standard, func(t *testing.T) {
+			proc := newProcessor("aqi")
+			proc.standard = tc.standard
+			client := &fakeClient{}
+			proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+			messages := client.messages()
+			if len(messages) != 1 {
+				t.Fatalf("Published %d messages, want 1", len(messages))
+			}
+			var output AQIReading
+			if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+				t.Fatalf("Failed to parse output: %v", err)
+			}
+			if output.AQI != tc.aqi || output.Category != tc.category || output.Scale != tc.standard {
+				t.Errorf("aqi/category/scale = %d/%s/%s, want %d/%s/%s", output.AQI, output.Category, output.Scale, tc.aqi, tc.category, tc.standard)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// influxMeasurement is the InfluxDB measurement readings are written to
+const influxMeasurement = "air_quality"
+
+// influxTagEscaper escapes tag keys and values in line protocol
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// formatLineProtocol formats a reading as a single InfluxDB line protocol point
+// pm25 and pm10 are the concentrations the AQI was computed from. Tags with
+// empty values are omitted, as line protocol does not allow them.
+// See https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+func formatLineProtocol(reading AQIReading, pm25, pm10 float64, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurement)
+	for _, tag := range []struct{ key, value string }{
+		{"serialno", reading.SerialNo},
+		{"model", reading.Model},
+	} {
+		if tag.value != "" {
+			fmt.Fprintf(&b, ",%s=%s", tag.key, influxTagEscaper.Replace(tag.value))
+		}
+	}
+
+	fmt.Fprintf(&b, " aqi=%di", reading.AQI)
+	for _, field := range []struct {
+		key   string
+		value float64
+	}{
+		{"pm25", pm25},
+		{"pm10", pm10},
+		{"temp", reading.Atmp},
+		{"humidity", reading.Rhum},
+		{"co2", reading.RCO2},
+	} {
+		fmt.Fprintf(&b, ",%s=%s", field.key, strconv.FormatFloat(field.value, 'f', -1, 64))
+	}
+
+	fmt.Fprintf(&b, " %d", t.UnixNano())
+	return b.String()
+}
+
+// influxWriter writes points to the InfluxDB v2 HTTP API
+type influxWriter struct {
+	writeURL string // Full write endpoint including org, bucket and precision
+	token    string
+	client   *http.Client
+}
+
+// newInfluxWriter creates a writer for the given server URL, organization and bucket
+func newInfluxWriter(serverURL, org, bucket, token string) *influxWriter {
+	query := url.Values{}
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+	return &influxWriter{
+		writeURL: strings.TrimSuffix(serverURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:    token,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// write sends a line protocol point to InfluxDB
+func (w *influxWriter) write(line string) error {
+	req, err := http.NewRequest(http.MethodPost, w.writeURL, bytes.NewBufferString(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influxdb write failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// publishInflux sends a reading in line protocol to the -influx-topic and/or
+// the InfluxDB HTTP API, independently of the JSON output
+func (p *processor) publishInflux(client mqtt.Client, reading AQIReading, pm25, pm10 float64, t time.Time) {
+	if p.influxTopic == "" && p.influx == nil {
+		return
+	}
+
+	line := formatLineProtocol(reading, pm25, pm10, t)
+	if p.influxTopic != "" {
+		p.publish(client, p.influxTopic, false, []byte(line))
+	}
+	if p.influx != nil {
+		// Write in the background so a slow server does not stall message handling
+		influx := p.influx
+		p.goBackground(func() {
+			if err := influx.write(line); err != nil {
+				slog.Error("Error writing to InfluxDB", "serialno", reading.SerialNo, "error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFormatLineProtocol(t *testing.T) {
+	reading := AQIReading{
+		SensorReading: SensorReading{
+			SerialNo: "d83bda1d7660",
+			Model:    "O-1PST",
+			Atmp:     24.1,
+			Rhum:     45,
+			RCO2:     612,
+		},
+		AQI: 42,
+	}
+	ts := time.Unix(1700000000, 123)
+
+	got := formatLineProtocol(reading, 10.2, 12.5, ts)
+	want := "air_quality,serialno=d83bda1d7660,model=O-1PST aqi=42i,pm25=10.2,pm10=12.5,temp=24.1,humidity=45,co2=612 1700000000000000123"
+	if got != want {
+		t.Errorf("formatLineProtocol() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatLineProtocolTags(t *testing.T) {
+	reading := AQIReading{SensorReading: SensorReading{Model: "I-9PSL DIY,v2"}}
+
+	got := formatLineProtocol(reading, 0, 0, time.Unix(0, 0))
+	want := `air_quality,model=I-9PSL\ DIY\,v2 aqi=0i,pm25=0,pm10=0,temp=0,humidity=0,co2=0 0`
+	if got != want {
+		t.Errorf("formatLineProtocol() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	var gotPath, gotQuery, gotAuth, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotQuery, gotAuth, gotBody = r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w := newInfluxWriter(server.URL+"/", "home", "air", "secret")
+	if err := w.write("air_quality aqi=1i 0"); err != nil {
+		t.Fatalf("write returned error: %v", err)
+	}
+	if gotPath != "/api/v2/write" {
+		t.Errorf("Path = %s, want /api/v2/write", gotPath)
+	}
+	if gotQuery != "bucket=air&org=home&precision=ns" {
+		t.Errorf("Query = %s", gotQuery)
+	}
+	if gotAuth != "Token secret" {
+		t.Errorf("Authorization = %q, want Token secret", gotAuth)
+	}
+	if gotBody != "air_quality aqi=1i 0" {
+		t.Errorf("Body = %q", gotBody)
+	}
+}
+
+func TestInfluxWriterError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	if err := newInfluxWriter(server.URL, "home", "missing", "").write("air_quality aqi=1i 0"); err == nil {
+		t.Error("write returned nil error for a 404 response")
+	}
+}
+
+// TestInfluxTopic tests that line protocol is published alongside the JSON output
+func TestInfluxTopic(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.influxTopic = "influx/aqi"
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`),
+	})
+
+	topics := map[string]bool{}
+	for _, msg := range client.messages() {
+		topics[msg.Topic] = true
+	}
+	if !topics["aqi"] || !topics["influx/aqi"] {
+		t.Errorf("Published to %v, want aqi and influx/aqi", topics)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNewLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "info")
+	if err != nil {
+		t.Fatalf("newLogger returned error: %v", err)
+	}
+
+	logger.Debug("Hidden")
+	logger.Info("Published AQI", "serialno", "abc", "aqi", 42, "error", errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Got %d log lines, want 1 (debug should be filtered): %q", len(lines), buf.String())
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Log line is not JSON: %v", err)
+	}
+	if entry["msg"] != "Published AQI" || entry["serialno"] != "abc" || entry["aqi"] != 42.0 || entry["error"] != "boom" {
+		t.Errorf("Unexpected log entry: %v", entry)
+	}
+}
+
+func TestNewLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "text", "debug")
+	if err != nil {
+		t.Fatalf("newLogger returned error: %v", err)
+	}
+
+	logger.Debug("Processing message", "topic", "a/b")
+	if !strings.Contains(buf.String(), "level=DEBUG") || !strings.Contains(buf.String(), "topic=a/b") {
+		t.Errorf("Unexpected text log output: %q", buf.String())
+	}
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("newLogger accepted an invalid format")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "text", "verbose"); err == nil {
+		t.Error("newLogger accepted an invalid level")
+	}
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"math"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"aqi-mqtt/aqi"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -42,220 +52,1320 @@ type SensorReading struct {
 	SerialNo        string  `json:"serialno"`
 	Firmware        string  `json:"firmware"`
 	Model           string  `json:"model"`
+
+	// Ozone is an optional ozone concentration in ppb. It is not reported by
+	// AirGradient sensors, so it is nil unless the payload includes it.
+	Ozone *float64 `json:"ozone,omitempty"`
+
+	// NO2 is an optional 1-hour nitrogen dioxide concentration in ppb. Unlike
+	// NOXIndex it is an actual concentration.
+	NO2 *float64 `json:"no2,omitempty"`
+
+	// CO is an optional carbon monoxide concentration in ppm. It is unrelated
+	// to RCO2, which is carbon dioxide and has no AQI.
+	CO *float64 `json:"co,omitempty"`
+
+	// SO2 is an optional 1-hour sulphur dioxide concentration in ppb.
+	SO2 *float64 `json:"so2,omitempty"`
+
+	// noPM1, noPM25 and noPM10 are set when the reading lacks the
+	// concentration, so that it is left out of averaging and the sub-indices
+	// instead of counting as 0
+	noPM1, noPM25, noPM10 bool
 }
 
 // AQIReading extends SensorReading with AQI value
 type AQIReading struct {
 	SensorReading
-	AQI int `json:"aqi"`
+	AQI      int    `json:"aqi"`
+	Scale    string `json:"scale"` // Index standard the AQI is expressed in
+	Category string `json:"category"`
+	Color    string `json:"color"`
+
+	// Recommendation is the EPA cautionary statement for the category,
+	// only set for the EPA standard
+	Recommendation string `json:"recommendation,omitempty"`
+
+	// NowCastAQI is the AQI of the EPA NowCast PM2.5 concentration. It is
+	// omitted until enough hourly data has been buffered.
+	NowCastAQI *int `json:"nowcastAqi,omitempty"`
+
+	// Averaging is the PM averaging the AQI was computed from with
+	// -pm-averaging 24h or nowcast: "24h", "nowcast", or "instant" while
+	// the NowCast lacks data
+	Averaging string `json:"averaging,omitempty"`
+
+	// AQIInstant is the index of the instantaneous PM concentrations on the
+	// same scale as AQI, set when AQI is computed from averaged PM
+	AQIInstant *int `json:"aqiInstant,omitempty"`
+
+	// Trend is whether the AQI is rising, falling or steady compared to the
+	// sensor's recent readings, set with -trend-window
+	Trend string `json:"trend,omitempty"`
+
+	// Sub-indices of the individual pollutants; AQI is the highest of them.
+	// They are only set for the EPA standard, and the gases only when the
+	// reading includes them.
+	AQIPM25  *int `json:"aqiPm25,omitempty"`
+	AQIPM10  *int `json:"aqiPm10,omitempty"`
+	AQIOzone *int `json:"aqiOzone,omitempty"`
+	AQICO    *int `json:"aqiCo,omitempty"`
+	AQISO2   *int `json:"aqiSo2,omitempty"`
+	AQINO2   *int `json:"aqiNo2,omitempty"`
+
+	// AQIPM1Experimental is an unofficial PM1.0 sub-index, set with
+	// -experimental-pm1. It is not part of AQI.
+	AQIPM1Experimental *int `json:"aqiPm1Experimental,omitempty"`
+
+	// Categories of the Sensirion VOC and NOx indices, see gasIndexCategory.
+	// They are omitted when the sensor reports no index.
+	VOCCategory string `json:"vocCategory,omitempty"`
+	NOxCategory string `json:"noxCategory,omitempty"`
+
+	// TempUnit is set when temperatures were converted from Celsius
+	TempUnit string `json:"tempUnit,omitempty"`
+
+	// Timestamp is when the reading was taken, either when it was processed
+	// or from the payload, see -timestamp-source. ReceivedAt is when the
+	// message arrived, set only when it can differ from Timestamp.
+	Timestamp  string `json:"timestamp"`
+	ReceivedAt string `json:"receivedAt,omitempty"`
+
+	// Warnings lists implausible values found by validateReading
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Backfilled lists the pollutants missing from the reading that were
+	// filled in from earlier ones, see -backfill-max-age
+	Backfilled []string `json:"backfilled,omitempty"`
+
+	// Set by processMessage for handleMessage, not published
+	pm25, pm10 float64   // Concentrations the index was computed from
+	at         time.Time // When the reading was taken, see Timestamp
+	dominant   string    // Pollutant with the highest EPA sub-index
 }
 
 // topicConfig holds the topic configuration for reconnection
+// The topics can change when the configuration is reloaded.
 type topicConfig struct {
-	inputTopic  string
-	outputTopic string
+	mu          sync.Mutex
+	inputTopics []string
+	outputTopic string // May contain {serialno}
 }
 
-// AQI breakpoint structure for calculations
-type AQIBreakpoint struct {
-	ConcLow  float64
-	ConcHigh float64
-	AQILow   int
-	AQIHigh  int
+// get returns the current input and output topics
+func (t *topicConfig) get() ([]string, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inputTopics, t.outputTopic
 }
 
-// PM2.5 AQI breakpoints based on EPA standards
-// Source: https://www.airnow.gov/sites/default/files/2020-05/aqi-technical-assistance-document-sept2018.pdf
-var pm25Breakpoints = []AQIBreakpoint{
-	{0.0, 12.0, 0, 50},
-	{12.1, 35.4, 51, 100},
-	{35.5, 55.4, 101, 150},
-	{55.5, 150.4, 151, 200},
-	{150.5, 250.4, 201, 300},
-	{250.5, 350.4, 301, 400},
-	{350.5, 500.4, 401, 500},
+// set replaces the input and output topics
+func (t *topicConfig) set(inputTopics []string, outputTopic string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inputTopics, t.outputTopic = inputTopics, outputTopic
 }
 
-// PM10 AQI breakpoints based on EPA standards
-var pm10Breakpoints = []AQIBreakpoint{
-	{0, 54.9, 0, 50},
-	{55, 154.9, 51, 100},
-	{155, 254.9, 101, 150},
-	{255, 354.9, 151, 200},
-	{355, 424.9, 201, 300},
-	{425, 504.9, 301, 400},
-	{505, 604.9, 401, 500},
+// drainTimeout bounds how long shutdown waits for in-flight messages
+const drainTimeout = 5 * time.Second
+
+// defaultMaxPayloadBytes is the default -max-payload-bytes, generous for
+// sensor readings of a few hundred bytes
+const defaultMaxPayloadBytes = 64 << 10
+
+// processor holds state that persists across incoming messages
+type processor struct {
+	outputTopic        string         // May contain placeholders, see expandTopicTemplate
+	calc               aqi.Calculator // EPA AQI tables and options
+	experimentalPM1    bool           // Add the experimental PM1.0 sub-index
+	standard           string         // Index standard, see validateStandard
+	caqiGrid           string         // CAQI grid when standard is caqi
+	pm25Source         string         // PM2.5 field used for the index, see selectPM25
+	tempSource         string         // Temperature field published, see selectClimate
+	humiditySource     string         // Humidity field published, see selectClimate
+	pmUnit             string         // Unit of incoming PM concentrations, see normalizePM
+	pmScale            float64        // Multiplier for incoming PM concentrations
+	correction         string         // PM2.5 correction mode, see correctPM25
+	averageWindow      time.Duration  // Zero disables averaging
+	backfillMaxAge     time.Duration  // Fill in missing pollutants from readings up to this old, zero to disable
+	pmAveraging        string         // See -pm-averaging
+	outputQoS          byte           // QoS for published messages
+	maxPayloadBytes    int            // Larger input payloads are rejected unparsed, zero for no limit
+	ignoreRetained     time.Duration  // Drop retained input this long after subscribing, zero to disable
+	retain             bool           // Set the retained flag on output messages
+	messageExpiry      time.Duration  // MQTT 5 expiry of output messages, zero for none
+	pollutants         []string       // EPA sub-indices counted, all if empty
+	outputFields       []string       // JSON fields to publish, all if empty
+	roundDecimals      int            // Decimals output numbers are rounded to, -1 to disable
+	compress           bool           // Publish gzipped output to <output-topic>/gz
+	explode            bool           // Also publish scalar subtopics
+	plainTopic         string         // Topic for the AQI as a plain integer, empty to disable; may contain placeholders
+	haDiscovery        bool           // Publish Home Assistant discovery configs
+	haStateMode        string         // Where discovered entities read their state, see validateHAStateMode
+	discoveryPrefix    string         // Home Assistant discovery topic prefix, including any -topic-prefix
+	discoveryQoS       byte           // QoS of the discovery config
+	errorTopic         string         // Dead-letter topic for rejected messages, empty to drop them
+	strictValidation   bool           // Reject readings that fail validation instead of publishing them
+	dedup              bool           // Drop readings that are not newer than the last one, see isDuplicate
+	tempUnit           string         // Unit for published temperatures, see validateTempUnit
+	timestampSource    string         // Where the output timestamp comes from, see validateTimestampSource
+	throttle           *throttle      // Limits publishing per serial number, see -min-interval
+	publishOnChange    bool           // Suppress readings whose AQI matches the last published one
+	categoryHysteresis int            // AQI points past a boundary before the EPA category changes
+	influxTopic        string         // Topic for InfluxDB line protocol, empty to disable
+	influx             *influxWriter  // InfluxDB HTTP writer, nil to disable
+	webhook            *webhook       // HTTP POST of output messages, nil to disable
+	outputClient       mqtt.Client    // Client of the -output-broker, nil to disable
+	csvLog             *csvLog        // CSV file of readings, nil to disable
+	heartbeat          time.Duration  // Republish an unchanged AQI after this long, zero to never force
+	summaryTopic       string         // Topic for daily summaries, empty to disable
+	summaryLocation    *time.Location // Time zone whose midnight ends a summary day
+	staleAfter         time.Duration  // Flag sensors silent for this long as stale, zero to disable
+	alertTopic         string         // Topic for threshold alerts, empty to disable
+	alertThreshold     int            // Alert when the AQI exceeds this
+	alertHysteresis    int            // Points below alertThreshold at which an alert clears
+	trendWindow        int            // Readings the trend compares against, zero to disable
+	trendMinDelta      int            // AQI change from the recent mean that counts as rising or falling
+	clock              Clock          // Source of the current time, replaced in tests
+	metrics            *metrics
+	health             *health
+	stats              *stats
+
+	fieldMap map[string]string // Incoming JSON keys renamed before parsing, see remapFields
+
+	// Table of the experimental PM1.0 sub-index from the breakpoints file,
+	// nil to use the PM2.5 table, see pm1Index
+	pm1Breakpoints []aqi.AQIBreakpoint
+
+	// Work that drain waits for. Messages are only added to inflight under
+	// inflightMu, and not once drain has set draining.
+	inflightMu sync.Mutex
+	draining   bool           // Set by drain; messages arriving later are dropped
+	inflight   sync.WaitGroup // Messages being handled
+	background sync.WaitGroup // Goroutines started for handled messages, see goBackground
+	queue      *publishQueue  // Asynchronous publishing, nil to publish synchronously
+
+	// beforeHandle, if set, is called with each message before it is
+	// handled; tests use it to inject failures
+	beforeHandle func(msg mqtt.Message)
+
+	// configMu is held for reading while a message is handled and for
+	// writing while the settings above are replaced, see reload
+	configMu sync.RWMutex
+
+	mu         sync.Mutex
+	nowcasts   map[string]*NowCast       // Keyed by serial number
+	averages   map[string]*movingAverage // Keyed by serial number
+	discovered map[string]bool           // Serial numbers with published discovery config
+	published  map[string]publishedAQI   // Last published AQI, keyed by serial number
+	bands      map[string]int            // Last EPA category band, keyed by serial number
+	summaries  map[string]*summaryDay    // Today's readings for the daily summary, keyed by serial number
+	sequences  map[string]lastReading    // Last accepted reading, keyed by serial number, see isDuplicate
+	activity   map[string]*staleState    // Last reading for -stale-after, keyed by serial number
+	alerting   map[string]bool           // Serial numbers whose AQI is above the alert threshold
+	trends     map[string][]int          // Recent AQIs for the trend, keyed by serial number
+
+	// Last known concentrations for backfill, keyed by serial number and pollutant
+	concentrations map[string]map[string]knownConcentration
+
+	hasConnected bool      // Whether the client has connected before, see connected
+	subscribedAt time.Time // When the input topics were last subscribed to
+}
+
+// publishedAQI records the last AQI published for a sensor
+type publishedAQI struct {
+	aqi int
+	at  time.Time
 }
 
-// calculateAQI computes the Air Quality Index
-// Based on EPA formula: AQI = ((IHi - ILo) / (BPHi - BPLo)) * (Cp - BPLo) + ILo
-// Where:
-// - IHi = AQI value corresponding to BPHi
-// - ILo = AQI value corresponding to BPLo
-// - BPHi = Concentration breakpoint >= Cp
-// - BPLo = Concentration breakpoint <= Cp
-// - Cp = Pollutant concentration
-// Source: https://www.airnow.gov/sites/default/files/2020-05/aqi-technical-assistance-document-sept2018.pdf
-func calculateAQI(concentration float64, breakpoints []AQIBreakpoint) int {
-	// Truncate to one decimal place as per EPA guidelines
-	concentration = math.Floor(concentration*10) / 10
+// newProcessor creates a processor publishing to outputTopic
+func newProcessor(outputTopic string) *processor {
+	p := &processor{
+		outputTopic:     outputTopic,
+		calc:            aqi.NewCalculator(),
+		outputQoS:       1,
+		maxPayloadBytes: defaultMaxPayloadBytes,
+		standard:        standardEPA,
+		caqiGrid:        caqiGridBackground,
+		pm25Source:      pm25SourceStandard,
+		tempSource:      climateSourceRaw,
+		humiditySource:  climateSourceRaw,
+		pmUnit:          pmUnitMicrograms,
+		pmScale:         1,
+		haStateMode:     haStateCombined,
+		discoveryPrefix: haDiscoveryPrefix,
+		discoveryQoS:    1,
+		correction:      correctionNone,
+		tempUnit:        tempUnitCelsius,
+		timestampSource: timestampProcessing,
+		pmAveraging:     pmAveragingWindow,
+		roundDecimals:   -1,
+		nowcasts:        make(map[string]*NowCast),
+		averages:        make(map[string]*movingAverage),
+		discovered:      make(map[string]bool),
+		published:       make(map[string]publishedAQI),
+		bands:           make(map[string]int),
+		summaryLocation: time.Local,
+		summaries:       make(map[string]*summaryDay),
+		sequences:       make(map[string]lastReading),
+		activity:        make(map[string]*staleState),
+		alerting:        make(map[string]bool),
+		trends:          make(map[string][]int),
+		concentrations:  make(map[string]map[string]knownConcentration),
+		clock:           realClock{},
+		metrics:         newMetrics(),
+		health:          newHealth(),
+		stats:           newStats(time.Now()),
+	}
+	// Deferred publishes read the configuration like handleMessage does
+	p.throttle = newThrottle(0, p.configMu.RLocker())
+	return p
+}
 
-	for _, bp := range breakpoints {
-		if concentration >= bp.ConcLow && concentration <= bp.ConcHigh {
-			// Apply EPA AQI formula
-			aqi := ((float64(bp.AQIHigh-bp.AQILow) / (bp.ConcHigh - bp.ConcLow)) *
-				(concentration - bp.ConcLow)) + float64(bp.AQILow)
-			return int(math.Round(aqi))
+// setSubIndices copies the sub-indices of an aqi.AQIResult into the output
+func (r *AQIReading) setSubIndices(sub map[string]int) {
+	index := func(pollutant string) *int {
+		if v, ok := sub[pollutant]; ok {
+			return &v
 		}
+		return nil
 	}
+	r.AQIPM25 = index(aqi.PollutantPM25)
+	r.AQIPM10 = index(aqi.PollutantPM10)
+	r.AQIOzone = index(aqi.PollutantOzone)
+	r.AQICO = index(aqi.PollutantCO)
+	r.AQISO2 = index(aqi.PollutantSO2)
+	r.AQINO2 = index(aqi.PollutantNO2)
+}
 
-	// If concentration exceeds all breakpoints, return 500+ (hazardous)
-	return 500
+// categoryForAQI returns the EPA category label for an AQI value
+func categoryForAQI(value int) string {
+	return aqi.Category(value)
 }
 
-// computeAQI calculates AQI from PM2.5 and PM10 values
-// Returns the higher of the two AQI values as per EPA guidelines
-func computeAQI(pm25, pm10 float64) int {
-	aqiPM25 := calculateAQI(pm25, pm25Breakpoints)
-	aqiPM10 := calculateAQI(pm10, pm10Breakpoints)
+// colorForAQI returns the official EPA hex color for an AQI value
+func colorForAQI(aqi int) string {
+	switch {
+	case aqi <= 50:
+		return "#00E400" // Green
+	case aqi <= 100:
+		return "#FFFF00" // Yellow
+	case aqi <= 150:
+		return "#FF7E00" // Orange
+	case aqi <= 200:
+		return "#FF0000" // Red
+	case aqi <= 300:
+		return "#8F3F97" // Purple
+	default:
+		return "#7E0023" // Maroon
+	}
+}
 
-	// Return the maximum AQI value
-	if aqiPM25 > aqiPM10 {
-		return aqiPM25
+// recommendationForAQI returns the EPA cautionary statement for particle
+// pollution at an AQI value
+// EPA has no statement for Good, so a plain all-clear is returned instead.
+// Source: EPA Technical Assistance Document for the Reporting of Daily Air
+// Quality (2024), PM2.5 cautionary statements
+func recommendationForAQI(aqi int) string {
+	switch {
+	case aqi <= 50:
+		return "Air quality is good. No precautions are necessary."
+	case aqi <= 100:
+		return "Unusually sensitive individuals should consider limiting prolonged or heavy exertion."
+	case aqi <= 150:
+		return "People with heart or lung disease, older adults, children, and people of lower socioeconomic status should reduce prolonged or heavy exertion."
+	case aqi <= 200:
+		return "People with heart or lung disease, older adults, children, and people of lower socioeconomic status should avoid prolonged or heavy exertion; everyone else should reduce prolonged or heavy exertion."
+	case aqi <= 300:
+		return "People with heart or lung disease, older adults, children, and people of lower socioeconomic status should avoid all physical activity outdoors. Everyone else should avoid prolonged or heavy exertion."
+	default:
+		// Hazardous, and beyond the index
+		return "Everyone should avoid all physical activity outdoors; people with heart or lung disease, older adults, children, and people of lower socioeconomic status should remain indoors and keep activity levels low."
 	}
-	return aqiPM10
+}
+
+// validatePort checks that a broker port is within the valid TCP port range
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %d: must be between 1 and 65535", port)
+	}
+	return nil
+}
+
+// redactPassword masks a password for logging
+func redactPassword(password string) string {
+	if password == "" {
+		return "(none)"
+	}
+	return "********"
+}
+
+// defaultClientID is the -client-id template used unless one is configured
+const defaultClientID = "aqi-calculator-{hostname}"
+
+// expandClientID substitutes the {hostname} and {pid} placeholders in a client ID template
+func expandClientID(template, hostname string, pid int) string {
+	return strings.NewReplacer("{hostname}", hostname, "{pid}", strconv.Itoa(pid)).Replace(template)
 }
 
 func main() {
-	// Parse command-line flags
-	versionFlag := flag.Bool("version", false, "Print version information")
-	brokerHost := flag.String("broker", "", "MQTT broker hostname or IP address (required)")
-	brokerPort := flag.Int("port", 1883, "MQTT broker port (default: 1883)")
-	inputTopic := flag.String("input-topic", "", "MQTT topic to subscribe for sensor readings (required)")
-	outputTopic := flag.String("output-topic", "", "MQTT topic to publish AQI data (required)")
-	clientID := flag.String("client-id", "", "MQTT client ID (default: aqi-mqtt-<pid>)")
-	flag.Parse()
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
 
 	// Handle version flag
-	if *versionFlag {
-		fmt.Printf("AQI MQTT Daemon\n")
-		fmt.Printf("Git Commit: %s\n", GitCommit)
-		fmt.Printf("Build Time: %s\n", BuildTime)
+	if cfg.Version {
+		printVersion(os.Stdout)
 		os.Exit(0)
 	}
 
-	// Validate required flags
-	if *brokerHost == "" || *inputTopic == "" || *outputTopic == "" {
-		fmt.Fprintf(os.Stderr, "Error: Missing required flags\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s -broker <host> -input-topic <topic> -output-topic <topic> [-port <port>]\n\n", os.Args[0])
-		flag.PrintDefaults()
+	if cfg.CheckConfig {
+		os.Exit(runCheckConfig(cfg, os.Stdout, os.Stderr))
+	}
+
+	// Validate configuration
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if errors.Is(err, errMissingRequired) {
+			fmt.Fprintf(os.Stderr, "\nUsage: %s -broker <host> -input-topic <topic> -output-topic <topic> [-port <port>]\n\n", os.Args[0])
+			fs := newFlagSet(defaultConfig())
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		os.Exit(1)
+	}
+
+	// In -stdin and -replay-dir mode stdout carries the output, so log to stderr
+	logOutput := os.Stdout
+	if cfg.writesStdout() {
+		logOutput = os.Stderr
+	}
+	logger, err := newLogger(logOutput, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	slog.SetDefault(logger)
+	version, commit, buildTime := buildInfo()
+	slog.Info("Starting AQI MQTT daemon", "version", version, "commit", commit, "built", buildTime)
+
+	proc := newProcessor(cfg.OutputTopic)
+	proc.applyConfig(cfg)
+	// Set once, as the midnight flush only runs if summaries are enabled at startup
+	proc.summaryTopic = cfg.SummaryTopic
+
+	// Override the built-in breakpoint tables
+	if cfg.BreakpointsFile != "" {
+		if err := proc.applyBreakpointsFile(cfg.BreakpointsFile); err != nil {
+			fatal("Failed to load breakpoints file", "file", cfg.BreakpointsFile, "error", err)
+		}
+		slog.Info("Loaded breakpoint tables", "file", cfg.BreakpointsFile)
+	}
+
+	if cfg.CSVFile != "" {
+		csvLog, err := openCSVLog(cfg.CSVFile, cfg.CSVMaxSize)
+		if err != nil {
+			fatal("Failed to open CSV log", "file", cfg.CSVFile, "error", err)
+		}
+		proc.csvLog = csvLog
+		slog.Info("Logging readings to CSV file", "file", cfg.CSVFile)
+	}
+
+	// Process readings from stdin without connecting to a broker
+	if cfg.Stdin {
+		err := proc.runStdin(os.Stdin, os.Stdout)
+		proc.closeCSVLog()
+		if err != nil {
+			fatal("Failed to process stdin", "error", err)
+		}
+		return
+	}
+
+	// Replay captured readings to stdout without connecting to a broker
+	if cfg.ReplayDir != "" && !cfg.ReplayPublish {
+		client := &writerClient{w: os.Stdout}
+		err := proc.runReplay(client, cfg.ReplayDir, cfg.ReplaySpeed)
+		if !proc.drain(drainTimeout) {
+			slog.Warn("Timed out waiting for in-flight messages", "timeout", drainTimeout)
+		}
+		if err == nil {
+			err = client.writeErr()
+		}
+		proc.closeCSVLog()
+		if err != nil {
+			fatal("Failed to replay readings", "dir", cfg.ReplayDir, "error", err)
+		}
+		return
+	}
+
+	// Carry on from the state saved by the previous run
+	if cfg.StateFile != "" {
+		proc.loadState(cfg.StateFile)
+	}
+	if cfg.PublishBuffer > 0 {
+		proc.startPublishQueue(cfg.PublishBuffer)
+	}
 
 	// MQTT configuration
-	broker := fmt.Sprintf("tcp://%s:%d", *brokerHost, *brokerPort)
+	broker := brokerURL(cfg.Transport, cfg.Broker, cfg.Port, cfg.WSPath, cfg.TLS)
 
-	// Generate unique client ID if not provided
-	if *clientID == "" {
-		*clientID = fmt.Sprintf("aqi-mqtt-%d", os.Getpid())
+	// Expand the client ID placeholders so that instances on different hosts
+	// do not take over each other's connection
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = defaultClientID
 	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("Failed to get hostname for the client ID", "error", err)
+		hostname = "unknown"
+	}
+	clientID = expandClientID(clientID, hostname, os.Getpid())
+
+	if (cfg.Username == "") != (cfg.Password == "") {
+		slog.Warn("Only one of username and password is set; both are usually required")
+	}
+
+	slog.Info("Starting AQI MQTT daemon", "broker", broker, "client_id", clientID,
+		"username", cfg.Username, "password", redactPassword(cfg.Password))
 
 	// Create channels for topic info
 	topicInfo := &topicConfig{
-		inputTopic:  *inputTopic,
-		outputTopic: *outputTopic,
+		inputTopics: cfg.InputTopics,
+		outputTopic: cfg.OutputTopic,
 	}
 
 	// Configure MQTT client options
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
-	opts.SetClientID(*clientID)
-	opts.SetKeepAlive(30 * time.Second)
-	opts.SetPingTimeout(10 * time.Second)
-	opts.SetConnectTimeout(30 * time.Second)
+	opts.SetClientID(clientID)
+	if cfg.Username != "" {
+		opts.SetUsername(cfg.Username)
+	}
+	if cfg.Password != "" {
+		opts.SetPassword(cfg.Password)
+	}
+	if usesTLS(cfg.Transport, cfg.TLS) {
+		tlsConfig, err := newTLSConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.InsecureSkipVerify)
+		if err != nil {
+			fatal("Failed to configure TLS", "error", err)
+		}
+		if cfg.InsecureSkipVerify {
+			slog.Warn("Broker certificate verification is disabled")
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	setConnectionTimeouts(opts, cfg)
+	setSession(opts, cfg)
+	if cfg.StatusTopic != "" {
+		setStatusWill(opts, cfg.StatusTopic)
+	}
+	// Reconnect with exponential backoff capped at reconnectMaxInterval; the
+	// initial connection is retried by connectWithRetry
 	opts.SetAutoReconnect(true)
-	opts.SetMaxReconnectInterval(1 * time.Minute)
+	opts.SetMaxReconnectInterval(cfg.ReconnectMaxInterval)
 	opts.SetDefaultPublishHandler(messageHandler)
+	opts.SetConnectionAttemptHandler(func(brokerURL *url.URL, tlsCfg *tls.Config) *tls.Config {
+		slog.Info("Connecting to MQTT broker", "broker", brokerURL.String())
+		return tlsCfg
+	})
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		log.Printf("Connection lost: %v. Will attempt to reconnect automatically.", err)
+		proc.connectionLost()
+		slog.Warn("Connection lost, will attempt to reconnect automatically", "error", err)
 	})
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		log.Printf("Connected/Reconnected to MQTT broker at %s", broker)
-		// Re-subscribe to topics after reconnection
-		if token := client.Subscribe(topicInfo.inputTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
-			handleMessage(client, msg, topicInfo.outputTopic)
-		}); token.Wait() && token.Error() != nil {
-			log.Printf("Failed to subscribe to topic %s: %v", topicInfo.inputTopic, token.Error())
-		} else {
-			log.Printf("Subscribed to topic: %s", topicInfo.inputTopic)
-			log.Printf("Publishing AQI data to topic: %s", topicInfo.outputTopic)
+		slog.Info("Connected to MQTT broker", "broker", broker, "client_id", clientID)
+		slog.Info("MQTT connection settings", connectionSettings(client)...)
+		proc.connected()
+		// Subscriptions are not kept across reconnects with a clean session,
+		// so subscribe again every time the connection is established;
+		// subscribing again to a persistent session is harmless
+		inputTopics, outputTopic := topicInfo.get()
+		proc.markSubscribed()
+		subscribe(client, inputTopics, byte(cfg.InputQoS), proc.handleMessage)
+		slog.Info("Publishing AQI data", "topic", outputTopic)
+
+		// Announce availability, replacing the retained Last Will
+		if cfg.StatusTopic != "" {
+			if err := publishStatus(client, cfg.StatusTopic, statusOnline); err != nil {
+				slog.Error("Failed to publish status", "topic", cfg.StatusTopic, "error", err)
+			}
 		}
 	})
 
+	// Start the metrics endpoint
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", proc.metrics.handler())
+		metricsServer = startHTTPServer(cfg.MetricsAddr, mux)
+		slog.Info("Serving Prometheus metrics", "addr", cfg.MetricsAddr, "path", "/metrics")
+	}
+
+	// Start the health check endpoints
+	var healthServer *http.Server
+	if cfg.HealthAddr != "" {
+		healthServer = startHTTPServer(cfg.HealthAddr, proc.health.handler())
+		slog.Info("Serving health checks", "addr", cfg.HealthAddr, "paths", "/healthz, /readyz")
+	}
+
 	// Create MQTT client
-	client := mqtt.NewClient(opts)
+	protocol, _ := protocolVersion(cfg.MQTTVersion) // Checked by validate
+	client := newMQTTClient(opts, protocol)
 
-	// Connect to MQTT broker
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+	// Connect to the optional second broker for output; failures there are
+	// logged but do not stop the daemon
+	if cfg.OutputBroker != "" {
+		outputOpts, err := outputBrokerOptions(cfg, clientID)
+		if err != nil {
+			fatal("Failed to configure output broker", "error", err)
+		}
+		proc.outputClient = mqtt.NewClient(outputOpts)
+		slog.Info("Also publishing to output broker", "broker", cfg.OutputBroker,
+			"username", cfg.OutputUsername, "password", redactPassword(cfg.OutputPassword))
+		connectOutputBroker(proc.outputClient, cfg.OutputBroker, cfg.ReconnectMaxInterval)
+	}
+
+	// Reload the configuration file on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	r := &reloader{
+		args:     os.Args[1:],
+		cfg:      cfg,
+		proc:     proc,
+		topics:   topicInfo,
+		client:   client,
+		inputQoS: byte(cfg.InputQoS),
+	}
+	go r.run(hupChan)
+
+	// Background loops, stopped on shutdown
+	stop := make(chan struct{})
+	if cfg.StatsInterval > 0 {
+		go proc.stats.logStats(cfg.StatsInterval, stop)
+	}
+	if cfg.SummaryTopic != "" {
+		go proc.runSummaries(client, stop)
+	}
+	if cfg.HTTPPollURL != "" {
+		go proc.runHTTPPoll(client, cfg.HTTPPollURL, cfg.PollInterval, stop)
+	}
+	if cfg.StaleAfter > 0 {
+		proc.staleAfter = cfg.StaleAfter
+		go proc.runStaleWatchdog(client, stop)
+	}
+	if cfg.StateFile != "" {
+		go proc.runStateSaver(cfg.StateFile, cfg.StateInterval, stop)
+	}
+	if proc.csvLog != nil {
+		go proc.csvLog.run(csvFlushInterval, stop)
+	}
+	if cfg.HeartbeatInterval > 0 {
+		go proc.runAvailability(client, cfg.AvailabilityTopic, cfg.HeartbeatInterval, stop)
 	}
 
-	// Wait for interrupt signal to gracefully shutdown
+	// Wait for interrupt signal to gracefully shutdown, including while
+	// the initial connection is still being retried
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	replayDone := make(chan struct{})
 
-	log.Println("Shutting down...")
+	// Connect to MQTT broker in the background, retrying until the broker
+	// is up or -connect-retries attempts have failed
+	go func() {
+		connect := func() error {
+			token := client.Connect()
+			token.Wait()
+			return token.Error()
+		}
+		maxInterval := min(connectRetryInterval, cfg.ReconnectMaxInterval)
+		if err := connectWithRetry(connect, cfg.ConnectRetries, connectRetryInitial, maxInterval); err != nil {
+			fatal("Failed to connect to MQTT broker", "broker", broker, "error", err)
+		}
 
-	// Unsubscribe and disconnect
-	client.Unsubscribe(topicInfo.inputTopic)
-	client.Disconnect(250)
+		// With -replay-publish, shut down once the replay is published
+		if cfg.ReplayDir != "" {
+			if err := proc.runReplay(client, cfg.ReplayDir, cfg.ReplaySpeed); err != nil {
+				slog.Error("Failed to replay readings", "dir", cfg.ReplayDir, "error", err)
+			}
+			close(replayDone)
+		}
+	}()
+
+	select {
+	case <-sigChan:
+	case <-replayDone:
+	}
+
+	slog.Info("Shutting down...")
+
+	close(stop)
+	inputTopics, _ := topicInfo.get()
+	shutdownMQTT(client, proc, inputTopics, cfg.StatusTopic)
+	if proc.outputClient != nil {
+		proc.outputClient.Disconnect(250)
+	}
+	proc.closeCSVLog()
+	if cfg.StateFile != "" {
+		if err := proc.saveState(cfg.StateFile, time.Now()); err != nil {
+			slog.Error("Failed to save state", "file", cfg.StateFile, "error", err)
+		}
+	}
+	if cfg.StatsInterval > 0 {
+		slog.Info("Statistics", proc.stats.summary(time.Now())...)
+	}
+
+	if metricsServer != nil {
+		shutdownHTTPServer(metricsServer)
+	}
+	if healthServer != nil {
+		shutdownHTTPServer(healthServer)
+	}
 
-	log.Println("Shutdown complete")
+	slog.Info("Shutdown complete")
+}
+
+// subscribe subscribes handler to each topic, logging the outcome
+func subscribe(client mqtt.Client, topics []string, qos byte, handler mqtt.MessageHandler) {
+	for _, topic := range topics {
+		if token := client.Subscribe(topic, qos, handler); token.Wait() && token.Error() != nil {
+			slog.Error("Failed to subscribe", "topic", topic, "error", token.Error())
+		} else {
+			slog.Info("Subscribed to topic", "topic", topic)
+		}
+	}
+}
+
+// shutdownMQTT stops receiving messages, lets in-flight messages finish
+// publishing, and disconnects from the broker
+func shutdownMQTT(client mqtt.Client, proc *processor, inputTopics []string, statusTopic string) {
+	if len(inputTopics) > 0 {
+		client.Unsubscribe(inputTopics...)
+	}
+	if !proc.drain(drainTimeout) {
+		slog.Warn("Timed out waiting for in-flight messages", "timeout", drainTimeout)
+	}
+
+	// The Last Will is not sent on a clean disconnect, so publish it ourselves
+	if statusTopic != "" && client.IsConnected() {
+		if err := publishStatus(client, statusTopic, statusOffline); err != nil {
+			slog.Error("Failed to publish status", "topic", statusTopic, "error", err)
+		}
+	}
+	client.Disconnect(250)
 }
 
 func messageHandler(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("Received message on topic %s: %s", msg.Topic(), msg.Payload())
+	slog.Info("Received message", "topic", msg.Topic(), "payload", string(msg.Payload()))
 }
 
 func connectionLostHandler(client mqtt.Client, err error) {
-	log.Printf("Connection lost: %v", err)
+	slog.Warn("Connection lost", "error", err)
 }
 
-func handleMessage(client mqtt.Client, msg mqtt.Message, outputTopic string) {
-	log.Printf("Processing message from topic: %s", msg.Topic())
+// nowCast adds a PM2.5 concentration to the sensor's NowCast buffer and
+// returns the NowCast concentration
+// ok is false if there is not enough data yet.
+func (p *processor) nowCast(serialNo string, t time.Time, pm25 float64) (concentration float64, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	// Parse JSON message
-	var reading SensorReading
-	if err := json.Unmarshal(msg.Payload(), &reading); err != nil {
-		log.Printf("Error parsing JSON: %v", err)
+	nc, ok := p.nowcasts[serialNo]
+	if !ok {
+		nc = NewNowCast()
+		p.nowcasts[serialNo] = nc
+	}
+	nc.Add(t, pm25)
+	return nc.Value(t)
+}
+
+// valueOrZero returns the value of an optional concentration, or zero if absent
+func valueOrZero(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// applyConfig copies the processing settings from cfg
+func (p *processor) applyConfig(cfg *Config) {
+	p.calc = newCalculator(cfg.PM25Revision, cfg.ExtendedAQI, cfg.AQIRounding)
+	p.experimentalPM1 = cfg.ExperimentalPM1
+	p.pm1Breakpoints = nil // Set again by applyBreakpoints
+	p.outputTopic = cfg.OutputTopic
+	p.standard = cfg.Standard
+	p.caqiGrid = cfg.CAQIGrid
+	p.fieldMap = cfg.FieldMap
+	p.pm25Source = cfg.PM25Source
+	p.tempSource = cfg.TempSource
+	p.humiditySource = cfg.HumiditySource
+	p.outputFields = cfg.OutputFields
+	p.roundDecimals = cfg.RoundDecimals
+	p.compress = cfg.Compress
+	p.pollutants = cfg.Pollutants
+	p.pmUnit = cfg.PMUnit
+	p.pmScale = cfg.PMScale
+	p.correction = cfg.Correction
+	p.pmAveraging = cfg.PMAveraging
+	p.averageWindow = cfg.AverageWindow
+	p.backfillMaxAge = cfg.BackfillMaxAge
+	if cfg.PMAveraging == pmAveraging24h {
+		p.averageWindow = 24 * time.Hour
+	}
+	p.outputQoS = byte(cfg.OutputQoS)
+	p.maxPayloadBytes = cfg.MaxPayloadBytes
+	p.ignoreRetained = cfg.IgnoreRetainedInput
+	p.retain = cfg.Retain
+	p.messageExpiry = cfg.MessageExpiry
+	p.explode = cfg.Explode
+	p.plainTopic = cfg.PlainTopic
+	p.haDiscovery = cfg.HADiscovery
+	p.haStateMode = cfg.HAStateMode
+	p.discoveryPrefix = prefixTopic(cfg.TopicPrefix, cfg.DiscoveryPrefix)
+	p.discoveryQoS = byte(cfg.DiscoveryQoS)
+	p.errorTopic = cfg.ErrorTopic
+	p.strictValidation = cfg.StrictValidation
+	p.dedup = cfg.Dedup
+	p.tempUnit = cfg.TempUnit
+	p.timestampSource = cfg.TimestampSource
+	p.throttle.setInterval(cfg.MinInterval)
+	p.publishOnChange = cfg.PublishOnChange
+	p.heartbeat = cfg.Heartbeat
+	p.categoryHysteresis = cfg.CategoryHysteresis
+	p.alertTopic = cfg.AlertTopic
+	p.alertThreshold = cfg.AlertThreshold
+	p.alertHysteresis = cfg.AlertHysteresis
+	p.trendWindow = cfg.TrendWindow
+	p.trendMinDelta = cfg.TrendMinDelta
+	p.summaryLocation, _ = time.LoadLocation(cfg.SummaryTimezone) // Checked by validate
+	p.influxTopic = cfg.InfluxTopic
+	p.influx = nil
+	if cfg.InfluxURL != "" {
+		p.influx = newInfluxWriter(cfg.InfluxURL, cfg.InfluxOrg, cfg.InfluxBucket, cfg.InfluxToken)
+	}
+	p.webhook = nil
+	if cfg.WebhookURL != "" {
+		p.webhook = newWebhook(cfg.WebhookURL)
+	}
+
+	// Averages already being collected switch to the new window
+	p.mu.Lock()
+	for _, avg := range p.averages {
+		avg.window = p.averageWindow
+	}
+	p.mu.Unlock()
+}
+
+// changed reports whether aqi should be published for a sensor in
+// -publish-on-change mode, and records it as published if so
+// An unchanged AQI is published again once the heartbeat has elapsed.
+func (p *processor) changed(serialNo string, aqi int, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	last, ok := p.published[serialNo]
+	if ok && last.aqi == aqi && (p.heartbeat <= 0 || now.Sub(last.at) < p.heartbeat) {
+		return false
+	}
+	p.published[serialNo] = publishedAQI{aqi: aqi, at: now}
+	return true
+}
+
+// drain stops handling new messages and waits, up to timeout, for those
+// being handled to finish
+// Publishes deferred by -min-interval are then made without waiting for the
+// interval, and drain waits for them, for the background work of the handled
+// messages, and for the publish queue to empty, after which publishing is
+// synchronous. It returns false if the
+// timeout expired first.
+func (p *processor) drain(timeout time.Duration) bool {
+	p.inflightMu.Lock()
+	p.draining = true
+	p.inflightMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		p.throttle.flushAll()
+		p.background.Wait()
+		if p.queue != nil {
+			p.queue.close()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// average adds PM readings to the sensor's moving average and returns the
+// averaged concentrations
+// A nil concentration is missing from the reading and not averaged.
+func (p *processor) average(serialNo string, t time.Time, pm25, pm10 *float64) (float64, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	avg, ok := p.averages[serialNo]
+	if !ok {
+		avg = newMovingAverage(p.averageWindow)
+		p.averages[serialNo] = avg
+	}
+	return avg.Add(t, pm25, pm10)
+}
+
+// Errors returned by processMessage and publishReading, to be checked with
+// errors.Is
+var (
+	ErrParse      = errors.New("parsing JSON")
+	ErrValidation = errors.New("validation failed")
+	ErrPublish    = errors.New("publishing failed")
+)
+
+// errDropped is returned by processMessage for readings that are dropped
+// without being an error, such as duplicates. The reason is already logged.
+var errDropped = errors.New("reading dropped")
+
+// startHandling adds a message to those drain waits for, returning false
+// once the daemon is shutting down
+func (p *processor) startHandling() bool {
+	p.inflightMu.Lock()
+	defer p.inflightMu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.inflight.Add(1)
+	return true
+}
+
+// goBackground runs fn in a goroutine that drain waits for
+// It must be called while handling a message, or from a call deferred by the
+// throttle, so that drain is still waiting for those.
+func (p *processor) goBackground(fn func()) {
+	p.background.Add(1)
+	go func() {
+		defer p.background.Done()
+		fn()
+	}()
+}
+
+// handleMessage processes a sensor reading and publishes its AQI
+func (p *processor) handleMessage(client mqtt.Client, msg mqtt.Message) {
+	if !p.startHandling() {
+		slog.Warn("Shutting down, dropping message", "topic", msg.Topic())
 		return
 	}
+	defer p.inflight.Done()
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	defer p.recoverPanic(msg)
 
-	// Calculate AQI using PM2.5 and PM10 values
-	// Using the standard values as they represent ambient conditions
-	aqi := computeAQI(reading.PM02Standard, reading.PM10Standard)
+	now := p.clock.Now()
+	slog.Debug("Processing message", "topic", msg.Topic())
+	p.metrics.messagesReceived.Inc()
+	p.stats.messageReceived()
+	if p.beforeHandle != nil {
+		p.beforeHandle(msg)
+	}
 
-	// Create output message with AQI
+	// The broker sends the retained reading of each topic on subscribing,
+	// which may be hours old
+	if msg.Retained() && p.ignoringRetained(now) {
+		slog.Info("Ignoring retained input message", "topic", msg.Topic())
+		return
+	}
+
+	// Reject oversized payloads before json.Unmarshal allocates for them
+	if p.maxPayloadBytes > 0 && len(msg.Payload()) > p.maxPayloadBytes {
+		slog.Error("Payload too large, not parsing", "topic", msg.Topic(), "bytes", len(msg.Payload()), "limit", p.maxPayloadBytes)
+		p.metrics.oversized.Inc()
+		return
+	}
+
+	aqiReading, err := p.process(msg.Payload(), now)
+	switch {
+	case errors.Is(err, ErrParse):
+		slog.Error("Error parsing JSON", "topic", msg.Topic(), "error", err)
+		p.metrics.parseErrors.Inc()
+		p.stats.parseError()
+		p.deadLetter(client, msg.Payload(), err)
+		return
+	case errors.Is(err, ErrValidation):
+		p.deadLetter(client, msg.Payload(), err)
+		return
+	case err != nil:
+		return
+	}
+	serialNo := aqiReading.SerialNo
+	outputTopic := expandTopicTemplate(p.outputTopic, aqiReading)
+
+	if p.staleAfter > 0 {
+		p.markSeen(client, serialNo, outputTopic, now)
+	}
+	if p.haDiscovery {
+		p.publishDiscovery(client, aqiReading.SensorReading, outputTopic)
+	}
+	if p.summaryTopic != "" && p.standard == standardEPA {
+		p.recordSummary(client, serialNo, aqiReading.at, aqiReading.AQI, aqiReading.dominant)
+	}
+	if p.alertTopic != "" {
+		p.checkAlert(client, serialNo, aqiReading.AQI, aqiReading.at)
+	}
+
+	p.publishInflux(client, aqiReading, aqiReading.pm25, aqiReading.pm10, aqiReading.at)
+	if p.csvLog != nil {
+		p.csvLog.write(aqiReading, aqiReading.pm25, aqiReading.pm10)
+	}
+
+	// Marshal to JSON
+	outputJSON, err := marshalOutput(aqiReading, p.standard)
+	if err == nil && p.roundDecimals >= 0 {
+		outputJSON, err = roundOutputNumbers(outputJSON, p.roundDecimals)
+	}
+	var selectedJSON []byte
+	if err == nil {
+		selectedJSON, err = selectOutputFields(outputJSON, p.outputFields)
+	}
+	if err != nil {
+		slog.Error("Error marshaling output JSON", "serialno", serialNo, "error", err)
+		return
+	}
+
+	// Publish to output topic, at most once per -min-interval for each sensor
+	// The time a publish is deferred for is not part of the latency.
+	processing := p.clock.Now().Sub(now)
+	publishTopic, publishPayload := outputTopic, selectedJSON
+	if p.compress {
+		publishTopic += compressedTopicSuffix
+		if publishPayload, err = gzipPayload(selectedJSON); err != nil {
+			slog.Error("Error compressing output", "serialno", serialNo, "error", err)
+			return
+		}
+	}
+	p.throttle.Do(serialNo, now, func() {
+		if p.publishOnChange && !p.changed(serialNo, aqiReading.AQI, now) {
+			slog.Debug("Skipping unchanged AQI", "serialno", serialNo, "aqi", aqiReading.AQI)
+			return
+		}
+
+		client := p.readingClient(client, aqiReading.SensorReading)
+		start := p.clock.Now()
+		if err := p.publishReading(client, publishTopic, publishPayload); err == nil {
+			latency := processing + p.clock.Now().Sub(start)
+			p.metrics.processing.Observe(latency.Seconds())
+			slog.Debug("Processed message", "serialno", serialNo, "latency", latency)
+			if p.standard == standardAQHI {
+				slog.Info("Published AQHI", "serialno", serialNo, "aqhi", formatAQHI(aqiReading.AQI), "topic", publishTopic)
+			} else {
+				slog.Info("Published AQI", "serialno", serialNo, "aqi", aqiReading.AQI, "scale", p.standard, "topic", publishTopic)
+			}
+		}
+		p.publishOutputBroker(publishTopic, p.retain, publishPayload)
+		p.sendWebhook(serialNo, selectedJSON)
+
+		if p.explode {
+			p.publishExploded(client, outputTopic, aqiReading, aqiReading.pm25, aqiReading.pm10)
+		}
+		if p.plainTopic != "" {
+			p.publish(client, expandTopicTemplate(p.plainTopic, aqiReading), true, strconv.Itoa(aqiReading.AQI))
+		}
+		if p.haDiscovery && p.haStateMode == haStateSplit {
+			p.publishHAStates(client, outputTopic, outputJSON)
+		}
+	})
+}
+
+// processMessage parses a sensor reading received now and computes its index,
+// without publishing anything
+// Errors wrap ErrParse for payloads that cannot be parsed and ErrValidation
+// for readings rejected by -strict-validation.
+//
+// It is not free of side effects: like a received reading, it updates the
+// per-sensor state (averages, NowCast, deduplication, backfill, trends and
+// category hysteresis), the health status and the metrics. Call it once per
+// reading; processing the same reading twice counts it twice.
+func (p *processor) processMessage(payload []byte) (AQIReading, error) {
+	return p.process(payload, p.clock.Now())
+}
+
+// process is processMessage for a reading received at now
+func (p *processor) process(payload []byte, now time.Time) (AQIReading, error) {
+	// Parse JSON message, renaming fields of non-AirGradient sensors first
+	payload, err := remapFields(payload, p.fieldMap)
+	var reading SensorReading
+	if err == nil {
+		err = json.Unmarshal(payload, &reading)
+	}
+	if err != nil {
+		return AQIReading{}, fmt.Errorf("%w: %w", ErrParse, err)
+	}
+	p.health.messageProcessed(now)
+
+	// -pollutants only selects among the EPA sub-indices
+	var selected []string
+	if p.standard == standardEPA {
+		selected = p.pollutants
+	}
+	if !hasPollutantData(payload, reading, p.pm25Source, selected) {
+		slog.Warn("Reading has no pollutant data, not publishing", "serialno", reading.SerialNo)
+		return AQIReading{}, errDropped
+	}
+
+	// Drop redeliveries and readings older than the last one from the sensor
+	if p.dedup && p.isDuplicate(reading.SerialNo, payload, reading.Boot) {
+		slog.Debug("Dropping duplicate or out-of-order reading", "serialno", reading.SerialNo, "boot", reading.Boot)
+		p.metrics.duplicates.Inc()
+		return AQIReading{}, errDropped
+	}
+
+	// The breakpoints assume µg/m³
+	normalizePM(&reading, p.pmUnit, p.pmScale)
+
+	pm25, fellBack := selectPM25(p.pm25Source, reading)
+	if fellBack {
+		slog.Warn("No compensated PM2.5 in reading, using standard value", "serialno", reading.SerialNo)
+	}
+	reading.noPM1, reading.noPM25, reading.noPM10 = missingPM(payload, p.pm25Source)
+	var backfilled []string
+	if p.backfillMaxAge > 0 {
+		backfilled = p.backfill(payload, &reading, &pm25, now)
+		reading.noPM25 = reading.noPM25 && !slices.Contains(backfilled, backfillPM25)
+		reading.noPM10 = reading.noPM10 && !slices.Contains(backfilled, backfillPM10)
+	}
+	if missing := selectClimate(payload, &reading, p.tempSource, p.humiditySource); len(missing) > 0 {
+		slog.Warn("No compensated value in reading, using raw value", "serialno", reading.SerialNo, "fields", missing)
+	}
+	if p.correction != correctionNone && !reading.noPM25 {
+		pm25 = correctPM25(p.correction, pm25, reading.Rhum)
+		reading.PM02Compensated = pm25
+	}
+
+	warnings := validateReading(reading)
+	if len(warnings) > 0 {
+		slog.Warn("Reading failed validation", "serialno", reading.SerialNo, "warnings", warnings)
+		if p.strictValidation {
+			return AQIReading{}, fmt.Errorf("%w: %s", ErrValidation, strings.Join(warnings, "; "))
+		}
+	}
+
+	// Create output message with the index on the selected scale
 	aqiReading := AQIReading{
 		SensorReading: reading,
-		AQI:           aqi,
+		Scale:         p.standard,
+		VOCCategory:   vocCategory(reading.TVOCIndex),
+		NOxCategory:   noxCategory(reading.NOXIndex),
+		Timestamp:     formatTimestamp(now),
+		Warnings:      warnings,
+		Backfilled:    backfilled,
+	}
+	timestamp := now
+	if p.timestampSource == timestampPayload {
+		if t, ok := payloadTimestamp(payload); ok {
+			timestamp = t
+		} else {
+			slog.Debug("No timestamp in payload, using processing time", "serialno", reading.SerialNo)
+		}
+		aqiReading.Timestamp = formatTimestamp(timestamp)
+		aqiReading.ReceivedAt = formatTimestamp(now)
 	}
+	aqiReading.at = timestamp
 
-	// Marshal to JSON
-	outputJSON, err := json.Marshal(aqiReading)
+	// Averages follow the reading's timestamp, so replayed data with payload
+	// timestamps is averaged over the time it was measured
+	present := func(v float64, missing bool) *float64 {
+		if missing {
+			return nil
+		}
+		return &v
+	}
+	avgPM25, avgPM10 := p.average(reading.SerialNo, timestamp, present(pm25, reading.noPM25), present(reading.PM10Standard, reading.noPM10))
+	var nowCastPM25 float64
+	var nowCastOK bool
+	if !reading.noPM25 {
+		nowCastPM25, nowCastOK = p.nowCast(reading.SerialNo, timestamp, pm25)
+	}
+	switch p.pmAveraging {
+	case pmAveraging24h:
+		aqiReading.Averaging = pmAveraging24h
+	case pmAveragingNowCast:
+		aqiReading.Averaging = pmAveragingInstant
+		if nowCastOK {
+			avgPM25 = nowCastPM25
+			aqiReading.Averaging = pmAveragingNowCast
+		}
+	}
+	aqiReading.pm25, aqiReading.pm10 = avgPM25, avgPM10
+	if p.averageWindow > 0 || p.pmAveraging == pmAveragingNowCast {
+		instant := p.index(reading, pm25, reading.PM10Standard)
+		aqiReading.AQIInstant = &instant
+	}
+	switch p.standard {
+	case standardAQHI:
+		// The AQHI requires all three pollutants; missing ones contribute nothing
+		aqhi := computeAQHI(valueOrZero(reading.NO2), valueOrZero(reading.Ozone), avgPM25)
+		aqiReading.AQI = aqhi
+		aqiReading.Category = aqhiCategory(aqhi)
+	case standardCAQI:
+		caqi := computeCAQI(avgPM25, avgPM10, reading.NO2, reading.Ozone, p.caqiGrid)
+		aqiReading.AQI = caqi
+		aqiReading.Category = caqiCategory(caqi)
+		aqiReading.Color = caqiColor(caqi)
+	case standardDAQI:
+		daqi := computeDAQI(avgPM25, avgPM10, reading.NO2, reading.Ozone, reading.SO2)
+		aqiReading.AQI = daqi
+		aqiReading.Category = daqiBand(daqi)
+		aqiReading.Color = daqiColor(daqi)
+	case standardIndia:
+		index := computeIndiaAQI(avgPM25, avgPM10)
+		aqiReading.AQI = index
+		aqiReading.Category = indiaCategory(index)
+		aqiReading.Color = indiaColor(index)
+	default:
+		// Calculate AQI using PM2.5 and PM10 values, plus ozone and CO when present
+		result := p.epaResult(reading, avgPM25, avgPM10)
+		aqi := result.Value
+		aqiReading.setSubIndices(result.SubIndices)
+		aqiReading.AQI = aqi
+		aqiReading.Category = result.Category
+		aqiReading.Color = colorForAQI(aqi)
+		aqiReading.Recommendation = recommendationForAQI(aqi)
+		aqiReading.dominant = result.Dominant
+		if p.categoryHysteresis > 0 {
+			bandAQI := epaBandAQI(p.categoryBand(reading.SerialNo, aqi))
+			aqiReading.Category = categoryForAQI(bandAQI)
+			aqiReading.Color = colorForAQI(bandAQI)
+			aqiReading.Recommendation = recommendationForAQI(bandAQI)
+		}
+		if nowCastOK {
+			nowCastAQI := p.calc.CalculateAQI(nowCastPM25, p.calc.PM25)
+			aqiReading.NowCastAQI = &nowCastAQI
+		}
+		if p.experimentalPM1 && !reading.noPM1 {
+			pm1 := p.pm1Index(reading.PM01Standard)
+			aqiReading.AQIPM1Experimental = &pm1
+		}
+		p.metrics.observeCategory(reading.SerialNo, aqi)
+	}
+
+	p.metrics.observeReading(aqiReading, avgPM25, avgPM10)
+	if p.trendWindow > 0 {
+		aqiReading.Trend = p.trend(reading.SerialNo, aqiReading.AQI)
+	}
+
+	// Convert after metrics, which are always exported in Celsius
+	if p.tempUnit == tempUnitFahrenheit {
+		convertTemperatures(&aqiReading.SensorReading, p.tempUnit)
+		aqiReading.TempUnit = p.tempUnit
+	}
+	return aqiReading, nil
+}
+
+// recoverPanic stops a panic while handling msg from crashing the daemon
+// It must be deferred directly by handleMessage. The panic is logged with the
+// payload and stack trace and counted, and the next message is handled as usual.
+func (p *processor) recoverPanic(msg mqtt.Message) {
+	if r := recover(); r != nil {
+		slog.Error("Panic while handling message", "topic", msg.Topic(), "payload", string(msg.Payload()),
+			"panic", r, "stack", string(debug.Stack()))
+		p.metrics.panics.Inc()
+	}
+}
+
+// publishReading publishes an output message to topic, returning an error
+// wrapping ErrPublish if it fails. Failures are also logged and counted.
+func (p *processor) publishReading(client mqtt.Client, topic string, payload []byte) error {
+	if !p.publish(client, topic, p.retain, payload) {
+		return fmt.Errorf("%w to %s", ErrPublish, topic)
+	}
+	return nil
+}
+
+// publishExploded publishes each value as a retained scalar on its own subtopic
+func (p *processor) publishExploded(client mqtt.Client, outputTopic string, reading AQIReading, pm25, pm10 float64) {
+	values := []struct {
+		subtopic string
+		value    string
+	}{
+		{"pm25", strconv.FormatFloat(pm25, 'f', -1, 64)},
+		{"pm10", strconv.FormatFloat(pm10, 'f', -1, 64)},
+		{"value", strconv.Itoa(reading.AQI)},
+		{"category", reading.Category},
+	}
+
+	for _, v := range values {
+		p.publish(client, outputTopic+"/"+v.subtopic, true, v.value)
+	}
+}
+
+// deadLetterMessage is published to the error topic for messages that could not be processed
+type deadLetterMessage struct {
+	Error   string `json:"error"`
+	Payload string `json:"payload"`
+}
+
+// deadLetter republishes a rejected payload to the error topic, if configured,
+// and counts it as dropped otherwise
+func (p *processor) deadLetter(client mqtt.Client, payload []byte, reason error) {
+	if p.errorTopic == "" {
+		p.metrics.messagesDropped.Inc()
+		return
+	}
+
+	envelope, err := json.Marshal(deadLetterMessage{Error: reason.Error(), Payload: string(payload)})
 	if err != nil {
-		log.Printf("Error marshaling output JSON: %v", err)
+		slog.Error("Error marshaling dead-letter message", "error", err)
+		p.metrics.messagesDropped.Inc()
 		return
 	}
+	if !p.publish(client, p.errorTopic, false, envelope) {
+		p.metrics.messagesDropped.Inc()
+	}
+}
+
+// publish publishes payload at the output QoS and waits for completion
+// Failures are logged and counted. Returns true on success.
+// With -publish-buffer the message is queued instead, and true is returned
+// once it is queued; errors are then only logged and counted.
+func (p *processor) publish(client mqtt.Client, topic string, retained bool, payload interface{}) bool {
+	return p.publishQoS(client, topic, p.outputQoS, retained, payload)
+}
+
+// publishQoS is publish at the given QoS
+func (p *processor) publishQoS(client mqtt.Client, topic string, qos byte, retained bool, payload interface{}) bool {
+	return p.send(publishRequest{client: client, topic: topic, qos: qos, retained: retained, payload: payload})
+}
+
+// send publishes req, through the publish queue if there is one
+func (p *processor) send(req publishRequest) bool {
+	if p.queue != nil {
+		p.enqueue(req)
+		return true
+	}
+	return p.publishNow(req.client, req.topic, req.qos, req.retained, req.payload)
+}
 
-	// Publish to output topic
-	token := client.Publish(outputTopic, 1, false, outputJSON)
+// publishNow publishes a message and waits for the broker to acknowledge it
+func (p *processor) publishNow(client mqtt.Client, topic string, qos byte, retained bool, payload interface{}) bool {
+	token := client.Publish(topic, qos, retained, payload)
 	token.Wait()
 
 	if token.Error() != nil {
-		log.Printf("Error publishing to topic %s: %v", outputTopic, token.Error())
-	} else {
-		log.Printf("Published AQI=%d to topic %s", aqi, outputTopic)
+		slog.Error("Error publishing", "topic", topic, "error", token.Error())
+		p.metrics.publishErrors.Inc()
+		p.stats.publishError()
+		return false
 	}
+	now := p.clock.Now()
+	p.metrics.messagesPublished.Inc()
+	p.metrics.lastPublish.Set(float64(now.Unix()))
+	p.stats.messagePublished(now)
+	return true
 }
@@ -2,13 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"aqi-mqtt/aqi"
 )
 
 const (
@@ -20,8 +25,13 @@ const (
 )
 
 // startMosquitto starts a Mosquitto MQTT broker in Docker
+// Tests that need it are skipped with -short; TestEndToEndEmbeddedBroker
+// covers the same flow without Docker.
 func startMosquitto(t *testing.T) {
 	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping Docker-based test in short mode")
+	}
 
 	// Stop any existing container
 	_ = exec.Command("docker", "stop", containerName).Run()
@@ -311,84 +321,661 @@ func TestEndToEndHappyPath(t *testing.T) {
 	}
 }
 
-// TestAQICalculation tests the AQI calculation logic directly
-func TestAQICalculation(t *testing.T) {
+// TestEndToEndRetain tests that with -retain a client subscribing after the
+// AQI was published still receives it
+func TestEndToEndRetain(t *testing.T) {
+	startMosquitto(t)
+	defer stopMosquitto(t)
+
+	buildCmd := exec.Command("go", "build", "-o", "test-aqi-daemon", ".")
+	if err := buildCmd.Run(); err != nil {
+		t.Fatalf("Failed to build daemon: %v", err)
+	}
+	defer os.Remove("test-aqi-daemon")
+
+	daemonCmd := exec.Command("./test-aqi-daemon",
+		"-broker", "localhost",
+		"-port", testBrokerPort,
+		"-input-topic", testInputTopic,
+		"-output-topic", testOutputTopic,
+		"-client-id", "aqi-daemon-test",
+		"-retain")
+	if testing.Verbose() {
+		daemonCmd.Stdout = os.Stdout
+		daemonCmd.Stderr = os.Stderr
+	}
+	if err := daemonCmd.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	defer func() {
+		if err := daemonCmd.Process.Kill(); err != nil {
+			t.Logf("Failed to kill daemon process: %v", err)
+		}
+		daemonCmd.Wait()
+	}()
+
+	if !waitForDaemonReady(t, testInputTopic) {
+		t.Fatal("Daemon failed to become ready within timeout")
+	}
+
+	// Publish a reading and wait until the daemon has published its AQI
+	publisher := createTestClient(t, "test-publisher")
+	defer publisher.Disconnect(250)
+
+	published := make(chan struct{}, 1)
+	token := publisher.Subscribe(testOutputTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		var reading AQIReading
+		if err := json.Unmarshal(msg.Payload(), &reading); err == nil && reading.PM02Standard == 35.7 {
+			select {
+			case published <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to subscribe to output topic: %v", token.Error())
+	}
+
+	token = publisher.Publish(testInputTopic, 1, false, []byte(`{"serialno": "d83bda1d7660", "pm02Standard": 35.7, "pm10Standard": 45}`))
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to publish test message: %v", token.Error())
+	}
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for output message")
+	}
+
+	// A client subscribing now gets the retained AQI from the broker
+	subscriber := createTestClient(t, "test-late-subscriber")
+	defer subscriber.Disconnect(250)
+
+	retained := make(chan mqtt.Message, 1)
+	token = subscriber.Subscribe(testOutputTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		select {
+		case retained <- msg:
+		default:
+		}
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to subscribe to output topic: %v", token.Error())
+	}
+
+	select {
+	case msg := <-retained:
+		if !msg.Retained() {
+			t.Error("Late subscriber received a message without the retained flag")
+		}
+		var output AQIReading
+		if err := json.Unmarshal(msg.Payload(), &output); err != nil {
+			t.Fatalf("Failed to parse output message: %v", err)
+		}
+		if output.PM02Standard != 35.7 {
+			t.Errorf("Retained PM2.5 = %v, want 35.7", output.PM02Standard)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Late subscriber did not receive the retained AQI")
+	}
+}
+
+// TestCategoryForAQI tests the mapping from AQI values to EPA category labels
+func TestCategoryForAQI(t *testing.T) {
 	testCases := []struct {
-		name     string
-		pm25     float64
-		pm10     float64
-		expected int
+		aqi      int
+		expected string
 	}{
-		{"Good air quality", 8.0, 20.0, 33},
-		{"Moderate air quality", 35.4, 50.0, 100},
-		{"Unhealthy for sensitive groups", 55.4, 100.0, 150},
-		{"Very unhealthy", 250.4, 350.0, 300},
-		{"Hazardous", 400.0, 500.0, 434},
-		{"PM10 dominant", 10.0, 200.0, 123}, // PM10 AQI higher than PM2.5
+		{0, "Good"},
+		{50, "Good"},
+		{75, "Moderate"},
+		{125, "Unhealthy for Sensitive Groups"},
+		{175, "Unhealthy"},
+		{250, "Very Unhealthy"},
+		{301, "Hazardous"},
+		{500, "Hazardous"},
+		{501, "Beyond Index"},
 	}
 
 	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			result := computeAQI(tc.pm25, tc.pm10)
-			// Allow small tolerance for rounding
-			if result < tc.expected-1 || result > tc.expected+1 {
-				t.Errorf("computeAQI(%f, %f) = %d, want ~%d", tc.pm25, tc.pm10, result, tc.expected)
+		t.Run(fmt.Sprintf("AQI=%d", tc.aqi), func(t *testing.T) {
+			if result := categoryForAQI(tc.aqi); result != tc.expected {
+				t.Errorf("categoryForAQI(%d) = %q, want %q", tc.aqi, result, tc.expected)
 			}
 		})
 	}
 }
 
-// TestAQIBreakpointEdgeCases tests edge cases in AQI calculation
-func TestAQIBreakpointEdgeCases(t *testing.T) {
-	// Test exact breakpoint values
+// TestColorForAQI tests the EPA color codes at each band boundary
+func TestColorForAQI(t *testing.T) {
 	testCases := []struct {
-		pm25     float64
-		expected int
+		aqi      int
+		expected string
 	}{
-		{0.0, 0},     // Minimum
-		{12.0, 50},   // Exact breakpoint
-		{12.1, 51},   // Just over breakpoint
-		{35.4, 100},  // Exact breakpoint
-		{35.5, 101},  // Just over breakpoint
-		{500.4, 500}, // Maximum defined breakpoint
-		{600.0, 500}, // Beyond maximum (should cap at 500)
+		{50, "#00E400"},
+		{51, "#FFFF00"},
+		{100, "#FFFF00"},
+		{101, "#FF7E00"},
+		{150, "#FF7E00"},
+		{151, "#FF0000"},
+		{200, "#FF0000"},
+		{201, "#8F3F97"},
+		{300, "#8F3F97"},
+		{301, "#7E0023"},
+		{600, "#7E0023"},
 	}
 
 	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("PM2.5=%.1f", tc.pm25), func(t *testing.T) {
-			result := calculateAQI(tc.pm25, pm25Breakpoints)
-			if result != tc.expected {
-				t.Errorf("calculateAQI(%f) = %d, want %d", tc.pm25, result, tc.expected)
+		t.Run(fmt.Sprintf("AQI=%d", tc.aqi), func(t *testing.T) {
+			if result := colorForAQI(tc.aqi); result != tc.expected {
+				t.Errorf("colorForAQI(%d) = %q, want %q", tc.aqi, result, tc.expected)
 			}
 		})
 	}
 }
 
-// TestPM10BreakpointGap tests the critical gap between 54 and 55 for PM10
-func TestPM10BreakpointGap(t *testing.T) {
-	// Test PM10 values around the 54-55 boundary where the bug occurred
+// TestRecommendationForAQI maps band midpoints to the EPA cautionary statements
+func TestRecommendationForAQI(t *testing.T) {
+	testCases := []struct {
+		aqi      int
+		expected string
+	}{
+		{25, "Air quality is good. No precautions are necessary."},
+		{75, "Unusually sensitive individuals should consider limiting prolonged or heavy exertion."},
+		{125, "People with heart or lung disease, older adults, children, and people of lower socioeconomic status should reduce prolonged or heavy exertion."},
+		{175, "People with heart or lung disease, older adults, children, and people of lower socioeconomic status should avoid prolonged or heavy exertion; everyone else should reduce prolonged or heavy exertion."},
+		{250, "People with heart or lung disease, older adults, children, and people of lower socioeconomic status should avoid all physical activity outdoors. Everyone else should avoid prolonged or heavy exertion."},
+		{400, "Everyone should avoid all physical activity outdoors; people with heart or lung disease, older adults, children, and people of lower socioeconomic status should remain indoors and keep activity levels low."},
+		{600, "Everyone should avoid all physical activity outdoors; people with heart or lung disease, older adults, children, and people of lower socioeconomic status should remain indoors and keep activity levels low."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("AQI=%d", tc.aqi), func(t *testing.T) {
+			if result := recommendationForAQI(tc.aqi); result != tc.expected {
+				t.Errorf("recommendationForAQI(%d) = %q, want %q", tc.aqi, result, tc.expected)
+			}
+		})
+	}
+}
+
+// TestValidatePort tests broker port validation
+func TestValidatePort(t *testing.T) {
+	for _, port := range []int{1, 1883, 8883, 65535} {
+		if err := validatePort(port); err != nil {
+			t.Errorf("validatePort(%d) returned error: %v", port, err)
+		}
+	}
+	for _, port := range []int{-1, 0, 65536} {
+		if err := validatePort(port); err == nil {
+			t.Errorf("validatePort(%d) returned nil, want error", port)
+		}
+	}
+}
+
+// TestRedactPassword tests that passwords never appear in log output
+func TestRedactPassword(t *testing.T) {
+	if got := redactPassword(""); got != "(none)" {
+		t.Errorf("redactPassword(\"\") = %q, want %q", got, "(none)")
+	}
+	if got := redactPassword("secret"); got == "secret" || got == "" {
+		t.Errorf("redactPassword(\"secret\") = %q, want a redacted value", got)
+	}
+}
+
+// TestExplodedPublish tests that -explode publishes retained scalar subtopics
+func TestExplodedPublish(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.explode = true
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45}`),
+	})
+
+	expected := map[string]string{
+		"aqi/pm25":     "35.7",
+		"aqi/pm10":     "45",
+		"aqi/value":    fmt.Sprint(aqi.ComputeAQI(35.7, 45)),
+		"aqi/category": "Unhealthy for Sensitive Groups",
+	}
+
+	messages := client.messages()
+	if len(messages) != len(expected)+1 {
+		t.Fatalf("Published %d messages, want %d", len(messages), len(expected)+1)
+	}
+	if messages[0].Topic != "aqi" || messages[0].Retained {
+		t.Errorf("Combined payload published to %s (retained=%v), want aqi (not retained)", messages[0].Topic, messages[0].Retained)
+	}
+	for _, msg := range messages[1:] {
+		want, ok := expected[msg.Topic]
+		if !ok {
+			t.Errorf("Unexpected topic %s", msg.Topic)
+			continue
+		}
+		if string(msg.Payload) != want {
+			t.Errorf("Topic %s payload = %q, want %q", msg.Topic, msg.Payload, want)
+		}
+		if !msg.Retained {
+			t.Errorf("Topic %s not retained", msg.Topic)
+		}
+		if msg.QoS != messages[0].QoS {
+			t.Errorf("Topic %s QoS = %d, want %d", msg.Topic, msg.QoS, messages[0].QoS)
+		}
+	}
+}
+
+// TestRetainOutput tests that -retain sets the retained flag on the output message
+func TestRetainOutput(t *testing.T) {
+	for _, retain := range []bool{false, true} {
+		proc := newProcessor("aqi")
+		proc.retain = retain
+		client := &fakeClient{}
+
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45}`),
+		})
+
+		messages := client.messages()
+		if len(messages) != 1 {
+			t.Fatalf("Published %d messages, want 1", len(messages))
+		}
+		if messages[0].Retained != retain {
+			t.Errorf("retain=%v: output retained = %v", retain, messages[0].Retained)
+		}
+	}
+}
+
+// TestOutputQoS tests that the output message is published at the configured QoS
+func TestOutputQoS(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OutputTopic = "aqi"
+	cfg.OutputQoS = 2
+	proc := newProcessor("")
+	proc.applyConfig(cfg)
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 || messages[0].QoS != 2 {
+		t.Errorf("Published %+v, want one message at QoS 2", messages)
+	}
+}
+
+// TestDeadLetter tests that unparseable payloads are republished to the error topic
+func TestDeadLetter(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.errorTopic = "aqi/errors"
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte("garbage")})
+
+	messages := client.messages()
+	if len(messages) != 1 || messages[0].Topic != "aqi/errors" {
+		t.Fatalf("Published %+v, want one message on aqi/errors", messages)
+	}
+	var envelope deadLetterMessage
+	if err := json.Unmarshal(messages[0].Payload, &envelope); err != nil {
+		t.Fatalf("Failed to parse dead-letter message: %v", err)
+	}
+	if envelope.Payload != "garbage" || envelope.Error == "" {
+		t.Errorf("Dead-letter message = %+v, want raw payload and error", envelope)
+	}
+
+	// Without an error topic the message is dropped and counted
+	proc.errorTopic = ""
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte("garbage")})
+	if len(client.messages()) != 1 {
+		t.Errorf("Message published without an error topic")
+	}
+	if got := testutil.ToFloat64(proc.metrics.messagesDropped); got != 1 {
+		t.Errorf("messages dropped = %f, want 1", got)
+	}
+}
+
+// TestMaxPayloadBytes tests that an oversized payload is rejected and
+// counted without being parsed or dead-lettered
+func TestMaxPayloadBytes(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.maxPayloadBytes = 64
+	proc.errorTopic = "aqi/errors"
+	client := &fakeClient{}
+
+	payload := `{"serialno": "abc", "pm02Standard": 35.7, "padding": "` + strings.Repeat("x", 64) + `"}`
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+	if msgs := client.messages(); len(msgs) != 0 {
+		t.Errorf("Published %d messages for an oversized payload, want 0", len(msgs))
+	}
+	if got := testutil.ToFloat64(proc.metrics.oversized); got != 1 {
+		t.Errorf("aqi_oversized_messages_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(proc.metrics.parseErrors); got != 0 {
+		t.Errorf("aqi_parse_errors_total = %v, want 0", got)
+	}
+
+	// A payload within the limit is processed
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7}`)})
+	if msgs := client.messages(); len(msgs) != 1 || msgs[0].Topic != "aqi" {
+		t.Errorf("Published %+v, want one output message", msgs)
+	}
+}
+
+// TestCOOutput tests that the CO sub-index is published only when CO is present
+func TestCOOutput(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	for _, payload := range []string{
+		`{"serialno": "abc", "pm02Standard": 5, "rco2": 800, "co": 9.4}`,
+		`{"serialno": "abc", "pm02Standard": 5, "rco2": 800}`,
+	} {
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+	}
+
+	messages := client.messages()
+	var withCO, withoutCO AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &withCO); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if err := json.Unmarshal(messages[1].Payload, &withoutCO); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if withCO.AQICO == nil || *withCO.AQICO != 100 || withCO.AQI != 100 {
+		t.Errorf("With CO: aqiCo = %v, aqi = %d, want 100 and 100", withCO.AQICO, withCO.AQI)
+	}
+	if withoutCO.AQICO != nil {
+		t.Errorf("Without CO: aqiCo = %d, want omitted", *withoutCO.AQICO)
+	}
+}
+
+// TestSO2NO2Output tests that SO2 and NO2 count toward the EPA AQI and their
+// sub-indices are published when present
+func TestSO2NO2Output(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5, "so2": 75, "no2": 360}`),
+	})
+
+	var output AQIReading
+	if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output.AQISO2 == nil || *output.AQISO2 != 100 {
+		t.Errorf("aqiSo2 = %v, want 100", output.AQISO2)
+	}
+	if output.AQINO2 == nil || *output.AQINO2 != 150 {
+		t.Errorf("aqiNo2 = %v, want 150", output.AQINO2)
+	}
+	if output.AQI != 150 {
+		t.Errorf("aqi = %d, want 150 from NO2", output.AQI)
+	}
+}
+
+// TestSubIndices tests that each pollutant's sub-index is published next to the AQI
+func TestSubIndices(t *testing.T) {
 	testCases := []struct {
-		pm10     float64
-		expected int
+		name         string
+		pm25         float64
+		pm10         float64
+		expectedPM25 int
+		expectedPM10 int
 	}{
-		{53.0, 48},  // Just below first breakpoint upper bound
-		{54.0, 49},  // At first breakpoint upper bound
-		{54.5, 50},  // In the gap - should be in first tier
-		{54.9, 50},  // Just below 55
-		{55.0, 51},  // At second breakpoint lower bound
-		{55.1, 51},  // Just above 55
-		{100.0, 73}, // Middle value in second tier
-		{154.0, 100}, // Near upper bound of second tier
-		{154.5, 100}, // In the gap between 154 and 155
-		{155.0, 101}, // At third breakpoint lower bound
+		{"Good air quality", 8.0, 20.0, 33, 19},
+		{"Moderate air quality", 35.4, 50.0, 100, 46},
+		{"Unhealthy for sensitive groups", 55.4, 100.0, 150, 73},
+		{"Very unhealthy", 250.4, 350.0, 300, 198},
+		{"Hazardous", 400.0, 500.0, 434, 395},
+		{"PM10 dominant", 10.0, 200.0, 42, 123},
 	}
 
 	for _, tc := range testCases {
-		t.Run(fmt.Sprintf("PM10=%.1f", tc.pm10), func(t *testing.T) {
-			result := calculateAQI(tc.pm10, pm10Breakpoints)
-			if result != tc.expected {
-				t.Errorf("calculateAQI(PM10=%f) = %d, want %d", tc.pm10, result, tc.expected)
+		t.Run(tc.name, func(t *testing.T) {
+			proc := newProcessor("aqi")
+			client := &fakeClient{}
+			proc.handleMessage(client, &fakeMessage{
+				topic:   "airgradient/readings",
+				payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %v, "pm10Standard": %v}`, tc.pm25, tc.pm10)),
+			})
+
+			var output AQIReading
+			if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+				t.Fatalf("Failed to parse output: %v", err)
+			}
+			if output.AQIPM25 == nil || *output.AQIPM25 != tc.expectedPM25 {
+				t.Errorf("aqiPm25 = %v, want %d", output.AQIPM25, tc.expectedPM25)
+			}
+			if output.AQIPM10 == nil || *output.AQIPM10 != tc.expectedPM10 {
+				t.Errorf("aqiPm10 = %v, want %d", output.AQIPM10, tc.expectedPM10)
+			}
+			if want := max(tc.expectedPM25, tc.expectedPM10); output.AQI != want {
+				t.Errorf("aqi = %d, want %d", output.AQI, want)
+			}
+			if output.AQIOzone != nil {
+				t.Errorf("aqiOzone = %d, want omitted without ozone", *output.AQIOzone)
 			}
 		})
 	}
 }
+
+// TestPollutantsPM25Only tests that -pollutants pm25 keeps a high PM10 from
+// dominating the AQI
+func TestPollutantsPM25Only(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 10.0, "pm10Standard": 200.0}`)
+
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+	var both AQIReading
+	if err := json.Unmarshal(client.messages()[0].Payload, &both); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if both.AQI != 123 {
+		t.Fatalf("Default AQI = %d, want 123 from PM10", both.AQI)
+	}
+
+	proc = newProcessor("aqi")
+	proc.pollutants = []string{aqi.PollutantPM25}
+	client = &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+	var pm25Only AQIReading
+	if err := json.Unmarshal(client.messages()[0].Payload, &pm25Only); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if pm25Only.AQI != 42 {
+		t.Errorf("PM2.5-only AQI = %d, want 42 from PM2.5", pm25Only.AQI)
+	}
+	if pm25Only.AQIPM10 != nil {
+		t.Errorf("aqiPm10 = %d, want omitted when PM10 is not selected", *pm25Only.AQIPM10)
+	}
+	if pm25Only.Category != "Good" {
+		t.Errorf("Category = %q, want Good", pm25Only.Category)
+	}
+}
+
+// TestPanicRecovery tests that a panic while handling one message is logged
+// and counted, and that later messages are still processed
+func TestPanicRecovery(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.beforeHandle = func(msg mqtt.Message) {
+		if strings.Contains(string(msg.Payload()), "boom") {
+			panic("boom")
+		}
+	}
+	client := &fakeClient{}
+
+	for _, payload := range []string{
+		`{"serialno": "abc", "pm02Standard": 5}`,
+		`{"serialno": "boom", "pm02Standard": 5}`,
+		`{"serialno": "def", "pm02Standard": 5}`,
+	} {
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+	}
+
+	if got := len(client.messages()); got != 2 {
+		t.Errorf("Published %d messages, want 2 around the panicking one", got)
+	}
+	if got := testutil.ToFloat64(proc.metrics.panics); got != 1 {
+		t.Errorf("aqi_panics_total = %v, want 1", got)
+	}
+	// The panicking message must not be left in flight or holding the config lock
+	if !proc.drain(time.Second) {
+		t.Error("drain timed out after a panic")
+	}
+	proc.configMu.Lock()
+	proc.configMu.Unlock()
+}
+
+// TestShutdownDrainsInFlightMessages tests that a message being published
+// when shutdown starts is published before disconnecting
+func TestShutdownDrainsInFlightMessages(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{publishDelay: 200 * time.Millisecond, publishStarted: make(chan struct{})}
+
+	go proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`),
+	})
+	<-client.publishStarted
+
+	shutdownMQTT(client, proc, []string{"airgradient/readings"}, "")
+
+	if client.IsConnected() {
+		t.Fatal("Client still connected after shutdown")
+	}
+	if client.publishedAtDisconnect != 1 {
+		t.Errorf("Published %d messages before disconnecting, want 1", client.publishedAtDisconnect)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.inflight.Add(1)
+	defer proc.inflight.Done()
+
+	if proc.drain(10 * time.Millisecond) {
+		t.Error("drain returned true with a message still in flight")
+	}
+}
+
+// TestDrainStopsHandling tests that messages arriving once drain has started
+// are dropped rather than racing with it
+func TestDrainStopsHandling(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+	if !proc.drain(time.Second) {
+		t.Fatal("drain timed out")
+	}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`),
+	})
+	if got := len(client.messages()); got != 0 {
+		t.Errorf("Published %d messages after drain, want 0", got)
+	}
+}
+
+// TestOzoneOptional tests that ozone is nil when absent from the payload
+func TestOzoneOptional(t *testing.T) {
+	var reading SensorReading
+	if err := json.Unmarshal([]byte(`{"pm02Standard": 8.0}`), &reading); err != nil {
+		t.Fatalf("Failed to parse reading: %v", err)
+	}
+	if reading.Ozone != nil {
+		t.Errorf("Ozone = %v, want nil when absent from payload", *reading.Ozone)
+	}
+}
+
+func TestExpandClientID(t *testing.T) {
+	testCases := []struct {
+		template string
+		expected string
+	}{
+		{defaultClientID, "aqi-calculator-pi4"},
+		{"aqi-{hostname}-{pid}", "aqi-pi4-1234"},
+		{"fixed-id", "fixed-id"},
+		{"{pid}{pid}", "12341234"},
+	}
+	for _, tc := range testCases {
+		if got := expandClientID(tc.template, "pi4", 1234); got != tc.expected {
+			t.Errorf("expandClientID(%q) = %q, want %q", tc.template, got, tc.expected)
+		}
+	}
+}
+
+// TestProcessMessageErrors tests that processMessage computes the AQI without
+// a broker and returns errors of the right type for rejected payloads
+func TestProcessMessageErrors(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.strictValidation = true
+
+	reading, err := proc.processMessage([]byte(`{"serialno": "abc", "pm02Standard": 35.7}`))
+	if err != nil || reading.AQI != 101 {
+		t.Errorf("processMessage(valid) = AQI %d, %v; want 101 and no error", reading.AQI, err)
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    error
+	}{
+		{"Bad JSON", `{"serialno": "abc", "pm02Standard":`, ErrParse},
+		{"Wrong type", `{"serialno": "abc", "pm02Standard": "high"}`, ErrParse},
+		{"Negative PM2.5", `{"serialno": "abc", "pm02Standard": -5}`, ErrValidation},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := proc.processMessage([]byte(tc.payload))
+			if !errors.Is(err, tc.want) {
+				t.Errorf("processMessage() error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestPublishReadingError tests that a failed publish returns ErrPublish and
+// is counted
+func TestPublishReadingError(t *testing.T) {
+	proc := newProcessor("aqi")
+
+	if err := proc.publishReading(&fakeClient{}, "aqi", []byte(`{}`)); err != nil {
+		t.Errorf("publishReading() error = %v, want nil", err)
+	}
+
+	client := &fakeClient{publishErr: errors.New("not connected")}
+	err := proc.publishReading(client, "aqi", []byte(`{}`))
+	if !errors.Is(err, ErrPublish) || errors.Is(err, ErrParse) {
+		t.Errorf("publishReading() error = %v, want %v", err, ErrPublish)
+	}
+	if got := testutil.ToFloat64(proc.metrics.publishErrors); got != 1 {
+		t.Errorf("publish errors = %f, want 1", got)
+	}
+}
+
+// TestPlainTopic tests that -plain-topic receives the AQI alone as a retained
+// integer string alongside the JSON output
+func TestPlainTopic(t *testing.T) {
+	proc := newProcessor("aqi/{serialno}")
+	proc.plainTopic = "aqi/{model}/{serialno}/plain"
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "model": "I-9PSL", "pm02Standard": 36.0, "pm10Standard": 45}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 2 || messages[0].Topic != "aqi/abc" {
+		t.Fatalf("Published %+v, want JSON on aqi/abc and the plain AQI", messages)
+	}
+	plain := messages[1]
+	if plain.Topic != "aqi/I-9PSL/abc/plain" || string(plain.Payload) != "102" || !plain.Retained {
+		t.Errorf("Plain message = %s %q (retained %v), want retained \"102\" on aqi/I-9PSL/abc/plain", plain.Topic, plain.Payload, plain.Retained)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors updated by the processor
+type metrics struct {
+	registry *prometheus.Registry
+
+	aqi         *prometheus.GaugeVec
+	pm25        *prometheus.GaugeVec
+	pm10        *prometheus.GaugeVec
+	temperature *prometheus.GaugeVec
+	humidity    *prometheus.GaugeVec
+	co2         *prometheus.GaugeVec
+	categories  *prometheus.CounterVec
+
+	messagesReceived   prometheus.Counter
+	messagesPublished  prometheus.Counter
+	parseErrors        prometheus.Counter
+	messagesDropped    prometheus.Counter
+	duplicates         prometheus.Counter
+	publishErrors      prometheus.Counter
+	publishDropped     prometheus.Counter
+	webhookErrors      prometheus.Counter
+	outputBrokerErrors prometheus.Counter
+	panics             prometheus.Counter
+	pollErrors         prometheus.Counter
+	oversized          prometheus.Counter
+	lastPublish        prometheus.Gauge
+	processing         prometheus.Histogram
+	connected          prometheus.Gauge
+	reconnects         prometheus.Counter
+
+	mu      sync.Mutex
+	sensors map[string]sensorLabels // Labels of each sensor's gauges, keyed by serial number
+}
+
+// sensorLabels are the hardware labels of a sensor's gauges besides serialno
+type sensorLabels struct {
+	model, firmware string
+}
+
+// newMetrics creates the collectors and registers them in a dedicated registry
+func newMetrics() *metrics {
+	sensorGauge := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"serialno", "model", "firmware"})
+	}
+
+	m := &metrics{
+		registry:    prometheus.NewRegistry(),
+		sensors:     make(map[string]sensorLabels),
+		aqi:         sensorGauge("aqi_value", "Most recent Air Quality Index."),
+		pm25:        sensorGauge("aqi_pm25_concentration", "PM2.5 concentration used for the AQI in µg/m³."),
+		pm10:        sensorGauge("aqi_pm10_concentration", "PM10 concentration used for the AQI in µg/m³."),
+		temperature: sensorGauge("sensor_temperature_celsius", "Ambient temperature in degrees Celsius."),
+		humidity:    sensorGauge("sensor_humidity_percent", "Relative humidity in percent."),
+		co2:         sensorGauge("sensor_co2_ppm", "CO2 concentration in ppm."),
+		categories: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "aqi_category_readings_total",
+			Help: "Total number of readings whose EPA AQI fell in each category.",
+		}, []string{"serialno", "category"}),
+		messagesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_messages_received_total",
+			Help: "Total number of sensor messages received.",
+		}),
+		messagesPublished: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_messages_published_total",
+			Help: "Total number of successful MQTT publishes.",
+		}),
+		parseErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_parse_errors_total",
+			Help: "Total number of sensor messages that could not be parsed.",
+		}),
+		messagesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_messages_dropped_total",
+			Help: "Total number of rejected messages that were not republished to the error topic.",
+		}),
+		duplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_duplicates_total",
+			Help: "Total number of duplicate or out-of-order readings dropped by -dedup.",
+		}),
+		publishErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_publish_errors_total",
+			Help: "Total number of failed MQTT publishes.",
+		}),
+		publishDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_publish_dropped_total",
+			Help: "Total number of messages dropped because the -publish-buffer was full.",
+		}),
+		webhookErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_webhook_errors_total",
+			Help: "Total number of output messages that could not be posted to the -webhook-url.",
+		}),
+		outputBrokerErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_output_broker_errors_total",
+			Help: "Total number of output messages that could not be published to the -output-broker.",
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_panics_total",
+			Help: "Total number of messages whose handling panicked and was recovered.",
+		}),
+		pollErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_poll_errors_total",
+			Help: "Total number of failed requests to the -http-poll-url.",
+		}),
+		oversized: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "aqi_oversized_messages_total",
+			Help: "Total number of input messages rejected for exceeding -max-payload-bytes.",
+		}),
+		lastPublish: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "aqi_last_publish_timestamp_seconds",
+			Help: "Unix time of the last successful MQTT publish.",
+		}),
+		processing: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "aqi_processing_seconds",
+			Help:    "Time spent processing a sensor message and publishing its output, excluding any -min-interval deferral.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_connected",
+			Help: "Whether the client is connected to the MQTT broker, 1 or 0.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_reconnects_total",
+			Help: "Total number of times the client reconnected to the MQTT broker after the first connection.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.aqi, m.pm25, m.pm10, m.temperature, m.humidity, m.co2, m.categories,
+		m.messagesReceived, m.messagesPublished, m.parseErrors, m.messagesDropped, m.duplicates, m.publishErrors, m.publishDropped, m.webhookErrors, m.outputBrokerErrors, m.panics, m.pollErrors, m.oversized, m.lastPublish, m.processing,
+		m.connected, m.reconnects,
+	)
+	return m
+}
+
+// observeReading updates the per-sensor gauges
+// pm25 and pm10 are the concentrations the AQI was computed from. The gauges
+// are labeled with the sensor's model and firmware; when either changes, the
+// series with the old labels are removed, so each sensor has one series.
+func (m *metrics) observeReading(reading AQIReading, pm25, pm10 float64) {
+	serialNo := reading.SerialNo
+	labels := sensorLabels{reading.Model, reading.Firmware}
+	gauges := []*prometheus.GaugeVec{m.aqi, m.pm25, m.pm10, m.temperature, m.humidity, m.co2}
+
+	m.mu.Lock()
+	if old, ok := m.sensors[serialNo]; ok && old != labels {
+		for _, gauge := range gauges {
+			gauge.DeleteLabelValues(serialNo, old.model, old.firmware)
+		}
+	}
+	m.sensors[serialNo] = labels
+	m.mu.Unlock()
+
+	values := []string{serialNo, labels.model, labels.firmware}
+	m.aqi.WithLabelValues(values...).Set(float64(reading.AQI))
+	m.pm25.WithLabelValues(values...).Set(pm25)
+	m.pm10.WithLabelValues(values...).Set(pm10)
+	m.temperature.WithLabelValues(values...).Set(reading.Atmp)
+	m.humidity.WithLabelValues(values...).Set(reading.Rhum)
+	m.co2.WithLabelValues(values...).Set(reading.RCO2)
+}
+
+// observeCategory counts a reading in the EPA category of its AQI
+func (m *metrics) observeCategory(serialNo string, aqi int) {
+	m.categories.WithLabelValues(serialNo, categoryLabel(categoryForAQI(aqi))).Inc()
+}
+
+// categoryLabel converts an EPA category to its metric label value,
+// e.g. "Very Unhealthy" to "very-unhealthy"
+func categoryLabel(category string) string {
+	if category == "Unhealthy for Sensitive Groups" {
+		return "usg"
+	}
+	return strings.ReplaceAll(strings.ToLower(category), " ", "-")
+}
+
+// handler returns the HTTP handler serving the metrics
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// startHTTPServer serves handler on addr in the background
+// The returned server should be shut down with Shutdown.
+func startHTTPServer(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "addr", addr, "error", err)
+		}
+	}()
+	return server
+}
+
+// shutdownHTTPServer gracefully stops a server started with startHTTPServer
+func shutdownHTTPServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down HTTP server", "addr", server.Addr, "error", err)
+	}
+}
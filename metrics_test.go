@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsUpdatedByHandleMessage(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 12.0, "pm10Standard": 20, "atmp": 24.1, "rhum": 60.7, "rco2": 417}`),
+	})
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(`not json`)})
+
+	m := proc.metrics
+	if got := testutil.ToFloat64(m.messagesReceived); got != 2 {
+		t.Errorf("messages received = %f, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.parseErrors); got != 1 {
+		t.Errorf("parse errors = %f, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.aqi.WithLabelValues("abc", "", "")); got != 50 {
+		t.Errorf("aqi_value = %f, want 50", got)
+	}
+	if got := testutil.ToFloat64(m.temperature.WithLabelValues("abc", "", "")); got != 24.1 {
+		t.Errorf("sensor_temperature_celsius = %f, want 24.1", got)
+	}
+	if got := testutil.ToFloat64(m.co2.WithLabelValues("abc", "", "")); got != 417 {
+		t.Errorf("sensor_co2_ppm = %f, want 417", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := newMetrics()
+	m.observeReading(AQIReading{SensorReading: SensorReading{SerialNo: "abc"}, AQI: 42}, 10, 20)
+
+	rec := httptest.NewRecorder()
+	m.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{`aqi_value{firmware="",model="",serialno="abc"} 42`, `aqi_pm10_concentration{firmware="",model="",serialno="abc"} 20`, "aqi_publish_errors_total 0", "aqi_messages_published_total 0"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics output missing %q", want)
+		}
+	}
+}
+
+// TestMetricsHardwareLabels tests that the gauges are labeled with the
+// sensor's model and firmware, and that a firmware update replaces the series
+func TestMetricsHardwareLabels(t *testing.T) {
+	m := newMetrics()
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := io.ReadAll(rec.Body)
+		return string(body)
+	}
+	reading := AQIReading{SensorReading: SensorReading{SerialNo: "abc", Model: "I-9PSL", Firmware: "3.1.3"}, AQI: 42}
+
+	m.observeReading(reading, 10, 20)
+	oldSeries := `aqi_value{firmware="3.1.3",model="I-9PSL",serialno="abc"} 42`
+	if body := scrape(); !strings.Contains(body, oldSeries) {
+		t.Errorf("Metrics output missing %q", oldSeries)
+	}
+
+	reading.Firmware = "3.2.0"
+	reading.AQI = 43
+	m.observeReading(reading, 10, 20)
+	body := scrape()
+	if want := `aqi_value{firmware="3.2.0",model="I-9PSL",serialno="abc"} 43`; !strings.Contains(body, want) {
+		t.Errorf("Metrics output missing %q", want)
+	}
+	if strings.Contains(body, `firmware="3.1.3"`) {
+		t.Errorf("Metrics output still has the series of the old firmware")
+	}
+}
+
+// TestProcessingLatency tests that the time from receipt to publish, read
+// from the processor's clock, is observed in aqi_processing_seconds
+func TestProcessingLatency(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	proc.beforeHandle = func(mqtt.Message) { clock.advance(250 * time.Millisecond) }
+
+	proc.handleMessage(&fakeClient{}, &fakeMessage{topic: "airgradient/readings", payload: []byte(`{"serialno": "abc", "pm02Standard": 10}`)})
+	// A failed publish is not observed
+	proc.handleMessage(&fakeClient{publishErr: errors.New("not connected")}, &fakeMessage{topic: "airgradient/readings", payload: []byte(`{"serialno": "def", "pm02Standard": 10}`)})
+
+	rec := httptest.NewRecorder()
+	proc.metrics.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{"aqi_processing_seconds_count 1", "aqi_processing_seconds_sum 0.25", `aqi_processing_seconds_bucket{le="0.25"} 1`, `aqi_processing_seconds_bucket{le="0.1"} 0`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics output missing %q", want)
+		}
+	}
+}
+
+// TestProcessingLatencyDeferred tests that the time a publish waits for
+// -min-interval is not counted as processing
+func TestProcessingLatencyDeferred(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	proc.throttle.setInterval(time.Minute)
+	var fire func()
+	proc.throttle.afterFunc = func(d time.Duration, f func()) { fire = f }
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(`{"serialno": "abc", "pm02Standard": 10}`)})
+	proc.beforeHandle = func(mqtt.Message) { clock.advance(250 * time.Millisecond) }
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(`{"serialno": "abc", "pm02Standard": 12}`)})
+	clock.advance(time.Minute)
+	fire()
+
+	rec := httptest.NewRecorder()
+	proc.metrics.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{"aqi_processing_seconds_count 2", "aqi_processing_seconds_sum 0.25"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Metrics output missing %q", want)
+		}
+	}
+}
+
+// TestCategoryCounters feeds readings across the EPA bands and checks the per-category counters
+func TestCategoryCounters(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	// PM10 concentrations giving AQIs of 46, 73, 123, 173, 266, 395 and 73 again
+	for _, pm10 := range []float64{50, 100, 200, 300, 400, 500, 100} {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm10Standard": %g}`, pm10)),
+		})
+	}
+
+	expected := map[string]float64{
+		"good":           1,
+		"moderate":       2,
+		"usg":            1,
+		"unhealthy":      1,
+		"very-unhealthy": 1,
+		"hazardous":      1,
+	}
+	for category, want := range expected {
+		if got := testutil.ToFloat64(proc.metrics.categories.WithLabelValues("abc", category)); got != want {
+			t.Errorf("aqi_category_readings_total{category=%q} = %f, want %f", category, got, want)
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqtt5Client speaks MQTT 5 through the paho.golang client for
+// -mqtt-version 5, behind the mqtt.Client interface the rest of the daemon
+// uses
+// It is configured from the same options as the 3.1.1 client: the broker,
+// client ID, credentials, TLS, keep-alive, connect timeout, clean session,
+// Last Will, maximum reconnect interval, and the connection handlers. It
+// reconnects on its own, like the 3.1.1 client with auto-reconnect.
+type mqtt5Client struct {
+	opts   *mqtt.ClientOptions
+	ctx    context.Context // Cancelled by Disconnect, ending pending operations
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	pending       sync.WaitGroup              // Operations whose tokens have not completed, added to under mu
+	disconnecting bool                        // Set by Disconnect; no operations are started after it
+	conn          *autopaho.ConnectionManager // Created by the first Connect
+	connectFailed context.CancelCauseFunc     // Ends the Connect in progress, if any
+	routes        map[string]mqtt.MessageHandler
+	lastHandled   chan struct{} // Closed once the last received message is handled
+	connected     atomic.Bool
+}
+
+// newMQTT5Client returns an MQTT 5 client for opts, which is not connected yet
+func newMQTT5Client(opts *mqtt.ClientOptions) *mqtt5Client {
+	opts.ProtocolVersion = 5 // Reported by OptionsReader; SetProtocolVersion only accepts 3 and 4
+	ctx, cancel := context.WithCancel(context.Background())
+	lastHandled := make(chan struct{})
+	close(lastHandled)
+	return &mqtt5Client{
+		opts:        opts,
+		ctx:         ctx,
+		cancel:      cancel,
+		routes:      make(map[string]mqtt.MessageHandler),
+		lastHandled: lastHandled,
+	}
+}
+
+// clientConfig translates the options to the paho.golang connection settings
+func (c *mqtt5Client) clientConfig() autopaho.ClientConfig {
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    c.opts.Servers,
+		TlsCfg:                        c.opts.TLSConfig,
+		KeepAlive:                     uint16(min(c.opts.KeepAlive, math.MaxUint16)),
+		CleanStartOnInitialConnection: c.opts.CleanSession,
+		ConnectTimeout:                c.opts.ConnectTimeout,
+		ReconnectBackoff:              reconnectBackoff(c.opts.MaxReconnectInterval),
+		ConnectUsername:               c.opts.Username,
+		ConnectPassword:               []byte(c.opts.Password),
+		OnConnectionUp:                c.connectionUp,
+		OnConnectionDown:              c.connectionDown,
+		OnConnectError:                c.connectError,
+		ConnectPacketBuilder: func(connect *paho.Connect, server *url.URL) (*paho.Connect, error) {
+			if c.opts.OnConnectAttempt != nil {
+				c.opts.OnConnectAttempt(server, c.opts.TLSConfig)
+			}
+			return connect, nil
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          c.opts.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.route},
+		},
+	}
+	// Without a clean session the broker keeps the session until the client
+	// reconnects, as with 3.1.1; with one it ends when the connection closes
+	if !c.opts.CleanSession {
+		cfg.SessionExpiryInterval = math.MaxUint32
+	}
+	if c.opts.WillEnabled {
+		cfg.WillMessage = &paho.WillMessage{
+			Topic:   c.opts.WillTopic,
+			Payload: c.opts.WillPayload,
+			QoS:     c.opts.WillQos,
+			Retain:  c.opts.WillRetained,
+		}
+	}
+	return cfg
+}
+
+// reconnectBackoff returns the delay before each connection attempt: none
+// before the first, then doubling from connectRetryInitial up to maxInterval
+func reconnectBackoff(maxInterval time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		if attempt <= 0 {
+			return 0
+		}
+		delay := connectRetryInitial
+		for range min(attempt-1, 32) {
+			delay *= 2
+		}
+		return min(delay, max(maxInterval, connectRetryInitial))
+	}
+}
+
+// Connect starts connecting and returns a token that completes once the
+// connection is up, or with the error of the first failed attempt
+// Failed attempts are retried in the background, so calling Connect again
+// waits for the next one.
+func (c *mqtt5Client) Connect() mqtt.Token {
+	return c.run(c.connect)
+}
+
+func (c *mqtt5Client) connect() error {
+	ctx, failed := context.WithCancelCause(c.ctx)
+	defer failed(nil)
+	if c.opts.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.ConnectTimeout)
+		defer cancel()
+	}
+
+	c.mu.Lock()
+	c.connectFailed = failed
+	if c.conn == nil {
+		conn, err := autopaho.NewConnection(c.ctx, c.clientConfig())
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.conn = conn
+	}
+	conn := c.conn
+	c.mu.Unlock()
+
+	err := conn.AwaitConnection(ctx)
+	c.mu.Lock()
+	c.connectFailed = nil
+	c.mu.Unlock()
+	if err != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// connectionUp is called by paho.golang when a connection is established
+func (c *mqtt5Client) connectionUp(*autopaho.ConnectionManager, *paho.Connack) {
+	c.connected.Store(true)
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c) // Must not block paho.golang
+	}
+}
+
+// connectionDown is called by paho.golang when an established connection is
+// lost; returning true keeps reconnecting
+func (c *mqtt5Client) connectionDown() bool {
+	c.connected.Store(false)
+	if c.ctx.Err() == nil && c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(c, fmt.Errorf("connection to MQTT broker lost"))
+	}
+	return true
+}
+
+// connectError is called by paho.golang when a connection attempt fails
+func (c *mqtt5Client) connectError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connectFailed != nil {
+		c.connectFailed(err)
+	}
+}
+
+// IsConnected reports whether the connection is up
+func (c *mqtt5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+// IsConnectionOpen reports whether the connection is up
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	return c.connected.Load()
+}
+
+// Disconnect closes the connection once pending operations, such as
+// publishes waiting for their acknowledgement, have completed, waiting up to
+// quiesce milliseconds for them
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	c.mu.Lock()
+	c.disconnecting = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	if conn != nil {
+		conn.Disconnect(ctx)
+	}
+	c.cancel()
+	c.connected.Store(false)
+}
+
+// Publish publishes payload, a string, []byte or bytes.Buffer, to topic
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.publish(topic, qos, retained, payload, nil)
+}
+
+// publish is Publish with MQTT 5 properties, which may be nil
+func (c *mqtt5Client) publish(topic string, qos byte, retained bool, payload interface{}, properties *paho.PublishProperties) mqtt.Token {
+	return c.run(func() error {
+		var data []byte
+		switch p := payload.(type) {
+		case string:
+			data = []byte(p)
+		case []byte:
+			data = p
+		case bytes.Buffer:
+			data = p.Bytes()
+		case *bytes.Buffer:
+			data = p.Bytes()
+		default:
+			return fmt.Errorf("unknown payload type %T", payload)
+		}
+		conn, err := c.connection()
+		if err != nil {
+			return err
+		}
+		_, err = conn.Publish(c.ctx, &paho.Publish{
+			Topic:      topic,
+			QoS:        qos,
+			Retain:     retained,
+			Payload:    data,
+			Properties: properties,
+		})
+		return err
+	})
+}
+
+// connection returns the connection manager, or an error before Connect
+func (c *mqtt5Client) connection() (*autopaho.ConnectionManager, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, mqtt.ErrNotConnected
+	}
+	return c.conn, nil
+}
+
+// Subscribe subscribes callback to a topic filter
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes callback to several topic filters
+func (c *mqtt5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.run(func() error {
+		conn, err := c.connection()
+		if err != nil {
+			return err
+		}
+		subscribe := &paho.Subscribe{}
+		for topic, qos := range filters {
+			subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+			c.AddRoute(topic, callback)
+		}
+		suback, err := conn.Subscribe(c.ctx, subscribe)
+		if err != nil {
+			return err
+		}
+		for _, reason := range suback.Reasons {
+			if reason >= 0x80 {
+				return fmt.Errorf("subscription refused with reason code %#x", reason)
+			}
+		}
+		return nil
+	})
+}
+
+// Unsubscribe unsubscribes from topic filters
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	return c.run(func() error {
+		c.mu.Lock()
+		for _, topic := range topics {
+			delete(c.routes, topic)
+		}
+		c.mu.Unlock()
+		conn, err := c.connection()
+		if err != nil {
+			return err
+		}
+		_, err = conn.Unsubscribe(c.ctx, &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+// AddRoute passes messages matching a topic filter to callback
+func (c *mqtt5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+// OptionsReader returns the options the client was created with
+func (c *mqtt5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewOptionsReader(c.opts)
+}
+
+// route passes a received message to the handler of a matching filter, or
+// to the default publish handler
+// Handlers run in order, but not on paho.golang's goroutine: it stops reading
+// acknowledgements while a message is being delivered, so a handler waiting
+// for its publish to be acknowledged would otherwise deadlock.
+func (c *mqtt5Client) route(received paho.PublishReceived) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	handler := c.opts.DefaultPublishHandler
+	for filter, callback := range c.routes {
+		if topicMatches(filter, received.Packet.Topic) {
+			handler = callback
+			break
+		}
+	}
+	if handler == nil {
+		return false, nil
+	}
+
+	previous, done := c.lastHandled, make(chan struct{})
+	c.lastHandled = done
+	go func() {
+		defer close(done)
+		<-previous
+		handler(c, &mqtt5Message{packet: received.Packet})
+	}()
+	return true, nil
+}
+
+// propertiesClient publishes through an MQTT 5 client with properties
+// attached to every message
+type propertiesClient struct {
+	*mqtt5Client
+	properties *paho.PublishProperties
+}
+
+// Publish publishes payload to topic with the client's properties
+func (c propertiesClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.publish(topic, qos, retained, payload, c.properties)
+}
+
+// readingClient returns a client that attaches the sensor's model and
+// firmware as user properties to the messages published for a reading, and
+// the -message-expiry interval
+// MQTT 3.1.1 has no message properties, so other clients are returned as is.
+func (p *processor) readingClient(client mqtt.Client, reading SensorReading) mqtt.Client {
+	c, ok := client.(*mqtt5Client)
+	if !ok {
+		return client
+	}
+	properties := &paho.PublishProperties{}
+	if reading.Model != "" {
+		properties.User.Add("model", reading.Model)
+	}
+	if reading.Firmware != "" {
+		properties.User.Add("firmware", reading.Firmware)
+	}
+	if p.messageExpiry > 0 {
+		expiry := uint32(min(p.messageExpiry/time.Second, math.MaxUint32))
+		properties.MessageExpiry = &expiry
+	}
+	return propertiesClient{c, properties}
+}
+
+// mqtt5Message is a received MQTT 5 message
+type mqtt5Message struct {
+	packet *paho.Publish
+}
+
+func (m *mqtt5Message) Duplicate() bool   { return false } // Not exposed by paho.golang
+func (m *mqtt5Message) Qos() byte         { return m.packet.QoS }
+func (m *mqtt5Message) Retained() bool    { return m.packet.Retain }
+func (m *mqtt5Message) Topic() string     { return m.packet.Topic }
+func (m *mqtt5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m *mqtt5Message) Payload() []byte   { return m.packet.Payload }
+func (m *mqtt5Message) Ack()              {} // Acknowledged by paho.golang once handled
+
+// mqtt5Token completes when an MQTT 5 operation, run in the background, returns
+type mqtt5Token struct {
+	done chan struct{}
+	err  error
+}
+
+// run runs operation in the background, returning its token
+func (c *mqtt5Client) run(operation func() error) *mqtt5Token {
+	t := &mqtt5Token{done: make(chan struct{})}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disconnecting {
+		t.err = mqtt.ErrNotConnected
+		close(t.done)
+		return t
+	}
+	c.pending.Add(1)
+	go func() {
+		defer c.pending.Done()
+		t.err = operation()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(timeout time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (t *mqtt5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Error returns the operation's error once it has completed
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// nowCastHours is the number of hourly averages used by the NowCast algorithm
+const nowCastHours = 12
+
+// nowCastSample is a single timestamped concentration
+type nowCastSample struct {
+	Time          time.Time `json:"time"`
+	Concentration float64   `json:"concentration"`
+}
+
+// NowCast buffers recent PM2.5 concentrations and computes the EPA NowCast
+// The NowCast is a weighted average of the last 12 hourly averages where
+// recent hours weigh more when concentrations are changing quickly:
+//
+//	w* = min / max over the 12 hourly averages, w = max(w*, 0.5)
+//	NowCast = Σ w^(i-1) * c_i / Σ w^(i-1), for i = 1 (most recent hour) .. 12
+//
+// Hours without readings are skipped. At least two of the three most recent
+// hours must have readings for a NowCast to be valid.
+// Source: https://usepa.servicenowservices.com/airnow?id=kb_article_view&sysparm_article=KB0011856
+type NowCast struct {
+	samples []nowCastSample
+}
+
+// NewNowCast creates an empty NowCast buffer
+func NewNowCast() *NowCast {
+	return &NowCast{}
+}
+
+// Add records a concentration observed at time t and evicts samples older than 12 hours
+func (n *NowCast) Add(t time.Time, concentration float64) {
+	n.samples = append(n.samples, nowCastSample{Time: t, Concentration: concentration})
+
+	cutoff := t.Add(-nowCastHours * time.Hour)
+	kept := n.samples[:0]
+	for _, s := range n.samples {
+		if s.Time.After(cutoff) {
+			kept = append(kept, s)
+		}
+	}
+	n.samples = kept
+}
+
+// hourlyAverages returns the average concentration for each of the last 12
+// hours relative to now, index 0 being the most recent. Hours without
+// samples are reported as not present.
+func (n *NowCast) hourlyAverages(now time.Time) (averages [nowCastHours]float64, present [nowCastHours]bool) {
+	var sums [nowCastHours]float64
+	var counts [nowCastHours]int
+
+	for _, s := range n.samples {
+		age := now.Sub(s.Time)
+		if age < 0 {
+			continue
+		}
+		hour := int(age / time.Hour)
+		if hour >= nowCastHours {
+			continue
+		}
+		sums[hour] += s.Concentration
+		counts[hour]++
+	}
+
+	for i := range averages {
+		if counts[i] > 0 {
+			averages[i] = sums[i] / float64(counts[i])
+			present[i] = true
+		}
+	}
+	return averages, present
+}
+
+// Value computes the NowCast concentration as of now
+// Returns false when there is not enough recent data for a valid NowCast.
+func (n *NowCast) Value(now time.Time) (float64, bool) {
+	averages, present := n.hourlyAverages(now)
+
+	recent := 0
+	for i := 0; i < 3; i++ {
+		if present[i] {
+			recent++
+		}
+	}
+	if recent < 2 {
+		return 0, false
+	}
+
+	minConc, maxConc := math.Inf(1), math.Inf(-1)
+	for i, c := range averages {
+		if !present[i] {
+			continue
+		}
+		minConc = math.Min(minConc, c)
+		maxConc = math.Max(maxConc, c)
+	}
+
+	weight := 1.0
+	if maxConc > 0 {
+		weight = minConc / maxConc
+	}
+	if weight < 0.5 {
+		weight = 0.5
+	}
+
+	var sum, weights float64
+	for i, c := range averages {
+		if !present[i] {
+			continue
+		}
+		w := math.Pow(weight, float64(i))
+		sum += w * c
+		weights += w
+	}
+
+	return sum / weights, true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNowCastValue(t *testing.T) {
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		hourly   []float64 // Oldest first
+		expected float64
+	}{
+		{"Steady concentration", []float64{10, 10, 10, 10}, 10},
+		// min/max = 0.25 is clamped to 0.5: (40 + 0.5*20 + 0.25*10) / 1.75
+		{"Rising concentration", []float64{10, 20, 40}, 30},
+		// min/max = 0.8: (8 + 0.8*10) / 1.8
+		{"Mild decrease", []float64{10, 8}, 8.888888888888889},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nc := NewNowCast()
+			for i, c := range tc.hourly {
+				nc.Add(start.Add(time.Duration(i)*time.Hour+30*time.Minute), c)
+			}
+			now := start.Add(time.Duration(len(tc.hourly)-1)*time.Hour + 45*time.Minute)
+
+			value, ok := nc.Value(now)
+			if !ok {
+				t.Fatal("NowCast reported insufficient data")
+			}
+			if math.Abs(value-tc.expected) > 1e-9 {
+				t.Errorf("NowCast = %f, want %f", value, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNowCastInsufficientData(t *testing.T) {
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	nc := NewNowCast()
+
+	// A single hour of data is not enough
+	nc.Add(start, 10)
+	nc.Add(start.Add(10*time.Minute), 12)
+	if _, ok := nc.Value(start.Add(20 * time.Minute)); ok {
+		t.Error("NowCast valid with only one hour of data")
+	}
+
+	// Two of the three most recent hours are enough
+	nc.Add(start.Add(2*time.Hour), 14)
+	if _, ok := nc.Value(start.Add(2*time.Hour + 5*time.Minute)); !ok {
+		t.Error("NowCast invalid with two of the three most recent hours present")
+	}
+}
+
+func TestNowCastEviction(t *testing.T) {
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	nc := NewNowCast()
+
+	nc.Add(start, 500)
+	nc.Add(start.Add(13*time.Hour), 10)
+	nc.Add(start.Add(14*time.Hour), 10)
+
+	value, ok := nc.Value(start.Add(14 * time.Hour))
+	if !ok {
+		t.Fatal("NowCast reported insufficient data")
+	}
+	if value != 10 {
+		t.Errorf("NowCast = %f, want 10 after evicting old sample", value)
+	}
+	if len(nc.samples) != 2 {
+		t.Errorf("Buffer holds %d samples, want 2", len(nc.samples))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// marshalOutput converts a reading to the JSON published on the output topic
+// For the EPA standard the AQIReading is marshaled as is. For other standards
+// the index is published under the standard's own field name and EPA-only
+// fields are removed.
+func marshalOutput(reading AQIReading, standard string) ([]byte, error) {
+	data, err := json.Marshal(reading)
+	if err != nil || standard == standardEPA {
+		return data, err
+	}
+
+	// Decode into a map, keeping numbers exactly as marshaled
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	switch standard {
+	case standardAQHI:
+		fields["aqhi"] = fields["aqi"]
+		delete(fields, "aqi")
+		renameField(fields, "aqiInstant", "aqhiInstant")
+		delete(fields, "color")
+		delete(fields, "nowcastAqi")
+	case standardCAQI, standardIndia:
+		delete(fields, "nowcastAqi")
+	case standardDAQI:
+		fields["daqi"] = fields["aqi"]
+		delete(fields, "aqi")
+		renameField(fields, "aqiInstant", "daqiInstant")
+		delete(fields, "nowcastAqi")
+	}
+
+	return json.Marshal(fields)
+}
+
+// renameField moves a field to a new key if it is present
+func renameField(fields map[string]interface{}, from, to string) {
+	if v, ok := fields[from]; ok {
+		fields[to] = v
+		delete(fields, from)
+	}
+}
+
+// outputFieldNames returns the JSON keys an output message can contain
+func outputFieldNames() map[string]bool {
+	// AQI renamed by marshalOutput
+	names := map[string]bool{"aqhi": true, "aqhiInstant": true, "daqi": true, "daqiInstant": true}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Anonymous {
+				collect(field.Type)
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				names[name] = true
+			}
+		}
+	}
+	collect(reflect.TypeOf(AQIReading{}))
+	return names
+}
+
+// validateOutputFields checks that every selected field can appear in the output
+func validateOutputFields(fields []string) error {
+	known := outputFieldNames()
+	for _, field := range fields {
+		if !known[field] {
+			return fmt.Errorf("unknown output field %q", field)
+		}
+	}
+	return nil
+}
+
+// selectOutputFields reduces output JSON to the given fields, for consumers
+// that only need a few values. All fields are kept if fields is empty, and
+// selected fields that a message lacks are left out.
+func selectOutputFields(data []byte, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// roundOutputNumbers rounds the fractional numbers in output JSON to the given
+// number of decimals, for cleaner dashboards
+// Integers such as the AQI are left alone.
+func roundOutputNumbers(data []byte, decimals int) ([]byte, error) {
+	var fields interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(roundNumbers(fields, math.Pow(10, float64(decimals))))
+}
+
+// roundNumbers rounds the fractional json.Numbers in a decoded JSON value to
+// multiples of 1/scale
+func roundNumbers(value interface{}, scale float64) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = roundNumbers(field, scale)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = roundNumbers(element, scale)
+		}
+	case json.Number:
+		if !strings.ContainsAny(v.String(), ".eE") {
+			return v
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return v
+		}
+		rounded := math.Round(f*scale) / scale
+		if rounded == 0 {
+			rounded = 0 // Not -0
+		}
+		return json.Number(strconv.FormatFloat(rounded, 'f', -1, 64))
+	}
+	return value
+}
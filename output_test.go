@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestOutputFields tests that only the selected fields are published
+func TestOutputFields(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.outputFields = []string{"aqi", "category", "pm02Standard", "pm10Standard", "nowcastAqi"}
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 45, "rco2": 612, "atmp": 21.5, "rhum": 40}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var output map[string]any
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+
+	// nowcastAqi is selected but omitted until enough data is buffered
+	expected := map[string]any{"aqi": 101.0, "category": "Unhealthy for Sensitive Groups", "pm02Standard": 35.7, "pm10Standard": 45.0}
+	if len(output) != len(expected) {
+		t.Errorf("Output %s has %d fields, want %d", messages[0].Payload, len(output), len(expected))
+	}
+	for field, want := range expected {
+		if output[field] != want {
+			t.Errorf("%s = %v, want %v", field, output[field], want)
+		}
+	}
+}
+
+func TestOutputFieldsDefault(t *testing.T) {
+	data := []byte(`{"aqi":42,"serialno":"abc"}`)
+	got, err := selectOutputFields(data, nil)
+	if err != nil {
+		t.Fatalf("selectOutputFields returned error: %v", err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("selectOutputFields(nil) = %s, want %s unchanged", got, data)
+	}
+}
+
+func TestValidateOutputFields(t *testing.T) {
+	for _, fields := range [][]string{nil, {"aqi", "serialno", "pm02Standard"}, {"aqhi"}, {"aqiPm10", "vocCategory"}} {
+		if err := validateOutputFields(fields); err != nil {
+			t.Errorf("validateOutputFields(%q) returned error: %v", fields, err)
+		}
+	}
+	for _, fields := range [][]string{{"pm25"}, {"aqi", "SensorReading"}} {
+		if err := validateOutputFields(fields); err == nil {
+			t.Errorf("validateOutputFields(%q) returned no error", fields)
+		}
+	}
+}
+
+func TestRoundOutputNumbers(t *testing.T) {
+	data := []byte(`{"aqi":101,"pm02":35.666666666,"atmp":21.05,"big":32520.834,"neg":-0.126,"tiny":1e-7,"serialno":"abc","list":[1.23456]}`)
+
+	testCases := []struct {
+		decimals int
+		expected string
+	}{
+		{2, `{"aqi":101,"atmp":21.05,"big":32520.83,"list":[1.23],"neg":-0.13,"pm02":35.67,"serialno":"abc","tiny":0}`},
+		{1, `{"aqi":101,"atmp":21.1,"big":32520.8,"list":[1.2],"neg":-0.1,"pm02":35.7,"serialno":"abc","tiny":0}`},
+		{0, `{"aqi":101,"atmp":21,"big":32521,"list":[1],"neg":0,"pm02":36,"serialno":"abc","tiny":0}`},
+	}
+	for _, tc := range testCases {
+		got, err := roundOutputNumbers(data, tc.decimals)
+		if err != nil {
+			t.Fatalf("roundOutputNumbers(%d) returned error: %v", tc.decimals, err)
+		}
+		if string(got) != tc.expected {
+			t.Errorf("roundOutputNumbers(%d) =\n%s\nwant\n%s", tc.decimals, got, tc.expected)
+		}
+	}
+}
+
+// TestRoundDecimals tests that -round-decimals rounds the published output
+// and that the default leaves it alone
+func TestRoundDecimals(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 35.666666, "atmp": 21.4567}`)
+
+	for _, tc := range []struct {
+		decimals int
+		pm25     float64
+		atmp     float64
+	}{
+		{-1, 35.666666, 21.4567},
+		{1, 35.7, 21.5},
+	} {
+		proc := newProcessor("aqi")
+		proc.roundDecimals = tc.decimals
+		client := &fakeClient{}
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+		var output AQIReading
+		if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		if output.PM02Standard != tc.pm25 || output.Atmp != tc.atmp {
+			t.Errorf("With %d decimals: pm02Standard %v, atmp %v, want %v, %v", tc.decimals, output.PM02Standard, output.Atmp, tc.pm25, tc.atmp)
+		}
+		if output.AQI != 101 {
+			t.Errorf("With %d decimals: AQI = %d, want 101 from the unrounded PM2.5", tc.decimals, output.AQI)
+		}
+	}
+}
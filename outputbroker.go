@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// outputBrokerTimeout bounds how long a publish to the -output-broker may
+// take before it is counted as failed
+const outputBrokerTimeout = 10 * time.Second
+
+// validateOutputBroker checks that an -output-broker is a URL paho can connect to
+func validateOutputBroker(broker string) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return fmt.Errorf("invalid output broker: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("invalid output broker %q: must be a URL such as tcp://host:1883 or ssl://host:8883", broker)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid output broker %q: missing host", broker)
+	}
+	return nil
+}
+
+// outputBrokerTLS reports whether an -output-broker URL uses TLS
+func outputBrokerTLS(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "wss":
+		return true
+	}
+	return false
+}
+
+// outputClientIDSuffix is appended to the client ID of the primary
+// connection for the -output-broker connection
+const outputClientIDSuffix = "-output"
+
+// outputBrokerOptions configures the client for the -output-broker, which
+// only receives output messages and has its own credentials and TLS settings
+// Its client ID is derived from clientID, the primary one, so that the two
+// connections do not take over each other's session when both brokers are
+// the same or bridged.
+func outputBrokerOptions(cfg *Config, clientID string) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(cfg.OutputBroker)
+	opts.SetClientID(clientID + outputClientIDSuffix)
+	if cfg.OutputUsername != "" {
+		opts.SetUsername(cfg.OutputUsername)
+	}
+	if cfg.OutputPassword != "" {
+		opts.SetPassword(cfg.OutputPassword)
+	}
+	if outputBrokerTLS(cfg.OutputBroker) || cfg.OutputCAFile != "" || cfg.OutputCertFile != "" {
+		tlsConfig, err := newTLSConfig(cfg.OutputCAFile, cfg.OutputCertFile, cfg.OutputKeyFile, false)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	setConnectionTimeouts(opts, cfg)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(cfg.ReconnectMaxInterval)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		slog.Info("Connected to output broker", "broker", cfg.OutputBroker)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		slog.Warn("Connection to output broker lost, will attempt to reconnect automatically", "broker", cfg.OutputBroker, "error", err)
+	})
+	return opts, nil
+}
+
+// connectOutputBroker connects client in the background, retrying until the
+// output broker is up
+// Unlike the primary broker it never gives up, as the output broker is optional.
+func connectOutputBroker(client mqtt.Client, broker string, maxInterval time.Duration) {
+	go func() {
+		connect := func() error {
+			token := client.Connect()
+			token.Wait()
+			return token.Error()
+		}
+		if err := connectWithRetry(connect, 0, connectRetryInitial, min(connectRetryInterval, maxInterval)); err != nil {
+			slog.Error("Failed to connect to output broker", "broker", broker, "error", err)
+		}
+	}()
+}
+
+// publishOutputBroker copies an output message to the -output-broker, if any
+// It does not wait for the broker, and failures are only logged and counted,
+// so the output broker cannot hold up or break publishing to the primary.
+func (p *processor) publishOutputBroker(topic string, retained bool, payload []byte) {
+	client := p.outputClient
+	if client == nil {
+		return
+	}
+	if !client.IsConnectionOpen() {
+		slog.Debug("Not connected to output broker, skipping", "topic", topic)
+		p.metrics.outputBrokerErrors.Inc()
+		return
+	}
+
+	token := client.Publish(topic, p.outputQoS, retained, payload)
+	p.goBackground(func() {
+		if !token.WaitTimeout(outputBrokerTimeout) {
+			slog.Error("Timed out publishing to output broker", "topic", topic)
+			p.metrics.outputBrokerErrors.Inc()
+		} else if err := token.Error(); err != nil {
+			slog.Error("Error publishing to output broker", "topic", topic, "error", err)
+			p.metrics.outputBrokerErrors.Inc()
+		}
+	})
+}
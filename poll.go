@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// pollTimeout bounds each request to a polled sensor
+const pollTimeout = 10 * time.Second
+
+// maxPollBody bounds the size of a reading fetched with -http-poll-url
+const maxPollBody = 1 << 20
+
+// pollMessage is a reading fetched with -http-poll-url
+// Its topic is the URL it was fetched from.
+type pollMessage struct {
+	url     string
+	payload []byte
+}
+
+func (m *pollMessage) Duplicate() bool   { return false }
+func (m *pollMessage) Qos() byte         { return 0 }
+func (m *pollMessage) Retained() bool    { return false }
+func (m *pollMessage) Topic() string     { return m.url }
+func (m *pollMessage) MessageID() uint16 { return 0 }
+func (m *pollMessage) Payload() []byte   { return m.payload }
+func (m *pollMessage) Ack()              {}
+
+// httpPoller fetches readings from a sensor's local HTTP API, such as the
+// /measures/current endpoint of AirGradient monitors
+type httpPoller struct {
+	url    string
+	client *http.Client
+}
+
+// newHTTPPoller creates a poller for url
+func newHTTPPoller(url string) *httpPoller {
+	return &httpPoller{url: url, client: &http.Client{Timeout: pollTimeout}}
+}
+
+// fetch GETs the current reading
+func (h *httpPoller) fetch() ([]byte, error) {
+	resp, err := h.client.Get(h.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxPollBody))
+}
+
+// poll fetches one reading and handles it like a message from the broker
+// Nothing is fetched while the broker is not connected, as the result could
+// not be published.
+func (p *processor) poll(client mqtt.Client, poller *httpPoller) {
+	if !client.IsConnected() {
+		slog.Debug("Not connected to the broker, skipping poll", "url", poller.url)
+		return
+	}
+	payload, err := poller.fetch()
+	if err != nil {
+		slog.Error("Failed to poll sensor", "url", poller.url, "error", err)
+		p.metrics.pollErrors.Inc()
+		return
+	}
+	p.handleMessage(client, &pollMessage{url: poller.url, payload: payload})
+}
+
+// runHTTPPoll polls url immediately and then every interval until stop is closed
+func (p *processor) runHTTPPoll(client mqtt.Client, url string, interval time.Duration, stop <-chan struct{}) {
+	poller := newHTTPPoller(url)
+	slog.Info("Polling sensor over HTTP", "url", url, "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.poll(client, poller)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
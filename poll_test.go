@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestHTTPPoll tests that a reading served over HTTP is published like one
+// received over MQTT
+func TestHTTPPoll(t *testing.T) {
+	sample, err := os.ReadFile("example_input.json")
+	if err != nil {
+		t.Fatalf("Failed to read sample payload: %v", err)
+	}
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodGet || r.URL.Path != "/measures/current" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(sample)
+	}))
+	defer server.Close()
+
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+	proc.poll(client, newHTTPPoller(server.URL+"/measures/current"))
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var input SensorReading
+	if err := json.Unmarshal(sample, &input); err != nil {
+		t.Fatalf("Failed to parse sample payload: %v", err)
+	}
+	var output AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output.SerialNo != input.SerialNo || output.PM02Standard != input.PM02Standard {
+		t.Errorf("Output serial %q PM2.5 %v, want %q %v from the polled reading", output.SerialNo, output.PM02Standard, input.SerialNo, input.PM02Standard)
+	}
+	if want := proc.calc.ComputeAQI(input.PM02Standard, input.PM10Standard); output.AQI != want {
+		t.Errorf("AQI = %d, want %d", output.AQI, want)
+	}
+
+	// Nothing is fetched while the broker is disconnected
+	client.Disconnect(0)
+	proc.poll(client, newHTTPPoller(server.URL+"/measures/current"))
+	if requests != 1 {
+		t.Errorf("Made %d requests, want 1 while disconnected", requests)
+	}
+}
+
+func TestHTTPPollError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+	proc.poll(client, newHTTPPoller(server.URL))
+
+	if len(client.messages()) != 0 {
+		t.Errorf("Published %d messages after a failed poll, want 0", len(client.messages()))
+	}
+	if got := testutil.ToFloat64(proc.metrics.pollErrors); got != 1 {
+		t.Errorf("aqi_poll_errors_total = %v, want 1", got)
+	}
+}
+
+// TestRunHTTPPoll tests that the sensor is polled at startup and every interval
+func TestRunHTTPPoll(t *testing.T) {
+	polled := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"serialno": "abc", "pm02Standard": 5}`))
+		polled <- struct{}{}
+	}))
+	defer server.Close()
+
+	proc := newProcessor("aqi")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		proc.runHTTPPoll(&fakeClient{}, server.URL, 10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-polled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for poll %d", i+1)
+		}
+	}
+	close(stop)
+	<-done
+}
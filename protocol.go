@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT protocol versions selectable with -mqtt-version
+const (
+	mqttVersion31  = "3.1"
+	mqttVersion311 = "3.1.1"
+	mqttVersion5   = "5"
+)
+
+// validateQoS checks that an -input-qos or -output-qos value is an MQTT QoS level
+func validateQoS(qos int) error {
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS %d: must be 0, 1 or 2", qos)
+	}
+	return nil
+}
+
+// protocolName maps a paho protocol version number back to its -mqtt-version name
+func protocolName(version uint) string {
+	switch version {
+	case 3:
+		return mqttVersion31
+	case 4:
+		return mqttVersion311
+	default:
+		return fmt.Sprint(version)
+	}
+}
+
+// protocolVersion maps an -mqtt-version value to the MQTT protocol version number
+// paho.mqtt.golang only speaks 3.1 and 3.1.1; version 5 uses the separate
+// paho.golang client, see newMQTTClient.
+func protocolVersion(version string) (uint, error) {
+	switch version {
+	case mqttVersion31:
+		return 3, nil
+	case mqttVersion311:
+		return 4, nil
+	case mqttVersion5:
+		return 5, nil
+	default:
+		return 0, fmt.Errorf("unknown MQTT version %q: must be %q, %q or %q", version, mqttVersion31, mqttVersion311, mqttVersion5)
+	}
+}
+
+// newMQTTClient creates the client for the -mqtt-version protocol version
+func newMQTTClient(opts *mqtt.ClientOptions, version uint) mqtt.Client {
+	if version == 5 {
+		return newMQTT5Client(opts)
+	}
+	opts.SetProtocolVersion(version)
+	return mqtt.NewClient(opts)
+}
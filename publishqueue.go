@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// publishRequest is a message waiting in the publish queue
+type publishRequest struct {
+	client   mqtt.Client
+	topic    string
+	qos      byte
+	retained bool
+	payload  interface{}
+	keep     bool // Never dropped when the queue is full, for discovery configs
+}
+
+// publishQueue hands messages to a worker goroutine so that a slow broker
+// does not block the MQTT callback that delivers sensor readings
+// When the buffer is full the oldest queued message is dropped: for a stream
+// of readings the newest values are the ones worth delivering. Discovery
+// configs are only published once per sensor, so they are never dropped and
+// may take the queue over its size.
+type publishQueue struct {
+	size int
+
+	mu       sync.Mutex
+	cond     *sync.Cond // Signalled when a request is queued or the queue is closed
+	requests []publishRequest
+	closed   bool
+	done     chan struct{} // Closed when the worker has emptied the queue and exited
+}
+
+// startPublishQueue makes p.publish asynchronous, with up to size messages
+// waiting for the broker
+func (p *processor) startPublishQueue(size int) {
+	q := &publishQueue{size: size, done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mu)
+	p.queue = q
+	go func() {
+		defer close(q.done)
+		for {
+			q.mu.Lock()
+			for len(q.requests) == 0 && !q.closed {
+				q.cond.Wait()
+			}
+			if len(q.requests) == 0 {
+				q.mu.Unlock()
+				return
+			}
+			req := q.requests[0]
+			q.requests = q.requests[1:]
+			q.mu.Unlock()
+
+			p.publishNow(req.client, req.topic, req.qos, req.retained, req.payload)
+		}
+	}()
+}
+
+// enqueue adds a message to the queue, dropping the oldest ones to make room
+// Once the queue is closed the message is published synchronously instead.
+func (p *processor) enqueue(req publishRequest) {
+	q := p.queue
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		p.publishNow(req.client, req.topic, req.qos, req.retained, req.payload)
+		return
+	}
+	if len(q.requests) >= q.size {
+		if i := slices.IndexFunc(q.requests, func(r publishRequest) bool { return !r.keep }); i >= 0 {
+			slog.Warn("Publish buffer full, dropping oldest message", "topic", q.requests[i].topic)
+			p.metrics.publishDropped.Inc()
+			q.requests = slices.Delete(q.requests, i, i+1)
+		}
+	}
+	q.requests = append(q.requests, req)
+	q.cond.Signal()
+	q.mu.Unlock()
+}
+
+// close stops the queue once the messages already in it are published, and
+// waits for the worker to finish
+func (q *publishQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Signal()
+	q.mu.Unlock()
+	<-q.done
+}
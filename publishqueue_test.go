@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestPublishQueueDoesNotBlockIngestion tests that handling readings returns
+// while the broker is not acknowledging, and that drain waits for the queue
+func TestPublishQueueDoesNotBlockIngestion(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.startPublishQueue(10)
+	client := &fakeClient{publishBlock: make(chan struct{})}
+
+	// Publish blocks until publishBlock is closed, so this would hang if
+	// ingestion waited for publishing
+	for i := range 5 {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "sensor-%d", "pm02Standard": 5}`, i)),
+		})
+	}
+	if got := len(client.messages()); got != 0 {
+		t.Fatalf("Published %d messages while the broker was blocked, want 0", got)
+	}
+
+	close(client.publishBlock)
+	if !proc.drain(5 * time.Second) {
+		t.Fatal("drain timed out")
+	}
+	if got := len(client.messages()); got != 5 {
+		t.Errorf("Published %d messages after drain, want 5", got)
+	}
+}
+
+// TestPublishQueueDropsOldest tests that a full queue makes room for new
+// messages by dropping the oldest queued ones
+func TestPublishQueueDropsOldest(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.startPublishQueue(2)
+	client := &fakeClient{publishBlock: make(chan struct{}), publishStarted: make(chan struct{})}
+
+	handle := func(i int) {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "sensor-%d", "pm02Standard": 5}`, i)),
+		})
+	}
+
+	// The first message occupies the worker, the rest compete for two slots
+	handle(0)
+	<-client.publishStarted
+	for i := 1; i <= 5; i++ {
+		handle(i)
+	}
+	close(client.publishBlock)
+	if !proc.drain(5 * time.Second) {
+		t.Fatal("drain timed out")
+	}
+
+	var serials []string
+	for _, msg := range client.messages() {
+		var output AQIReading
+		if err := json.Unmarshal(msg.Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		serials = append(serials, output.SerialNo)
+	}
+	if fmt.Sprint(serials) != "[sensor-0 sensor-4 sensor-5]" {
+		t.Errorf("Published %v, want the first message and the two newest", serials)
+	}
+	if dropped := testutil.ToFloat64(proc.metrics.publishDropped); dropped != 3 {
+		t.Errorf("aqi_publish_dropped_total = %g, want 3", dropped)
+	}
+}
+
+// TestPublishQueueKeepsDiscovery tests that a full queue drops readings
+// rather than discovery configs, which are not published again
+func TestPublishQueueKeepsDiscovery(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.haDiscovery = true
+	proc.startPublishQueue(1)
+	client := &fakeClient{publishBlock: make(chan struct{}), publishStarted: make(chan struct{})}
+
+	handle := func(serial string) {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(`{"serialno": "` + serial + `", "pm02Standard": 5}`),
+		})
+	}
+	handle("sensor-a")
+	<-client.publishStarted
+	handle("sensor-b")
+	close(client.publishBlock)
+	if !proc.drain(5 * time.Second) {
+		t.Fatal("drain timed out")
+	}
+
+	discovery := 0
+	for _, msg := range client.messages() {
+		if strings.HasPrefix(msg.Topic, "homeassistant/") {
+			discovery++
+		}
+	}
+	if want := 2 * len(haEntities); discovery != want {
+		t.Errorf("Published %d discovery configs, want %d", discovery, want)
+	}
+}
+
+// TestPublishQueueClosed tests that publishing after drain has closed the
+// queue is synchronous, as for the offline status on shutdown
+func TestPublishQueueClosed(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.startPublishQueue(1)
+	client := &fakeClient{}
+	if !proc.drain(time.Second) {
+		t.Fatal("drain timed out")
+	}
+
+	proc.publish(client, "aqi/status", true, "offline")
+	if got := len(client.messages()); got != 1 {
+		t.Errorf("Published %d messages after the queue was closed, want 1", got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// restartFields are the configuration keys that only take effect after a
+// restart, because they configure the broker connection or the listeners
+var restartFields = []string{
+	"broker", "port", "transport", "ws_path", "tls", "cafile", "certfile", "keyfile",
+	"insecure_skip_verify", "client_id", "username", "password", "mqtt_version",
+	"input_qos", "publish_buffer", "status_topic", "availability_topic", "heartbeat_interval", "reconnect_max_interval", "keepalive", "connect_timeout", "connect_retries", "clean_session",
+	"metrics_addr", "health_addr", "stats_interval", "summary_topic", "state_file", "state_interval", "stale_after", "http_poll_url", "poll_interval", "csv_file", "csv_max_size",
+	"output_broker", "output_username", "output_password", "output_cafile", "output_certfile", "output_keyfile",
+	"log_format", "log_level",
+}
+
+// configChanges returns the YAML keys of the settings that differ between old and new
+func configChanges(old, new *Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		key, _, _ := strings.Cut(oldValue.Type().Field(i).Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// reload replaces the processing settings with those from cfg
+// The breakpoints file is loaded first, so that an invalid file leaves the
+// current settings in place. Messages being handled finish with the old
+// settings.
+func (p *processor) reload(cfg *Config) error {
+	var tables *breakpointsFile
+	if cfg.BreakpointsFile != "" {
+		var err error
+		if tables, err = loadBreakpointsFile(cfg.BreakpointsFile); err != nil {
+			return err
+		}
+	}
+
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+	p.applyConfig(cfg)
+	if tables != nil {
+		p.applyBreakpoints(tables)
+	}
+	return nil
+}
+
+// reloader re-reads the configuration when the daemon receives SIGHUP
+type reloader struct {
+	args     []string // Command-line arguments, which still override the file
+	cfg      *Config  // Configuration loaded last
+	proc     *processor
+	topics   *topicConfig
+	client   mqtt.Client
+	inputQoS byte
+}
+
+// run reloads the configuration for every signal received on sighup
+func (r *reloader) run(sighup <-chan os.Signal) {
+	for range sighup {
+		slog.Info("Reloading configuration")
+		r.reload()
+	}
+}
+
+// reload loads and applies the configuration, keeping the current one if the
+// new one is invalid
+func (r *reloader) reload() {
+	cfg, err := loadConfig(r.args)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		slog.Error("Failed to reload configuration, keeping the current one", "error", err)
+		return
+	}
+
+	changed := configChanges(r.cfg, cfg)
+	if len(changed) == 0 {
+		slog.Info("Configuration unchanged")
+		return
+	}
+	if err := r.proc.reload(cfg); err != nil {
+		slog.Error("Failed to reload configuration, keeping the current one", "error", err)
+		return
+	}
+
+	// Move the subscriptions to the new input topics
+	oldTopics, _ := r.topics.get()
+	r.topics.set(cfg.InputTopics, cfg.OutputTopic)
+	var removed, added []string
+	for _, topic := range oldTopics {
+		if !slices.Contains(cfg.InputTopics, topic) {
+			removed = append(removed, topic)
+		}
+	}
+	for _, topic := range cfg.InputTopics {
+		if !slices.Contains(oldTopics, topic) {
+			added = append(added, topic)
+		}
+	}
+	if len(removed) > 0 && r.client.IsConnected() {
+		if token := r.client.Unsubscribe(removed...); token.Wait() && token.Error() != nil {
+			slog.Error("Failed to unsubscribe", "topics", removed, "error", token.Error())
+		}
+	}
+	if len(added) > 0 && r.client.IsConnected() {
+		r.proc.markSubscribed()
+		subscribe(r.client, added, r.inputQoS, r.proc.handleMessage)
+	}
+
+	var restart []string
+	for _, key := range changed {
+		if slices.Contains(restartFields, key) {
+			restart = append(restart, key)
+		}
+	}
+	slog.Info("Reloaded configuration", "changed", changed)
+	if len(restart) > 0 {
+		slog.Warn("Some changed settings only take effect after a restart", "settings", restart)
+	}
+	r.cfg = cfg
+}
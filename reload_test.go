@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"aqi-mqtt/aqi"
+)
+
+// newTestReloader loads the configuration from args into a processor and
+// returns a reloader for it
+func newTestReloader(t *testing.T, args []string) (*reloader, *fakeClient) {
+	t.Helper()
+
+	cfg, err := loadConfig(args)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	proc := newProcessor("")
+	proc.applyConfig(cfg)
+	client := &fakeClient{}
+	return &reloader{
+		args:     args,
+		cfg:      cfg,
+		proc:     proc,
+		topics:   &topicConfig{inputTopics: cfg.InputTopics, outputTopic: cfg.OutputTopic},
+		client:   client,
+		inputQoS: 1,
+	}, client
+}
+
+// TestReloadOnSIGHUP rewrites the config file, sends SIGHUP, and checks that
+// the new averaging window takes effect
+func TestReloadOnSIGHUP(t *testing.T) {
+	path := writeConfigFile(t, "average_window: 0s\n")
+	r, client := newTestReloader(t, []string{"-config", path, "-broker", "localhost", "-input-topic", "in", "-output-topic", "aqi"})
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		r.run(sighup)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		signal.Stop(sighup)
+		close(sighup)
+		<-done
+	})
+
+	if err := os.WriteFile(path, []byte("average_window: 10m\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rewrite config file: %v", err)
+	}
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Failed to find own process: %v", err)
+	}
+	if err := self.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to send SIGHUP: %v", err)
+	}
+
+	window := func() time.Duration {
+		r.proc.configMu.RLock()
+		defer r.proc.configMu.RUnlock()
+		return r.proc.averageWindow
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for window() != 10*time.Minute {
+		if time.Now().After(deadline) {
+			t.Fatalf("Average window = %v after SIGHUP, want 10m", window())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Two readings are now averaged
+	for _, pm10 := range []string{"100", "200"} {
+		r.proc.handleMessage(client, &fakeMessage{
+			topic:   "in",
+			payload: []byte(`{"serialno": "abc", "pm10Standard": ` + pm10 + `}`),
+		})
+	}
+	messages := client.messages()
+	var output AQIReading
+	if err := json.Unmarshal(messages[len(messages)-1].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if want := aqi.ComputeAQI(0, 150); output.AQI != want {
+		t.Errorf("AQI after reload = %d, want %d from the averaged PM10", output.AQI, want)
+	}
+}
+
+// TestReloadTopics tests that a reload moves the subscriptions to the new input topics
+func TestReloadTopics(t *testing.T) {
+	path := writeConfigFile(t, "input_topics: [a, b]\noutput_topic: aqi\n")
+	r, client := newTestReloader(t, []string{"-config", path, "-broker", "localhost"})
+
+	if err := os.WriteFile(path, []byte("input_topics: [b, c]\noutput_topic: aqi/{serialno}\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rewrite config file: %v", err)
+	}
+	r.reload()
+
+	if !reflect.DeepEqual(client.unsubscribed, []string{"a"}) || !reflect.DeepEqual(client.subscribed, []string{"c"}) {
+		t.Errorf("Unsubscribed %v and subscribed %v, want [a] and [c]", client.unsubscribed, client.subscribed)
+	}
+	if inputTopics, outputTopic := r.topics.get(); !reflect.DeepEqual(inputTopics, []string{"b", "c"}) || outputTopic != "aqi/{serialno}" {
+		t.Errorf("Topics after reload = %v, %q", inputTopics, outputTopic)
+	}
+	if r.proc.outputTopic != "aqi/{serialno}" {
+		t.Errorf("Processor output topic = %q, want aqi/{serialno}", r.proc.outputTopic)
+	}
+}
+
+// TestReloadKeepsThrottle tests that a reload changes -min-interval without
+// losing the publishes it has already deferred
+func TestReloadKeepsThrottle(t *testing.T) {
+	path := writeConfigFile(t, "min_interval: 1h\n")
+	r, client := newTestReloader(t, []string{"-config", path, "-broker", "localhost", "-input-topic", "in", "-output-topic", "aqi"})
+	throttle := r.proc.throttle
+
+	for _, pm25 := range []string{"5", "6"} {
+		r.proc.handleMessage(client, &fakeMessage{
+			topic:   "in",
+			payload: []byte(`{"serialno": "abc", "pm02Standard": ` + pm25 + `}`),
+		})
+	}
+	if err := os.WriteFile(path, []byte("min_interval: 2h\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rewrite config file: %v", err)
+	}
+	r.reload()
+
+	if r.proc.throttle != throttle || throttle.interval != 2*time.Hour {
+		t.Fatalf("Reload did not update the throttle in place")
+	}
+	if !r.proc.drain(time.Second) {
+		t.Fatal("drain timed out")
+	}
+	if got := len(client.messages()); got != 2 {
+		t.Errorf("Published %d messages, want the deferred one as well", got)
+	}
+}
+
+// TestReloadSummaryTopic tests that a summary topic added on reload waits
+// for a restart, which starts the midnight flush along with it
+func TestReloadSummaryTopic(t *testing.T) {
+	path := writeConfigFile(t, "average_window: 5m\n")
+	r, _ := newTestReloader(t, []string{"-config", path, "-broker", "localhost", "-input-topic", "in", "-output-topic", "aqi"})
+
+	if err := os.WriteFile(path, []byte("summary_topic: aqi/summary\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rewrite config file: %v", err)
+	}
+	r.reload()
+
+	if r.proc.summaryTopic != "" {
+		t.Errorf("Summary topic = %q after reload, want it unchanged until a restart", r.proc.summaryTopic)
+	}
+	if r.cfg.SummaryTopic != "aqi/summary" {
+		t.Errorf("Reloaded config has summary topic %q, want aqi/summary", r.cfg.SummaryTopic)
+	}
+}
+
+// TestReloadInvalidConfig tests that an invalid file keeps the current configuration
+func TestReloadInvalidConfig(t *testing.T) {
+	path := writeConfigFile(t, "average_window: 5m\n")
+	r, _ := newTestReloader(t, []string{"-config", path, "-broker", "localhost", "-input-topic", "in", "-output-topic", "aqi"})
+
+	if err := os.WriteFile(path, []byte("standard: bogus\naverage_window: 1m\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rewrite config file: %v", err)
+	}
+	r.reload()
+
+	if r.proc.averageWindow != 5*time.Minute || r.proc.standard != standardEPA {
+		t.Errorf("Invalid reload changed the settings: window %v, standard %q", r.proc.averageWindow, r.proc.standard)
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old := defaultConfig()
+	next := defaultConfig()
+	next.Broker = "other"
+	next.AverageWindow = time.Minute
+	next.InputTopics = []string{"in"}
+
+	expected := []string{"broker", "input_topics", "average_window"}
+	if got := configChanges(old, next); !reflect.DeepEqual(got, expected) {
+		t.Errorf("configChanges = %v, want %v", got, expected)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// replayMessage is a reading read from a -replay-dir file
+type replayMessage struct {
+	path    string
+	payload []byte
+}
+
+func (m *replayMessage) Duplicate() bool   { return false }
+func (m *replayMessage) Qos() byte         { return 0 }
+func (m *replayMessage) Retained() bool    { return false }
+func (m *replayMessage) Topic() string     { return m.path }
+func (m *replayMessage) MessageID() uint16 { return 0 }
+func (m *replayMessage) Payload() []byte   { return m.payload }
+func (m *replayMessage) Ack()              {}
+
+// replayFiles returns the *.json files in dir, sorted by name
+func replayFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("listing replay files: %w", err)
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("reading replay directory: %w", err)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// replayDelay is how long to wait between readings taken at prev and next
+// when replaying at speed times real time
+func replayDelay(prev, next time.Time, speed float64) time.Duration {
+	return time.Duration(float64(next.Sub(prev)) / speed)
+}
+
+// runReplay feeds each *.json file in dir through handleMessage as one
+// reading, in name order, publishing with client
+// With a speed above zero, readings with payload timestamps are spaced out
+// by the time between their timestamps divided by speed; otherwise they are
+// replayed as fast as possible.
+func (p *processor) runReplay(client mqtt.Client, dir string, speed float64) error {
+	files, err := replayFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var prev time.Time
+	for _, path := range files {
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading replay file: %w", err)
+		}
+		payload = bytes.TrimSpace(payload)
+		if t, ok := payloadTimestamp(payload); ok {
+			if speed > 0 && !prev.IsZero() {
+				if d := replayDelay(prev, t, speed); d > 0 {
+					<-p.clock.After(d)
+				}
+			}
+			prev = t
+		}
+		p.handleMessage(client, &replayMessage{path: path, payload: payload})
+	}
+	return nil
+}
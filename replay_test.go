@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aqi-mqtt/aqi"
+)
+
+// writeReplayFiles writes each payload to a file named by its key in a new
+// directory
+func writeReplayFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, payload := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(payload), 0o644); err != nil {
+			t.Fatalf("Failed to write replay file: %v", err)
+		}
+	}
+	return dir
+}
+
+// TestRunReplay replays two files and checks that the output follows the
+// file names and skips files that are not *.json
+func TestRunReplay(t *testing.T) {
+	dir := writeReplayFiles(t, map[string]string{
+		"002.json":   `{"serialno": "bedroom", "pm02Standard": 8.0, "pm10Standard": 20}` + "\n",
+		"001.json":   `{"serialno": "kitchen", "pm02Standard": 35.7, "pm10Standard": 45}`,
+		"notes.txt":  "not a reading",
+		"003.json~":  `{"serialno": "backup", "pm02Standard": 5}`,
+		"004.jsonld": `{"serialno": "other", "pm02Standard": 5}`,
+	})
+
+	proc := newProcessor("aqi")
+	var out bytes.Buffer
+	if err := proc.runReplay(&writerClient{w: &out}, dir, 0); err != nil {
+		t.Fatalf("runReplay returned error: %v", err)
+	}
+
+	expected := []struct {
+		serialNo string
+		aqi      int
+	}{
+		{"kitchen", aqi.ComputeAQI(35.7, 45)},
+		{"bedroom", aqi.ComputeAQI(8.0, 20)},
+	}
+	scanner := bufio.NewScanner(&out)
+	for i, want := range expected {
+		if !scanner.Scan() {
+			t.Fatalf("Output has %d lines, want %d", i, len(expected))
+		}
+		var reading AQIReading
+		if err := json.Unmarshal(scanner.Bytes(), &reading); err != nil {
+			t.Fatalf("Line %d is not JSON: %v", i, err)
+		}
+		if reading.SerialNo != want.serialNo || reading.AQI != want.aqi {
+			t.Errorf("Line %d = %s AQI %d, want %s AQI %d", i, reading.SerialNo, reading.AQI, want.serialNo, want.aqi)
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("Unexpected extra output: %s", scanner.Text())
+	}
+
+	if err := proc.runReplay(&writerClient{w: &out}, filepath.Join(dir, "missing"), 0); err == nil {
+		t.Error("runReplay accepted a missing directory")
+	}
+}
+
+// TestReplaySpeed tests that -replay-speed spaces out readings by their
+// payload timestamps
+func TestReplaySpeed(t *testing.T) {
+	dir := writeReplayFiles(t, map[string]string{
+		"001.json": `{"serialno": "abc", "pm02Standard": 5, "timestamp": "2024-08-01T12:00:00Z"}`,
+		"002.json": `{"serialno": "abc", "pm02Standard": 5, "timestamp": "2024-08-01T12:10:00Z"}`,
+	})
+
+	clock := &fakeClock{now: time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	client := &fakeClient{}
+	done := make(chan error)
+	go func() { done <- proc.runReplay(client, dir, 60) }()
+
+	// Ten minutes at 60 times real time is ten seconds
+	clock.waitForWaiters(t, 1)
+	if n := len(client.messages()); n != 1 {
+		t.Fatalf("Published %d messages before the delay, want 1", n)
+	}
+	clock.advance(9 * time.Second)
+	if n := len(client.messages()); n != 1 {
+		t.Fatalf("Published %d messages before the delay elapsed, want 1", n)
+	}
+	clock.advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("runReplay returned error: %v", err)
+	}
+	if n := len(client.messages()); n != 2 {
+		t.Errorf("Published %d messages, want 2", n)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Payloads of the retained <output-topic>/stale flag
+const (
+	staleTrue  = "true"
+	staleFalse = "false"
+)
+
+// staleState tracks when a sensor last sent a reading, for -stale-after
+type staleState struct {
+	topic    string    // Stale flag topic
+	lastSeen time.Time // When the last reading arrived
+	stale    bool      // Whether the flag currently says stale
+	flagged  bool      // Whether the flag has been published at all
+}
+
+// staleTopic returns the topic of a sensor's stale flag, given its expanded
+// output topic
+func staleTopic(outputTopic string) string {
+	return outputTopic + "/stale"
+}
+
+// markSeen records a reading from a sensor at now and clears its stale flag,
+// publishing "false" the first time the sensor is seen and when it recovers
+// outputTopic is the sensor's expanded output topic.
+func (p *processor) markSeen(client mqtt.Client, serialNo, outputTopic string, now time.Time) {
+	p.mu.Lock()
+	activity, ok := p.activity[serialNo]
+	if !ok {
+		activity = &staleState{topic: staleTopic(outputTopic)}
+		p.activity[serialNo] = activity
+	}
+	activity.lastSeen = now
+	publish := activity.stale || !activity.flagged
+	activity.stale, activity.flagged = false, true
+	topic := activity.topic
+	p.mu.Unlock()
+
+	if publish {
+		if ok {
+			slog.Info("Sensor is sending readings again", "serialno", serialNo)
+		}
+		p.publish(client, topic, true, staleFalse)
+	}
+}
+
+// checkStale publishes "true" to the stale flag of every sensor that has sent
+// nothing for -stale-after as of now
+func (p *processor) checkStale(client mqtt.Client, now time.Time) {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+
+	type staleSensor struct {
+		serialNo, topic string
+		lastSeen        time.Time
+	}
+	p.mu.Lock()
+	var stale []staleSensor
+	for serialNo, activity := range p.activity {
+		if !activity.stale && now.Sub(activity.lastSeen) >= p.staleAfter {
+			activity.stale = true
+			stale = append(stale, staleSensor{serialNo, activity.topic, activity.lastSeen})
+		}
+	}
+	p.mu.Unlock()
+
+	for _, sensor := range stale {
+		slog.Warn("No readings from sensor, marking it stale", "serialno", sensor.serialNo, "last_seen", formatTimestamp(sensor.lastSeen))
+		p.publish(client, sensor.topic, true, staleTrue)
+	}
+}
+
+// staleCheckInterval is how often sensors are checked for -stale-after, so
+// that a stale sensor is flagged at most a tenth of the window late
+func staleCheckInterval(staleAfter time.Duration) time.Duration {
+	return max(staleAfter/10, time.Second)
+}
+
+// runStaleWatchdog checks for stale sensors until stop is closed
+func (p *processor) runStaleWatchdog(client mqtt.Client, stop <-chan struct{}) {
+	ticker := time.NewTicker(staleCheckInterval(p.staleAfter))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.checkStale(client, now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// staleFlags returns the payloads published to a stale flag topic
+func staleFlags(client *fakeClient, topic string) []string {
+	var flags []string
+	for _, msg := range client.messages() {
+		if msg.Topic == topic {
+			if !msg.Retained {
+				return append(flags, "not retained")
+			}
+			flags = append(flags, string(msg.Payload))
+		}
+	}
+	return flags
+}
+
+// TestStaleWatchdog drives the watchdog with a fake clock and checks that the
+// flag is set when a sensor goes quiet and cleared when it returns
+func TestStaleWatchdog(t *testing.T) {
+	proc := newProcessor("aqi/{serialno}")
+	proc.staleAfter = 10 * time.Minute
+	client := &fakeClient{}
+	start := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	proc.markSeen(client, "abc", "aqi/abc", start)
+	proc.markSeen(client, "abc", "aqi/abc", start.Add(5*time.Minute))
+
+	// Each reading resets the window
+	proc.checkStale(client, start.Add(14*time.Minute))
+	if got := staleFlags(client, "aqi/abc/stale"); len(got) != 1 || got[0] != staleFalse {
+		t.Fatalf("Flags before the window elapsed = %v, want [false]", got)
+	}
+
+	proc.checkStale(client, start.Add(15*time.Minute))
+	proc.checkStale(client, start.Add(20*time.Minute)) // Flagged only once
+	if got := staleFlags(client, "aqi/abc/stale"); len(got) != 2 || got[1] != staleTrue {
+		t.Fatalf("Flags after the window elapsed = %v, want [false true]", got)
+	}
+
+	proc.markSeen(client, "abc", "aqi/abc", start.Add(30*time.Minute))
+	if got := staleFlags(client, "aqi/abc/stale"); len(got) != 3 || got[2] != staleFalse {
+		t.Errorf("Flags after the sensor returned = %v, want [false true false]", got)
+	}
+}
+
+// TestStaleWatchdogReadings checks that handled readings feed the watchdog
+func TestStaleWatchdogReadings(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.staleAfter = time.Minute
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`),
+	})
+	proc.checkStale(client, time.Now().Add(2*time.Minute))
+
+	if got := staleFlags(client, "aqi/stale"); len(got) != 2 || got[0] != staleFalse || got[1] != staleTrue {
+		t.Errorf("Stale flags = %v, want [false true]", got)
+	}
+
+	// Without -stale-after nothing is tracked
+	proc = newProcessor("aqi")
+	client = &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`),
+	})
+	if got := staleFlags(client, "aqi/stale"); len(got) != 0 {
+		t.Errorf("Stale flags without -stale-after = %v, want none", got)
+	}
+}
+
+func TestStaleCheckInterval(t *testing.T) {
+	if got := staleCheckInterval(10 * time.Minute); got != time.Minute {
+		t.Errorf("staleCheckInterval(10m) = %v, want 1m", got)
+	}
+	if got := staleCheckInterval(5 * time.Second); got != time.Second {
+		t.Errorf("staleCheckInterval(5s) = %v, want 1s", got)
+	}
+}
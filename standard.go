@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"aqi-mqtt/aqi"
+)
+
+// Air quality index standards selectable with -standard
+const (
+	standardEPA   = "epa"
+	standardAQHI  = "aqhi"
+	standardCAQI  = "caqi"
+	standardDAQI  = "daqi"
+	standardIndia = "india"
+)
+
+// validateStandard checks that an index standard is supported
+func validateStandard(standard string) error {
+	switch standard {
+	case standardEPA, standardAQHI, standardCAQI, standardDAQI, standardIndia:
+		return nil
+	default:
+		return fmt.Errorf("unknown standard %q: must be %q, %q, %q, %q or %q", standard, standardEPA, standardAQHI, standardCAQI, standardDAQI, standardIndia)
+	}
+}
+
+// PM2.5 breakpoint revisions selectable with -pm25-revision
+const (
+	pm25Revision2012 = "2012"
+	pm25Revision2024 = "2024"
+)
+
+// validatePM25Revision checks that a PM2.5 breakpoint revision is supported
+func validatePM25Revision(revision string) error {
+	switch revision {
+	case pm25Revision2012, pm25Revision2024:
+		return nil
+	default:
+		return fmt.Errorf("unknown PM2.5 revision %q: must be %q or %q", revision, pm25Revision2012, pm25Revision2024)
+	}
+}
+
+// AQI rounding modes selectable with -aqi-rounding
+const (
+	aqiRoundingRound    = "round"
+	aqiRoundingTruncate = "truncate"
+	aqiRoundingCeil     = "ceil"
+)
+
+// aqiRoundings maps the -aqi-rounding modes to the aqi package's roundings
+var aqiRoundings = map[string]aqi.Rounding{
+	aqiRoundingRound:    aqi.RoundNearest,
+	aqiRoundingTruncate: aqi.RoundTruncate,
+	aqiRoundingCeil:     aqi.RoundCeil,
+}
+
+// validateAQIRounding checks that an AQI rounding mode is supported
+func validateAQIRounding(rounding string) error {
+	if _, ok := aqiRoundings[rounding]; !ok {
+		return fmt.Errorf("unknown AQI rounding %q: must be %q, %q or %q", rounding, aqiRoundingRound, aqiRoundingTruncate, aqiRoundingCeil)
+	}
+	return nil
+}
+
+// newCalculator creates an EPA AQI calculator for the PM2.5 revision
+// The PM10 table is the same in both revisions.
+func newCalculator(revision string, extended bool, rounding string) aqi.Calculator {
+	calc := aqi.NewCalculator()
+	if revision == pm25Revision2024 {
+		calc.PM25 = aqi.PM25Breakpoints2024
+	}
+	calc.Extended = extended
+	calc.Rounding = aqiRoundings[rounding]
+	return calc
+}
+
+// index computes the index value on the processor's standard from the PM
+// concentrations and the gases in reading
+func (p *processor) index(reading SensorReading, pm25, pm10 float64) int {
+	switch p.standard {
+	case standardAQHI:
+		return computeAQHI(valueOrZero(reading.NO2), valueOrZero(reading.Ozone), pm25)
+	case standardCAQI:
+		return computeCAQI(pm25, pm10, reading.NO2, reading.Ozone, p.caqiGrid)
+	case standardDAQI:
+		return computeDAQI(pm25, pm10, reading.NO2, reading.Ozone, reading.SO2)
+	case standardIndia:
+		return computeIndiaAQI(pm25, pm10)
+	default:
+		return p.epaResult(reading, pm25, pm10).Value
+	}
+}
+
+// validatePollutants checks that each pollutant has an EPA sub-index
+func validatePollutants(pollutants []string) error {
+	for _, pollutant := range pollutants {
+		if !slices.Contains(aqi.Pollutants, pollutant) {
+			return fmt.Errorf("unknown pollutant %q: must be one of %s", pollutant, strings.Join(aqi.Pollutants, ", "))
+		}
+	}
+	return nil
+}
+
+// gases returns the gas concentrations in the reading, as the EPA calculator
+// takes them
+func (r SensorReading) gases() aqi.Gases {
+	return aqi.Gases{Ozone: r.Ozone, CO: r.CO, SO2: r.SO2, NO2: r.NO2}
+}
+
+// epaResult computes the EPA AQI from PM concentrations and the gases in
+// reading, counting only the pollutants selected with -pollutants
+func (p *processor) epaResult(reading SensorReading, pm25, pm10 float64) aqi.AQIResult {
+	result := p.calc.ComputeAQIDetailed(pm25, pm10, reading.gases())
+	if len(p.pollutants) > 0 {
+		result = result.Select(p.pollutants)
+	}
+	// A missing PM concentration has no sub-index, rather than one of 0
+	if reading.noPM25 || reading.noPM10 {
+		result = result.Select(slices.DeleteFunc(slices.Clone(aqi.Pollutants), func(pollutant string) bool {
+			return pollutant == aqi.PollutantPM25 && reading.noPM25 || pollutant == aqi.PollutantPM10 && reading.noPM10
+		}))
+	}
+	return result
+}
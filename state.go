@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is incremented when the state file format changes incompatibly
+const stateVersion = 1
+
+// savedState is the per-sensor state written to -state-file
+// It holds what the daemon needs to carry on where it left off: the moving
+// average and NowCast buffers and the last published AQI for
+// -publish-on-change.
+type savedState struct {
+	Version   int                        `json:"version"`
+	SavedAt   time.Time                  `json:"savedAt"`
+	NowCasts  map[string][]nowCastSample `json:"nowcasts,omitempty"`
+	Averages  map[string][]averageSample `json:"averages,omitempty"`
+	Published map[string]savedAQI        `json:"published,omitempty"`
+}
+
+// savedAQI is a publishedAQI in the state file
+type savedAQI struct {
+	AQI int       `json:"aqi"`
+	At  time.Time `json:"at"`
+}
+
+// snapshot copies the processor's per-sensor state
+func (p *processor) snapshot(now time.Time) savedState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := savedState{
+		Version:   stateVersion,
+		SavedAt:   now,
+		NowCasts:  make(map[string][]nowCastSample, len(p.nowcasts)),
+		Averages:  make(map[string][]averageSample, len(p.averages)),
+		Published: make(map[string]savedAQI, len(p.published)),
+	}
+	for serialNo, nc := range p.nowcasts {
+		state.NowCasts[serialNo] = append([]nowCastSample(nil), nc.samples...)
+	}
+	for serialNo, avg := range p.averages {
+		if len(avg.samples) > 0 {
+			state.Averages[serialNo] = append([]averageSample(nil), avg.samples...)
+		}
+	}
+	for serialNo, last := range p.published {
+		state.Published[serialNo] = savedAQI{AQI: last.aqi, At: last.at}
+	}
+	return state
+}
+
+// restore replaces the processor's per-sensor state with a saved one
+// Samples that have fallen out of a window are evicted by the next reading.
+func (p *processor) restore(state savedState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for serialNo, samples := range state.NowCasts {
+		p.nowcasts[serialNo] = &NowCast{samples: samples}
+	}
+	for serialNo, samples := range state.Averages {
+		avg := newMovingAverage(p.averageWindow)
+		avg.samples = samples
+		p.averages[serialNo] = avg
+	}
+	for serialNo, last := range state.Published {
+		p.published[serialNo] = publishedAQI{aqi: last.AQI, at: last.At}
+	}
+}
+
+// saveState writes the processor's state to path
+// The file is replaced atomically so that a crash while writing cannot leave
+// a truncated state file behind.
+func (p *processor) saveState(path string, now time.Time) error {
+	data, err := json.Marshal(p.snapshot(now))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// loadState restores the processor's state from path
+// A missing file is not an error, since there is nothing to restore on the
+// first start. A corrupt or incompatible file is logged and ignored, leaving
+// the state empty, rather than keeping the daemon from starting.
+func (p *processor) loadState(path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No state file, starting with empty state", "file", path)
+		return
+	}
+	if err != nil {
+		slog.Warn("Failed to read state file, starting with empty state", "file", path, "error", err)
+		return
+	}
+
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("Ignoring corrupt state file", "file", path, "error", err)
+		return
+	}
+	if state.Version != stateVersion {
+		slog.Warn("Ignoring state file with unsupported version", "file", path, "version", state.Version)
+		return
+	}
+
+	p.restore(state)
+	slog.Info("Restored state", "file", path, "savedAt", state.SavedAt, "sensors", len(state.NowCasts))
+}
+
+// runStateSaver saves the state to path every interval until stop is closed
+func (p *processor) runStateSaver(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := p.saveState(path, now); err != nil {
+				slog.Error("Failed to save state", "file", path, "error", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestStateRestart tests that the NowCast and averaging buffers survive a
+// save and load by a new processor
+func TestStateRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	before := newProcessor("aqi")
+	before.averageWindow = time.Hour
+	before.nowCast("abc", start, 20)
+	before.nowCast("abc", start.Add(time.Hour), 30)
+	before.average("abc", start.Add(time.Hour), ptr(30.0), ptr(40.0))
+	before.changed("abc", 88, start.Add(time.Hour))
+	if err := before.saveState(path, start.Add(time.Hour)); err != nil {
+		t.Fatalf("saveState returned error: %v", err)
+	}
+
+	// "Restart" with a fresh processor
+	after := newProcessor("aqi")
+	after.averageWindow = time.Hour
+	after.loadState(path)
+
+	if !reflect.DeepEqual(after.nowcasts["abc"].samples, before.nowcasts["abc"].samples) {
+		t.Errorf("NowCast samples = %+v, want %+v", after.nowcasts["abc"].samples, before.nowcasts["abc"].samples)
+	}
+
+	// The third hour completes a valid NowCast only with the restored hours
+	got, ok := after.nowCast("abc", start.Add(2*time.Hour), 25)
+	want, _ := before.nowCast("abc", start.Add(2*time.Hour), 25)
+	if !ok {
+		t.Error("No NowCast after restart, want the restored buffer to be used")
+	} else if gotAQI, wantAQI := after.calc.CalculateAQI(got, after.calc.PM25), before.calc.CalculateAQI(want, before.calc.PM25); gotAQI != wantAQI {
+		t.Errorf("NowCast AQI after restart = %d, want %d", gotAQI, wantAQI)
+	}
+
+	if pm25, pm10 := after.average("abc", start.Add(90*time.Minute), ptr(50.0), ptr(60.0)); pm25 != 40 || pm10 != 50 {
+		t.Errorf("Average after restart = %g/%g, want 40/50 including the restored sample", pm25, pm10)
+	}
+	if after.changed("abc", 88, start.Add(2*time.Hour)) {
+		t.Error("Unchanged AQI reported as changed after restart, want the last published AQI restored")
+	}
+}
+
+func TestStateCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"truncated": `{"version": 1, "nowcasts": {"abc": [{"time": "2025-`,
+		"version":   `{"version": 99, "nowcasts": {"abc": [{"time": "2025-06-01T12:00:00Z", "concentration": 20}]}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			proc := newProcessor("aqi")
+			proc.loadState(path)
+			if len(proc.nowcasts) != 0 || len(proc.averages) != 0 || len(proc.published) != 0 {
+				t.Error("State restored from an unusable file, want empty state")
+			}
+		})
+	}
+}
+
+func TestStateMissingFile(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.loadState(filepath.Join(t.TempDir(), "missing.json"))
+	if len(proc.nowcasts) != 0 {
+		t.Error("State restored from a missing file")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// stats counts processed messages for the periodic -stats-interval summary
+type stats struct {
+	start time.Time
+
+	mu            sync.Mutex
+	received      uint64
+	published     uint64
+	parseErrors   uint64
+	publishErrors uint64
+	lastPublish   time.Time // Zero until the first successful publish
+}
+
+// newStats creates statistics for a daemon started at start
+func newStats(start time.Time) *stats {
+	return &stats{start: start}
+}
+
+// messageReceived counts an incoming message
+func (s *stats) messageReceived() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received++
+}
+
+// parseError counts a message that could not be parsed
+func (s *stats) parseError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parseErrors++
+}
+
+// messagePublished counts a successful publish at now
+func (s *stats) messagePublished(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published++
+	s.lastPublish = now
+}
+
+// publishError counts a failed publish
+func (s *stats) publishError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.publishErrors++
+}
+
+// summary returns the statistics as log attributes, with uptime measured at now
+func (s *stats) summary(now time.Time) []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastPublish := "never"
+	if !s.lastPublish.IsZero() {
+		lastPublish = formatTimestamp(s.lastPublish)
+	}
+	return []any{
+		"uptime", now.Sub(s.start).Round(time.Second).String(),
+		"received", s.received,
+		"published", s.published,
+		"parse_errors", s.parseErrors,
+		"publish_errors", s.publishErrors,
+		"last_publish", lastPublish,
+	}
+}
+
+// logStats logs the statistics summary every interval until stop is closed
+func (s *stats) logStats(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			slog.Info("Statistics", s.summary(now)...)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStatsSummary advances a fake clock and checks the counters and uptime
+func TestStatsSummary(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := newStats(start)
+
+	attrs := func(now time.Time) map[string]any {
+		summary := s.summary(now)
+		m := make(map[string]any)
+		for i := 0; i < len(summary); i += 2 {
+			m[summary[i].(string)] = summary[i+1]
+		}
+		return m
+	}
+
+	got := attrs(start)
+	if got["uptime"] != "0s" || got["received"] != uint64(0) || got["last_publish"] != "never" {
+		t.Errorf("Initial summary = %v", got)
+	}
+
+	s.messageReceived()
+	s.messageReceived()
+	s.parseError()
+	s.messagePublished(start.Add(time.Minute))
+	s.publishError()
+
+	got = attrs(start.Add(90 * time.Minute))
+	expected := map[string]any{
+		"uptime":         "1h30m0s",
+		"received":       uint64(2),
+		"published":      uint64(1),
+		"parse_errors":   uint64(1),
+		"publish_errors": uint64(1),
+		"last_publish":   "2024-01-01T12:01:00Z",
+	}
+	for key, want := range expected {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+}
+
+// TestStatsUpdatedByHandleMessage tests that the processor counts messages
+func TestStatsUpdatedByHandleMessage(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(`{"serialno": "abc", "pm02Standard": 12.0}`)})
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(`not json`)})
+
+	s := proc.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.received != 2 || s.parseErrors != 1 || s.published != 1 || s.lastPublish.IsZero() {
+		t.Errorf("stats = received %d, parse errors %d, published %d, last publish %v; want 2, 1, 1 and a time",
+			s.received, s.parseErrors, s.published, s.lastPublish)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Payloads published to the status topic
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// setStatusWill registers a retained "offline" Last Will and Testament on topic
+// The broker publishes it if the daemon disconnects without a clean shutdown.
+func setStatusWill(opts *mqtt.ClientOptions, topic string) {
+	opts.SetWill(topic, statusOffline, 1, true)
+}
+
+// publishStatus publishes a retained status payload to topic
+func publishStatus(client mqtt.Client, topic, status string) error {
+	token := client.Publish(topic, 1, true, status)
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestSetStatusWill(t *testing.T) {
+	opts := mqtt.NewClientOptions()
+	setStatusWill(opts, "aqi/status")
+
+	if !opts.WillEnabled || opts.WillTopic != "aqi/status" || string(opts.WillPayload) != "offline" {
+		t.Errorf("Will = (%v, %q, %q), want (true, aqi/status, offline)", opts.WillEnabled, opts.WillTopic, opts.WillPayload)
+	}
+	if !opts.WillRetained {
+		t.Error("Will is not retained")
+	}
+}
+
+func TestPublishStatus(t *testing.T) {
+	client := &fakeClient{}
+	if err := publishStatus(client, "aqi/status", statusOnline); err != nil {
+		t.Fatalf("publishStatus returned error: %v", err)
+	}
+
+	messages := client.messages()
+	if len(messages) != 1 || messages[0].Topic != "aqi/status" || string(messages[0].Payload) != "online" || !messages[0].Retained {
+		t.Errorf("Published %+v, want retained online on aqi/status", messages)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stdinTopic is the topic reported for readings read with -stdin
+const stdinTopic = "stdin"
+
+// maxStdinLine bounds the length of a single reading read with -stdin
+const maxStdinLine = 1 << 20
+
+// writerClient stands in for the MQTT client in -stdin mode
+// Every published payload is written to w as one line. It is always
+// connected, and subscribing succeeds without delivering anything.
+type writerClient struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error // First write error
+}
+
+func (c *writerClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+	if _, err := fmt.Fprintf(c.w, "%s\n", data); err != nil && c.err == nil {
+		c.err = err
+	}
+	return &writerToken{err: c.err}
+}
+
+func (c *writerClient) IsConnected() bool      { return true }
+func (c *writerClient) IsConnectionOpen() bool { return true }
+func (c *writerClient) Connect() mqtt.Token    { return &writerToken{} }
+func (c *writerClient) Disconnect(uint)        {}
+
+func (c *writerClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return &writerToken{}
+}
+
+func (c *writerClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &writerToken{}
+}
+
+func (c *writerClient) Unsubscribe(...string) mqtt.Token     { return &writerToken{} }
+func (c *writerClient) AddRoute(string, mqtt.MessageHandler) {}
+func (c *writerClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewOptionsReader(mqtt.NewClientOptions())
+}
+
+// writeErr returns the first error writing output
+func (c *writerClient) writeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// writerToken is the completed token returned by writerClient
+type writerToken struct {
+	err error
+}
+
+func (t *writerToken) Wait() bool                     { return true }
+func (t *writerToken) WaitTimeout(time.Duration) bool { return true }
+func (t *writerToken) Error() error                   { return t.err }
+
+func (t *writerToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// stdinMessage is a reading read with -stdin
+type stdinMessage struct {
+	payload []byte
+}
+
+func (m *stdinMessage) Duplicate() bool   { return false }
+func (m *stdinMessage) Qos() byte         { return 0 }
+func (m *stdinMessage) Retained() bool    { return false }
+func (m *stdinMessage) Topic() string     { return stdinTopic }
+func (m *stdinMessage) MessageID() uint16 { return 0 }
+func (m *stdinMessage) Payload() []byte   { return m.payload }
+func (m *stdinMessage) Ack()              {}
+
+// runStdin processes newline-delimited JSON readings from r without a broker
+// Everything the processor would publish is written to w, one message per
+// line. Blank lines are skipped. At the end of the input the processor is
+// drained, so the readings deferred by -min-interval are written as well.
+func (p *processor) runStdin(r io.Reader, w io.Writer) error {
+	client := &writerClient{w: w}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStdinLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		p.handleMessage(client, &stdinMessage{payload: bytes.Clone(line)})
+		if err := client.writeErr(); err != nil {
+			return fmt.Errorf("writing output: %w", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading input: %w", err)
+	}
+	if !p.drain(drainTimeout) {
+		slog.Warn("Timed out waiting for in-flight messages", "timeout", drainTimeout)
+	}
+	if err := client.writeErr(); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	return nil
+}
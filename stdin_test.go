@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"aqi-mqtt/aqi"
+)
+
+// TestRunStdin pipes two readings through -stdin mode
+func TestRunStdin(t *testing.T) {
+	input := strings.Join([]string{
+		`{"serialno": "kitchen", "pm02Standard": 35.7, "pm10Standard": 45}`,
+		``,
+		`{"serialno": "bedroom", "pm02Standard": 8.0, "pm10Standard": 20}`,
+	}, "\n")
+
+	proc := newProcessor("")
+	var out bytes.Buffer
+	if err := proc.runStdin(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("runStdin returned error: %v", err)
+	}
+
+	expected := []struct {
+		serialNo string
+		aqi      int
+	}{
+		{"kitchen", aqi.ComputeAQI(35.7, 45)},
+		{"bedroom", aqi.ComputeAQI(8.0, 20)},
+	}
+	scanner := bufio.NewScanner(&out)
+	for i, want := range expected {
+		if !scanner.Scan() {
+			t.Fatalf("Output has %d lines, want %d", i, len(expected))
+		}
+		var reading AQIReading
+		if err := json.Unmarshal(scanner.Bytes(), &reading); err != nil {
+			t.Fatalf("Line %d is not an AQI reading: %v", i+1, err)
+		}
+		if reading.SerialNo != want.serialNo || reading.AQI != want.aqi {
+			t.Errorf("Line %d = %s AQI %d, want %s AQI %d", i+1, reading.SerialNo, reading.AQI, want.serialNo, want.aqi)
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("Unexpected extra output: %s", scanner.Text())
+	}
+}
+
+// TestRunStdinMinInterval tests that the last reading deferred by
+// -min-interval is written when the input ends
+func TestRunStdinMinInterval(t *testing.T) {
+	input := strings.Join([]string{
+		`{"serialno": "kitchen", "pm02Standard": 8.0}`,
+		`{"serialno": "kitchen", "pm02Standard": 35.7}`,
+	}, "\n")
+
+	proc := newProcessor("")
+	proc.throttle.setInterval(time.Hour)
+	var out bytes.Buffer
+	if err := proc.runStdin(strings.NewReader(input), &out); err != nil {
+		t.Fatalf("runStdin returned error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Output has %d lines, want 2: %s", len(lines), out.String())
+	}
+	if !strings.Contains(lines[1], `"pm02Standard":35.7`) {
+		t.Errorf("Last line %s, want the deferred reading", lines[1])
+	}
+}
+
+func TestConfigValidateStdin(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Stdin = true
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate returned error for -stdin without broker settings: %v", err)
+	}
+}
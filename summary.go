@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// summaryUnhealthyAQI is the AQI above which an hour counts as unhealthy in
+// the daily summary; it is the upper bound of the Moderate category
+const summaryUnhealthyAQI = 100
+
+// dailySummary is the payload published to -summary-topic for a sensor and day
+type dailySummary struct {
+	Date              string  `json:"date"` // Local date, YYYY-MM-DD
+	SerialNo          string  `json:"serialno"`
+	Readings          int     `json:"readings"`
+	MinAQI            int     `json:"minAqi"`
+	MaxAQI            int     `json:"maxAqi"`
+	AvgAQI            float64 `json:"avgAqi"`
+	DominantPollutant string  `json:"dominantPollutant"`
+	UnhealthyHours    int     `json:"unhealthyHours"` // Hours with an AQI above summaryUnhealthyAQI
+}
+
+// summaryDay accumulates a sensor's readings for one local day
+type summaryDay struct {
+	date           string
+	readings       int
+	sum            int
+	min, max       int
+	pollutants     map[string]int // Readings per dominant pollutant
+	unhealthyHours map[int]bool   // Local hours with an unhealthy reading
+}
+
+// newSummaryDay starts accumulating readings for date
+func newSummaryDay(date string) *summaryDay {
+	return &summaryDay{
+		date:           date,
+		pollutants:     make(map[string]int),
+		unhealthyHours: make(map[int]bool),
+	}
+}
+
+// add records a reading taken in the local hour
+func (d *summaryDay) add(aqi int, pollutant string, hour int) {
+	if d.readings == 0 || aqi < d.min {
+		d.min = aqi
+	}
+	if d.readings == 0 || aqi > d.max {
+		d.max = aqi
+	}
+	d.readings++
+	d.sum += aqi
+	d.pollutants[pollutant]++
+	if aqi > summaryUnhealthyAQI {
+		d.unhealthyHours[hour] = true
+	}
+}
+
+// summary returns the payload for the accumulated day
+func (d *summaryDay) summary(serialNo string) dailySummary {
+	// The most frequent dominant pollutant, ties broken by name for stable output
+	dominant, count := "", 0
+	for pollutant, n := range d.pollutants {
+		if n > count || (n == count && pollutant < dominant) {
+			dominant, count = pollutant, n
+		}
+	}
+	return dailySummary{
+		Date:              d.date,
+		SerialNo:          serialNo,
+		Readings:          d.readings,
+		MinAQI:            d.min,
+		MaxAQI:            d.max,
+		AvgAQI:            math.Round(float64(d.sum)/float64(d.readings)*10) / 10,
+		DominantPollutant: dominant,
+		UnhealthyHours:    len(d.unhealthyHours),
+	}
+}
+
+// recordSummary adds a reading taken at now to the sensor's daily summary
+// A reading from a later day than the one being accumulated completes that
+// day, whose summary is published before the new day starts.
+func (p *processor) recordSummary(client mqtt.Client, serialNo string, now time.Time, aqi int, pollutant string) {
+	local := now.In(p.summaryLocation)
+	date := local.Format(time.DateOnly)
+
+	p.mu.Lock()
+	var completed *dailySummary
+	day, ok := p.summaries[serialNo]
+	if ok && day.date < date {
+		s := day.summary(serialNo)
+		completed = &s
+	}
+	if !ok || day.date < date {
+		day = newSummaryDay(date)
+		p.summaries[serialNo] = day
+	}
+	day.add(aqi, pollutant, local.Hour())
+	p.mu.Unlock()
+
+	if completed != nil {
+		p.publishSummary(client, *completed)
+	}
+}
+
+// flushSummaries publishes and removes the summaries of days before now's local date
+func (p *processor) flushSummaries(client mqtt.Client, now time.Time) {
+	p.configMu.RLock()
+	defer p.configMu.RUnlock()
+	date := now.In(p.summaryLocation).Format(time.DateOnly)
+
+	p.mu.Lock()
+	var completed []dailySummary
+	for serialNo, day := range p.summaries {
+		if day.date < date {
+			completed = append(completed, day.summary(serialNo))
+			delete(p.summaries, serialNo)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, s := range completed {
+		p.publishSummary(client, s)
+	}
+}
+
+// publishSummary publishes a completed daily summary to the summary topic
+func (p *processor) publishSummary(client mqtt.Client, s dailySummary) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		slog.Error("Error marshaling daily summary", "serialno", s.SerialNo, "error", err)
+		return
+	}
+	topic := expandOutputTopic(p.summaryTopic, s.SerialNo)
+	if p.publish(client, topic, false, payload) {
+		slog.Info("Published daily summary", "serialno", s.SerialNo, "date", s.Date, "topic", topic)
+	}
+}
+
+// nextMidnight returns the first midnight after now in loc
+func nextMidnight(now time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+}
+
+// runSummaries publishes the daily summaries at every local midnight until stop is closed
+func (p *processor) runSummaries(client mqtt.Client, stop <-chan struct{}) {
+	for {
+		p.configMu.RLock()
+		loc := p.summaryLocation
+		p.configMu.RUnlock()
+
+		timer := time.NewTimer(time.Until(nextMidnight(time.Now(), loc)))
+		select {
+		case now := <-timer.C:
+			p.flushSummaries(client, now)
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
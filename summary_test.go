@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestDailySummaryRollover feeds a day of readings with a fake clock and
+// checks the summary published when the next day begins
+func TestDailySummaryRollover(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	proc := newProcessor("aqi")
+	proc.summaryTopic = "aqi/{serialno}/summary"
+	proc.summaryLocation = loc
+	client := &fakeClient{}
+
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 3, day, hour, minute, 0, 0, loc)
+	}
+	readings := []struct {
+		at        time.Time
+		aqi       int
+		pollutant string
+	}{
+		{at(1, 9, 10), 40, "pm25"},
+		{at(1, 9, 50), 120, "pm25"},
+		{at(1, 9, 55), 130, "pm10"},
+		{at(1, 14, 0), 110, "pm25"},
+		{at(1, 23, 59), 50, "pm10"},
+	}
+	for _, r := range readings {
+		// Record in UTC to check that days follow the summary time zone
+		proc.recordSummary(client, "abc", r.at.UTC(), r.aqi, r.pollutant)
+	}
+	if messages := client.messages(); len(messages) != 0 {
+		t.Fatalf("Published %d messages before the day ended", len(messages))
+	}
+
+	// The first reading after midnight completes the previous day
+	proc.recordSummary(client, "abc", at(2, 0, 1), 30, "pm25")
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages at rollover, want 1", len(messages))
+	}
+	if messages[0].Topic != "aqi/abc/summary" {
+		t.Errorf("Summary published to %s, want aqi/abc/summary", messages[0].Topic)
+	}
+	var got dailySummary
+	if err := json.Unmarshal(messages[0].Payload, &got); err != nil {
+		t.Fatalf("Failed to parse summary: %v", err)
+	}
+	expected := dailySummary{
+		Date:              "2024-03-01",
+		SerialNo:          "abc",
+		Readings:          5,
+		MinAQI:            40,
+		MaxAQI:            130,
+		AvgAQI:            90,
+		DominantPollutant: "pm25",
+		UnhealthyHours:    2, // 09:00-10:00 and 14:00-15:00
+	}
+	if got != expected {
+		t.Errorf("Summary = %+v, want %+v", got, expected)
+	}
+
+	// The midnight flush publishes days that have ended, and only those
+	proc.flushSummaries(client, at(2, 12, 0))
+	if n := len(client.messages()); n != 1 {
+		t.Errorf("Flush during the day published %d summaries in total, want 1", n)
+	}
+	proc.flushSummaries(client, at(3, 0, 0))
+	messages = client.messages()
+	if len(messages) != 2 {
+		t.Fatalf("Published %d summaries in total after midnight flush, want 2", len(messages))
+	}
+	if err := json.Unmarshal(messages[1].Payload, &got); err != nil {
+		t.Fatalf("Failed to parse summary: %v", err)
+	}
+	if got.Date != "2024-03-02" || got.Readings != 1 || got.UnhealthyHours != 0 {
+		t.Errorf("Second summary = %+v, want 2024-03-02 with 1 reading and no unhealthy hours", got)
+	}
+}
+
+func TestNextMidnight(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	now := time.Date(2024, 12, 31, 22, 30, 0, 0, time.UTC) // 23:30 CET
+	expected := time.Date(2025, 1, 1, 0, 0, 0, 0, loc)
+	if got := nextMidnight(now, loc); !got.Equal(expected) {
+		t.Errorf("nextMidnight = %v, want %v", got, expected)
+	}
+}
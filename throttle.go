@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle limits how often a function runs per key
+// Calls within the interval are deferred rather than dropped: only the most
+// recent one is kept and runs when the interval has elapsed, so the last
+// reading from a sensor is always published.
+type throttle struct {
+	locker sync.Locker // Held while a deferred call runs, nil for none
+	// afterFunc calls f once d has elapsed, time.AfterFunc but for tests
+	afterFunc func(d time.Duration, f func())
+
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time // Time of the last run, keyed by serial number
+	pending  map[string]func()    // Most recent deferred call, keyed by serial number
+	closed   bool                 // Set by flushAll; calls are no longer deferred
+	running  sync.WaitGroup       // Deferred calls being run, added to under mu
+}
+
+// newThrottle creates a throttle that runs at most once per interval per key
+// A zero interval runs every call immediately. Deferred calls run holding
+// locker, as they run outside the caller of Do.
+func newThrottle(interval time.Duration, locker sync.Locker) *throttle {
+	return &throttle{
+		locker: locker,
+		afterFunc: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+		interval: interval,
+		last:     make(map[string]time.Time),
+		pending:  make(map[string]func()),
+	}
+}
+
+// setInterval changes the interval, keeping the calls already deferred
+func (t *throttle) setInterval(interval time.Duration) {
+	t.mu.Lock()
+	t.interval = interval
+	t.mu.Unlock()
+}
+
+// Do runs fn now if key has not run within the interval, otherwise defers it,
+// replacing any call already waiting for key
+func (t *throttle) Do(key string, now time.Time, fn func()) {
+	t.mu.Lock()
+	if t.interval <= 0 || t.closed {
+		t.mu.Unlock()
+		fn()
+		return
+	}
+	if _, waiting := t.pending[key]; waiting {
+		t.pending[key] = fn
+		t.mu.Unlock()
+		return
+	}
+	last, ok := t.last[key]
+	if !ok || now.Sub(last) >= t.interval {
+		t.last[key] = now
+		t.mu.Unlock()
+		fn()
+		return
+	}
+	t.pending[key] = fn
+	due := last.Add(t.interval)
+	t.mu.Unlock()
+
+	t.afterFunc(due.Sub(now), func() { t.flush(key, due) })
+}
+
+// flush runs the call deferred for key until due, unless flushAll already has
+func (t *throttle) flush(key string, due time.Time) {
+	t.mu.Lock()
+	fn, ok := t.pending[key]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.pending, key)
+	t.last[key] = due
+	t.running.Add(1)
+	t.mu.Unlock()
+
+	defer t.running.Done()
+	t.run(fn)
+}
+
+// run runs a deferred call holding the locker
+func (t *throttle) run(fn func()) {
+	if t.locker != nil {
+		t.locker.Lock()
+		defer t.locker.Unlock()
+	}
+	fn()
+}
+
+// flushAll runs the deferred calls now, without waiting for their interval,
+// and waits for those already running, so that no reading is lost on
+// shutdown. Calls made afterwards run immediately.
+func (t *throttle) flushAll() {
+	t.mu.Lock()
+	t.closed = true
+	pending := t.pending
+	t.pending = make(map[string]func())
+	t.mu.Unlock()
+
+	for _, fn := range pending {
+		t.run(fn)
+	}
+	t.running.Wait()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMinInterval tests that rapid readings are throttled to the first one
+// plus the most recent one once the interval has passed
+func TestMinInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	proc := newProcessor("aqi")
+	proc.clock = clock
+	proc.throttle.setInterval(time.Minute)
+	var timers []time.Duration
+	var fire func()
+	proc.throttle.afterFunc = func(d time.Duration, f func()) {
+		timers = append(timers, d)
+		fire = f
+	}
+	client := &fakeClient{}
+
+	for i := 1; i <= 5; i++ {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %d}`, i)),
+		})
+		clock.advance(10 * time.Second)
+	}
+	if got := len(client.messages()); got != 1 {
+		t.Fatalf("Published %d messages within the interval, want 1", got)
+	}
+	if fmt.Sprint(timers) != "[50s]" {
+		t.Fatalf("Started timers %v, want one for the rest of the interval", timers)
+	}
+
+	fire()
+	messages := client.messages()
+	if len(messages) != 2 {
+		t.Fatalf("Published %d messages after the interval, want 2", len(messages))
+	}
+	if !strings.Contains(string(messages[0].Payload), `"pm02Standard":1`) {
+		t.Errorf("First payload %s, want the first reading", messages[0].Payload)
+	}
+	if !strings.Contains(string(messages[1].Payload), `"pm02Standard":5`) {
+		t.Errorf("Deferred payload %s, want the most recent reading", messages[1].Payload)
+	}
+}
+
+// TestMinIntervalPerSensor tests that each serial number is throttled independently
+func TestMinIntervalPerSensor(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.throttle.setInterval(time.Hour)
+	client := &fakeClient{}
+
+	for _, serial := range []string{"abc", "def", "abc"} {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": %q, "pm02Standard": 5}`, serial)),
+		})
+	}
+	if got := len(client.messages()); got != 2 {
+		t.Errorf("Published %d messages, want 2", got)
+	}
+}
+
+func TestThrottleDisabled(t *testing.T) {
+	th := newThrottle(0, nil)
+	calls := 0
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		th.Do("abc", now, func() { calls++ })
+	}
+	if calls != 3 {
+		t.Errorf("Zero interval ran %d calls, want 3", calls)
+	}
+}
+
+// TestDrainFlushesThrottle tests that a publish deferred by -min-interval is
+// made on shutdown rather than lost
+func TestDrainFlushesThrottle(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.throttle.setInterval(time.Hour)
+	client := &fakeClient{}
+
+	for i := 1; i <= 2; i++ {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %d}`, i)),
+		})
+	}
+	if !proc.drain(time.Second) {
+		t.Fatal("drain timed out")
+	}
+	messages := client.messages()
+	if len(messages) != 2 {
+		t.Fatalf("Published %d messages after drain, want 2", len(messages))
+	}
+	if !strings.Contains(string(messages[1].Payload), `"pm02Standard":2`) {
+		t.Errorf("Flushed payload %s, want the most recent reading", messages[1].Payload)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Timestamp sources selectable with -timestamp-source
+const (
+	timestampProcessing = "processing"
+	timestampPayload    = "payload"
+)
+
+// validateTimestampSource checks that a timestamp source is supported
+func validateTimestampSource(source string) error {
+	switch source {
+	case timestampProcessing, timestampPayload:
+		return nil
+	default:
+		return fmt.Errorf("unknown timestamp source %q: must be %q or %q", source, timestampProcessing, timestampPayload)
+	}
+}
+
+// payloadTimestamp extracts the "timestamp" field of a sensor payload
+// The field may be an RFC 3339 string or a number of seconds since the Unix
+// epoch. ok is false if the field is missing or cannot be parsed.
+func payloadTimestamp(payload []byte) (t time.Time, ok bool) {
+	var fields struct {
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+	if err := json.Unmarshal(payload, &fields); err != nil || fields.Timestamp == nil {
+		return time.Time{}, false
+	}
+
+	var s string
+	if err := json.Unmarshal(fields.Timestamp, &s); err == nil {
+		t, err := time.Parse(time.RFC3339, s)
+		return t, err == nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(fields.Timestamp, &seconds); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+// formatTimestamp formats a time for the output JSON
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// publishedTimestamps handles a payload and returns the timestamp fields of the output
+func publishedTimestamps(t *testing.T, proc *processor, payload string) (timestamp, receivedAt string) {
+	t.Helper()
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+
+	var output AQIReading
+	if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	return output.Timestamp, output.ReceivedAt
+}
+
+func TestTimestampProcessing(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+	timestamp, receivedAt := publishedTimestamps(t, newProcessor("aqi"), `{"serialno": "abc", "pm02Standard": 5}`)
+
+	ts, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		t.Fatalf("timestamp %q is not RFC 3339: %v", timestamp, err)
+	}
+	if ts.Before(before) || ts.After(time.Now()) {
+		t.Errorf("timestamp %s is not the processing time", timestamp)
+	}
+	if receivedAt != "" {
+		t.Errorf("receivedAt = %q, want omitted", receivedAt)
+	}
+}
+
+func TestTimestampPayload(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.timestampSource = timestampPayload
+
+	testCases := []struct {
+		name     string
+		payload  string
+		expected string
+	}{
+		{"RFC 3339", `{"serialno": "abc", "pm02Standard": 5, "timestamp": "2024-06-01T14:00:00+02:00"}`, "2024-06-01T12:00:00Z"},
+		{"Unix seconds", `{"serialno": "abc", "pm02Standard": 5, "timestamp": 1717243200}`, "2024-06-01T12:00:00Z"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			timestamp, receivedAt := publishedTimestamps(t, proc, tc.payload)
+			if timestamp != tc.expected {
+				t.Errorf("timestamp = %q, want %q", timestamp, tc.expected)
+			}
+			if _, err := time.Parse(time.RFC3339, receivedAt); err != nil {
+				t.Errorf("receivedAt %q is not RFC 3339: %v", receivedAt, err)
+			}
+		})
+	}
+
+	// Without a timestamp in the payload the processing time is used
+	timestamp, _ := publishedTimestamps(t, proc, `{"serialno": "abc", "pm02Standard": 5, "timestamp": "yesterday"}`)
+	if _, err := time.Parse(time.RFC3339, timestamp); err != nil {
+		t.Errorf("Fallback timestamp %q is not RFC 3339: %v", timestamp, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCA writes a self-signed CA certificate to a temporary file
+func writeTestCA(t *testing.T) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aqi-mqtt test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	return path
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := newTLSConfig(writeTestCA(t), "", "", false)
+	if err != nil {
+		t.Fatalf("newTLSConfig returned error: %v", err)
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Error("RootCAs not set from CA file")
+	}
+	if tlsConfig.InsecureSkipVerify {
+		t.Error("InsecureSkipVerify set without being requested")
+	}
+
+	tlsConfig, err = newTLSConfig("", "", "", true)
+	if err != nil {
+		t.Fatalf("newTLSConfig returned error: %v", err)
+	}
+	if !tlsConfig.InsecureSkipVerify {
+		t.Error("InsecureSkipVerify not applied")
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	badPEM := filepath.Join(t.TempDir(), "bad.pem")
+	if err := os.WriteFile(badPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		caFile   string
+		certFile string
+		keyFile  string
+	}{
+		{"Missing CA file", filepath.Join(t.TempDir(), "missing.pem"), "", ""},
+		{"Invalid CA file", badPEM, "", ""},
+		{"Certificate without key", "", badPEM, ""},
+		{"Invalid key pair", "", badPEM, badPEM},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newTLSConfig(tc.caFile, tc.certFile, tc.keyFile, false); err == nil {
+				t.Error("newTLSConfig returned nil error")
+			}
+		})
+	}
+}
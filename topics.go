@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// serialNoPlaceholder is replaced with the reading's serial number in output topics
+const serialNoPlaceholder = "{serialno}"
+
+// categoryPlaceholder is replaced with the reading's category, which can change
+// from one reading to the next
+const categoryPlaceholder = "{category}"
+
+// topicPlaceholders are the placeholders allowed in -output-topic, with the
+// reading value each is replaced with
+var topicPlaceholders = map[string]func(AQIReading) string{
+	serialNoPlaceholder: func(r AQIReading) string { return r.SerialNo },
+	"{model}":           func(r AQIReading) string { return r.Model },
+	"{firmware}":        func(r AQIReading) string { return r.Firmware },
+	"{scale}":           func(r AQIReading) string { return r.Scale },
+	categoryPlaceholder: func(r AQIReading) string { return r.Category },
+}
+
+// placeholderPattern matches a placeholder in a topic template
+var placeholderPattern = regexp.MustCompile(`\{[^{}/]*\}`)
+
+// stringList is a flag value that may be repeated or given as a comma-separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// expandOutputTopic substitutes the serial number into an output topic template
+// Readings without a serial number are published under "unknown".
+func expandOutputTopic(template, serialNo string) string {
+	return strings.ReplaceAll(template, serialNoPlaceholder, sanitizeTopicValue(serialNo))
+}
+
+// expandTopicTemplate substitutes the reading's values into an output topic
+// template, see topicPlaceholders
+func expandTopicTemplate(template string, reading AQIReading) string {
+	return placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value, ok := topicPlaceholders[placeholder]
+		if !ok {
+			return placeholder // Rejected by validateTopicTemplate
+		}
+		return sanitizeTopicValue(value(reading))
+	})
+}
+
+// sanitizeTopicValue makes a value safe to substitute into a topic level
+// MQTT wildcards and level separators are replaced with underscores, so a
+// value cannot turn the topic into a filter or add levels. Empty values
+// become "unknown".
+func sanitizeTopicValue(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer("+", "_", "#", "_", "/", "_").Replace(value)
+}
+
+// validateTopicFilter checks the syntax of an input topic filter
+// Wildcards must occupy a whole level, and # must be the last level.
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty input topic")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && level != "+" && level != "#" {
+			return fmt.Errorf("invalid input topic %q: wildcards must occupy a whole level", filter)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("invalid input topic %q: # must be the last level", filter)
+		}
+	}
+	return nil
+}
+
+// topicMatches reports whether topic matches the subscription filter, with
+// + matching one level and # the remaining levels
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// validateTopicName checks that a topic published to contains no wildcards
+func validateTopicName(name, topic string) error {
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("invalid %s topic %q: wildcards are not allowed in published topics", name, topic)
+	}
+	return nil
+}
+
+// validateTopicTemplate checks that an output topic template only uses
+// known placeholders
+func validateTopicTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		if _, ok := topicPlaceholders[placeholder]; !ok {
+			return fmt.Errorf("unknown placeholder %s in output topic %q", placeholder, template)
+		}
+	}
+	return nil
+}
+
+// validateSerialNoTopic checks that a topic expanded with expandOutputTopic
+// uses no placeholder other than {serialno}; name is the topic's setting
+func validateSerialNoTopic(name, topic string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(topic, -1) {
+		if placeholder != serialNoPlaceholder {
+			return fmt.Errorf("placeholder %s in %s topic %q is not supported, only %s is", placeholder, name, topic, serialNoPlaceholder)
+		}
+	}
+	return nil
+}
+
+// prefixTopic prepends a -topic-prefix to a topic
+// The prefix may be given with or without a trailing slash; exactly one
+// slash separates it from the topic. Empty topics stay empty, since they
+// mean the feature is disabled.
+func prefixTopic(prefix, topic string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" || topic == "" {
+		return topic
+	}
+	return prefix + "/" + strings.TrimLeft(topic, "/")
+}
+
+// applyTopicPrefix prepends c.TopicPrefix to every configured topic
+func (c *Config) applyTopicPrefix() {
+	for i, topic := range c.InputTopics {
+		c.InputTopics[i] = prefixTopic(c.TopicPrefix, topic)
+	}
+	for _, topic := range []*string{&c.OutputTopic, &c.ErrorTopic, &c.StatusTopic, &c.AvailabilityTopic, &c.SummaryTopic, &c.AlertTopic, &c.InfluxTopic, &c.PlainTopic} {
+		*topic = prefixTopic(c.TopicPrefix, *topic)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStringListFlag(t *testing.T) {
+	var topics stringList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&topics, "input-topic", "")
+
+	args := []string{"-input-topic", "sensors/a", "-input-topic", "sensors/b, sensors/c", "-input-topic", ""}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+
+	expected := stringList{"sensors/a", "sensors/b", "sensors/c"}
+	if !reflect.DeepEqual(topics, expected) {
+		t.Errorf("topics = %q, want %q", topics, expected)
+	}
+}
+
+func TestExpandOutputTopic(t *testing.T) {
+	testCases := []struct {
+		template, serialNo, expected string
+	}{
+		{"aqi/{serialno}", "d83bda1d7660", "aqi/d83bda1d7660"},
+		{"aqi/{serialno}", "", "aqi/unknown"},
+		{"aqi/static", "d83bda1d7660", "aqi/static"},
+		{"aqi/{serialno}", "a/b+", "aqi/a_b_"},
+	}
+
+	for _, tc := range testCases {
+		if got := expandOutputTopic(tc.template, tc.serialNo); got != tc.expected {
+			t.Errorf("expandOutputTopic(%q, %q) = %q, want %q", tc.template, tc.serialNo, got, tc.expected)
+		}
+	}
+}
+
+func TestExpandTopicTemplate(t *testing.T) {
+	reading := AQIReading{
+		SensorReading: SensorReading{SerialNo: "d83bda1d7660", Model: "I-9PSL", Firmware: "3.1.3+dev#1"},
+		Scale:         standardEPA,
+		Category:      "Moderate",
+	}
+
+	testCases := []struct {
+		template, expected string
+	}{
+		{"aqi/{model}/{serialno}", "aqi/I-9PSL/d83bda1d7660"},
+		{"aqi/{scale}/{category}/{serialno}", "aqi/epa/Moderate/d83bda1d7660"},
+		{"aqi/{firmware}", "aqi/3.1.3_dev_1"}, // Wildcards are sanitized
+		{"aqi/static", "aqi/static"},
+	}
+	for _, tc := range testCases {
+		if got := expandTopicTemplate(tc.template, reading); got != tc.expected {
+			t.Errorf("expandTopicTemplate(%q) = %q, want %q", tc.template, got, tc.expected)
+		}
+	}
+
+	// Missing values are published under "unknown", like a missing serial number
+	if got := expandTopicTemplate("aqi/{model}/{serialno}", AQIReading{}); got != "aqi/unknown/unknown" {
+		t.Errorf("expandTopicTemplate of an empty reading = %q, want aqi/unknown/unknown", got)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{"airgradient/readings", "airgradient/+/readings", "airgradient/#", "#", "+"} {
+		if err := validateTopicFilter(filter); err != nil {
+			t.Errorf("validateTopicFilter(%q) = %v, want nil", filter, err)
+		}
+	}
+	for _, filter := range []string{"", "airgradient/#/readings", "airgradient/sensor+", "airgradient/#x"} {
+		if err := validateTopicFilter(filter); err == nil {
+			t.Errorf("validateTopicFilter(%q) = nil, want error", filter)
+		}
+	}
+}
+
+func TestValidateTopicTemplate(t *testing.T) {
+	for _, template := range []string{"aqi", "aqi/{serialno}", "aqi/{model}/{firmware}/{scale}/{category}"} {
+		if err := validateTopicTemplate(template); err != nil {
+			t.Errorf("validateTopicTemplate(%q) = %v, want nil", template, err)
+		}
+	}
+	for _, template := range []string{"aqi/{serial}", "aqi/{Model}", "aqi/{}"} {
+		if err := validateTopicTemplate(template); err == nil {
+			t.Errorf("validateTopicTemplate(%q) = nil, want error", template)
+		}
+	}
+}
+
+// TestPerSensorOutputTopic tests that readings are routed by serial number
+func TestPerSensorOutputTopic(t *testing.T) {
+	proc := newProcessor("aqi/{serialno}")
+	client := &fakeClient{}
+
+	for _, serial := range []string{"sensor-a", "sensor-b"} {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings/" + serial,
+			payload: []byte(`{"serialno": "` + serial + `", "pm02Standard": 10}`),
+		})
+	}
+
+	messages := client.messages()
+	if len(messages) != 2 || messages[0].Topic != "aqi/sensor-a" || messages[1].Topic != "aqi/sensor-b" {
+		t.Errorf("Published %+v, want one message each on aqi/sensor-a and aqi/sensor-b", messages)
+	}
+}
+
+func TestPrefixTopic(t *testing.T) {
+	testCases := []struct {
+		prefix, topic, expected string
+	}{
+		{"", "aqi", "aqi"},
+		{"home/livingroom", "aqi", "home/livingroom/aqi"},
+		{"home/livingroom/", "aqi", "home/livingroom/aqi"},
+		{"home/livingroom//", "/aqi", "home/livingroom/aqi"},
+		{"home/livingroom/", "", ""},
+	}
+	for _, tc := range testCases {
+		if got := prefixTopic(tc.prefix, tc.topic); got != tc.expected {
+			t.Errorf("prefixTopic(%q, %q) = %q, want %q", tc.prefix, tc.topic, got, tc.expected)
+		}
+	}
+}
+
+// TestTopicPrefix tests that -topic-prefix applies to every topic the daemon
+// subscribes or publishes to
+func TestTopicPrefix(t *testing.T) {
+	clearEnv(t)
+	cfg, err := loadConfig([]string{
+		"-topic-prefix", "home/livingroom/",
+		"-broker", "localhost",
+		"-input-topic", "airgradient/a,airgradient/b",
+		"-output-topic", "aqi/{serialno}",
+		"-error-topic", "errors",
+		"-status-topic", "status",
+		"-summary-topic", "summary",
+		"-influx-topic", "influx",
+		"-explode",
+		"-ha-discovery",
+	})
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.InputTopics, []string{"home/livingroom/airgradient/a", "home/livingroom/airgradient/b"}) {
+		t.Errorf("InputTopics = %q, want prefixed", cfg.InputTopics)
+	}
+	if cfg.StatusTopic != "home/livingroom/status" || cfg.SummaryTopic != "home/livingroom/summary" {
+		t.Errorf("StatusTopic/SummaryTopic = %s/%s, want prefixed", cfg.StatusTopic, cfg.SummaryTopic)
+	}
+
+	proc := newProcessor("")
+	proc.applyConfig(cfg)
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{topic: cfg.InputTopics[0], payload: []byte(`{"serialno": "abc", "pm02Standard": 5}`)})
+	proc.handleMessage(client, &fakeMessage{topic: cfg.InputTopics[0], payload: []byte(`not json`)})
+
+	messages := client.messages()
+	if len(messages) == 0 {
+		t.Fatal("Nothing published")
+	}
+	for _, msg := range messages {
+		if !strings.HasPrefix(msg.Topic, "home/livingroom/") || strings.Contains(msg.Topic, "//") {
+			t.Errorf("Published to %s, want a topic under home/livingroom/", msg.Topic)
+		}
+	}
+}
+
+// TestTopicMatches tests matching topics against subscription filters
+func TestTopicMatches(t *testing.T) {
+	testCases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"airgradient/readings", "airgradient/readings", true},
+		{"airgradient/readings", "airgradient/readings/abc", false},
+		{"airgradient/+", "airgradient/readings", true},
+		{"airgradient/+", "airgradient", false},
+		{"airgradient/+/abc", "airgradient/readings/abc", true},
+		{"airgradient/#", "airgradient/readings/abc", true},
+		{"airgradient/#", "airgradient", true},
+		{"#", "airgradient/readings", true},
+		{"other/#", "airgradient/readings", false},
+	}
+	for _, tc := range testCases {
+		if got := topicMatches(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
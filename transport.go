@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Broker transports selectable with -transport
+const (
+	transportTCP = "tcp"
+	transportWS  = "ws"
+	transportWSS = "wss"
+)
+
+// validateTransport checks that a -transport value is supported
+func validateTransport(transport string) error {
+	switch transport {
+	case transportTCP, transportWS, transportWSS:
+		return nil
+	default:
+		return fmt.Errorf("unknown transport %q: must be %q, %q or %q", transport, transportTCP, transportWS, transportWSS)
+	}
+}
+
+// usesTLS reports whether the broker connection is encrypted
+// wss always is; for the other transports it is enabled with -tls.
+func usesTLS(transport string, tls bool) bool {
+	return tls || transport == transportWSS
+}
+
+// brokerURL builds the broker URL for a transport
+// TCP connections have no path. WebSocket connections append wsPath, adding
+// the leading slash if it is missing. With TLS, tcp becomes ssl and ws becomes wss.
+func brokerURL(transport, host string, port int, wsPath string, tls bool) string {
+	secure := usesTLS(transport, tls)
+	switch transport {
+	case transportWS, transportWSS:
+		scheme := "ws"
+		if secure {
+			scheme = "wss"
+		}
+		if !strings.HasPrefix(wsPath, "/") {
+			wsPath = "/" + wsPath
+		}
+		return fmt.Sprintf("%s://%s:%d%s", scheme, host, port, wsPath)
+	default:
+		scheme := "tcp"
+		if secure {
+			scheme = "ssl"
+		}
+		return fmt.Sprintf("%s://%s:%d", scheme, host, port)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestBrokerURL(t *testing.T) {
+	testCases := []struct {
+		transport string
+		wsPath    string
+		tls       bool
+		expected  string
+	}{
+		{transportTCP, "/mqtt", false, "tcp://broker:1883"},
+		{transportTCP, "/mqtt", true, "ssl://broker:1883"},
+		{transportWS, "/mqtt", false, "ws://broker:1883/mqtt"},
+		{transportWS, "/mqtt", true, "wss://broker:1883/mqtt"},
+		{transportWSS, "/mqtt", false, "wss://broker:1883/mqtt"},
+		{transportWS, "proxy/mqtt", false, "ws://broker:1883/proxy/mqtt"},
+		{transportWS, "", false, "ws://broker:1883/"},
+	}
+	for _, tc := range testCases {
+		if got := brokerURL(tc.transport, "broker", 1883, tc.wsPath, tc.tls); got != tc.expected {
+			t.Errorf("brokerURL(%q, %q, tls=%v) = %q, want %q", tc.transport, tc.wsPath, tc.tls, got, tc.expected)
+		}
+	}
+}
+
+func TestValidateTransport(t *testing.T) {
+	for _, transport := range []string{transportTCP, transportWS, transportWSS} {
+		if err := validateTransport(transport); err != nil {
+			t.Errorf("validateTransport(%q) returned error: %v", transport, err)
+		}
+	}
+	if err := validateTransport("quic"); err == nil {
+		t.Error("validateTransport accepted an unknown transport")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+// Directions of the AQI trend in the output
+const (
+	trendRising  = "rising"
+	trendFalling = "falling"
+	trendSteady  = "steady"
+)
+
+// trend compares a sensor's AQI to the mean of its previous -trend-window
+// readings and records it for the next comparison
+// The AQI must differ from the mean by at least -trend-min-delta to count as
+// rising or falling, so small fluctuations read as steady. Returns "" for a
+// sensor's first reading.
+func (p *processor) trend(serialNo string, aqi int) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	history := p.trends[serialNo]
+	direction := ""
+	if len(history) > 0 {
+		sum := 0
+		for _, v := range history {
+			sum += v
+		}
+		mean := float64(sum) / float64(len(history))
+		switch delta := float64(aqi) - mean; {
+		case delta >= float64(p.trendMinDelta) && delta > 0:
+			direction = trendRising
+		case -delta >= float64(p.trendMinDelta) && delta < 0:
+			direction = trendFalling
+		default:
+			direction = trendSteady
+		}
+	}
+
+	history = append(history, aqi)
+	if len(history) > p.trendWindow {
+		history = history[len(history)-p.trendWindow:]
+	}
+	p.trends[serialNo] = history
+	return direction
+}
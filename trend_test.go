@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// TestTrendRising tests that a rising sequence of readings is published
+// with a rising trend
+func TestTrendRising(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.trendWindow = 3
+	proc.trendMinDelta = 5
+	client := &fakeClient{}
+
+	for _, pm25 := range []float64{5, 10, 20, 30} {
+		proc.handleMessage(client, &fakeMessage{
+			topic:   "airgradient/readings",
+			payload: []byte(fmt.Sprintf(`{"serialno": "abc", "pm02Standard": %g}`, pm25)),
+		})
+	}
+
+	messages := client.messages()
+	if len(messages) != 4 {
+		t.Fatalf("Published %d messages, want 4", len(messages))
+	}
+	want := []string{"", trendRising, trendRising, trendRising}
+	for i, msg := range messages {
+		var output AQIReading
+		if err := json.Unmarshal(msg.Payload, &output); err != nil {
+			t.Fatalf("Failed to parse output: %v", err)
+		}
+		if output.Trend != want[i] {
+			t.Errorf("Reading %d: trend = %q, want %q", i, output.Trend, want[i])
+		}
+	}
+}
+
+// TestTrend tests the trend against the mean of the window and the minimum
+// delta
+func TestTrend(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.trendWindow = 3
+	proc.trendMinDelta = 5
+
+	steps := []struct {
+		aqi  int
+		want string
+	}{
+		{50, ""},           // First reading
+		{54, trendSteady},  // Mean 50, within the minimum delta
+		{57, trendRising},  // Mean 52
+		{55, trendSteady},  // Mean 53.67
+		{50, trendFalling}, // Mean 55.33, the first reading has left the window
+		{40, trendFalling}, // Mean 54
+	}
+	for i, step := range steps {
+		if got := proc.trend("abc", step.aqi); got != step.want {
+			t.Errorf("Step %d: trend(%d) = %q, want %q", i, step.aqi, got, step.want)
+		}
+	}
+
+	// Sensors have separate histories
+	if got := proc.trend("def", 100); got != "" {
+		t.Errorf("trend of a new sensor = %q, want \"\"", got)
+	}
+}
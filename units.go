@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Temperature units selectable with -temp-unit
+const (
+	tempUnitCelsius    = "celsius"
+	tempUnitFahrenheit = "fahrenheit"
+)
+
+// validateTempUnit checks that a temperature unit is supported
+func validateTempUnit(unit string) error {
+	switch unit {
+	case tempUnitCelsius, tempUnitFahrenheit:
+		return nil
+	default:
+		return fmt.Errorf("unknown temperature unit %q: must be %q or %q", unit, tempUnitCelsius, tempUnitFahrenheit)
+	}
+}
+
+// PM concentration units selectable with -pm-unit
+const (
+	pmUnitMicrograms = "ugm3" // µg/m³, what the AQI breakpoints assume
+	pmUnitMilligrams = "mgm3" // mg/m³
+)
+
+// validatePMUnit checks that a PM concentration unit is supported
+func validatePMUnit(unit string) error {
+	switch unit {
+	case pmUnitMicrograms, pmUnitMilligrams:
+		return nil
+	default:
+		return fmt.Errorf("unknown PM unit %q: must be %q or %q", unit, pmUnitMicrograms, pmUnitMilligrams)
+	}
+}
+
+// normalizePM converts the PM concentrations of a reading to µg/m³
+// Each value is multiplied by scale, for sensors that report scaled integers,
+// and then converted from unit.
+func normalizePM(reading *SensorReading, unit string, scale float64) {
+	factor := scale
+	if unit == pmUnitMilligrams {
+		factor *= 1000
+	}
+	if factor == 1 {
+		return
+	}
+	for _, v := range []*float64{
+		&reading.PM01, &reading.PM02, &reading.PM10,
+		&reading.PM01Standard, &reading.PM02Standard, &reading.PM10Standard,
+		&reading.PM02Compensated,
+	} {
+		*v *= factor
+	}
+}
+
+// celsiusToFahrenheit converts a temperature, rounded to two decimals to keep
+// floating point noise out of the published JSON
+func celsiusToFahrenheit(c float64) float64 {
+	return math.Round((c*9/5+32)*100) / 100
+}
+
+// convertTemperatures rewrites the raw and compensated temperatures in unit
+// Readings arrive in Celsius, so there is nothing to do for tempUnitCelsius.
+func convertTemperatures(reading *SensorReading, unit string) {
+	if unit != tempUnitFahrenheit {
+		return
+	}
+	reading.Atmp = celsiusToFahrenheit(reading.Atmp)
+	reading.AtmpCompensated = celsiusToFahrenheit(reading.AtmpCompensated)
+}
+
+// temperatureSymbol returns the unit of measurement for a temperature unit
+func temperatureSymbol(unit string) string {
+	if unit == tempUnitFahrenheit {
+		return "°F"
+	}
+	return "°C"
+}
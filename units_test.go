@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// TestFahrenheitOutput tests that both temperatures are converted in the published JSON
+func TestFahrenheitOutput(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.tempUnit = tempUnitFahrenheit
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5, "atmp": 24.1, "atmpCompensated": 24.1}`),
+	})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	for _, field := range []string{`"atmp":75.38`, `"atmpCompensated":75.38`, `"tempUnit":"fahrenheit"`} {
+		if !strings.Contains(string(messages[0].Payload), field) {
+			t.Errorf("Payload %s does not contain %s", messages[0].Payload, field)
+		}
+	}
+}
+
+func TestCelsiusOutputUnchanged(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 5, "atmp": 24.1}`),
+	})
+
+	var output map[string]any
+	if err := json.Unmarshal(client.messages()[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output["atmp"] != 24.1 {
+		t.Errorf("atmp = %v, want 24.1", output["atmp"])
+	}
+	if _, ok := output["tempUnit"]; ok {
+		t.Error("tempUnit present in Celsius output")
+	}
+}
+
+func TestCelsiusToFahrenheit(t *testing.T) {
+	testCases := []struct {
+		celsius  float64
+		expected float64
+	}{
+		{-40, -40},
+		{0, 32},
+		{24.1, 75.38},
+		{100, 212},
+	}
+	for _, tc := range testCases {
+		if got := celsiusToFahrenheit(tc.celsius); got != tc.expected {
+			t.Errorf("celsiusToFahrenheit(%v) = %v, want %v", tc.celsius, got, tc.expected)
+		}
+	}
+}
+
+// TestPMUnitNormalization tests that scaled and mg/m³ inputs produce the same
+// AQI as the equivalent µg/m³ reading
+func TestPMUnitNormalization(t *testing.T) {
+	testCases := []struct {
+		name    string
+		unit    string
+		scale   float64
+		payload string
+	}{
+		{"µg/m³", pmUnitMicrograms, 1, `{"serialno": "abc", "pm02Standard": 35.7, "pm10Standard": 160}`},
+		{"Scaled by 10", pmUnitMicrograms, 0.1, `{"serialno": "abc", "pm02Standard": 357, "pm10Standard": 1600}`},
+		{"mg/m³", pmUnitMilligrams, 1, `{"serialno": "abc", "pm02Standard": 0.0357, "pm10Standard": 0.16}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proc := newProcessor("aqi")
+			proc.pmUnit = tc.unit
+			proc.pmScale = tc.scale
+			client := &fakeClient{}
+
+			proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(tc.payload)})
+
+			messages := client.messages()
+			if len(messages) != 1 {
+				t.Fatalf("Published %d messages, want 1", len(messages))
+			}
+			var output AQIReading
+			if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+				t.Fatalf("Failed to parse output: %v", err)
+			}
+			// PM2.5 35.7 µg/m³ is AQI 101 and PM10 160 µg/m³ is AQI 103
+			if output.AQI != 103 || output.AQIPM25 == nil || *output.AQIPM25 != 101 {
+				t.Errorf("AQI = %d, PM2.5 sub-index = %v, want 103 and 101", output.AQI, output.AQIPM25)
+			}
+			if output.PM02Standard != 35.7 {
+				t.Errorf("Published pm02Standard = %g, want 35.7", output.PM02Standard)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"aqi-mqtt/aqi"
+)
+
+// Plausible sensor ranges used by validateReading
+const (
+	minHumidity    = 0.0
+	maxHumidity    = 100.0
+	minTemperature = -40.0 // Operating range of the SHT sensors used by AirGradient
+	maxTemperature = 85.0
+)
+
+// fieldValue pairs a JSON field name with its value for validation messages
+type fieldValue struct {
+	field string
+	value float64
+}
+
+// validateReading checks a reading for physically impossible values
+// Returns a list of human-readable warnings, empty if the reading looks valid.
+func validateReading(r SensorReading) []string {
+	var warnings []string
+
+	concentrations := []fieldValue{
+		{"pm01", r.PM01},
+		{"pm02", r.PM02},
+		{"pm10", r.PM10},
+		{"pm01Standard", r.PM01Standard},
+		{"pm02Standard", r.PM02Standard},
+		{"pm10Standard", r.PM10Standard},
+		{"pm02Compensated", r.PM02Compensated},
+	}
+	for _, gas := range []struct {
+		field string
+		value *float64
+	}{{"ozone", r.Ozone}, {"co", r.CO}, {"so2", r.SO2}, {"no2", r.NO2}} {
+		if gas.value != nil {
+			concentrations = append(concentrations, fieldValue{gas.field, *gas.value})
+		}
+	}
+	for _, c := range concentrations {
+		if c.value < 0 {
+			warnings = append(warnings, fmt.Sprintf("%s is negative (%g)", c.field, c.value))
+		}
+	}
+
+	for _, h := range []fieldValue{{"rhum", r.Rhum}, {"rhumCompensated", r.RhumCompensated}} {
+		if h.value < minHumidity || h.value > maxHumidity {
+			warnings = append(warnings, fmt.Sprintf("%s is outside %g-%g%% (%g)", h.field, minHumidity, maxHumidity, h.value))
+		}
+	}
+
+	for _, temp := range []fieldValue{{"atmp", r.Atmp}, {"atmpCompensated", r.AtmpCompensated}} {
+		if temp.value < minTemperature || temp.value > maxTemperature {
+			warnings = append(warnings, fmt.Sprintf("%s is outside %g..%g°C (%g)", temp.field, minTemperature, maxTemperature, temp.value))
+		}
+	}
+
+	return warnings
+}
+
+// pollutantFields records which particulate fields a payload contains
+// SensorReading decodes an absent field as zero, so these pointers are what
+// tell a missing concentration apart from a genuine reading of zero.
+type pollutantFields struct {
+	PM01Standard    *float64 `json:"pm01Standard"`
+	PM02            *float64 `json:"pm02"`
+	PM02Standard    *float64 `json:"pm02Standard"`
+	PM02Compensated *float64 `json:"pm02Compensated"`
+	PM10Standard    *float64 `json:"pm10Standard"`
+}
+
+// hasPM25 reports whether the fields include the PM2.5 concentration
+// selectPM25 reads for source, counting the standard value the compensated
+// source falls back to
+func (f pollutantFields) hasPM25(source string) bool {
+	switch source {
+	case pm25SourceCompensated:
+		return f.PM02Compensated != nil || f.PM02Standard != nil
+	case pm25SourceAtmospheric:
+		return f.PM02 != nil
+	default:
+		return f.PM02Standard != nil
+	}
+}
+
+// hasPollutantData reports whether a payload has any concentration an index
+// can be calculated from, with PM2.5 read according to pm25Source and only
+// the pollutants listed counted, all if none are. A payload without one would
+// otherwise be published as AQI 0, which reads as clean air rather than no
+// data.
+func hasPollutantData(payload []byte, reading SensorReading, pm25Source string, pollutants []string) bool {
+	var fields pollutantFields
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return false
+	}
+	present := map[string]bool{
+		aqi.PollutantPM25:  fields.hasPM25(pm25Source),
+		aqi.PollutantPM10:  fields.PM10Standard != nil,
+		aqi.PollutantOzone: reading.Ozone != nil,
+		aqi.PollutantCO:    reading.CO != nil,
+		aqi.PollutantSO2:   reading.SO2 != nil,
+		aqi.PollutantNO2:   reading.NO2 != nil,
+	}
+	for pollutant, ok := range present {
+		if ok && (len(pollutants) == 0 || slices.Contains(pollutants, pollutant)) {
+			return true
+		}
+	}
+	return false
+}
+
+// missingPM reports whether a payload lacks PM1.0, PM2.5 in the field
+// pm25Source selects, and PM10
+func missingPM(payload []byte, pm25Source string) (pm1, pm25, pm10 bool) {
+	var fields pollutantFields
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return false, false, false
+	}
+	return fields.PM01Standard == nil, !fields.hasPM25(pm25Source), fields.PM10Standard == nil
+}
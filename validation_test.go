@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateReading(t *testing.T) {
+	negative := -1.0
+
+	testCases := []struct {
+		name     string
+		reading  SensorReading
+		expected []string // Substrings expected in the warnings, in order
+	}{
+		{"Valid reading", SensorReading{PM02Standard: 12, Rhum: 50, Atmp: 20}, nil},
+		{"Negative PM2.5", SensorReading{PM02Standard: -3}, []string{"pm02Standard is negative"}},
+		{"Negative ozone", SensorReading{Ozone: &negative}, []string{"ozone is negative"}},
+		{"Negative gases", SensorReading{CO: &negative, SO2: &negative, NO2: &negative}, []string{"co is negative", "so2 is negative", "no2 is negative"}},
+		{"Humidity above 100%", SensorReading{Rhum: 104}, []string{"rhum is outside"}},
+		{"Negative compensated humidity", SensorReading{RhumCompensated: -1}, []string{"rhumCompensated is outside"}},
+		{"Temperature too low", SensorReading{Atmp: -45}, []string{"atmp is outside"}},
+		{"Compensated temperature too high", SensorReading{AtmpCompensated: 90}, []string{"atmpCompensated is outside"}},
+		{"Multiple violations", SensorReading{PM10Standard: -1, Rhum: 120, Atmp: 100}, []string{"pm10Standard", "rhum", "atmp"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			warnings := validateReading(tc.reading)
+			if len(warnings) != len(tc.expected) {
+				t.Fatalf("validateReading returned %q, want %d warnings", warnings, len(tc.expected))
+			}
+			for i, want := range tc.expected {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("Warning %d = %q, want it to contain %q", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
+
+// TestStrictValidation tests that warnings are attached to the output and that
+// strict validation suppresses publishing
+func TestStrictValidation(t *testing.T) {
+	payload := []byte(`{"serialno": "abc", "pm02Standard": 10, "rhum": 120}`)
+
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages, want 1", len(messages))
+	}
+	var output AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if len(output.Warnings) != 1 {
+		t.Errorf("Output warnings = %q, want 1 warning", output.Warnings)
+	}
+
+	proc.strictValidation = true
+	client = &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: payload})
+	if len(client.messages()) != 0 {
+		t.Errorf("Published %d messages with strict validation, want 0", len(client.messages()))
+	}
+}
+
+func TestHasPollutantData(t *testing.T) {
+	ozone := 40.0
+
+	testCases := []struct {
+		name       string
+		payload    string
+		reading    SensorReading
+		source     string
+		pollutants []string
+		expected   bool
+	}{
+		{"All missing", `{"serialno": "abc", "rhum": 50, "atmp": 20}`, SensorReading{}, pm25SourceStandard, nil, false},
+		{"Null PM2.5", `{"serialno": "abc", "pm02Standard": null}`, SensorReading{}, pm25SourceStandard, nil, false},
+		{"Zero PM2.5", `{"serialno": "abc", "pm02Standard": 0}`, SensorReading{}, pm25SourceStandard, nil, true},
+		{"PM10 only", `{"serialno": "abc", "pm10Standard": 45}`, SensorReading{}, pm25SourceStandard, nil, true},
+		{"Compensated only", `{"serialno": "abc", "pm02Compensated": 8}`, SensorReading{}, pm25SourceCompensated, nil, true},
+		{"Compensated only, standard source", `{"serialno": "abc", "pm02Compensated": 8}`, SensorReading{}, pm25SourceStandard, nil, false},
+		{"Atmospheric only, standard source", `{"serialno": "abc", "pm02": 200}`, SensorReading{}, pm25SourceStandard, nil, false},
+		{"Ozone only", `{"serialno": "abc", "ozone": 40}`, SensorReading{Ozone: &ozone}, pm25SourceStandard, nil, true},
+		{"PM10 only, PM2.5 selected", `{"serialno": "abc", "pm10Standard": 400}`, SensorReading{}, pm25SourceStandard, []string{"pm25"}, false},
+		{"Ozone only, ozone selected", `{"serialno": "abc", "ozone": 40}`, SensorReading{Ozone: &ozone}, pm25SourceStandard, []string{"pm25", "ozone"}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hasPollutantData([]byte(tc.payload), tc.reading, tc.source, tc.pollutants); got != tc.expected {
+				t.Errorf("hasPollutantData(%s, %s) = %v, want %v", tc.payload, tc.source, got, tc.expected)
+			}
+		})
+	}
+}
+
+// TestMissingPollutants tests that readings without any pollutant data are
+// not published as AQI 0, while PM10-only readings still get an AQI
+func TestMissingPollutants(t *testing.T) {
+	proc := newProcessor("aqi")
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "rco2": 450, "rhum": 50, "atmp": 20}`),
+	})
+	if len(client.messages()) != 0 {
+		t.Errorf("Published %d messages for a reading without pollutants, want 0", len(client.messages()))
+	}
+
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm10Standard": 45, "rhum": 50, "atmp": 20}`),
+	})
+	messages := client.messages()
+	if len(messages) != 1 {
+		t.Fatalf("Published %d messages for a PM10-only reading, want 1", len(messages))
+	}
+	var output AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if output.AQIPM10 == nil || output.AQI != *output.AQIPM10 || output.AQI == 0 {
+		t.Errorf("PM10-only reading: AQI = %d, PM10 sub-index = %v, want the PM10 sub-index", output.AQI, output.AQIPM10)
+	}
+	if output.AQIPM25 != nil {
+		t.Errorf("PM10-only reading has PM2.5 sub-index %d, want none", *output.AQIPM25)
+	}
+}
+
+// TestUnselectedPollutantsOnly tests that a reading with none of the
+// -pollutants is dropped rather than published as AQI 0
+func TestUnselectedPollutantsOnly(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.pollutants = []string{"pm25"}
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm10Standard": 400}`),
+	})
+	if messages := client.messages(); len(messages) != 0 {
+		t.Errorf("Published %s for a reading without PM2.5, want it dropped", messages[0].Payload)
+	}
+
+	// Other standards ignore -pollutants
+	proc.standard = standardIndia
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm10Standard": 400}`),
+	})
+	if messages := client.messages(); len(messages) != 1 {
+		t.Errorf("Published %d messages with -standard india, want 1", len(messages))
+	}
+}
+
+// TestMissingPM25NotAveraged tests that a reading without PM2.5 does not
+// pull the PM2.5 average and NowCast towards 0
+func TestMissingPM25NotAveraged(t *testing.T) {
+	proc := newProcessor("aqi")
+	proc.averageWindow = time.Hour
+	client := &fakeClient{}
+	for _, payload := range []string{
+		`{"serialno": "abc", "pm02Standard": 40, "pm10Standard": 20}`,
+		`{"serialno": "abc", "pm10Standard": 20}`,
+	} {
+		proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(payload)})
+	}
+
+	messages := client.messages()
+	if len(messages) != 2 {
+		t.Fatalf("Published %d messages, want 2", len(messages))
+	}
+	var first, second AQIReading
+	if err := json.Unmarshal(messages[0].Payload, &first); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if err := json.Unmarshal(messages[1].Payload, &second); err != nil {
+		t.Fatalf("Failed to parse output: %v", err)
+	}
+	if second.AQIPM25 != nil || second.AQI != *first.AQIPM10 {
+		t.Errorf("Reading without PM2.5: AQI %d, PM2.5 sub-index %v, want the PM10 sub-index %d only", second.AQI, second.AQIPM25, *first.AQIPM10)
+	}
+	if got := len(proc.nowcasts["abc"].samples); got != 1 {
+		t.Errorf("NowCast has %d samples, want only the reading with PM2.5", got)
+	}
+}
+
+// TestMissingPM25BySource tests that PM2.5 only counts as present in the
+// field -pm25-source reads, so a payload with PM2.5 in another field is not
+// published as AQI 0
+func TestMissingPM25BySource(t *testing.T) {
+	testCases := []struct {
+		source  string
+		payload string
+		want    int // Expected AQI, 0 if the reading should be dropped
+	}{
+		{pm25SourceStandard, `{"serialno": "abc", "pm02": 200}`, 0},
+		{pm25SourceStandard, `{"serialno": "abc", "pm02Compensated": 200}`, 0},
+		{pm25SourceAtmospheric, `{"serialno": "abc", "pm02": 200}`, 250},
+		{pm25SourceAtmospheric, `{"serialno": "abc", "pm02Compensated": 200}`, 0},
+		{pm25SourceCompensated, `{"serialno": "abc", "pm02": 200}`, 0},
+		{pm25SourceCompensated, `{"serialno": "abc", "pm02Compensated": 200}`, 250},
+		{pm25SourceCompensated, `{"serialno": "abc", "pm02Standard": 200}`, 250},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.source+" "+tc.payload, func(t *testing.T) {
+			proc := newProcessor("aqi")
+			proc.pm25Source = tc.source
+			client := &fakeClient{}
+			proc.handleMessage(client, &fakeMessage{topic: "airgradient/readings", payload: []byte(tc.payload)})
+
+			messages := client.messages()
+			if tc.want == 0 {
+				if len(messages) != 0 {
+					t.Errorf("Published %s, want the reading dropped", messages[0].Payload)
+				}
+				return
+			}
+			if len(messages) != 1 {
+				t.Fatalf("Published %d messages, want 1", len(messages))
+			}
+			var output AQIReading
+			if err := json.Unmarshal(messages[0].Payload, &output); err != nil {
+				t.Fatalf("Failed to parse output: %v", err)
+			}
+			if output.AQI != tc.want || output.AQIPM25 == nil {
+				t.Errorf("AQI = %d, PM2.5 sub-index %v, want %d from PM2.5", output.AQI, output.AQIPM25, tc.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,49 @@
 package main
 
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
 // Build-time variables set by -ldflags
 var (
+	Version   = "dev"
 	GitCommit = "unknown"
 	BuildTime = "unknown"
 )
+
+// buildInfo returns the version, commit and build time of the binary
+// Values not injected with -ldflags are taken from the build information Go
+// embeds, so `go install` and plain `go build` binaries still identify
+// themselves.
+func buildInfo() (version, commit, buildTime string) {
+	version, commit, buildTime = Version, GitCommit, BuildTime
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version, commit, buildTime
+	}
+	if version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && commit == "unknown":
+			commit = setting.Value
+		case setting.Key == "vcs.time" && buildTime == "unknown":
+			buildTime = setting.Value
+		}
+	}
+	return version, commit, buildTime
+}
+
+// printVersion writes the -version output
+func printVersion(w io.Writer) {
+	version, commit, buildTime := buildInfo()
+	fmt.Fprintf(w, "AQI MQTT Daemon %s\n", version)
+	fmt.Fprintf(w, "Git Commit: %s\n", commit)
+	fmt.Fprintf(w, "Build Time: %s\n", buildTime)
+	fmt.Fprintf(w, "Go Version: %s\n", runtime.Version())
+}
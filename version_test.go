@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestPrintVersion(t *testing.T) {
+	oldVersion, oldCommit := Version, GitCommit
+	Version, GitCommit = "v1.2.3", "abc1234"
+	defer func() { Version, GitCommit = oldVersion, oldCommit }()
+
+	var out bytes.Buffer
+	printVersion(&out)
+	for _, want := range []string{"AQI MQTT Daemon v1.2.3", "Git Commit: abc1234", "Build Time:", "Go Version: go"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Version output %q does not contain %q", out.String(), want)
+		}
+	}
+}
+
+// TestVersionFlag runs main with -version in a subprocess, re-executing the
+// test binary, and checks that it prints the version and exits zero
+func TestVersionFlag(t *testing.T) {
+	if os.Getenv("AQI_MQTT_RUN_MAIN") == "1" {
+		os.Args = []string{"aqi-mqtt-daemon", "-version"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$")
+	cmd.Env = append(os.Environ(), "AQI_MQTT_RUN_MAIN=1")
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("-version exited with %v, want status 0", err)
+	}
+	if !strings.HasPrefix(string(output), "AQI MQTT Daemon ") {
+		t.Errorf("-version printed %q, want a version string", output)
+	}
+}
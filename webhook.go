@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webhookTimeout bounds each webhook request, so a slow endpoint cannot pile
+// up requests
+const webhookTimeout = 5 * time.Second
+
+// webhook POSTs output messages to an HTTP endpoint
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+// newWebhook creates a webhook posting to url
+func newWebhook(url string) *webhook {
+	return &webhook{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// validateHTTPURL checks that a URL is an absolute HTTP(S) URL
+// name describes the URL in the error, e.g. "webhook".
+func validateHTTPURL(name, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid %s URL: %w", name, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s URL %q: must be an http or https URL", name, rawURL)
+	}
+	return nil
+}
+
+// post sends body to the webhook, retrying once if the first attempt fails
+func (w *webhook) post(body []byte) error {
+	if err := w.postOnce(body); err != nil {
+		slog.Debug("Webhook request failed, retrying", "error", err)
+		return w.postOnce(body)
+	}
+	return nil
+}
+
+// postOnce sends body to the webhook, treating any non-2xx status as an error
+func (w *webhook) postOnce(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sendWebhook posts an output message to the -webhook-url, if configured
+func (p *processor) sendWebhook(serialNo string, payload []byte) {
+	if p.webhook == nil {
+		return
+	}
+
+	// Post in the background so a slow endpoint does not stall MQTT publishing
+	webhook := p.webhook
+	p.goBackground(func() {
+		if err := webhook.post(payload); err != nil {
+			slog.Error("Error posting to webhook", "serialno", serialNo, "error", err)
+			p.metrics.webhookErrors.Inc()
+		}
+	})
+}
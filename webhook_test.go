@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestWebhook tests that each published output message is also POSTed to the webhook
+func TestWebhook(t *testing.T) {
+	received := make(chan []byte, 1)
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+		received <- body
+	}))
+	defer server.Close()
+
+	proc := newProcessor("aqi")
+	proc.webhook = newWebhook(server.URL)
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7}`),
+	})
+
+	select {
+	case body := <-received:
+		if want := string(client.messages()[0].Payload); string(body) != want {
+			t.Errorf("Webhook body = %s, want the MQTT payload %s", body, want)
+		}
+		if contentType != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", contentType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the webhook request")
+	}
+}
+
+// TestWebhookRetry tests that a failed request is retried once
+func TestWebhookRetry(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	if err := newWebhook(server.URL).post([]byte(`{}`)); err != nil {
+		t.Errorf("post returned error after a successful retry: %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Made %d requests, want 2", got)
+	}
+}
+
+// TestWebhookFailure tests that a webhook failing twice is logged and counted
+func TestWebhookFailure(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	proc := newProcessor("aqi")
+	proc.webhook = newWebhook(server.URL)
+	client := &fakeClient{}
+	proc.handleMessage(client, &fakeMessage{
+		topic:   "airgradient/readings",
+		payload: []byte(`{"serialno": "abc", "pm02Standard": 35.7}`),
+	})
+
+	// MQTT publishing does not wait for the webhook
+	if len(client.messages()) != 1 {
+		t.Errorf("Published %d MQTT messages, want 1", len(client.messages()))
+	}
+
+	// Shutdown waits for the request in the background
+	if !proc.drain(5 * time.Second) {
+		t.Fatal("drain timed out waiting for the webhook")
+	}
+	if got := testutil.ToFloat64(proc.metrics.webhookErrors); got != 1 {
+		t.Errorf("aqi_webhook_errors_total = %g, want 1", got)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Made %d requests, want 2", got)
+	}
+}
+
+func TestValidateHTTPURL(t *testing.T) {
+	for _, u := range []string{"http://localhost:8080/hook", "https://example.com/aqi"} {
+		if err := validateHTTPURL("webhook", u); err != nil {
+			t.Errorf("validateHTTPURL(%q) returned error: %v", u, err)
+		}
+	}
+	for _, u := range []string{"localhost:8080", "ftp://example.com", "http://", "::"} {
+		if err := validateHTTPURL("webhook", u); err == nil {
+			t.Errorf("validateHTTPURL(%q) returned nil, want error", u)
+		}
+	}
+}